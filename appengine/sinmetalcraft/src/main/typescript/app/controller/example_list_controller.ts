@@ -37,7 +37,7 @@ namespace SinmetalCraft.Controller.Example.List {
 
             this.exampleService.list(request)
                 .success(data=> {
-                    this.store.examples.items = data;
+                    this.store.examples = data;
                 })
                 .error((_, status) => {
                     if (status === 0) {
@@ -60,6 +60,9 @@ namespace SinmetalCraft.Controller.Example.List {
 
             this.exampleService.list(request)
                 .success(data=> {
+                    this.store.examples.items = this.store.examples.items.concat(data.items);
+                    this.store.examples.cursor = data.cursor;
+                    this.store.examples.hasNext = data.hasNext;
                 })
                 .error((_, status) => {
                     if (status === 0) {
@@ -35,9 +35,13 @@ namespace SinmetalCraft.Model {
         body: any;
     }
 
+    /**
+     * Minecraft World
+     * openapi.json の #/components/schemas/Minecraft と合わせること
+     */
     export interface IExample {
         key?: string;
-        name: string;
+        name?: string;
         world: string;
         resourceID: number;
         zone: string;
@@ -45,15 +49,55 @@ namespace SinmetalCraft.Model {
         status: string;
         operationType: string;
         operationStatus: string;
+        latestSnapshot: string;
         jarVersion: string;
+        overviewerSnapshot: string;
         createdAt?: string;
         updatedAt?: string;
     }
 
+    /**
+     * GCE Instance
+     * openapi.json の #/components/schemas/Instance と合わせること
+     */
+    export interface IInstance {
+        instanceName: string;
+        zone: string;
+        ipAddr: string;
+        status: string;
+        creationTimestamp: string;
+    }
+
+    /**
+     * World DiskのSnapshot
+     * openapi.json の #/components/schemas/Snapshot と合わせること
+     */
+    export interface ISnapshot {
+        name: string;
+        world: string;
+        label: string;
+        status: string;
+        diskSizeGb: number;
+        storageBytes: number;
+        creationTimestamp: string;
+    }
+
     export interface IMessage {
         message: string;
     }
 
+    /**
+     * /api/1/* が2xx以外で返すError
+     * openapi.json の #/components/schemas/Error と合わせること
+     */
+    export interface IError {
+        error: {
+            code: string;
+            message: string;
+            details?: any;
+        };
+    }
+
     export interface IListExampleRequest {
         cursor: string;
         limit: number;
@@ -39,9 +39,9 @@ namespace SinmetalCraft {
 
         /**
          * Example一覧を取得する
-         * @returns {ng.IHttpPromise<IExample[]>}
+         * @returns {ng.IHttpPromise<ICursorList<IExample>>}
          */
-        list(options?:IListOptions):ng.IHttpPromise<IExample[]> {
+        list(options?:IListOptions):ng.IHttpPromise<ICursorList<IExample>> {
             var opts:any = {};
             var config:any = {};
             if (options) {
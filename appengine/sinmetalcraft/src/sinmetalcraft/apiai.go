@@ -151,8 +151,6 @@ func (a *ApiAIApi) handler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	w.WriteHeader(http.StatusOK)
-
 	sm := &struct {
 		Text string `json:"text"`
 	}{
@@ -168,6 +166,8 @@ func (a *ApiAIApi) handler(w http.ResponseWriter, r *http.Request) {
 		Data:   slack,
 		Source: "DuckDuckGo",
 	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
 	err = json.NewEncoder(w).Encode(res)
 	if err != nil {
 		log.Errorf(c, "%s", err.Error())
@@ -0,0 +1,101 @@
+package sinmetalcraft
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"google.golang.org/appengine/log"
+
+	"golang.org/x/net/context"
+)
+
+// APIError Code
+const (
+	ErrCodeInvalidRequest   = "invalid_request"
+	ErrCodeUnauthorized     = "unauthorized"
+	ErrCodeForbidden        = "forbidden"
+	ErrCodeNotFound         = "not_found"
+	ErrCodeMethodNotAllowed = "method_not_allowed"
+	ErrCodeConflict         = "conflict"
+	ErrCodeInternal         = "internal"
+)
+
+// APIError is /api/1/* が返すError
+// Response Bodyは {"error": {"code": "...", "message": "...", "details": {...}}} になる
+type APIError struct {
+	Status  int                    `json:"-"`
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// APIErrorResponse is APIErrorを返す時のResponse Body
+type APIErrorResponse struct {
+	Error *APIError `json:"error"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// WithDetail is detailsに値を追加する
+func (e *APIError) WithDetail(key string, value interface{}) *APIError {
+	if e.Details == nil {
+		e.Details = make(map[string]interface{})
+	}
+	e.Details[key] = value
+	return e
+}
+
+// NewAPIError is APIErrorを作成する
+func NewAPIError(status int, code string, message string) *APIError {
+	return &APIError{
+		Status:  status,
+		Code:    code,
+		Message: message,
+	}
+}
+
+func invalidRequestError(message string) *APIError {
+	return NewAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, message)
+}
+
+func notFoundError(message string) *APIError {
+	return NewAPIError(http.StatusNotFound, ErrCodeNotFound, message)
+}
+
+func conflictError(message string) *APIError {
+	return NewAPIError(http.StatusConflict, ErrCodeConflict, message)
+}
+
+// internalError is 予期しないErrorをAPIErrorにする
+// 内部のError MessageはResponseには含めずLogにだけ出す
+func internalError(err error) *APIError {
+	return NewAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal server error").WithDetail("cause", err.Error())
+}
+
+// writeJSON is Content-Typeを設定してからStatus CodeとJSONを書く
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError is errをAPIErrorとしてResponseに書く
+// APIError以外のerrorは500として扱う
+func writeError(ctx context.Context, w http.ResponseWriter, err error) {
+	ae, ok := err.(*APIError)
+	if !ok {
+		ae = internalError(err)
+	}
+	if ae.Status >= http.StatusInternalServerError {
+		log.Errorf(ctx, "API Error. %s, details = %v", ae.Error(), ae.Details)
+		if ae.Code == ErrCodeInternal {
+			ae = NewAPIError(ae.Status, ae.Code, ae.Message)
+		}
+	} else {
+		log.Infof(ctx, "API Error. %s, details = %v", ae.Error(), ae.Details)
+	}
+	writeJSON(w, ae.Status, APIErrorResponse{Error: ae})
+}
@@ -2,7 +2,6 @@ package sinmetalcraft
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"time"
 
@@ -14,12 +13,21 @@ import (
 )
 
 type AppConfig struct {
-	ClientId               string    `json:"clientId" datastore:",noindex"`               // GCP Client Id
-	ClientSecret           string    `json:"clientSecret" datastore:",noindex"`           // GCP Client Secret
-	SlackPostUrl           string    `json:"slackPostUrl" datastore:",noindex"`           // Slackにぶっこむ用URL
-	APIAIIntentIDRunServer string    `json:"aPIAIIntentIDRunServer" datastore:",noindex"` // api.ai RunServerのIntentID
-	CreatedAt              time.Time `json:"createdAt"`                                   // 作成日時
-	UpdatedAt              time.Time `json:"updatedAt"`                                   // 更新日時
+	ClientId                      string    `json:"clientId" datastore:",noindex"`                      // GCP Client Id
+	ClientSecret                  string    `json:"clientSecret" datastore:",noindex"`                  // GCP Client Secret
+	SlackPostUrl                  string    `json:"slackPostUrl" datastore:",noindex"`                  // Slackにぶっこむ用URL
+	APIAIIntentIDRunServer        string    `json:"aPIAIIntentIDRunServer" datastore:",noindex"`        // api.ai RunServerのIntentID
+	VersionManifestURL            string    `json:"versionManifestUrl" datastore:",noindex"`            // Minecraft Version Manifest。空の場合はMojangのManifest
+	PreemptionFallbackCount       int       `json:"preemptionFallbackCount" datastore:",noindex"`       // この回数Preemptされたら、次はstandard VMで起動する。0の場合は2
+	PreemptionFallbackWindowHours int       `json:"preemptionFallbackWindowHours" datastore:",noindex"` // Preempt回数を数える時間。0の場合は24
+	DNSProject                    string    `json:"dnsProject" datastore:",noindex"`                    // Cloud DNSのManaged ZoneがあるProject。空の場合はsinmetalcraft
+	DNSManagedZone                string    `json:"dnsManagedZone" datastore:",noindex"`                // Cloud DNSのManaged Zone Name。空の場合はDNSを更新しない
+	DNSDomain                     string    `json:"dnsDomain" datastore:",noindex"`                     // <world>.<dnsDomain> のA Recordを作る
+	DNSTTL                        int64     `json:"dnsTtl" datastore:",noindex"`                        // A RecordのTTL (秒)。0の場合は300
+	GCGracePeriodHours            int       `json:"gcGracePeriodHours" datastore:",noindex"`            // GCで見つけてから消すまでの時間。0の場合は72
+	GCAllowlist                   []string  `json:"gcAllowlist" datastore:",noindex"`                   // GCで消さないResource NameのPattern (path.Match)
+	CreatedAt                     time.Time `json:"createdAt"`                                          // 作成日時
+	UpdatedAt                     time.Time `json:"updatedAt"`                                          // 更新日時
 }
 
 const (
@@ -57,10 +65,24 @@ func (a *AppConfigApi) Put(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer r.Body.Close()
+	if err := validateGCAllowlist(ac.GCAllowlist); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ev := newAuditEvent(ctx, r, AuditActionConfigUpdate)
+	ev.Target = appConfigId
+	var s AppConfigService
+	before, err := s.Get(ctx)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		log.Warningf(ctx, "AppConfig get error : %s", err.Error())
+	}
 
 	_, err = datastore.Put(ctx, datastore.NewKey(ctx, "AppConfig", appConfigId, 0, nil), &ac)
+	ev.SetDiff(before, ac)
+	ev.Record(ctx, err)
 	if err != nil {
-		log.Errorf(ctx, fmt.Sprintf("datastore put error : ", err.Error()))
+		log.Errorf(ctx, "datastore put error : %s", err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
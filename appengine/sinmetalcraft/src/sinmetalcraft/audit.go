@@ -0,0 +1,366 @@
+package sinmetalcraft
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+
+	"golang.org/x/net/context"
+)
+
+func init() {
+	api := AuditApi{}
+
+	apiRouter.Handle("GET", "/api/1/audit", api.List, requireAdmin)
+}
+
+// AuditEvent Action
+const (
+	AuditActionWorldCreate      = "world.create"
+	AuditActionWorldUpdate      = "world.update"
+	AuditActionWorldDelete      = "world.delete"
+	AuditActionWorldClone       = "world.clone"
+	AuditActionWorldImport      = "world.import"
+	AuditActionWorldImportStart = "world.import.start"
+	AuditActionWorldImportDone  = "world.import.done"
+	AuditActionWorldExport      = "world.export"
+	AuditActionWorldExportDone  = "world.export.done"
+	AuditActionWorldUpgrade     = "world.upgrade"
+	AuditActionWorldUpgradeDone = "world.upgrade.done"
+	AuditActionWorldProperties  = "world.properties"
+	AuditActionWorldOverviewer  = "world.overviewer"
+	AuditActionWorldReconcile   = "world.reconcile" // ReconcileでDatastoreを直した
+	AuditActionPluginCreate     = "plugin.create"
+	AuditActionPluginUpdate     = "plugin.update"
+	AuditActionPluginDelete     = "plugin.delete"
+	AuditActionServerCreate     = "server.create"
+	AuditActionServerUpdate     = "server.update" // operationが分かった時点で server.start などに置き換える
+	AuditActionServerDelete     = "server.delete"
+	AuditActionServerPreempted  = "server.preempted"
+	AuditActionServerRestart    = "server.restart" // Preempt後の自動再起動
+	AuditActionConfigUpdate     = "config.update"
+	AuditActionOperationDone    = "operation.done"
+	AuditActionInstanceCreate   = "instance.create"
+	AuditActionInstanceDelete   = "instance.delete"
+	AuditActionSnapshotCreate   = "snapshot.create"
+	AuditActionSnapshotDone     = "snapshot.done"
+	AuditActionOverviewerCreate = "overviewer.create"
+	AuditActionOverviewerDelete = "overviewer.delete"
+	AuditActionOverviewerDone   = "overviewer.done"
+	AuditActionGCDelete         = "gc.delete" // GCで持ち主の無いResourceを消した
+)
+
+// AuditEvent Outcome
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+)
+
+// AuditEvent is 状態を変更する操作の記録
+type AuditEvent struct {
+	Key       *datastore.Key `json:"-" datastore:"-"`
+	KeyStr    string         `json:"key" datastore:"-"`
+	Actor     string         `json:"actor"`  // user email, "token:<email>", "cron", "tq", "anonymous"
+	Action    string         `json:"action"` // AuditAction*
+	Target    string         `json:"target"` // 操作対象のWorld Nameなど
+	Diff      []AuditDiff    `json:"diff" datastore:"-"`
+	DiffJSON  string         `json:"-" datastore:",noindex"`
+	Outcome   string         `json:"outcome"`
+	Error     string         `json:"error" datastore:",noindex"`
+	CreatedAt time.Time      `json:"createdAt"`
+}
+
+// AuditDiff is 変更されたField
+// 追加されたFieldはBeforeが、削除されたFieldはAfterがnilになる
+type AuditDiff struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// auditIgnoreFields is 毎回変わるのでDiffに含めないField
+var auditIgnoreFields = map[string]bool{
+	"key":       true,
+	"createdAt": true,
+	"updatedAt": true,
+}
+
+// auditMaskFields is 値をそのまま残すとまずいので、変更されたことだけを残すField
+var auditMaskFields = map[string]bool{
+	"clientSecret": true,
+	"slackPostUrl": true,
+}
+
+const auditMaskValue = "***"
+
+// newAuditEvent is Requestを送ってきたActorでAuditEventを作る
+func newAuditEvent(ctx context.Context, r *http.Request, action string) *AuditEvent {
+	return &AuditEvent{
+		Actor:  auditActor(ctx, r),
+		Action: action,
+		Diff:   make([]AuditDiff, 0),
+	}
+}
+
+// auditActor is Requestを送ってきたのが誰かを返す
+// Cron, TQはApp EngineがつけるHeaderで判断する
+func auditActor(ctx context.Context, r *http.Request) string {
+	if r.Header.Get("X-Appengine-Cron") == "true" {
+		return "cron"
+	}
+	if len(r.Header.Get("X-AppEngine-QueueName")) > 0 {
+		return "tq"
+	}
+	if u := user.Current(ctx); u != nil {
+		return u.Email
+	}
+	if u := userFromRequest(ctx, r); u != nil {
+		return "token:" + u.Email
+	}
+	return "anonymous"
+}
+
+// SetDiff is before, afterをJSONにした時のFieldの差分を設定する
+func (e *AuditEvent) SetDiff(before interface{}, after interface{}) {
+	e.Diff = auditDiff(before, after)
+}
+
+// Record is errをOutcomeにしてAuditEventを保存する
+// 保存に失敗しても元の操作は失敗させず、Logにだけ出す
+func (e *AuditEvent) Record(ctx context.Context, err error) {
+	e.Outcome = AuditOutcomeSuccess
+	if err != nil {
+		e.Outcome = AuditOutcomeFailure
+		e.Error = auditErrorMessage(err)
+	}
+	e.CreatedAt = time.Now()
+
+	_, perr := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "AuditEvent", nil), e)
+	if perr != nil {
+		log.Errorf(ctx, "AuditEvent Put Error. %s, event = %v", perr.Error(), e)
+	}
+}
+
+func (e *AuditEvent) Load(ps []datastore.Property) error {
+	if err := datastore.LoadStruct(e, ps); err != nil {
+		return err
+	}
+	e.Diff = make([]AuditDiff, 0)
+	if len(e.DiffJSON) < 1 {
+		return nil
+	}
+	return json.Unmarshal([]byte(e.DiffJSON), &e.Diff)
+}
+
+func (e *AuditEvent) Save() ([]datastore.Property, error) {
+	b, err := json.Marshal(e.Diff)
+	if err != nil {
+		return nil, err
+	}
+	e.DiffJSON = string(b)
+
+	return datastore.SaveStruct(e)
+}
+
+// auditErrorMessage is 500の場合はResponseに含めないcauseも残す
+func auditErrorMessage(err error) string {
+	ae, ok := err.(*APIError)
+	if !ok {
+		return err.Error()
+	}
+	if cause, ok := ae.Details["cause"]; ok {
+		return fmt.Sprintf("%s, cause = %v", ae.Error(), cause)
+	}
+	return ae.Error()
+}
+
+// auditDiff is before, afterをJSONのObjectとして比較して、変更されたFieldをField Name順に返す
+// nilは空のObjectとして扱う
+func auditDiff(before interface{}, after interface{}) []AuditDiff {
+	b := auditFields(before)
+	a := auditFields(after)
+
+	var fields []string
+	for k := range b {
+		fields = append(fields, k)
+	}
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			fields = append(fields, k)
+		}
+	}
+	sort.Strings(fields)
+
+	diff := make([]AuditDiff, 0)
+	for _, f := range fields {
+		if auditIgnoreFields[f] {
+			continue
+		}
+		bv, av := b[f], a[f]
+		if reflect.DeepEqual(bv, av) {
+			continue
+		}
+		if auditMaskFields[f] {
+			bv, av = auditMask(bv), auditMask(av)
+		}
+		diff = append(diff, AuditDiff{Field: f, Before: bv, After: av})
+	}
+	return diff
+}
+
+func auditFields(v interface{}) map[string]interface{} {
+	m := make(map[string]interface{})
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil()) {
+		return m
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return m
+	}
+	json.Unmarshal(b, &m)
+	return m
+}
+
+func auditMask(v interface{}) interface{} {
+	if v == nil || v == "" {
+		return v
+	}
+	return auditMaskValue
+}
+
+// audit is Handlerの結果をAuditEventとして記録するMiddleware
+// HandlerはauditEventFromContextでTarget, Diffを設定する
+func audit(action string) Middleware {
+	return func(h APIHandlerFunc) APIHandlerFunc {
+		return func(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+			e := newAuditEvent(ctx, r, action)
+			e.Target = p["world"]
+			err := h(context.WithValue(ctx, auditEventContextKey{}, e), w, r, p)
+			e.Record(ctx, err)
+			return err
+		}
+	}
+}
+
+type auditEventContextKey struct{}
+
+// auditEventFromContext is audit Middlewareが作ったAuditEventを返す
+// audit Middlewareを通っていない場合は記録されないAuditEventを返す
+func auditEventFromContext(ctx context.Context) *AuditEvent {
+	e, ok := ctx.Value(auditEventContextKey{}).(*AuditEvent)
+	if !ok {
+		return &AuditEvent{}
+	}
+	return e
+}
+
+// AuditApi is AuditEventを参照するAPI
+type AuditApi struct{}
+
+// AuditListParam is GET /api/1/audit のQuery Parameter
+type AuditListParam struct {
+	Limit   int
+	Cursor  string
+	Actor   string
+	Action  string
+	Target  string
+	Outcome string
+}
+
+// AuditListResponse is GET /api/1/audit のResponse
+type AuditListResponse struct {
+	Items   []*AuditEvent `json:"items"`
+	Cursor  string        `json:"cursor"`
+	HasNext bool          `json:"hasNext"`
+}
+
+// list audit event
+func (a *AuditApi) List(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	limit, err := parseLimit(r, 50, 200)
+	if err != nil {
+		return err
+	}
+	param := AuditListParam{
+		Limit:   limit,
+		Cursor:  r.FormValue("cursor"),
+		Actor:   r.FormValue("actor"),
+		Action:  r.FormValue("action"),
+		Target:  r.FormValue("target"),
+		Outcome: r.FormValue("outcome"),
+	}
+	if len(param.Outcome) > 0 && param.Outcome != AuditOutcomeSuccess && param.Outcome != AuditOutcomeFailure {
+		return invalidRequestError(fmt.Sprintf("outcome is %s or %s.", AuditOutcomeSuccess, AuditOutcomeFailure)).WithDetail("outcome", param.Outcome)
+	}
+
+	q := param.Query()
+	if len(param.Cursor) > 0 {
+		c, err := datastore.DecodeCursor(param.Cursor)
+		if err != nil {
+			return invalidRequestError("invalid cursor.").WithDetail("cursor", param.Cursor)
+		}
+		q = q.Start(c)
+	}
+
+	res := AuditListResponse{
+		Items: make([]*AuditEvent, 0),
+	}
+	t := q.Run(ctx)
+	for len(res.Items) < param.Limit {
+		var entity AuditEvent
+		key, err := t.Next(&entity)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return internalError(err)
+		}
+		entity.Key = key
+		entity.KeyStr = key.Encode()
+		res.Items = append(res.Items, &entity)
+	}
+	if len(res.Items) == param.Limit {
+		c, err := t.Cursor()
+		if err != nil {
+			return internalError(err)
+		}
+		var next AuditEvent
+		_, err = t.Next(&next)
+		if err != nil && err != datastore.Done {
+			return internalError(err)
+		}
+		if err == nil {
+			res.Cursor = c.String()
+			res.HasNext = true
+		}
+	}
+
+	writeJSON(w, http.StatusOK, res)
+	return nil
+}
+
+// Query is CreatedAtの降順でFilterを掛けたQueryを返す
+func (param AuditListParam) Query() *datastore.Query {
+	q := datastore.NewQuery("AuditEvent")
+	filters := []struct {
+		name  string
+		value string
+	}{
+		{"Actor", param.Actor},
+		{"Action", param.Action},
+		{"Target", param.Target},
+		{"Outcome", param.Outcome},
+	}
+	for _, f := range filters {
+		if len(f.value) > 0 {
+			q = q.Filter(f.name+" =", f.value)
+		}
+	}
+	return q.Order("-CreatedAt").Limit(param.Limit + 1)
+}
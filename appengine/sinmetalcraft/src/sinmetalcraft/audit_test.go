@@ -0,0 +1,55 @@
+package sinmetalcraft
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAuditDiff(t *testing.T) {
+	before := Minecraft{World: "hoge", Zone: "asia-northeast1-b", JarVersion: "1.12.1", UpdatedAt: time.Now()}
+	after := before
+	after.JarVersion = "1.12.2"
+	after.IPAddr = "203.0.113.1"
+	after.UpdatedAt = time.Now().Add(time.Minute)
+
+	diff := auditDiff(before, after)
+	expected := []AuditDiff{
+		{Field: "ipAddr", Before: "", After: "203.0.113.1"},
+		{Field: "jarVersion", Before: "1.12.1", After: "1.12.2"},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Fatalf("diff = %+v, want %+v", diff, expected)
+	}
+}
+
+func TestAuditDiffCreateAndDelete(t *testing.T) {
+	param := ServerApiPutParam{KeyStr: "key", Operation: "start"}
+
+	diff := auditDiff(nil, param)
+	expected := []AuditDiff{
+		{Field: "operation", Before: nil, After: "start"},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Fatalf("create diff = %+v, want %+v", diff, expected)
+	}
+
+	var deleted *Minecraft
+	if diff := auditDiff(deleted, nil); len(diff) != 0 {
+		t.Fatalf("nil pointer diff = %+v", diff)
+	}
+}
+
+func TestAuditDiffMask(t *testing.T) {
+	before := AppConfig{ClientSecret: "old-secret", SlackPostUrl: "https://hooks.slack.com/services/xxx"}
+	after := AppConfig{ClientSecret: "new-secret", SlackPostUrl: "https://hooks.slack.com/services/xxx", APIAIIntentIDRunServer: "intent"}
+
+	diff := auditDiff(before, after)
+	expected := []AuditDiff{
+		{Field: "aPIAIIntentIDRunServer", Before: "", After: "intent"},
+		{Field: "clientSecret", Before: auditMaskValue, After: auditMaskValue},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Fatalf("diff = %+v, want %+v", diff, expected)
+	}
+}
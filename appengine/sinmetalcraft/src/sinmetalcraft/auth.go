@@ -0,0 +1,34 @@
+package sinmetalcraft
+
+import (
+	"net/http"
+	"strings"
+
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+
+	"golang.org/x/net/context"
+)
+
+// OAuthScopeEmail is CLIなどからOAuth2 Bearer Tokenで叩く時に必要なScope
+const OAuthScopeEmail = "https://www.googleapis.com/auth/userinfo.email"
+
+// currentUser is Cookieでログインしているユーザを返す
+// Cookieが無い場合は Authorization: Bearer のTokenからユーザを取得する
+// どちらも無い場合はnilを返す
+func currentUser(ctx context.Context, r *http.Request) *user.User {
+	u := user.Current(ctx)
+	if u != nil {
+		return u
+	}
+
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") == false {
+		return nil
+	}
+	u, err := user.CurrentOAuth(ctx, OAuthScopeEmail)
+	if err != nil {
+		log.Infof(ctx, "OAuth user get error, %s", err.Error())
+		return nil
+	}
+	return u
+}
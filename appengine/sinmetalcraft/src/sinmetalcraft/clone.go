@@ -0,0 +1,153 @@
+package sinmetalcraft
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"google.golang.org/api/compute/v1"
+
+	"golang.org/x/net/context"
+)
+
+// MinecraftApiCloneParam is POST /api/1/minecraft/{world}/clone のRequest Body
+type MinecraftApiCloneParam struct {
+	World    string `json:"world"`    // 新しく作るWorld Name
+	Snapshot string `json:"snapshot"` // 省略した場合はClone元のLatestSnapshot
+	Zone     string `json:"zone"`     // 省略した場合はClone元のZone
+}
+
+// clone world from snapshot
+// Clone元のSnapshotからDiskを作るだけなので、Clone元のWorldには影響しない
+func (a *MinecraftApi) Clone(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	var param MinecraftApiCloneParam
+	err := json.NewDecoder(r.Body).Decode(&param)
+	if err != nil {
+		return invalidRequestError("invalid request.").WithDetail("cause", err.Error())
+	}
+	defer r.Body.Close()
+	if err := validateWorldName(param.World); err != nil {
+		return err
+	}
+
+	srcKey, err := minecraftKey(ctx, p, "")
+	if err != nil {
+		return err
+	}
+	ev := auditEventFromContext(ctx)
+	ev.Target = param.World
+
+	src, err := getMinecraft(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	if param.World == src.World {
+		return invalidRequestError("world is same as source world.").WithDetail("world", param.World)
+	}
+	sn := param.Snapshot
+	if len(sn) < 1 {
+		sn = src.LatestSnapshot
+	}
+	if len(sn) < 1 {
+		return conflictError(fmt.Sprintf("%s has no snapshot.", src.World))
+	}
+	// Cloneした直後のWorldのLatestSnapshotはClone元のWorldのSnapshotなので、LatestSnapshotはそのまま使える
+	if sn != src.LatestSnapshot && snapshotBelongsTo(sn, src.World) == false {
+		return invalidRequestError(fmt.Sprintf("snapshot is not %s snapshot.", src.World)).WithDetail("snapshot", sn)
+	}
+
+	s, err := newComputeService(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+	ss := compute.NewSnapshotsService(s)
+	_, err = ss.Get(PROJECT_NAME, sn).Do()
+	if isNotFoundError(err) {
+		return notFoundError(fmt.Sprintf("%s is not found.", sn)).WithDetail("snapshot", sn)
+	}
+	if err != nil {
+		return internalError(err)
+	}
+
+	minecraft := src.Clone(param.World, sn, param.Zone)
+	key := datastore.NewKey(ctx, "Minecraft", minecraft.World, 0, nil)
+	err = datastore.RunInTransaction(ctx, func(c context.Context) error {
+		var entity Minecraft
+		err := datastore.Get(c, key, &entity)
+		if err == nil {
+			return conflictError(fmt.Sprintf("%s already exists.", minecraft.World)).WithDetail("world", minecraft.World)
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		now := time.Now()
+		minecraft.CreatedAt = now
+		minecraft.UpdatedAt = now
+		_, err = datastore.Put(c, key, &minecraft)
+		return err
+	}, nil)
+	if ae, ok := err.(*APIError); ok {
+		return ae
+	}
+	if err != nil {
+		return internalError(err)
+	}
+	// Worldを作った後にコピーするので、既にあるWorldの設定を上書きすることはない
+	if err := cloneWorldSettings(ctx, src.World, minecraft.World); err != nil {
+		log.Errorf(ctx, "ERROR clone world settings %s to %s: %v", src.World, minecraft.World, err)
+		return internalError(err)
+	}
+	minecraft.KeyStr = key.Encode()
+	ev.SetDiff(nil, minecraft)
+
+	writeJSON(w, http.StatusCreated, minecraft)
+	return nil
+}
+
+// cloneWorldSettings is Clone元のWorldのserver.properties, Plugin, Render設定を新しいWorldにコピーする
+// 設定していないものはコピーしないので、新しいWorldでもDefaultのまま
+func cloneWorldSettings(ctx context.Context, src string, world string) error {
+	var keys []*datastore.Key
+	var entities []interface{}
+
+	sp, err := getServerProperties(ctx, src)
+	if err != nil {
+		return err
+	}
+	if !sp.CreatedAt.IsZero() {
+		c := sp.Clone(world)
+		keys = append(keys, datastore.NewKey(ctx, "ServerProperties", world, 0, nil))
+		entities = append(entities, &c)
+	}
+
+	plugins, err := listWorldPlugins(ctx, src)
+	if err != nil {
+		return err
+	}
+	for _, wp := range plugins {
+		c := wp.Clone(world)
+		keys = append(keys, worldPluginKey(ctx, world, c.Name))
+		entities = append(entities, &c)
+	}
+
+	oc, err := getOverviewerConfig(ctx, src)
+	if err != nil {
+		return err
+	}
+	if !oc.CreatedAt.IsZero() {
+		c := oc.Clone(world)
+		keys = append(keys, datastore.NewKey(ctx, "OverviewerConfig", world, 0, nil))
+		entities = append(entities, &c)
+	}
+
+	if len(keys) < 1 {
+		return nil
+	}
+	_, err = datastore.PutMulti(ctx, keys, entities)
+	return err
+}
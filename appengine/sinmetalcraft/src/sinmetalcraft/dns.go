@@ -0,0 +1,196 @@
+package sinmetalcraft
+
+import (
+	"fmt"
+	"net/http"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/dns/v1"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// dnsDefaultTTL is AppConfigで指定が無い場合のA RecordのTTL (秒)
+const dnsDefaultTTL = 300
+
+// dnsUpdater is WorldのA Recordを更新する
+// TestではCloud DNSを使わないFakeに差し替える
+type dnsUpdater interface {
+	// Upsert is nameのA Recordをipにする。A Recordが無い場合は作る
+	Upsert(ctx context.Context, name string, ip string, ttl int64) error
+	// Delete is nameのA Recordを消す。無い場合は何もしない
+	Delete(ctx context.Context, name string) error
+}
+
+// worldDNS is AppConfigのDNSの設定
+type worldDNS struct {
+	Project     string // Managed Zoneがある Project
+	ManagedZone string
+	Domain      string
+	TTL         int64
+}
+
+// dnsConfig is AppConfigからDNSの設定を返す。Managed Zoneが無い場合はokがfalse
+func (ac *AppConfig) dnsConfig() (worldDNS, bool) {
+	if len(ac.DNSManagedZone) < 1 || len(ac.DNSDomain) < 1 {
+		return worldDNS{}, false
+	}
+	c := worldDNS{
+		Project:     ac.DNSProject,
+		ManagedZone: ac.DNSManagedZone,
+		Domain:      ac.DNSDomain,
+		TTL:         ac.DNSTTL,
+	}
+	if len(c.Project) < 1 {
+		c.Project = PROJECT_NAME
+	}
+	if c.TTL < 1 {
+		c.TTL = dnsDefaultTTL
+	}
+	return c, true
+}
+
+// RecordName is WorldのA RecordのName。<world>.<domain>.
+func (c worldDNS) RecordName(world string) string {
+	return fmt.Sprintf("%s.%s.", world, c.Domain)
+}
+
+// instanceNatIP is InstanceのExternal IPを返す。無い場合は空文字を返す
+func instanceNatIP(ins *compute.Instance) string {
+	for _, ni := range ins.NetworkInterfaces {
+		for _, ac := range ni.AccessConfigs {
+			if len(ac.NatIP) > 0 {
+				return ac.NatIP
+			}
+		}
+	}
+	return ""
+}
+
+// upsertChange is 今のRecordをipのA Recordに置き換えるChangeを返す
+// 既に同じ場合はnilを返す
+func upsertChange(current []*dns.ResourceRecordSet, name string, ip string, ttl int64) *dns.Change {
+	if len(current) == 1 && current[0].Ttl == ttl && len(current[0].Rrdatas) == 1 && current[0].Rrdatas[0] == ip {
+		return nil
+	}
+	return &dns.Change{
+		Deletions: current,
+		Additions: []*dns.ResourceRecordSet{
+			&dns.ResourceRecordSet{
+				Kind:    "dns#resourceRecordSet",
+				Name:    name,
+				Type:    "A",
+				Ttl:     ttl,
+				Rrdatas: []string{ip},
+			},
+		},
+	}
+}
+
+// cloudDNSUpdater is Cloud DNSのManaged ZoneのA Recordを更新する
+type cloudDNSUpdater struct {
+	s           *dns.Service
+	project     string
+	managedZone string
+}
+
+// newCloudDNSUpdater is App EngineのService AccountでCloud DNS APIを叩くdnsUpdaterを作る
+func newCloudDNSUpdater(ctx context.Context, c worldDNS) (*cloudDNSUpdater, error) {
+	client := &http.Client{
+		Transport: &oauth2.Transport{
+			Source: google.AppEngineTokenSource(ctx, dns.NdevClouddnsReadwriteScope),
+			Base:   &urlfetch.Transport{Context: ctx},
+		},
+	}
+	s, err := dns.New(client)
+	if err != nil {
+		return nil, err
+	}
+	return &cloudDNSUpdater{s: s, project: c.Project, managedZone: c.ManagedZone}, nil
+}
+
+func (u *cloudDNSUpdater) current(name string) ([]*dns.ResourceRecordSet, error) {
+	res, err := dns.NewResourceRecordSetsService(u.s).List(u.project, u.managedZone).Name(name).Type("A").Do()
+	if err != nil {
+		return nil, err
+	}
+	return res.Rrsets, nil
+}
+
+// Upsert is Cloud DNSのChangeで、今のA Recordを消してから作る
+func (u *cloudDNSUpdater) Upsert(ctx context.Context, name string, ip string, ttl int64) error {
+	current, err := u.current(name)
+	if err != nil {
+		return err
+	}
+	change := upsertChange(current, name, ip, ttl)
+	if change == nil {
+		log.Infof(ctx, "%s is already %s", name, ip)
+		return nil
+	}
+	change, err = dns.NewChangesService(u.s).Create(u.project, u.managedZone, change).Do()
+	if err != nil {
+		return err
+	}
+	WriteLog(ctx, "DNS_CHANGE", change)
+	return nil
+}
+
+// Delete is Cloud DNSのA Recordを消す
+func (u *cloudDNSUpdater) Delete(ctx context.Context, name string) error {
+	current, err := u.current(name)
+	if err != nil {
+		return err
+	}
+	if len(current) < 1 {
+		return nil
+	}
+	change, err := dns.NewChangesService(u.s).Create(u.project, u.managedZone, &dns.Change{Deletions: current}).Do()
+	if err != nil {
+		return err
+	}
+	WriteLog(ctx, "DNS_CHANGE", change)
+	return nil
+}
+
+// newWorldDNSUpdater is AppConfigのDNSの設定とdnsUpdaterを返す
+// DNSの設定が無い場合はnilを返す
+func newWorldDNSUpdater(ctx context.Context) (dnsUpdater, worldDNS, error) {
+	acs := AppConfigService{}
+	config, err := acs.Get(ctx)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, worldDNS{}, nil
+	}
+	if err != nil {
+		return nil, worldDNS{}, err
+	}
+	c, ok := config.dnsConfig()
+	if !ok {
+		return nil, c, nil
+	}
+	u, err := newCloudDNSUpdater(ctx, c)
+	if err != nil {
+		return nil, c, err
+	}
+	return u, c, nil
+}
+
+// updateWorldDNS is Instanceが動いていれば<world>.<domain>をNAT IPにする
+// Instanceが消えた場合はRecordを消す。更新したIPを返す
+func updateWorldDNS(ctx context.Context, u dnsUpdater, c worldDNS, world string, ins *compute.Instance) (string, error) {
+	name := c.RecordName(world)
+	if ins == nil {
+		return "", u.Delete(ctx, name)
+	}
+	ip := instanceNatIP(ins)
+	if len(ip) < 1 {
+		return "", fmt.Errorf("%s has no external ip", ins.Name)
+	}
+	return ip, u.Upsert(ctx, name, ip, c.TTL)
+}
@@ -0,0 +1,125 @@
+package sinmetalcraft
+
+import (
+	"testing"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/dns/v1"
+
+	"golang.org/x/net/context"
+)
+
+// fakeDNSUpdater is Cloud DNSの代わりにA Recordをmapに持つ
+type fakeDNSUpdater struct {
+	records map[string]string
+	ttls    map[string]int64
+}
+
+func newFakeDNSUpdater() *fakeDNSUpdater {
+	return &fakeDNSUpdater{records: map[string]string{}, ttls: map[string]int64{}}
+}
+
+func (u *fakeDNSUpdater) Upsert(ctx context.Context, name string, ip string, ttl int64) error {
+	u.records[name] = ip
+	u.ttls[name] = ttl
+	return nil
+}
+
+func (u *fakeDNSUpdater) Delete(ctx context.Context, name string) error {
+	delete(u.records, name)
+	delete(u.ttls, name)
+	return nil
+}
+
+func runningInstance(ip string) *compute.Instance {
+	return &compute.Instance{
+		Name:   "minecraft-world-1",
+		Status: "RUNNING",
+		NetworkInterfaces: []*compute.NetworkInterface{
+			&compute.NetworkInterface{
+				AccessConfigs: []*compute.AccessConfig{
+					&compute.AccessConfig{Name: "External NAT", Type: "ONE_TO_ONE_NAT", NatIP: ip},
+				},
+			},
+		},
+	}
+}
+
+func TestDNSConfig(t *testing.T) {
+	if _, ok := (&AppConfig{DNSDomain: "sinmetal.org"}).dnsConfig(); ok {
+		t.Error("managed zone is empty. dns must not be configured")
+	}
+	c, ok := (&AppConfig{DNSManagedZone: "sinmetal-org", DNSDomain: "sinmetal.org"}).dnsConfig()
+	if !ok {
+		t.Fatal("dns is not configured")
+	}
+	if c.Project != PROJECT_NAME || c.TTL != dnsDefaultTTL {
+		t.Errorf("default project = %s, ttl = %d", c.Project, c.TTL)
+	}
+	c, _ = (&AppConfig{DNSProject: "stone-swallow", DNSManagedZone: "sinmetal-org", DNSDomain: "sinmetal.org", DNSTTL: 60}).dnsConfig()
+	if c.Project != "stone-swallow" || c.TTL != 60 {
+		t.Errorf("project = %s, ttl = %d", c.Project, c.TTL)
+	}
+	if got := c.RecordName("world-1"); got != "world-1.sinmetal.org." {
+		t.Errorf("RecordName = %s", got)
+	}
+}
+
+func TestUpdateWorldDNS(t *testing.T) {
+	ctx := context.Background()
+	u := newFakeDNSUpdater()
+	c := worldDNS{Project: "stone-swallow", ManagedZone: "sinmetal-org", Domain: "sinmetal.org", TTL: 300}
+
+	ip, err := updateWorldDNS(ctx, u, c, "world-1", runningInstance("104.198.1.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != "104.198.1.1" || u.records["world-1.sinmetal.org."] != "104.198.1.1" || u.ttls["world-1.sinmetal.org."] != 300 {
+		t.Errorf("ip = %s, records = %v", ip, u.records)
+	}
+
+	// 再起動でIPが変わった場合は置き換える
+	if _, err := updateWorldDNS(ctx, u, c, "world-1", runningInstance("104.198.2.2")); err != nil {
+		t.Fatal(err)
+	}
+	if u.records["world-1.sinmetal.org."] != "104.198.2.2" {
+		t.Errorf("records = %v", u.records)
+	}
+
+	if _, err := updateWorldDNS(ctx, u, c, "world-1", &compute.Instance{Name: "minecraft-world-1"}); err == nil {
+		t.Error("instance without external ip must be error")
+	}
+
+	if _, err := updateWorldDNS(ctx, u, c, "world-1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := u.records["world-1.sinmetal.org."]; ok {
+		t.Errorf("record is not deleted. records = %v", u.records)
+	}
+}
+
+func TestUpsertChange(t *testing.T) {
+	name := "world-1.sinmetal.org."
+	current := []*dns.ResourceRecordSet{
+		&dns.ResourceRecordSet{Name: name, Type: "A", Ttl: 300, Rrdatas: []string{"104.198.1.1"}},
+	}
+	if c := upsertChange(current, name, "104.198.1.1", 300); c != nil {
+		t.Errorf("same record. change = %v", c)
+	}
+
+	c := upsertChange(current, name, "104.198.2.2", 300)
+	if c == nil {
+		t.Fatal("change is nil")
+	}
+	if len(c.Deletions) != 1 || c.Deletions[0].Rrdatas[0] != "104.198.1.1" {
+		t.Errorf("deletions = %v", c.Deletions)
+	}
+	if len(c.Additions) != 1 || c.Additions[0].Rrdatas[0] != "104.198.2.2" || c.Additions[0].Type != "A" {
+		t.Errorf("additions = %v", c.Additions)
+	}
+
+	c = upsertChange(nil, name, "104.198.1.1", 300)
+	if c == nil || len(c.Deletions) != 0 || len(c.Additions) != 1 {
+		t.Errorf("new record. change = %v", c)
+	}
+}
@@ -0,0 +1,588 @@
+package sinmetalcraft
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"google.golang.org/api/compute/v1"
+
+	"golang.org/x/net/context"
+)
+
+func init() {
+	api := GCApi{}
+
+	http.HandleFunc("/cron/1/minecraft/gc", api.Cron)
+	apiRouter.Handle("POST", "/api/1/gc", api.Post, requireAdmin)
+}
+
+// gcDefaultGracePeriod is AppConfigで指定が無い場合に、見つけてから消すまで待つ時間
+const gcDefaultGracePeriod = 72 * time.Hour
+
+// GCCandidate Kind
+const (
+	GCKindInstance = "instance"
+	GCKindDisk     = "disk"
+	GCKindSnapshot = "snapshot"
+)
+
+// GCCandidate Action
+const (
+	GCActionPending     = "pending"     // Grace Periodが過ぎるのを待っている
+	GCActionDelete      = "delete"      // Grace Periodが過ぎたので消す
+	GCActionAllowlisted = "allowlisted" // AppConfig.GCAllowlistにあるので消さない
+)
+
+// diskPricesPerGBMonth is asia-northeast1のDisk Typeの1GB 1ヶ月の価格 (USD)
+var diskPricesPerGBMonth = map[string]float64{
+	"pd-standard": 0.052,
+	"pd-ssd":      0.221,
+}
+
+// snapshotPricePerGBMonth is asia-northeast1のSnapshotの1GB 1ヶ月の価格 (USD)
+const snapshotPricePerGBMonth = 0.034
+
+// hoursPerMonth is 1ヶ月の価格を出す時の時間
+const hoursPerMonth = 730
+
+// GCCandidate is 持ち主のWorldも、使っている途中のJobも無いGCEのResource
+// 見つけた時間を覚えておくために、Kind "GCCandidate" として保存する
+type GCCandidate struct {
+	Key                  *datastore.Key `json:"-" datastore:"-"`
+	Kind                 string         `json:"kind"`
+	Name                 string         `json:"name"`
+	Zone                 string         `json:"zone"` // Snapshotの場合は空
+	World                string         `json:"world"`
+	Reason               string         `json:"reason" datastore:",noindex"`
+	EstimatedMonthlyCost float64        `json:"estimatedMonthlyCost" datastore:",noindex"` // USD
+	Action               string         `json:"action" datastore:",noindex"`
+	FirstSeenAt          time.Time      `json:"firstSeenAt"`
+	DeleteAfter          time.Time      `json:"deleteAfter" datastore:",noindex"`
+	Deleted              bool           `json:"deleted" datastore:"-"`
+	Error                string         `json:"error" datastore:",noindex"`
+	UpdatedAt            time.Time      `json:"updatedAt" datastore:",noindex"`
+}
+
+// keyName is GCCandidateのKey Name。<kind>/<zone>/<name>
+func (c *GCCandidate) keyName() string {
+	return fmt.Sprintf("%s/%s/%s", c.Kind, c.Zone, c.Name)
+}
+
+// GCReport is GCの結果
+type GCReport struct {
+	DryRun               bool           `json:"dryRun"`
+	GracePeriodHours     int            `json:"gracePeriodHours"`
+	Candidates           []*GCCandidate `json:"candidates"`
+	Deleted              int            `json:"deleted"`
+	Pending              int            `json:"pending"`
+	Allowlisted          int            `json:"allowlisted"`
+	Failed               int            `json:"failed"`
+	EstimatedMonthlyCost float64        `json:"estimatedMonthlyCost"` // 消さずに残っているCandidateの1ヶ月の価格の合計 (USD)
+	CreatedAt            time.Time      `json:"createdAt"`
+}
+
+// summarize is Actionごとの数と、残っているCandidateの価格を数える
+func (r *GCReport) summarize() {
+	r.Deleted, r.Pending, r.Allowlisted, r.Failed = 0, 0, 0, 0
+	r.EstimatedMonthlyCost = 0
+	for _, c := range r.Candidates {
+		switch {
+		case c.Deleted:
+			r.Deleted++
+			continue
+		case len(c.Error) > 0:
+			r.Failed++
+		case c.Action == GCActionAllowlisted:
+			r.Allowlisted++
+		default:
+			r.Pending++
+		}
+		r.EstimatedMonthlyCost += c.EstimatedMonthlyCost
+	}
+}
+
+// Message is Slackに送るReportの要約
+func (r *GCReport) Message() string {
+	if r.DryRun {
+		return fmt.Sprintf("gc (dry run): %d orphaned resources cost about $%.2f/month.", len(r.Candidates), r.EstimatedMonthlyCost)
+	}
+	return fmt.Sprintf("gc: deleted %d, %d waiting %dh grace period, %d allowlisted, %d failed. remaining cost about $%.2f/month.", r.Deleted, r.Pending, r.GracePeriodHours, r.Allowlisted, r.Failed, r.EstimatedMonthlyCost)
+}
+
+// gcGracePeriod is AppConfigのGrace Periodを返す
+func (ac *AppConfig) gcGracePeriod() time.Duration {
+	if ac.GCGracePeriodHours > 0 {
+		return time.Duration(ac.GCGracePeriodHours) * time.Hour
+	}
+	return gcDefaultGracePeriod
+}
+
+// gcAllowed is nameがAllowlistのPatternのどれかに合うか
+// Patternはpath.Matchの形式 (e.g. "minecraft-world-archive-*")
+func gcAllowed(allowlist []string, name string) bool {
+	for _, p := range allowlist {
+		if ok, err := path.Match(p, name); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validateGCAllowlist is AllowlistのPatternがpath.Matchで使えるかを確認する
+func validateGCAllowlist(allowlist []string) error {
+	for _, p := range allowlist {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("gcAllowlist %q is invalid pattern. %v", p, err)
+		}
+	}
+	return nil
+}
+
+// instanceMonthlyCost is 動いているInstanceの1ヶ月の価格。止まっている場合は0
+func instanceMonthlyCost(ins *compute.Instance) float64 {
+	if ins.Status != "RUNNING" {
+		return 0
+	}
+	p, ok := machineTypePrices[path.Base(ins.MachineType)]
+	if !ok {
+		return 0
+	}
+	if ins.Scheduling != nil && ins.Scheduling.Preemptible {
+		return p.Preemptible * hoursPerMonth
+	}
+	return p.Standard * hoursPerMonth
+}
+
+// diskMonthlyCost is Diskの1ヶ月の価格
+func diskMonthlyCost(d *compute.Disk) float64 {
+	return diskPricesPerGBMonth[path.Base(d.Type)] * float64(d.SizeGb)
+}
+
+// snapshotMonthlyCost is Snapshotの1ヶ月の価格
+func snapshotMonthlyCost(sn *compute.Snapshot) float64 {
+	return snapshotPricePerGBMonth * float64(sn.StorageBytes) / (1 << 30)
+}
+
+// gcState is GCの時点のDatastoreとGCEの状態
+type gcState struct {
+	Worlds         []Minecraft
+	Imports        []WorldImport
+	Exports        []WorldExport
+	Upgrades       []WorldUpgrade
+	OverviewerJobs []*OverviewerJob
+	Instances      []*compute.Instance
+	Disks          []*compute.Disk
+	Snapshots      []*compute.Snapshot
+}
+
+// collectGarbage is 持ち主のWorldが無い、または使っているJobが無いResourceを返す
+// World Diskなど、Worldがあるものは消さない。Datastoreを書き換えないので、dry runでもそのまま使える
+func collectGarbage(st gcState) []*GCCandidate {
+	worlds := make(map[string]bool)
+	snapshotsInUse := make(map[string]bool)
+	for _, w := range st.Worlds {
+		worlds[w.World] = true
+		// CloneしたWorldは元のWorldのSnapshotをLatestSnapshotにしている
+		snapshotsInUse[w.LatestSnapshot] = true
+		snapshotsInUse[w.OverviewerSnapshot] = true
+	}
+	importing := make(map[string]bool)
+	for _, wi := range st.Imports {
+		if !wi.Finished() {
+			importing[wi.World] = true
+			snapshotsInUse[wi.Snapshot] = true
+		}
+	}
+	exporting := make(map[string]bool)
+	for _, we := range st.Exports {
+		if !we.Finished() {
+			exporting[worldExportResourceName(we)] = true
+			snapshotsInUse[we.Snapshot] = true
+		}
+	}
+	for _, wu := range st.Upgrades {
+		if !wu.Finished() {
+			snapshotsInUse[wu.PreSnapshot] = true
+		}
+	}
+	overviewerInstances := make(map[string]bool)
+	for _, job := range st.OverviewerJobs {
+		if !job.Finished() {
+			// Instanceを作る前のDiskも使っている途中
+			overviewerInstances[job.World] = true
+		}
+	}
+	for _, ins := range st.Instances {
+		if strings.HasPrefix(ins.Name, OverviewerInstanceName+"-") {
+			overviewerInstances[ins.Name[len(OverviewerInstanceName+"-"):]] = true
+		}
+	}
+
+	candidates := make([]*GCCandidate, 0)
+	for _, ins := range st.Instances {
+		c := &GCCandidate{
+			Kind:                 GCKindInstance,
+			Name:                 ins.Name,
+			Zone:                 path.Base(ins.Zone),
+			EstimatedMonthlyCost: instanceMonthlyCost(ins),
+		}
+		switch {
+		case strings.HasPrefix(ins.Name, INSTANCE_NAME+"-"):
+			c.World = ins.Name[len(INSTANCE_NAME+"-"):]
+			if worlds[c.World] {
+				continue
+			}
+			c.Reason = "world does not exist."
+		case strings.HasPrefix(ins.Name, OverviewerInstanceName+"-"):
+			c.World = ins.Name[len(OverviewerInstanceName+"-"):]
+			if worlds[c.World] {
+				continue
+			}
+			c.Reason = "world does not exist."
+		case strings.HasPrefix(ins.Name, WorldImportInstanceName+"-"):
+			c.World = ins.Name[len(WorldImportInstanceName+"-"):]
+			if importing[c.World] {
+				continue
+			}
+			c.Reason = "no active import."
+		case strings.HasPrefix(ins.Name, WorldExportInstanceName+"-"):
+			if exporting[ins.Name] {
+				continue
+			}
+			c.Reason = "no active export."
+		default:
+			continue
+		}
+		candidates = append(candidates, c)
+	}
+
+	overviewerDiskPrefix := fmt.Sprintf(OverViewerWorldDiskFormat, INSTANCE_NAME, "")
+	worldDiskPrefix := fmt.Sprintf("%s-world-", INSTANCE_NAME)
+	importDiskPrefix := worldImportDiskName("")
+	for _, d := range st.Disks {
+		if len(d.Users) > 0 {
+			// Instanceに付いているDiskはInstanceと一緒に消す
+			continue
+		}
+		c := &GCCandidate{
+			Kind:                 GCKindDisk,
+			Name:                 d.Name,
+			Zone:                 path.Base(d.Zone),
+			EstimatedMonthlyCost: diskMonthlyCost(d),
+		}
+		switch {
+		case strings.HasPrefix(d.Name, overviewerDiskPrefix):
+			c.World = d.Name[len(overviewerDiskPrefix):]
+			if worlds[c.World] && overviewerInstances[c.World] {
+				continue
+			}
+			c.Reason = "no active overviewer job."
+			if !worlds[c.World] {
+				c.Reason = "world does not exist."
+			}
+		case strings.HasPrefix(d.Name, worldDiskPrefix):
+			c.World = d.Name[len(worldDiskPrefix):]
+			if worlds[c.World] {
+				continue
+			}
+			c.Reason = "world does not exist."
+		case strings.HasPrefix(d.Name, importDiskPrefix):
+			c.World = d.Name[len(importDiskPrefix):]
+			if importing[c.World] {
+				continue
+			}
+			c.Reason = "no active import."
+		case strings.HasPrefix(d.Name, WorldExportInstanceName+"-"):
+			if exporting[d.Name] {
+				continue
+			}
+			c.Reason = "no active export."
+		default:
+			continue
+		}
+		candidates = append(candidates, c)
+	}
+
+	for _, sn := range st.Snapshots {
+		world := snapshotWorld(sn.Name)
+		if len(world) < 1 || worlds[world] || snapshotsInUse[sn.Name] {
+			continue
+		}
+		candidates = append(candidates, &GCCandidate{
+			Kind:                 GCKindSnapshot,
+			Name:                 sn.Name,
+			World:                world,
+			Reason:               "world does not exist.",
+			EstimatedMonthlyCost: snapshotMonthlyCost(sn),
+		})
+	}
+
+	sort.Sort(gcCandidates(candidates))
+	return candidates
+}
+
+// gcCandidates is Kind, Nameの順に並べる
+type gcCandidates []*GCCandidate
+
+func (l gcCandidates) Len() int      { return len(l) }
+func (l gcCandidates) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l gcCandidates) Less(i, j int) bool {
+	if l[i].Kind != l[j].Kind {
+		return l[i].Kind < l[j].Kind
+	}
+	return l[i].Name < l[j].Name
+}
+
+// decideGC is 最初に見つけた時間とGrace PeriodとAllowlistから、Candidateを消すかどうかを決める
+func decideGC(c *GCCandidate, firstSeen time.Time, grace time.Duration, allowlist []string, now time.Time) {
+	c.FirstSeenAt = firstSeen
+	c.DeleteAfter = firstSeen.Add(grace)
+	switch {
+	case gcAllowed(allowlist, c.Name):
+		c.Action = GCActionAllowlisted
+	case !now.Before(c.DeleteAfter):
+		c.Action = GCActionDelete
+	default:
+		c.Action = GCActionPending
+	}
+}
+
+// GCApi is 持ち主の無いGCEのResourceを見つけて、Grace Periodが過ぎたら消す
+type GCApi struct{}
+
+// Cron is /cron/1/minecraft/gc handler
+// dryRun=true の場合は消さずにSlackに知らせるだけ
+func (a *GCApi) Cron(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	dryRun, _ := strconv.ParseBool(r.FormValue("dryRun"))
+	report, err := a.run(ctx, r, dryRun)
+	if err != nil {
+		log.Errorf(ctx, "ERROR gc: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	WriteLog(ctx, "GC_REPORT", report)
+	if len(report.Candidates) > 0 {
+		notifyGC(ctx, report)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Post is POST /api/1/gc
+// ?dryRun=true の場合は消さずに見つけたものを返す
+func (a *GCApi) Post(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	var dryRun bool
+	if v := r.FormValue("dryRun"); len(v) > 0 {
+		var err error
+		dryRun, err = strconv.ParseBool(v)
+		if err != nil {
+			return invalidRequestError("dryRun is true or false.").WithDetail("dryRun", v)
+		}
+	}
+
+	report, err := a.run(ctx, r, dryRun)
+	if err != nil {
+		return internalError(err)
+	}
+	writeJSON(w, http.StatusOK, report)
+	return nil
+}
+
+// run is Datastoreの持ち主とGCEのResourceを集めてCandidateを決め、dry runでなければGrace Periodが過ぎたものを消す
+func (a *GCApi) run(ctx context.Context, r *http.Request, dryRun bool) (*GCReport, error) {
+	acs := AppConfigService{}
+	config, err := acs.Get(ctx)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	grace := config.gcGracePeriod()
+
+	var st gcState
+	keys, err := datastore.NewQuery("Minecraft").GetAll(ctx, &st.Worlds)
+	if err != nil {
+		return nil, err
+	}
+	zones := map[string]bool{"asia-northeast1-b": true}
+	for i := range st.Worlds {
+		st.Worlds[i].World = keys[i].StringID()
+		if len(st.Worlds[i].Zone) > 0 {
+			zones[st.Worlds[i].Zone] = true
+		}
+	}
+	if _, err := datastore.NewQuery("WorldImport").GetAll(ctx, &st.Imports); err != nil {
+		return nil, err
+	}
+	for _, wi := range st.Imports {
+		if len(wi.Zone) > 0 {
+			zones[wi.Zone] = true
+		}
+	}
+	exportKeys, err := datastore.NewQuery("WorldExport").GetAll(ctx, &st.Exports)
+	if err != nil {
+		return nil, err
+	}
+	for i := range st.Exports {
+		st.Exports[i].ID = exportKeys[i].IntID()
+	}
+	if _, err := datastore.NewQuery("WorldUpgrade").GetAll(ctx, &st.Upgrades); err != nil {
+		return nil, err
+	}
+	st.OverviewerJobs, err = queryActiveOverviewerJobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := newComputeService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	is := compute.NewInstancesService(s)
+	ds := compute.NewDisksService(s)
+	ss := compute.NewSnapshotsService(s)
+	for zone := range zones {
+		l, err := listAllInstances(is, zone)
+		if err != nil {
+			return nil, err
+		}
+		st.Instances = append(st.Instances, l...)
+
+		dl, err := listAllDisks(ds, zone)
+		if err != nil {
+			return nil, err
+		}
+		st.Disks = append(st.Disks, dl...)
+	}
+	st.Snapshots, err = listAllWorldSnapshots(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	var seen []*GCCandidate
+	seenKeys, err := datastore.NewQuery("GCCandidate").GetAll(ctx, &seen)
+	if err != nil {
+		return nil, err
+	}
+	firstSeen := make(map[string]time.Time)
+	for i, k := range seenKeys {
+		firstSeen[k.StringID()] = seen[i].FirstSeenAt
+	}
+
+	now := time.Now()
+	report := &GCReport{
+		DryRun:           dryRun,
+		GracePeriodHours: int(grace / time.Hour),
+		Candidates:       collectGarbage(st),
+		CreatedAt:        now,
+	}
+	current := make(map[string]bool)
+	for _, c := range report.Candidates {
+		name := c.keyName()
+		current[name] = true
+		fs, ok := firstSeen[name]
+		if !ok {
+			fs = now
+		}
+		decideGC(c, fs, grace, config.GCAllowlist, now)
+	}
+	if dryRun {
+		report.summarize()
+		return report, nil
+	}
+
+	for _, c := range report.Candidates {
+		c.Key = datastore.NewKey(ctx, "GCCandidate", c.keyName(), 0, nil)
+		c.UpdatedAt = now
+		if c.Action == GCActionDelete {
+			err := a.delete(ctx, r, is, ds, ss, c)
+			if err == nil {
+				c.Deleted = true
+				if err := datastore.Delete(ctx, c.Key); err != nil {
+					log.Warningf(ctx, "ERROR delete GCCandidate %s: %v", c.keyName(), err)
+				}
+				continue
+			}
+			log.Warningf(ctx, "ERROR gc %s %s: %v", c.Kind, c.Name, err)
+			c.Error = err.Error()
+		}
+		if _, err := datastore.Put(ctx, c.Key, c); err != nil {
+			return nil, err
+		}
+	}
+	// 消えたResourceや、持ち主が戻ったResourceは次に見つけた時に数え直す
+	for _, k := range seenKeys {
+		if current[k.StringID()] {
+			continue
+		}
+		if err := datastore.Delete(ctx, k); err != nil {
+			log.Warningf(ctx, "ERROR delete GCCandidate %s: %v", k.StringID(), err)
+		}
+	}
+	report.summarize()
+	return report, nil
+}
+
+// delete is Candidateを消す。既に無い場合は消したことにする
+func (a *GCApi) delete(ctx context.Context, r *http.Request, is *compute.InstancesService, ds *compute.DisksService, ss *compute.SnapshotsService, c *GCCandidate) error {
+	var ope *compute.Operation
+	var err error
+	switch c.Kind {
+	case GCKindInstance:
+		ope, err = is.Delete(PROJECT_NAME, c.Zone, c.Name).Do()
+	case GCKindDisk:
+		ope, err = ds.Delete(PROJECT_NAME, c.Zone, c.Name).Do()
+	case GCKindSnapshot:
+		ope, err = ss.Delete(PROJECT_NAME, c.Name).Do()
+	default:
+		return fmt.Errorf("unknown kind %s", c.Kind)
+	}
+	if isNotFoundError(err) {
+		err = nil
+	}
+	ev := newAuditEvent(ctx, r, AuditActionGCDelete)
+	ev.Target = c.Name
+	ev.SetDiff(c, nil)
+	ev.Record(ctx, err)
+	if err != nil {
+		return err
+	}
+	WriteLog(ctx, "GC_DELETE_OPE", ope)
+	return nil
+}
+
+// notifyGC is GCで見つけたものをSlackに送る
+// Slackに送れなくてもGCは止めない
+func notifyGC(ctx context.Context, report *GCReport) {
+	color := "#36a64f"
+	if report.Failed > 0 {
+		color = "#d00000"
+	} else if report.Pending > 0 || report.DryRun {
+		color = "#daa038"
+	}
+	fields := make([]SlackField, 0)
+	for _, c := range report.Candidates {
+		state := c.Action
+		switch {
+		case c.Deleted:
+			state = "deleted"
+		case len(c.Error) > 0:
+			state = "failed: " + c.Error
+		case c.Action == GCActionPending:
+			state = "delete after " + c.DeleteAfter.In(playWindowLocation).Format("2006-01-02 15:04")
+		}
+		fields = append(fields, SlackField{
+			Title: fmt.Sprintf("%s %s ($%.2f/month) %s %s", c.Kind, c.Name, c.EstimatedMonthlyCost, c.Reason, state),
+		})
+	}
+
+	notifySlack(ctx, report.Message(), color, fields...)
+}
@@ -0,0 +1,160 @@
+package sinmetalcraft
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+func findGC(candidates []*GCCandidate, kind string, name string) (*GCCandidate, bool) {
+	for _, c := range candidates {
+		if c.Kind == kind && c.Name == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+func TestCollectGarbage(t *testing.T) {
+	st := gcState{
+		Worlds: []Minecraft{
+			{World: "hoge", LatestSnapshot: "minecraft-world-hoge-20171101-000000"},
+			// 削除したWorldのSnapshotからCloneした
+			{World: "clone", LatestSnapshot: "minecraft-world-deleted-20171101-000000"},
+			{World: "rendering"},
+		},
+		Imports: []WorldImport{
+			{World: "importing", Status: WorldImportStatusUnpacking},
+			{World: "imported", Status: WorldImportStatusDone},
+		},
+		Exports: []WorldExport{
+			{ID: 1, World: "hoge", Status: WorldExportStatusArchiving, Snapshot: "minecraft-world-exported-20171101-000000"},
+			{ID: 2, World: "hoge", Status: WorldExportStatusFailed},
+		},
+		OverviewerJobs: []*OverviewerJob{
+			{World: "rendering", Status: OverviewerJobStatusCreatingDisk},
+			{World: "clone", Status: OverviewerJobStatusFailed},
+		},
+		Instances: []*compute.Instance{
+			&compute.Instance{Name: "minecraft-hoge", Zone: reconcileTestZone, Status: "RUNNING"},
+			&compute.Instance{Name: "minecraft-deleted", Zone: reconcileTestZone, Status: "RUNNING", MachineType: "zones/asia-northeast1-b/machineTypes/n1-standard-1"},
+			&compute.Instance{Name: "overviewer-hoge", Zone: reconcileTestZone, Status: "RUNNING"},
+			&compute.Instance{Name: "worldimport-importing", Zone: reconcileTestZone, Status: "RUNNING"},
+			&compute.Instance{Name: "worldimport-imported", Zone: reconcileTestZone, Status: "TERMINATED"},
+			&compute.Instance{Name: "worldexport-hoge-1", Zone: reconcileTestZone, Status: "RUNNING"},
+			&compute.Instance{Name: "worldexport-hoge-2", Zone: reconcileTestZone, Status: "RUNNING"},
+			&compute.Instance{Name: "other", Zone: reconcileTestZone, Status: "RUNNING"},
+		},
+		Disks: []*compute.Disk{
+			&compute.Disk{Name: "minecraft-world-hoge", Zone: reconcileTestZone},
+			&compute.Disk{Name: "minecraft-world-deleted", Zone: reconcileTestZone, SizeGb: 100, Type: "zones/asia-northeast1-b/diskTypes/pd-ssd"},
+			&compute.Disk{Name: "minecraft-world-attached", Zone: reconcileTestZone, Users: []string{"minecraft-attached"}},
+			&compute.Disk{Name: "minecraft-overviewer-world-hoge", Zone: reconcileTestZone},
+			&compute.Disk{Name: "minecraft-overviewer-world-clone", Zone: reconcileTestZone},
+			// OverviewerJobがInstanceを作る前
+			&compute.Disk{Name: "minecraft-overviewer-world-rendering", Zone: reconcileTestZone},
+			&compute.Disk{Name: "worldimport-world-importing", Zone: reconcileTestZone},
+			&compute.Disk{Name: "worldimport-world-imported", Zone: reconcileTestZone},
+		},
+		Snapshots: []*compute.Snapshot{
+			&compute.Snapshot{Name: "minecraft-world-hoge-20171101-000000"},
+			&compute.Snapshot{Name: "minecraft-world-deleted-20171101-000000"},
+			&compute.Snapshot{Name: "minecraft-world-deleted-20171102-000000", StorageBytes: 10 << 30},
+			&compute.Snapshot{Name: "minecraft-world-exported-20171101-000000"},
+		},
+	}
+
+	candidates := collectGarbage(st)
+	want := []struct {
+		kind   string
+		name   string
+		reason string
+	}{
+		{GCKindDisk, "minecraft-overviewer-world-clone", "no active overviewer job."},
+		{GCKindDisk, "minecraft-world-deleted", "world does not exist."},
+		{GCKindDisk, "worldimport-world-imported", "no active import."},
+		{GCKindInstance, "minecraft-deleted", "world does not exist."},
+		{GCKindInstance, "worldexport-hoge-2", "no active export."},
+		{GCKindInstance, "worldimport-imported", "no active import."},
+		{GCKindSnapshot, "minecraft-world-deleted-20171102-000000", "world does not exist."},
+	}
+	if len(candidates) != len(want) {
+		t.Fatalf("candidates = %d, want %d", len(candidates), len(want))
+	}
+	for i, w := range want {
+		c := candidates[i]
+		if c.Kind != w.kind || c.Name != w.name || c.Reason != w.reason {
+			t.Errorf("candidates[%d] = %+v, want %+v", i, c, w)
+		}
+	}
+
+	c, _ := findGC(candidates, GCKindDisk, "minecraft-world-deleted")
+	if c.World != "deleted" || c.Zone != "asia-northeast1-b" || c.EstimatedMonthlyCost != 22.1 {
+		t.Errorf("disk candidate = %+v", c)
+	}
+	c, _ = findGC(candidates, GCKindInstance, "minecraft-deleted")
+	if c.EstimatedMonthlyCost != machineTypePrices["n1-standard-1"].Standard*hoursPerMonth {
+		t.Errorf("instance cost = %f", c.EstimatedMonthlyCost)
+	}
+	c, _ = findGC(candidates, GCKindInstance, "worldimport-imported")
+	if c.EstimatedMonthlyCost != 0 {
+		t.Errorf("terminated instance cost = %f", c.EstimatedMonthlyCost)
+	}
+	c, _ = findGC(candidates, GCKindSnapshot, "minecraft-world-deleted-20171102-000000")
+	if c.Zone != "" || c.EstimatedMonthlyCost != 10*snapshotPricePerGBMonth {
+		t.Errorf("snapshot candidate = %+v", c)
+	}
+}
+
+func TestDecideGC(t *testing.T) {
+	now := time.Date(2017, 11, 4, 12, 0, 0, 0, time.UTC)
+	grace := 72 * time.Hour
+	allowlist := []string{"minecraft-world-archive-*"}
+
+	cases := []struct {
+		name      string
+		firstSeen time.Time
+		want      string
+	}{
+		{"minecraft-world-hoge", now, GCActionPending},
+		{"minecraft-world-hoge", now.Add(-71 * time.Hour), GCActionPending},
+		{"minecraft-world-hoge", now.Add(-72 * time.Hour), GCActionDelete},
+		{"minecraft-world-archive-2016", now.Add(-100 * time.Hour), GCActionAllowlisted},
+	}
+	for _, tc := range cases {
+		c := &GCCandidate{Kind: GCKindDisk, Name: tc.name}
+		decideGC(c, tc.firstSeen, grace, allowlist, now)
+		if c.Action != tc.want {
+			t.Errorf("%s first seen %s: action = %s, want %s", tc.name, tc.firstSeen, c.Action, tc.want)
+		}
+		if !c.DeleteAfter.Equal(tc.firstSeen.Add(grace)) {
+			t.Errorf("%s: deleteAfter = %s", tc.name, c.DeleteAfter)
+		}
+	}
+}
+
+func TestValidateGCAllowlist(t *testing.T) {
+	if err := validateGCAllowlist([]string{"minecraft-world-archive-*", "overviewer-hoge"}); err != nil {
+		t.Errorf("valid allowlist: %v", err)
+	}
+	if err := validateGCAllowlist([]string{"minecraft-[world"}); err == nil {
+		t.Error("invalid pattern must be error")
+	}
+}
+
+func TestGCReportSummarize(t *testing.T) {
+	r := GCReport{GracePeriodHours: 72, Candidates: []*GCCandidate{
+		{Action: GCActionDelete, Deleted: true, EstimatedMonthlyCost: 10},
+		{Action: GCActionDelete, Error: "hoge", EstimatedMonthlyCost: 1},
+		{Action: GCActionPending, EstimatedMonthlyCost: 2},
+		{Action: GCActionAllowlisted, EstimatedMonthlyCost: 0.5},
+	}}
+	r.summarize()
+	if r.Deleted != 1 || r.Failed != 1 || r.Pending != 1 || r.Allowlisted != 1 || r.EstimatedMonthlyCost != 3.5 {
+		t.Errorf("report = %+v", r)
+	}
+	if got := r.Message(); got != "gc: deleted 1, 1 waiting 72h grace period, 1 allowlisted, 1 failed. remaining cost about $3.50/month." {
+		t.Errorf("message = %s", got)
+	}
+}
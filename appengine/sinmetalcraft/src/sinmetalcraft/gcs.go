@@ -0,0 +1,258 @@
+package sinmetalcraft
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/urlfetch"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const storageScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// newStorageClient is Cloud Storage JSON APIを叩くためのhttp.Client
+func newStorageClient(ctx context.Context) *http.Client {
+	return &http.Client{
+		Transport: &oauth2.Transport{
+			Source: google.AppEngineTokenSource(ctx, storageScope),
+			Base:   &urlfetch.Transport{Context: ctx},
+		},
+	}
+}
+
+// gcsObjectURL is Cloud Storage JSON APIのObjectのURL
+func gcsObjectURL(bucket string, object string) string {
+	return fmt.Sprintf("https://www.googleapis.com/storage/v1/b/%s/o/%s", url.PathEscape(bucket), url.PathEscape(object))
+}
+
+// gcsObject is Cloud Storage JSON APIのObject Resourceのうち使うもの
+type gcsObject struct {
+	Size    int64
+	Updated time.Time
+}
+
+// gcsGetObject is ObjectのMetadataを返す
+// Objectが存在しない場合は (nil, false, nil) を返す
+func gcsGetObject(client *http.Client, bucket string, object string) (*gcsObject, bool, error) {
+	res, err := client.Get(gcsObjectURL(bucket, object))
+	if err != nil {
+		return nil, false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		return nil, false, fmt.Errorf("gcs object get error. status = %d, body = %s", res.StatusCode, b)
+	}
+
+	var o struct {
+		Size    string    `json:"size"`
+		Updated time.Time `json:"updated"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&o); err != nil {
+		return nil, false, err
+	}
+	size, err := strconv.ParseInt(o.Size, 10, 64)
+	if err != nil {
+		return nil, false, err
+	}
+	return &gcsObject{Size: size, Updated: o.Updated}, true, nil
+}
+
+// gcsObjectSize is Objectのサイズを返す
+// Objectが存在しない場合は (0, false, nil) を返す
+func gcsObjectSize(client *http.Client, bucket string, object string) (int64, bool, error) {
+	o, ok, err := gcsGetObject(client, bucket, object)
+	if err != nil || !ok {
+		return 0, ok, err
+	}
+	return o.Size, true, nil
+}
+
+// gcsDeleteObject is Objectを削除する。存在しない場合は何もしない
+func gcsDeleteObject(client *http.Client, bucket string, object string) error {
+	req, err := http.NewRequest("DELETE", gcsObjectURL(bucket, object), nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		b, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("gcs object delete error. status = %d, body = %s", res.StatusCode, b)
+	}
+	return nil
+}
+
+// gcsObjectReader is ObjectをRange Requestで必要な所だけ読むio.ReaderAt
+// urlfetchはResponseのサイズに上限があるので、大きなObjectを一度に読まないようにする
+type gcsObjectReader struct {
+	client *http.Client
+	bucket string
+	object string
+	size   int64
+}
+
+func (r *gcsObjectReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p)) - 1
+	if end >= r.size {
+		end = r.size - 1
+	}
+
+	req, err := http.NewRequest("GET", gcsObjectURL(r.bucket, r.object)+"?alt=media", nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, end))
+	res, err := r.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent && res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("gcs object read error. status = %d", res.StatusCode)
+	}
+
+	n, err := io.ReadFull(res.Body, p[:end-off+1])
+	if err != nil {
+		return n, err
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// signedURL is Cloud Storageに認証無しでアクセスできるV2 Signed URLを作る
+// signにはappengine.SignBytesを渡す
+func signedURL(accessID string, sign func([]byte) ([]byte, error), method string, bucket string, object string, contentType string, expires time.Time) (string, error) {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	path := "/" + bucket + "/" + (&url.URL{Path: object}).EscapedPath()
+	b, err := sign([]byte(method + "\n\n" + contentType + "\n" + exp + "\n" + path))
+	if err != nil {
+		return "", err
+	}
+
+	q := url.Values{
+		"GoogleAccessId": {accessID},
+		"Expires":        {exp},
+		"Signature":      {base64.StdEncoding.EncodeToString(b)},
+	}
+	return "https://storage.googleapis.com" + path + "?" + q.Encode(), nil
+}
+
+// appEngineSignedURL is App EngineのService Accountで署名したSigned URLを作る
+func appEngineSignedURL(ctx context.Context, method string, bucket string, object string, contentType string, expires time.Time) (string, error) {
+	accessID, err := appengine.ServiceAccount(ctx)
+	if err != nil {
+		return "", err
+	}
+	return signedURL(accessID, func(b []byte) ([]byte, error) {
+		_, sig, err := appengine.SignBytes(ctx, b)
+		return sig, err
+	}, method, bucket, object, contentType, expires)
+}
+
+// gcsUploadBaseURL is Cloud Storage JSON APIのUpload URL
+const gcsUploadBaseURL = "https://www.googleapis.com/upload/storage/v1"
+
+// gcsResumableUpload is Resumable UploadでObjectを先頭から少しずつ書き込む
+// urlfetchはRequestのサイズにも上限があるので、大きなObjectはChunkに分けて送る
+type gcsResumableUpload struct {
+	client  *http.Client
+	session string
+	size    int64
+}
+
+// gcsStartResumableUpload is Resumable UploadのSessionを作る
+// baseURLは通常gcsUploadBaseURLで、Testの時だけ差し替える
+func gcsStartResumableUpload(client *http.Client, baseURL string, bucket string, object string, contentType string, size int64) (*gcsResumableUpload, error) {
+	u := fmt.Sprintf("%s/b/%s/o?uploadType=resumable&name=%s", baseURL, url.PathEscape(bucket), url.QueryEscape(object))
+	req, err := http.NewRequest("POST", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Upload-Content-Type", contentType)
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		return nil, fmt.Errorf("gcs resumable upload start error. status = %d, body = %s", res.StatusCode, b)
+	}
+	session := res.Header.Get("Location")
+	if len(session) < 1 {
+		return nil, fmt.Errorf("gcs resumable upload start error. Location is empty")
+	}
+	return &gcsResumableUpload{client: client, session: session, size: size}, nil
+}
+
+// WriteChunk is offからpを書き込む
+// 最後以外のChunkのサイズは256KiBの倍数にする。最後のChunkを書き込むとObjectができる
+func (u *gcsResumableUpload) WriteChunk(p []byte, off int64) error {
+	end := off + int64(len(p)) - 1
+	req, err := http.NewRequest("PUT", u.session, bytes.NewReader(p))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(p))
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", off, end, u.size))
+	res, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	last := end == u.size-1
+	switch {
+	case last && (res.StatusCode == http.StatusOK || res.StatusCode == http.StatusCreated):
+		return nil
+	case !last && res.StatusCode == http.StatusPermanentRedirect:
+		return nil
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	return fmt.Errorf("gcs resumable upload error. range = %d-%d/%d, status = %d, body = %s", off, end, u.size, res.StatusCode, b)
+}
+
+// httpReadRange is urlのoffからlen(p)分をRange Requestで読む
+func httpReadRange(client *http.Client, u string, off int64, p []byte) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	// Rangeに対応していない場合は全体が返ってくるので、先頭から読む時だけ許す
+	if res.StatusCode != http.StatusPartialContent && !(res.StatusCode == http.StatusOK && off == 0) {
+		return fmt.Errorf("range read error. url = %s, status = %d", u, res.StatusCode)
+	}
+	_, err = io.ReadFull(res.Body, p)
+	return err
+}
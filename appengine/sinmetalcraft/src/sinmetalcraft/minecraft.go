@@ -1,6 +1,8 @@
 package sinmetalcraft
 
 import (
+	"fmt"
+	"regexp"
 	"time"
 
 	"google.golang.org/appengine/datastore"
@@ -10,23 +12,26 @@ import (
 )
 
 // UpdateOverviewerSnapshot is Overviewerを作成したSnapshotのVersionを更新する
-func (m *Minecraft) UpdateOverviewerSnapshot(ctx context.Context, key *datastore.Key) error {
-	return datastore.RunInTransaction(ctx, func(c context.Context) error {
-		var entity Minecraft
-		err := datastore.Get(ctx, key, &entity)
-		if err != datastore.ErrNoSuchEntity && err != nil {
-			return err
-		}
-
-		entity.OverviewerSnapshot = entity.LatestSnapshot
-		entity.UpdatedAt = time.Now()
-		_, err = datastore.Put(ctx, key, &entity)
-		if err != nil {
-			return err
-		}
+// OverviewerJobのTransactionの中で呼ぶ。Worldが消されている場合や
+// 古いSnapshotを指定してRenderした場合は、新しいSnapshotのRenderを戻さないように何もしない
+func (m *Minecraft) UpdateOverviewerSnapshot(c context.Context, key *datastore.Key, snapshot string) error {
+	var entity Minecraft
+	err := datastore.Get(c, key, &entity)
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
+	if len(entity.OverviewerSnapshot) > 0 && !snapshotNewer(snapshot, entity.OverviewerSnapshot) {
 		return nil
-	}, nil)
+	}
+
+	entity.OverviewerSnapshot = snapshot
+	entity.UpdatedAt = time.Now()
+	_, err = datastore.Put(c, key, &entity)
+	return err
 }
 
 //QueryExistsServers is 起動しているサーバ一覧を取得
@@ -35,6 +40,45 @@ func (m *Minecraft) QueryExistsServers(ctx context.Context) ([]Minecraft, error)
 	_, err := datastore.NewQuery("Minecraft").Filter("Status = ", "exists").GetAll(ctx, &minecrafts)
 	if err != nil {
 		log.Errorf(ctx, "Minecraft Query error. %s\n", err.Error())
+		return nil, err
 	}
 	return minecrafts, nil
 }
+
+// worldNameMaxLength is Snapshot Name (minecraft-world-<world>-<yyyyMMdd>-<HHmmss>) が
+// GCEのResource Nameの上限63文字に収まるWorld Nameの長さ
+const worldNameMaxLength = 63 - len("minecraft-world-") - len("-20060102-150405")
+
+// worldNamePattern is Instance, Disk, SnapshotのNameに使えるWorld Name
+var worldNamePattern = regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])?$`)
+
+// validateWorldName is World NameがGCEのResource Nameに使えるかを確認する
+func validateWorldName(world string) error {
+	if len(world) < 1 {
+		return invalidRequestError("world is required.")
+	}
+	if len(world) > worldNameMaxLength || worldNamePattern.MatchString(world) == false {
+		return invalidRequestError(fmt.Sprintf("world is lowercase letters, numbers and - (max %d), starts with a letter.", worldNameMaxLength)).WithDetail("world", world)
+	}
+	return nil
+}
+
+// Clone is srcのSnapshotからWorldを作る時のMinecraftを返す
+// Serverの設定はsrcからコピーし、状態はInstanceが無い状態にする
+// server.properties, Plugin, Render設定は別のEntityなので、cloneWorldSettingsでコピーする
+func (m *Minecraft) Clone(world string, snapshot string, zone string) Minecraft {
+	c := Minecraft{
+		World:          world,
+		Zone:           m.Zone,
+		Status:         "not_exists",
+		LatestSnapshot: snapshot,
+		JarVersion:     m.JarVersion,
+		ServerType:     m.ServerType,
+		ServerBuild:    m.ServerBuild,
+		PlayWindows:    m.PlayWindows,
+	}
+	if len(zone) > 0 {
+		c.Zone = zone
+	}
+	return c
+}
@@ -1,9 +1,10 @@
 package sinmetalcraft
 
 import (
-	"fmt"
 	"net/http"
+	"path"
 	"strings"
+	"time"
 
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
@@ -15,7 +16,6 @@ import (
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
-	"time"
 )
 
 func init() {
@@ -44,12 +44,30 @@ func (a *MinecraftCronApi) Handler(w http.ResponseWriter, r *http.Request) {
 	}
 	is := compute.NewInstancesService(s)
 
-	instances, _, err := listInstance(ctx, is, "asia-northeast1-b")
+	// Capacityが足りずに別のZoneに移したWorldもあるので、起動中のWorldのZoneも見る
+	zones := map[string]bool{"asia-northeast1-b": true}
+	var mc Minecraft
+	servers, err := mc.QueryExistsServers(ctx)
 	if err != nil {
-		log.Errorf(ctx, "ERROR list instance error %s", err.Error())
+		log.Errorf(ctx, "ERROR query exists servers: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	for _, m := range servers {
+		if len(m.Zone) > 0 {
+			zones[m.Zone] = true
+		}
+	}
+	var instances []*compute.Instance
+	for zone := range zones {
+		l, _, err := listInstance(ctx, is, zone)
+		if err != nil {
+			log.Errorf(ctx, "ERROR list instance error %s", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		instances = append(instances, l...)
+	}
 
 	ds := compute.NewDisksService(s)
 
@@ -65,7 +83,11 @@ func (a *MinecraftCronApi) Handler(w http.ResponseWriter, r *http.Request) {
 			if ins.Status == "TERMINATED" {
 				taskCount++
 				go func() {
-					err = api.createSnapshot(ctx, ds, ins.Name[len("minecraft-"):len(ins.Name)])
+					world := ins.Name[len("minecraft-"):len(ins.Name)]
+					err := api.createSnapshot(ctx, ds, world)
+					ev := newAuditEvent(ctx, r, AuditActionSnapshotCreate)
+					ev.Target = world
+					ev.Record(ctx, err)
 					receiver <- err
 				}()
 			}
@@ -75,7 +97,10 @@ func (a *MinecraftCronApi) Handler(w http.ResponseWriter, r *http.Request) {
 				oapi := OverviewerAPI{}
 				taskCount++
 				go func() {
-					err = oapi.deleteInstance(ctx, is, ins.Name)
+					err := oapi.deleteInstance(ctx, is, path.Base(ins.Zone), ins.Name)
+					ev := newAuditEvent(ctx, r, AuditActionOverviewerDelete)
+					ev.Target = ins.Name
+					ev.Record(ctx, err)
 					receiver <- err
 				}()
 			}
@@ -127,9 +152,6 @@ func (a *MinecraftCronApi) deleteInstance(ctx context.Context, is *compute.Insta
 
 // create snapshot
 func (a *MinecraftCronApi) createSnapshot(ctx context.Context, ds *compute.DisksService, world string) error {
-	sn := fmt.Sprintf("minecraft-world-%s-%s", world, time.Now().Format("20060102-150405"))
-	log.Infof(ctx, "create snapshot %s", sn)
-
 	var minecraft Minecraft
 	key := datastore.NewKey(ctx, "Minecraft", world, 0, nil)
 
@@ -141,22 +163,26 @@ func (a *MinecraftCronApi) createSnapshot(ctx context.Context, ds *compute.Disks
 	if err != nil {
 		return nil
 	}
-	minecraft.Key = key
-
-	s := &compute.Snapshot{
-		Name: sn,
+	if minecraft.Status == "stopping" {
+		// ServerApiのstopでSnapshotを作成するので、ここでは何もしない
+		log.Infof(ctx, "%s is stopping. skip snapshot.", world)
+		return nil
 	}
-
-	disk := fmt.Sprintf("minecraft-world-%s", world)
-	ope, err := ds.CreateSnapshot(PROJECT_NAME, minecraft.Zone, disk, s).Do()
-	if err != nil {
-		log.Errorf(ctx, "ERROR insert snapshot: %s", err)
-		return err
+	if inPlayWindow(minecraft.PlayWindows, time.Now()) {
+		// PreemptされたServerはPreemptionTQが起動し直すので、Instanceを残す
+		// PlayWindowの中でもStopしたServerや、再起動を諦めたServerはSnapshotを作る
+		p, err := latestPreemption(ctx, world)
+		if err != nil {
+			return err
+		}
+		if preemptionRestartPending(p) {
+			log.Infof(ctx, "%s is restarting from preemption. skip snapshot.", world)
+			return nil
+		}
 	}
-	WriteLog(ctx, "INSTNCE_SNAPSHOT_OPE", ope)
-
-	tq := ServerTQApi{}
-	_, err = tq.CallDeleteInstance(ctx, minecraft.Key, ope.Name, sn)
+	minecraft.Key = key
+	minecraft.World = world
 
+	_, err = createWorldSnapshot(ctx, ds, minecraft)
 	return err
 }
@@ -1,8 +1,10 @@
 package sinmetalcraft
 
 import (
+	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"google.golang.org/appengine"
@@ -27,7 +29,9 @@ func init() {
 
 type MinecraftTQApi struct{}
 
-func CallMinecraftTQ(c context.Context, minecraftKey *datastore.Key, operationID string) (*taskqueue.Task, error) {
+// CallMinecraftTQ is Operationが終わるのを待ってWorldの状態を更新するTQを登録する
+// triedZonesはCapacityが足りずにInstanceを作れなかったZone
+func CallMinecraftTQ(c context.Context, minecraftKey *datastore.Key, operationID string, triedZones ...string) (*taskqueue.Task, error) {
 	log.Infof(c, "Call Minecraft TQ, key = %v, operationID = %s", minecraftKey, operationID)
 	if minecraftKey == nil {
 		return nil, errors.New("key is required")
@@ -39,6 +43,7 @@ func CallMinecraftTQ(c context.Context, minecraftKey *datastore.Key, operationID
 	t := taskqueue.NewPOSTTask("/tq/1/minecraft", url.Values{
 		"keyStr":      {minecraftKey.Encode()},
 		"operationID": {operationID},
+		"triedZones":  {strings.Join(triedZones, ",")},
 	})
 	t.Delay = time.Second * 30
 	return taskqueue.Add(c, t, "minecraft")
@@ -50,8 +55,12 @@ func (a *MinecraftTQApi) Handler(w http.ResponseWriter, r *http.Request) {
 
 	keyStr := r.FormValue("keyStr")
 	operationID := r.FormValue("operationID")
+	var triedZones []string
+	if v := r.FormValue("triedZones"); len(v) > 0 {
+		triedZones = strings.Split(v, ",")
+	}
 
-	log.Infof(ctx, "keyStr = %s, operationID = %s", keyStr, operationID)
+	log.Infof(ctx, "keyStr = %s, operationID = %s, triedZones = %v", keyStr, operationID, triedZones)
 
 	key, err := datastore.DecodeKey(keyStr)
 	if err != nil {
@@ -72,31 +81,73 @@ func (a *MinecraftTQApi) Handler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	// Capacityが足りずに別のZoneに移したWorldもあるので、WorldのZoneでOperationを見る
+	zone := "asia-northeast1-b"
+	var current Minecraft
+	if err := datastore.Get(ctx, key, &current); err == nil && len(current.Zone) > 0 {
+		zone = current.Zone
+	}
 	nzos := compute.NewZoneOperationsService(s)
-	ope, err := nzos.Get(PROJECT_NAME, "asia-northeast1-b", operationID).Do()
+	ope, err := nzos.Get(PROJECT_NAME, zone, operationID).Do()
 	if err != nil {
-		log.Errorf(ctx, "ERROR compute Zone Operation Get Error. zone = %s, operation = %s, error = %s", "asia-northeast1-b", operationID, err.Error())
+		log.Errorf(ctx, "ERROR compute Zone Operation Get Error. zone = %s, operation = %s, error = %s", zone, operationID, err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	WriteLog(ctx, "__GET_ZONE_COMPUTE_OPE__", ope)
 
+	if ope.Status == "DONE" && ope.OperationType == "insert" && isCapacityOperationError(ope) {
+		current.Key = key
+		current.World = key.StringID()
+		current.Zone = zone
+		err = a.retryCapacity(ctx, r, s, current, triedZones)
+		if err != nil {
+			log.Errorf(ctx, "ERROR retry instance create: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
 	status := "exists"
 	if ope.OperationType == "delete" {
 		status = "not_exists"
 	}
 
 	resStatus := http.StatusOK
+	ipAddr := current.IPAddr
+	if ope.Status == "DONE" {
+		current.World = key.StringID()
+		current.Zone = zone
+		ipAddr, err = a.updateDNS(ctx, s, current, ope)
+		if err == errOperationWaiting {
+			w.WriteHeader(http.StatusRequestTimeout)
+			return
+		}
+		if err != nil {
+			// Statusを更新する前なので、TQのRetryでやり直す
+			log.Errorf(ctx, "ERROR update dns: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
 	if ope.Status == "DONE" {
+		ev := newAuditEvent(ctx, r, AuditActionOperationDone)
+		ev.Target = key.StringID()
+		var before, after Minecraft
 		err = datastore.RunInTransaction(ctx, func(c context.Context) error {
 			var entity Minecraft
 			err := datastore.Get(ctx, key, &entity)
 			if err != nil {
 				return err
 			}
+			before = entity
 
 			entity.ResourceID = int64(ope.TargetId)
 			entity.Status = status
+			entity.IPAddr = ipAddr
+			entity.JoinableAt = time.Time{}
 			entity.OperationStatus = ope.Status
 			entity.OperationType = ope.OperationType
 			entity.UpdatedAt = time.Now()
@@ -105,9 +156,16 @@ func (a *MinecraftTQApi) Handler(w http.ResponseWriter, r *http.Request) {
 			if err != nil {
 				return err
 			}
+			after = entity
 
 			return nil
 		}, nil)
+		ev.SetDiff(before, after)
+		ev.Record(ctx, err)
+		if err == nil && isServerStartOperation(ope) {
+			srAPI := ServerReadyTQApi{}
+			_, err = srAPI.CallServerReady(ctx, key, after.ResourceID, time.Now())
+		}
 	} else {
 		log.Infof(ctx, "Operation Status = %s", ope.Status)
 		resStatus = http.StatusRequestTimeout
@@ -140,3 +198,76 @@ func (a *MinecraftTQApi) Handler(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(resStatus)
 }
+
+// retryCapacity is Capacityが足りずにInsertのOperationが失敗したInstanceを作り直す
+// preemptible VMだった場合はstandard VMで、standard VMでも足りない場合は同じRegionの別のZoneで作る
+func (a *MinecraftTQApi) retryCapacity(ctx context.Context, r *http.Request, s *compute.Service, minecraft Minecraft, triedZones []string) error {
+	log.Warningf(ctx, "no capacity in %s. provisioning = %s", minecraft.Zone, minecraft.Provisioning)
+	ev := newAuditEvent(ctx, r, AuditActionInstanceCreate)
+	ev.Target = minecraft.World
+
+	var err error
+	if minecraft.Provisioning != ProvisioningStandard {
+		p := instanceProvisioning{Reason: fmt.Sprintf("preemptible capacity is unavailable in %s.", minecraft.Zone)}
+		_, err = createInstanceWith(ctx, compute.NewInstancesService(s), minecraft, p, triedZones)
+		if !isCapacityError(err) {
+			ev.Record(ctx, err)
+			return err
+		}
+	}
+	zone, err := moveToAlternateZone(ctx, s, minecraft, triedZones)
+	if err == nil {
+		ev.SetDiff(map[string]string{"zone": minecraft.Zone}, map[string]string{"zone": zone})
+	}
+	ev.Record(ctx, err)
+	return err
+}
+
+// updateDNS is InstanceがRUNNINGになったらWorldのA RecordをNAT IPにし、Instanceを消したらRecordを消す
+// AppConfigにDNSの設定が無い場合はIPを返すだけ。RUNNINGになるまではerrOperationWaitingを返す
+func (a *MinecraftTQApi) updateDNS(ctx context.Context, s *compute.Service, minecraft Minecraft, ope *compute.Operation) (string, error) {
+	if ope.Error != nil && len(ope.Error.Errors) > 0 {
+		log.Warningf(ctx, "%s operation error. %s", ope.OperationType, ope.Error.Errors[0].Message)
+		return minecraft.IPAddr, nil
+	}
+	u, c, err := newWorldDNSUpdater(ctx)
+	if err != nil {
+		return minecraft.IPAddr, err
+	}
+
+	switch {
+	case isServerStartOperation(ope):
+		ins, err := compute.NewInstancesService(s).Get(PROJECT_NAME, minecraft.Zone, INSTANCE_NAME+"-"+minecraft.World).Do()
+		if err != nil {
+			return minecraft.IPAddr, err
+		}
+		if ins.Status != "RUNNING" {
+			log.Infof(ctx, "instance status = %s", ins.Status)
+			return minecraft.IPAddr, errOperationWaiting
+		}
+		if u == nil {
+			return instanceNatIP(ins), nil
+		}
+		log.Infof(ctx, "upsert dns record %s A %s", c.RecordName(minecraft.World), instanceNatIP(ins))
+		return updateWorldDNS(ctx, u, c, minecraft.World, ins)
+	case ope.OperationType == "delete":
+		if u == nil {
+			return "", nil
+		}
+		log.Infof(ctx, "delete dns record %s", c.RecordName(minecraft.World))
+		return updateWorldDNS(ctx, u, c, minecraft.World, nil)
+	}
+	return minecraft.IPAddr, nil
+}
+
+// isServerStartOperation is Minecraft Serverが起動するOperationが成功したか
+func isServerStartOperation(ope *compute.Operation) bool {
+	if ope.Error != nil && len(ope.Error.Errors) > 0 {
+		return false
+	}
+	switch ope.OperationType {
+	case "insert", "start", "reset":
+		return true
+	}
+	return false
+}
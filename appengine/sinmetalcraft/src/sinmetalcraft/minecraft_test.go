@@ -0,0 +1,54 @@
+package sinmetalcraft
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateWorldName(t *testing.T) {
+	for _, world := range []string{"hoge", "hoge-fuga", "survival2", strings.Repeat("a", worldNameMaxLength)} {
+		if err := validateWorldName(world); err != nil {
+			t.Errorf("%s should be valid. err = %v", world, err)
+		}
+	}
+	for _, world := range []string{"", "Hoge", "2hoge", "hoge-", "hoge_fuga", "hoge/fuga", strings.Repeat("a", worldNameMaxLength+1)} {
+		if err := validateWorldName(world); err == nil {
+			t.Errorf("%s should be invalid", world)
+		}
+	}
+}
+
+func TestMinecraftClone(t *testing.T) {
+	src := Minecraft{
+		World:              "survival",
+		ResourceID:         100,
+		Zone:               "asia-northeast1-b",
+		IPAddr:             "203.0.113.1",
+		Status:             "exists",
+		OperationType:      "start",
+		OperationStatus:    "DONE",
+		LatestSnapshot:     "minecraft-world-survival-20170102-030405",
+		JarVersion:         "1.12.2",
+		OverviewerSnapshot: "minecraft-world-survival-20170101-030405",
+		PlayWindows:        []string{"sat,sun 10:00-23:00"},
+	}
+
+	c := src.Clone("creative", "minecraft-world-survival-20170101-030405", "")
+	want := Minecraft{
+		World:          "creative",
+		Zone:           "asia-northeast1-b",
+		Status:         "not_exists",
+		LatestSnapshot: "minecraft-world-survival-20170101-030405",
+		JarVersion:     "1.12.2",
+		PlayWindows:    []string{"sat,sun 10:00-23:00"},
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("Clone = %+v, want %+v", c, want)
+	}
+
+	c = src.Clone("creative", src.LatestSnapshot, "us-central1-b")
+	if c.Zone != "us-central1-b" {
+		t.Errorf("Clone Zone = %s, want us-central1-b", c.Zone)
+	}
+}
@@ -0,0 +1,393 @@
+package sinmetalcraft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/user"
+)
+
+const openAPISpecPath = "../../openapi.json"
+
+type openAPISpec struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas   map[string]*jsonSchema      `json:"schemas"`
+		Responses map[string]*openAPIResponse `json:"responses"`
+	} `json:"components"`
+}
+
+type openAPIOperation struct {
+	RequestBody *struct {
+		Content map[string]openAPIMediaType `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]*openAPIResponse `json:"responses"`
+}
+
+type openAPIResponse struct {
+	Ref     string                      `json:"$ref"`
+	Content map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIMediaType struct {
+	Schema *jsonSchema `json:"schema"`
+}
+
+// jsonSchema is openapi.jsonで使っているJSON Schemaのsubset
+type jsonSchema struct {
+	Ref                  string                 `json:"$ref"`
+	Type                 string                 `json:"type"`
+	Nullable             bool                   `json:"nullable"`
+	Enum                 []interface{}          `json:"enum"`
+	Required             []string               `json:"required"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+}
+
+func loadOpenAPISpec(t *testing.T) *openAPISpec {
+	b, err := ioutil.ReadFile(openAPISpecPath)
+	if err != nil {
+		t.Fatalf("openapi.json read error: %v", err)
+	}
+	var spec openAPISpec
+	if err := json.Unmarshal(b, &spec); err != nil {
+		t.Fatalf("openapi.json decode error: %v", err)
+	}
+	return &spec
+}
+
+func (spec *openAPISpec) resolve(s *jsonSchema) *jsonSchema {
+	for s != nil && len(s.Ref) > 0 {
+		s = spec.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	return s
+}
+
+// validate is valueがschemaに合っているかを確認し、合っていない箇所を返す
+func (spec *openAPISpec) validate(s *jsonSchema, value interface{}, path string) []string {
+	s = spec.resolve(s)
+	if s == nil {
+		return []string{fmt.Sprintf("%s: schema is not found", path)}
+	}
+	if value == nil {
+		if s.Nullable || len(s.Type) < 1 {
+			return nil
+		}
+		return []string{fmt.Sprintf("%s: null is not allowed", path)}
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if e == value {
+				found = true
+			}
+		}
+		if !found {
+			return []string{fmt.Sprintf("%s: %v is not in %v", path, value, s.Enum)}
+		}
+	}
+
+	var errs []string
+	switch s.Type {
+	case "object":
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: %T is not object", path, value)}
+		}
+		for _, r := range s.Required {
+			if _, ok := m[r]; !ok {
+				errs = append(errs, fmt.Sprintf("%s.%s: required", path, r))
+			}
+		}
+		var keys []string
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			ps, ok := s.Properties[k]
+			if !ok {
+				if s.AdditionalProperties != nil && *s.AdditionalProperties == false {
+					errs = append(errs, fmt.Sprintf("%s.%s: not defined in spec", path, k))
+				}
+				continue
+			}
+			errs = append(errs, spec.validate(ps, m[k], path+"."+k)...)
+		}
+	case "array":
+		l, ok := value.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: %T is not array", path, value)}
+		}
+		for i, v := range l {
+			errs = append(errs, spec.validate(s.Items, v, path+"["+strconv.Itoa(i)+"]")...)
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			errs = append(errs, fmt.Sprintf("%s: %T is not string", path, value))
+		}
+	case "integer":
+		f, ok := value.(float64)
+		if !ok || f != float64(int64(f)) {
+			errs = append(errs, fmt.Sprintf("%s: %v is not integer", path, value))
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			errs = append(errs, fmt.Sprintf("%s: %T is not number", path, value))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			errs = append(errs, fmt.Sprintf("%s: %T is not boolean", path, value))
+		}
+	}
+	return errs
+}
+
+func (spec *openAPISpec) validateJSON(t *testing.T, s *jsonSchema, b []byte, name string) {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Errorf("%s: json decode error: %v, body = %s", name, err, b)
+		return
+	}
+	for _, e := range spec.validate(s, v, name) {
+		t.Error(e)
+	}
+}
+
+// pathTemplate is Request Pathに対応するspecのPath ("/api/1/minecraft/{world}" など) を返す
+func (spec *openAPISpec) pathTemplate(path string) string {
+	if _, ok := spec.Paths[path]; ok {
+		return path
+	}
+	segments := splitPath(path)
+	for tmpl := range spec.Paths {
+		rt := route{segments: splitPath(tmpl)}
+		if _, ok := rt.match(segments); ok {
+			return tmpl
+		}
+	}
+	return path
+}
+
+func (spec *openAPISpec) operation(t *testing.T, path string, method string) *openAPIOperation {
+	b, ok := spec.Paths[spec.pathTemplate(path)][strings.ToLower(method)]
+	if !ok {
+		t.Fatalf("%s %s is not defined in spec", method, path)
+	}
+	var op openAPIOperation
+	if err := json.Unmarshal(b, &op); err != nil {
+		t.Fatalf("%s %s spec decode error: %v", method, path, err)
+	}
+	return &op
+}
+
+// checkRequest is request bodyがspecに合っているかを確認する
+func (spec *openAPISpec) checkRequest(t *testing.T, path string, method string, body string) {
+	op := spec.operation(t, path, method)
+	if op.RequestBody == nil {
+		t.Fatalf("%s %s has no requestBody in spec", method, path)
+	}
+	spec.validateJSON(t, op.RequestBody.Content["application/json"].Schema, []byte(body), method+" "+path+" request")
+}
+
+// checkResponse is Status CodeとResponse Bodyがspecに合っているかを確認する
+func (spec *openAPISpec) checkResponse(t *testing.T, path string, method string, rec *httptest.ResponseRecorder) {
+	op := spec.operation(t, path, method)
+	name := fmt.Sprintf("%s %s %d", method, path, rec.Code)
+	res, ok := op.Responses[strconv.Itoa(rec.Code)]
+	if !ok {
+		t.Errorf("%s: status is not defined in spec, body = %s", name, rec.Body.String())
+		return
+	}
+	if len(res.Ref) > 0 {
+		res = spec.Components.Responses[strings.TrimPrefix(res.Ref, "#/components/responses/")]
+	}
+	mt, ok := res.Content["application/json"]
+	if !ok || mt.Schema == nil {
+		return
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("%s: Content-Type = %q", name, ct)
+	}
+	spec.validateJSON(t, mt.Schema, rec.Body.Bytes(), name)
+}
+
+func TestOpenAPIStructs(t *testing.T) {
+	spec := loadOpenAPISpec(t)
+
+	now := time.Now()
+	cases := []struct {
+		schema string
+		value  interface{}
+	}{
+		{"Minecraft", Minecraft{KeyStr: "key", World: "hoge", Zone: "asia-northeast1-b", ServerType: ServerTypePaper, ServerBuild: "1620", PlayWindows: []string{"sat,sun 10:00-23:00"}, Provisioning: ProvisioningStandard, StandardFallbackAt: now, JoinableAt: now, Status: "exists", OperationStatus: "DONE", LatestSnapshot: "minecraft-world-hoge-20170101-000000", CreatedAt: now, UpdatedAt: now}},
+		{"MinecraftList", MinecraftListResponse{Items: []*Minecraft{{KeyStr: "key", World: "hoge", ServerType: ServerTypeVanilla, CreatedAt: now, UpdatedAt: now}}, Cursor: "cursor", HasNext: true}},
+		{"MinecraftCloneRequest", MinecraftApiCloneParam{World: "hoge-creative", Snapshot: "minecraft-world-hoge-20170101-000000"}},
+		{"WorldExportList", WorldExportListResponse{Items: []*WorldExport{{ID: 1, World: "hoge", Snapshot: "minecraft-world-hoge-20170101-000000", Status: WorldExportStatusDone, DownloadURL: "https://storage.googleapis.com/bucket/exports/hoge.tar.gz", DownloadExpiresAt: &now, CreatedAt: now, UpdatedAt: now}}}},
+		{"WorldExportPostRequest", WorldExportApiPostParam{Snapshot: "minecraft-world-hoge-20170101-000000"}},
+		{"WorldUpgrade", WorldUpgrade{World: "hoge", Zone: "asia-northeast1-b", FromVersion: "1.12.1", ToVersion: "1.12.2", PreSnapshot: "minecraft-world-hoge-20170101-000000", InstanceExists: true, Status: WorldUpgradeStatusRolledBack, Error: "server crashed", StartedAt: now, CreatedAt: now, UpdatedAt: now}},
+		{"WorldUpgradePostRequest", WorldUpgradeApiPostParam{JarVersion: "1.12.2"}},
+		{"ServerProperties", ServerPropertiesApiResponse{ServerProperties: ServerProperties{World: "hoge", Properties: map[string]string{"difficulty": "hard"}, CreatedAt: now, UpdatedAt: now}, Diff: auditDiff(nil, map[string]string{"difficulty": "hard"}), RestartRequired: true}},
+		{"ServerPropertiesPutRequest", ServerPropertiesApiPutParam{Properties: map[string]string{"difficulty": "hard", "pvp": "false"}}},
+		{"OverviewerConfig", newOverviewerConfigApiResponse(OverviewerConfig{World: "hoge", Dimensions: []string{"overworld", "nether"}, Rendermodes: []string{"normal", "day"}, TextureVersion: "1.12.2", OutputPrefix: "maps/hoge", CreatedAt: now, UpdatedAt: now}, auditDiff(nil, map[string][]string{"dimensions": {"overworld", "nether"}}), Minecraft{World: "hoge", JarVersion: "1.12.1"})},
+		{"OverviewerConfigPutRequest", OverviewerConfigApiPutParam{Dimensions: []string{"overworld"}, Rendermodes: []string{"night", "cave"}}},
+		{"OverviewerJobList", OverviewerJobListResponse{Items: []*OverviewerJob{{ID: 2, World: "hoge", Zone: "asia-northeast1-b", Snapshot: "minecraft-world-hoge-20170101-000000", JarVersion: "1.12.2", OutputPrefix: "hoge", Config: "worlds = {}", Trigger: OverviewerJobTriggerAPI, Attempt: 2, RetryOf: 1, Status: OverviewerJobStatusRendering, OperationID: "operation-1", DiskCreatedAt: now, InstanceCreatedAt: now, CreatedAt: now, UpdatedAt: now}}}},
+		{"OverviewerJobPostRequest", OverviewerApiPostParam{Snapshot: "minecraft-world-hoge-20170101-000000"}},
+		{"WorldPluginList", WorldPluginListResponse{Items: []*WorldPlugin{{World: "hoge", Name: "WorldEdit", Version: "6.1.9", MinecraftVersion: "1.12", Source: WorldPluginSourceURL, URL: "https://example.com/worldedit.jar", SHA256: strings.Repeat("a", 64), Enabled: true, Warnings: []string{"vanilla server does not load plugins or mods."}, CreatedAt: now, UpdatedAt: now}}}},
+		{"WorldPluginResponse", WorldPluginApiResponse{Plugin: WorldPlugin{World: "hoge", Name: "jei", Version: "4.16.1", Source: WorldPluginSourceUpload, URL: "gs://sinmetalcraft-minecraft-plugin/hoge/jei-4.16.1.jar", SHA256: strings.Repeat("a", 64), Warnings: []string{}, CreatedAt: now, UpdatedAt: now}, UploadURL: "https://storage.googleapis.com/sinmetalcraft-minecraft-plugin/hoge/jei-4.16.1.jar", ContentType: "application/java-archive", ExpiresAt: &now}},
+		{"WorldImportPostRequest", WorldImportApiPostParam{Zone: "asia-northeast1-b", JarVersion: "1.12.2", Format: WorldImportFormatZip}},
+		{"WorldImportPostResponse", WorldImportApiPostResponse{Import: WorldImport{World: "hoge", Format: WorldImportFormatZip, Object: "hoge/1500000000.zip", Status: WorldImportStatusWaitingUpload, CreatedAt: now, UpdatedAt: now}, UploadURL: "https://storage.googleapis.com/bucket/hoge/1500000000.zip", ContentType: "application/zip", ExpiresAt: now}},
+		{"PreemptionList", PreemptionListResponse{Items: []*Preemption{{OperationID: "systemevent-1509760800000-abc", World: "hoge", Instance: "minecraft-hoge", InstanceID: "1234567890", Zone: "asia-northeast1-b", PreemptedAt: now, InPlayWindow: true, Status: PreemptionStatusRestarted, CreatedAt: now, UpdatedAt: now}}}},
+		{"ReconcileReport", ReconcileReport{Worlds: 2, Instances: 1, Disks: 1, Snapshots: 3, Findings: []ReconcileFinding{{Kind: ReconcileKindStatus, World: "hoge", Resource: "minecraft-hoge", Zone: "asia-northeast1-b", Message: "status is exists but instance does not exist.", Fix: "set status to not_exists.", Fixed: true}, {Kind: ReconcileKindOrphanInstance, World: "fuga", Resource: "minecraft-fuga", Zone: "asia-northeast1-b", Message: "instance is RUNNING but world does not exist."}}, Fixed: 1, Unresolved: 1, CreatedAt: now}},
+		{"GCReport", GCReport{GracePeriodHours: 72, Candidates: []*GCCandidate{{Kind: GCKindDisk, Name: "minecraft-world-hoge", Zone: "asia-northeast1-b", World: "hoge", Reason: "world does not exist.", EstimatedMonthlyCost: 2.21, Action: GCActionDelete, FirstSeenAt: now, DeleteAfter: now, Deleted: true, UpdatedAt: now}, {Kind: GCKindSnapshot, Name: "minecraft-world-hoge-20171101-000000", World: "hoge", Reason: "world does not exist.", EstimatedMonthlyCost: 0.1, Action: GCActionPending, FirstSeenAt: now, DeleteAfter: now, UpdatedAt: now}}, Deleted: 1, Pending: 1, EstimatedMonthlyCost: 0.1, CreatedAt: now}},
+		{"ReindexReport", ReindexReport{Worlds: 3, Reindexed: 2, Failed: []string{"hoge"}, CreatedAt: now}},
+		{"InstanceList", MinecraftApiListResponse{Items: []MinecraftApiResponse{{InstanceName: "minecraft-hoge", IPAddr: "203.0.113.1"}}}},
+		{"SnapshotList", SnapshotApiListResponse{Items: []SnapshotApiResponse{{Name: "minecraft-world-hoge-20170101-000000", World: "hoge"}}}},
+		{"SnapshotPostResponse", SnapshotApiPostResponse{Name: "minecraft-world-hoge-20170101-000000", World: "hoge", Flush: true, Message: "accepted"}},
+		{"ServerPutRequest", ServerApiPutParam{KeyStr: "key", Operation: "start"}},
+		{"AuditEventList", AuditListResponse{Items: []*AuditEvent{{KeyStr: "key", Actor: "cron", Action: AuditActionWorldUpdate, Target: "hoge", Diff: auditDiff(nil, Minecraft{World: "hoge"}), Outcome: AuditOutcomeSuccess, CreatedAt: now}}}},
+		{"AppConfig", AppConfig{SlackPostUrl: "https://hooks.slack.com/services/xxx", VersionManifestURL: "http://localhost:8080/static/version_manifest.json", PreemptionFallbackCount: 3, PreemptionFallbackWindowHours: 12, DNSProject: "stone-swallow", DNSManagedZone: "sinmetal-org", DNSDomain: "sinmetal.org", DNSTTL: 300, GCGracePeriodHours: 48, GCAllowlist: []string{"minecraft-world-archive-*"}, CreatedAt: now, UpdatedAt: now}},
+		{"MinecraftVersionList", MinecraftVersionListResponse{Items: []*MinecraftVersion{{ID: "1.12.2", Type: MinecraftVersionTypeRelease, ReleaseTime: now, ServerURL: "https://launcher.mojang.com/mc/game/1.12.2/server/server.jar", ServerSHA1: "886945bfb2b978778c3a0288fd7fab09d315b25f", ServerSize: 30222121, Status: MinecraftVersionStatusMirrored, CreatedAt: now, UpdatedAt: now}}}},
+		{"APIAIResponse", APIAIResponse{Data: map[string]interface{}{"slack": map[string]string{"text": "hoge"}}, Source: "DuckDuckGo"}},
+	}
+	for _, c := range cases {
+		b, err := json.Marshal(c.value)
+		if err != nil {
+			t.Fatalf("%s json marshal error: %v", c.schema, err)
+		}
+		spec.validateJSON(t, &jsonSchema{Ref: "#/components/schemas/" + c.schema}, b, c.schema)
+	}
+}
+
+func TestOpenAPIHandlers(t *testing.T) {
+	inst, err := aetest.NewInstance(&aetest.Options{StronglyConsistentDatastore: true})
+	if err != nil {
+		t.Skipf("aetest instance is not available: %v", err)
+	}
+	defer inst.Close()
+
+	spec := loadOpenAPISpec(t)
+	admin := &user.User{Email: "admin@example.com", Admin: true}
+
+	serve := func(h http.Handler, method string, path string, query string, body string, u *user.User) *httptest.ResponseRecorder {
+		if len(body) > 0 {
+			spec.checkRequest(t, path, method, body)
+		}
+		u2 := path
+		if len(query) > 0 {
+			u2 += "?" + query
+		}
+		r, err := inst.NewRequest(method, u2, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatalf("NewRequest error: %v", err)
+		}
+		if u != nil {
+			aetest.Login(u, r)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		spec.checkResponse(t, path, method, rec)
+		return rec
+	}
+
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatalf("NewRequest error: %v", err)
+	}
+	ctx := appengine.NewContext(r)
+	_, err = datastore.Put(ctx, datastore.NewKey(ctx, "MinecraftVersion", "1.12.2", 0, nil), &MinecraftVersion{Type: MinecraftVersionTypeRelease, Status: MinecraftVersionStatusMirrored, ReleaseTime: time.Now()})
+	if err != nil {
+		t.Fatalf("MinecraftVersion put error: %v", err)
+	}
+	serve(apiRouter, "GET", "/api/1/versions", "", "", nil)
+	serve(apiRouter, "GET", "/api/1/versions", "type=release&status=mirrored&limit=10", "", nil)
+	serve(apiRouter, "POST", "/api/1/minecraft", "", `{"world":"spec","zone":"asia-northeast1-b","jarVersion":"0.0.0"}`, admin)
+
+	rec := serve(apiRouter, "POST", "/api/1/minecraft", "", `{"world":"spec","zone":"asia-northeast1-b","jarVersion":"1.12.2"}`, nil)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("POST /api/1/minecraft without login status = %d", rec.Code)
+	}
+	rec = serve(apiRouter, "POST", "/api/1/minecraft", "", `{"world":"spec","zone":"asia-northeast1-b","jarVersion":"1.12.2"}`, admin)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /api/1/minecraft status = %d", rec.Code)
+	}
+	var created Minecraft
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatalf("created world decode error: %v", err)
+	}
+
+	serve(apiRouter, "GET", "/api/1/minecraft", "", "", nil)
+	serve(apiRouter, "GET", "/api/1/minecraft", "limit=1&status=not_exists&zone=asia-northeast1-b&jarVersion=1.12.2", "", nil)
+	serve(apiRouter, "GET", "/api/1/minecraft", "limit=0", "", nil)
+	serve(apiRouter, "GET", "/api/1/minecraft/spec", "", "", nil)
+	serve(apiRouter, "GET", "/api/1/minecraft/notfound", "", "", nil)
+	serve(apiRouter, "PUT", "/api/1/minecraft", "", fmt.Sprintf(`{"key":"%s","world":"spec","zone":"asia-northeast1-b","jarVersion":"1.12.2","ipAddr":"203.0.113.1"}`, created.KeyStr), admin)
+	serve(apiRouter, "PUT", "/api/1/minecraft/spec", "", `{"world":"spec","zone":"asia-northeast1-b","jarVersion":"1.12.2"}`, admin)
+	serve(apiRouter, "PUT", "/api/1/minecraft/spec", "", `{"world":"spec","zone":"asia-northeast1-b","jarVersion":"1.12.2","playWindows":["sunday 10:00-23:00"]}`, admin)
+	serve(apiRouter, "PUT", "/api/1/minecraft/spec", "", `{"world":"spec","zone":"asia-northeast1-b","jarVersion":"1.12.2","playWindows":["sat,sun 10:00-23:00"]}`, admin)
+	serve(apiRouter, "GET", "/api/1/minecraft/spec/preemptions", "", "", admin)
+	serve(apiRouter, "POST", "/api/1/minecraft/spec/clone", "", `{"world":"Invalid World"}`, admin)
+	serve(apiRouter, "POST", "/api/1/minecraft/notfound/clone", "", `{"world":"spec-clone"}`, admin)
+	serve(apiRouter, "POST", "/api/1/minecraft/spec/import", "", `{"zone":"asia-northeast1-b","jarVersion":"1.12.2","format":"rar"}`, admin)
+	serve(apiRouter, "GET", "/api/1/minecraft/notfound/import", "", "", admin)
+	serve(apiRouter, "POST", "/api/1/minecraft/notfound/import/start", "", "", admin)
+	serve(apiRouter, "GET", "/api/1/minecraft/spec/exports", "", "", admin)
+	serve(apiRouter, "GET", "/api/1/minecraft/spec/exports/hoge", "", "", admin)
+	serve(apiRouter, "GET", "/api/1/minecraft/spec/exports/1", "", "", admin)
+	serve(apiRouter, "POST", "/api/1/minecraft/spec/exports", "", `{"snapshot":"minecraft-world-other-20170101-000000"}`, admin)
+	serve(apiRouter, "GET", "/api/1/minecraft/spec/upgrade", "", "", admin)
+	serve(apiRouter, "POST", "/api/1/minecraft/spec/upgrade", "", `{}`, admin)
+	serve(apiRouter, "POST", "/api/1/minecraft/spec/upgrade", "", `{"jarVersion":"1.12.2"}`, admin)
+	serve(apiRouter, "GET", "/api/1/minecraft/spec/properties", "", "", admin)
+	serve(apiRouter, "GET", "/api/1/minecraft/notfound/properties", "", "", admin)
+	serve(apiRouter, "PUT", "/api/1/minecraft/spec/properties", "", `{"properties":{"level-name":"hoge"}}`, admin)
+	rec = serve(apiRouter, "PUT", "/api/1/minecraft/spec/properties", "", `{"properties":{"difficulty":"hard","motd":"spec"}}`, admin)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT /api/1/minecraft/spec/properties status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	serve(apiRouter, "GET", "/api/1/minecraft/spec/properties", "", "", admin)
+	sha := strings.Repeat("a", 64)
+	serve(apiRouter, "POST", "/api/1/minecraft/spec/plugins", "", `{"name":"WorldEdit","version":"6.1.9","url":"http://example.com/worldedit.jar","sha256":"`+sha+`"}`, admin)
+	rec = serve(apiRouter, "POST", "/api/1/minecraft/spec/plugins", "", `{"name":"WorldEdit","version":"6.1.9","minecraftVersion":"1.13","url":"https://example.com/worldedit.jar","sha256":"`+sha+`"}`, admin)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /api/1/minecraft/spec/plugins status = %d, body = %s", rec.Code, rec.Body.String())
+	}
+	serve(apiRouter, "POST", "/api/1/minecraft/spec/plugins", "", `{"name":"WorldEdit","version":"6.1.9","url":"https://example.com/worldedit.jar","sha256":"`+sha+`"}`, admin)
+	serve(apiRouter, "PUT", "/api/1/minecraft/spec/plugins/WorldEdit", "", `{"enabled":false}`, admin)
+	serve(apiRouter, "PUT", "/api/1/minecraft/spec/plugins/notfound", "", `{"enabled":false}`, admin)
+	serve(apiRouter, "GET", "/api/1/minecraft/spec/plugins", "", "", admin)
+	serve(apiRouter, "DELETE", "/api/1/minecraft/spec/plugins/WorldEdit", "", "", admin)
+	serve(apiRouter, "DELETE", "/api/1/minecraft/spec/plugins/WorldEdit", "", "", admin)
+	serve(apiRouter, "DELETE", "/api/1/minecraft", "key=invalid", "", admin)
+	serve(apiRouter, "DELETE", "/api/1/minecraft/spec", "", "", admin)
+
+	serve(apiRouter, "GET", "/api/1/snapshot", "world=spec", "", nil)
+	serve(apiRouter, "GET", "/api/1/minecraft/spec/snapshots", "", "", nil)
+	serve(apiRouter, "POST", "/api/1/minecraft/spec/snapshots", "", `{"label":"Invalid Label"}`, admin)
+	serve(apiRouter, "GET", "/api/1/server", "", "", nil)
+	serve(apiRouter, "PUT", "/api/1/server", "", `{"key":"invalid","operation":"start"}`, nil)
+	serve(apiRouter, "GET", "/api/1/audit", "", "", admin)
+	serve(apiRouter, "GET", "/api/1/audit", "outcome=failure&limit=10", "", admin)
+	serve(apiRouter, "GET", "/api/1/audit", "outcome=hoge", "", admin)
+	serve(apiRouter, "POST", "/api/1/reconcile", "dryRun=hoge", "", admin)
+	serve(apiRouter, "POST", "/api/1/gc", "dryRun=hoge", "", admin)
+
+	configAPI := AppConfigApi{}
+	serve(http.HandlerFunc(configAPI.Handler), "POST", "/admin/api/1/config", "", `{"slackPostUrl":"https://hooks.slack.com/services/xxx","aPIAIIntentIDRunServer":"intent"}`, admin)
+
+	apiaiAPI := ApiAIApi{}
+	serve(http.HandlerFunc(apiaiAPI.handler), "POST", "/apiai", "", `{"id":"1","lang":"ja","result":{"metadata":{"intentId":"intent"}}}`, nil)
+}
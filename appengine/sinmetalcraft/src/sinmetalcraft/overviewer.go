@@ -1,37 +1,236 @@
 package sinmetalcraft
 
 import (
-	"errors"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
-	"net/url"
+	"strconv"
 	"time"
 
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/taskqueue"
-	"google.golang.org/appengine/urlfetch"
 
 	"google.golang.org/api/compute/v1"
 
 	"golang.org/x/net/context"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 )
 
+// OverviewerAPI is 毎日LatestSnapshotが変わったWorldのOverviewerを作り直す
+// APIからもCronを待たずにRenderできる
 type OverviewerAPI struct{}
 
 const OverviewerInstanceName = "overviewer"
 const OverViewerWorldDiskFormat = "%s-overviewer-world-%s"
 
+// OverviewerBucket is RenderしたMapを置くBucket。<OverviewerConfig.OutputPrefix>/index.html が入口になる
+const OverviewerBucket = "sinmetalcraft-overviewer"
+
+// overviewerMaxAttempts is 1つのSnapshotのRenderを試す回数
+const overviewerMaxAttempts = 3
+
+// overviewerRetryBackoff is 失敗したRenderを試し直すまでの時間
+// 1回目の失敗の後は15分、2回目の失敗の後は30分待つ
+func overviewerRetryBackoff(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	return 15 * time.Minute << uint(attempt-1)
+}
+
+// OverviewerJob Status
+const (
+	OverviewerJobStatusCreatingDisk     = "creating_disk"
+	OverviewerJobStatusCreatingInstance = "creating_instance"
+	OverviewerJobStatusRendering        = "rendering"
+	OverviewerJobStatusUploading        = "uploading"
+	OverviewerJobStatusDone             = "done"
+	OverviewerJobStatusFailed           = "failed"
+)
+
+// overviewerJobActiveStatuses is まだ終わっていないOverviewerJobのStatus
+var overviewerJobActiveStatuses = []string{
+	OverviewerJobStatusCreatingDisk,
+	OverviewerJobStatusCreatingInstance,
+	OverviewerJobStatusRendering,
+	OverviewerJobStatusUploading,
+}
+
+// OverviewerJob Trigger
+const (
+	OverviewerJobTriggerCron = "cron" // 毎日05:00のCron
+	OverviewerJobTriggerAPI  = "api"  // POST /api/1/minecraft/{world}/overviewer
+)
+
+// OverviewerJob is 1つのWorldのSnapshotからOverviewerを作る処理の状態
+type OverviewerJob struct {
+	Key               *datastore.Key `json:"-" datastore:"-"`
+	ID                int64          `json:"id" datastore:"-"`
+	World             string         `json:"world"`
+	Zone              string         `json:"zone" datastore:",noindex"`
+	Snapshot          string         `json:"snapshot" datastore:",noindex"`
+	JarVersion        string         `json:"jarVersion" datastore:",noindex"`   // TextureにするMinecraft Clientのversion
+	OutputPrefix      string         `json:"outputPrefix" datastore:",noindex"` // OverviewerBucketのUpload先
+	Config            string         `json:"-" datastore:",noindex"`            // Overviewerに渡す設定ファイル。Jobを作った時点のOverviewerConfigから作る
+	Trigger           string         `json:"trigger" datastore:",noindex"`      // Jobを作ったきっかけ。試し直したJobは元のJobと同じ
+	Attempt           int            `json:"attempt" datastore:",noindex"`      // 同じSnapshotを何回目にRenderしているか。1から数える
+	RetryOf           int64          `json:"retryOf" datastore:",noindex"`      // 失敗して試し直した元のJobのID
+	Status            string         `json:"status"`
+	OperationID       string         `json:"operationID" datastore:",noindex"`
+	Error             string         `json:"error" datastore:",noindex"`
+	DiskCreatedAt     time.Time      `json:"diskCreatedAt" datastore:",noindex"`
+	InstanceCreatedAt time.Time      `json:"instanceCreatedAt" datastore:",noindex"`
+	RenderedAt        time.Time      `json:"renderedAt" datastore:",noindex"`
+	FinishedAt        time.Time      `json:"finishedAt" datastore:",noindex"`
+	CreatedAt         time.Time      `json:"createdAt"`
+	UpdatedAt         time.Time      `json:"updatedAt" datastore:",noindex"`
+}
+
+// Finished is Jobが終わっているか
+func (job *OverviewerJob) Finished() bool {
+	return job.Status == OverviewerJobStatusDone || job.Status == OverviewerJobStatusFailed
+}
+
+// newOverviewerJob is WorldのLatestSnapshotをRenderするJobを作る
+// Render設定はJobに写しておくので、Render中にOverviewerConfigを変えても次のJobから反映される
+func newOverviewerJob(minecraft Minecraft, config OverviewerConfig, now time.Time) OverviewerJob {
+	textureVersion := config.textureVersion(minecraft)
+	return OverviewerJob{
+		World:        minecraft.World,
+		Zone:         minecraft.Zone,
+		Snapshot:     minecraft.LatestSnapshot,
+		JarVersion:   textureVersion,
+		OutputPrefix: config.outputPrefix(),
+		Config:       renderOverviewerConfig(minecraft.World, config, textureVersion),
+		Attempt:      1,
+		Status:       OverviewerJobStatusCreatingDisk,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+}
+
+// outputPrefix is OverviewerBucketのUpload先
+// OutputPrefixを持っていない古いJobはWorld Nameに置く
+func (job *OverviewerJob) outputPrefix() string {
+	if len(job.OutputPrefix) > 0 {
+		return job.OutputPrefix
+	}
+	return job.World
+}
+
+// config is Overviewerに渡す設定ファイル
+// Configを持っていない古いJobはdefaultOverviewerConfigでRenderする
+func (job *OverviewerJob) config() string {
+	if len(job.Config) > 0 {
+		return job.Config
+	}
+	return renderOverviewerConfig(job.World, defaultOverviewerConfig(job.World), job.JarVersion)
+}
+
+// newOverviewerRetryJob is 失敗したJobと同じSnapshotをもう一度RenderするJobを作る
+// 試す回数を使い切った場合はfalseを返す
+func newOverviewerRetryJob(failed OverviewerJob, now time.Time) (OverviewerJob, bool) {
+	if failed.Attempt >= overviewerMaxAttempts {
+		return OverviewerJob{}, false
+	}
+	return OverviewerJob{
+		World:        failed.World,
+		Zone:         failed.Zone,
+		Snapshot:     failed.Snapshot,
+		JarVersion:   failed.JarVersion,
+		OutputPrefix: failed.OutputPrefix,
+		Config:       failed.Config,
+		Trigger:      failed.Trigger,
+		Attempt:      failed.Attempt + 1,
+		RetryOf:      failed.ID,
+		Status:       OverviewerJobStatusCreatingDisk,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}, true
+}
+
+// overviewerTargets is Overviewerを作り直すWorldを返す
+// LatestSnapshotがOverviewerSnapshotと同じWorldと、Jobが動いているWorldは除く
+// OverviewerSnapshotはRenderが成功した時だけ進むので、失敗したWorldは次の日にもう一度Renderする
+func overviewerTargets(worlds []*Minecraft, active map[string]bool) []*Minecraft {
+	targets := make([]*Minecraft, 0)
+	for _, minecraft := range worlds {
+		if len(minecraft.LatestSnapshot) < 1 || minecraft.LatestSnapshot == minecraft.OverviewerSnapshot {
+			continue
+		}
+		if active[minecraft.World] {
+			continue
+		}
+		targets = append(targets, minecraft)
+	}
+	return targets
+}
+
+// queryActiveOverviewerJobs is まだ終わっていないOverviewerJobを返す
+func queryActiveOverviewerJobs(ctx context.Context) ([]*OverviewerJob, error) {
+	jobs := make([]*OverviewerJob, 0)
+	for _, status := range overviewerJobActiveStatuses {
+		var l []*OverviewerJob
+		keys, err := datastore.NewQuery("OverviewerJob").Filter("Status =", status).GetAll(ctx, &l)
+		if err != nil {
+			return nil, err
+		}
+		for i := range l {
+			l[i].Key = keys[i]
+			l[i].ID = keys[i].IntID()
+		}
+		jobs = append(jobs, l...)
+	}
+	return jobs, nil
+}
+
 func init() {
 	api := OverviewerAPI{}
 
 	http.HandleFunc("/cron/1/overviewer", api.handler)
-	http.HandleFunc("/tq/1/overviewer/instance/create", api.handleTQCreateInstace)
+	apiRouter.Handle("GET", "/api/1/minecraft/{world}/overviewer", api.List, requireAdmin)
+	apiRouter.Handle("POST", "/api/1/minecraft/{world}/overviewer", api.Post, requireAdmin, audit(AuditActionOverviewerCreate))
 }
 
+// OverviewerLock is WorldをRenderしているOverviewerJob
+// Keyは対象のWorld Name。DiskとInstanceのNameはWorldごとに1つなので、同じWorldのJobは同時に動かせない
+type OverviewerLock struct {
+	JobID     int64     `datastore:",noindex"`
+	UpdatedAt time.Time `datastore:",noindex"`
+}
+
+// putOverviewerJob is Transactionの中でOverviewerLockを確認して、Jobを保存してLockを置き換える
+// Lockしている別のJobが終わっていない場合はconflictErrorを返す。試し直すJobは元のJobのLockを引き継ぐ
+// OverviewerJobとOverviewerLockは別のEntity Groupなので、XGのTransactionで呼ぶ
+func putOverviewerJob(c context.Context, job *OverviewerJob) error {
+	lkey := datastore.NewKey(c, "OverviewerLock", job.World, 0, nil)
+	var lock OverviewerLock
+	err := datastore.Get(c, lkey, &lock)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	if lock.JobID != 0 && lock.JobID != job.RetryOf {
+		var current OverviewerJob
+		err := datastore.Get(c, datastore.NewKey(c, "OverviewerJob", "", lock.JobID, nil), &current)
+		if err == nil && current.Finished() == false {
+			return conflictError(fmt.Sprintf("%s overviewer job %d is %s.", job.World, lock.JobID, current.Status)).WithDetail("id", lock.JobID)
+		}
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+	}
+
+	_, err = datastore.Put(c, job.Key, job)
+	if err != nil {
+		return err
+	}
+	_, err = datastore.Put(c, lkey, &OverviewerLock{JobID: job.ID, UpdatedAt: time.Now()})
+	return err
+}
+
+// handler is Overviewerを作り直すWorldごとにOverviewerJobを作り、TQに渡す
+// 1つのWorldで失敗しても、残りのWorldのJobは作る
 func (a *OverviewerAPI) handler(w http.ResponseWriter, r *http.Request) {
 	ctx := appengine.NewContext(r)
 
@@ -55,59 +254,190 @@ func (a *OverviewerAPI) handler(w http.ResponseWriter, r *http.Request) {
 		list = append(list, &entity)
 	}
 
-	client := &http.Client{
-		Transport: &oauth2.Transport{
-			Source: google.AppEngineTokenSource(ctx, compute.ComputeScope),
-			Base:   &urlfetch.Transport{Context: ctx},
-		},
+	jobs, err := queryActiveOverviewerJobs(ctx)
+	if err != nil {
+		log.Errorf(ctx, "OverviewerJob Query Error. error = %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	active := make(map[string]bool)
+	for _, job := range jobs {
+		log.Infof(ctx, "overviewer job is running. world = %s, id = %d, status = %s", job.World, job.ID, job.Status)
+		active[job.World] = true
 	}
 
-	// TODO 本来は1つずつTQにする方がよい
-	for _, minecraft := range list {
-		if minecraft.LatestSnapshot == minecraft.OverviewerSnapshot {
+	failed := 0
+	for _, minecraft := range overviewerTargets(list, active) {
+		ev := newAuditEvent(ctx, r, AuditActionOverviewerCreate)
+		ev.Target = minecraft.World
+		ev.SetDiff(map[string]string{"overviewerSnapshot": minecraft.OverviewerSnapshot}, map[string]string{"overviewerSnapshot": minecraft.LatestSnapshot})
+		config, err := getOverviewerConfig(ctx, minecraft.World)
+		if err == nil {
+			job := newOverviewerJob(*minecraft, config, time.Now())
+			job.Trigger = OverviewerJobTriggerCron
+			err = a.startJob(ctx, &job)
+		}
+		ev.Record(ctx, err)
+		if ae, ok := err.(*APIError); ok && ae.Status == http.StatusConflict {
+			// APIで作ったJobがまだ動いている
+			log.Infof(ctx, "skip overviewer job. world = %s, error = %v", minecraft.World, err)
 			continue
 		}
-
-		s, err := compute.New(client)
-		if err != nil {
-			log.Errorf(ctx, "ERROR compute.New: %s", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+		if ae, ok := err.(*APIError); ok && ae.Status == http.StatusBadRequest {
+			// OverviewerConfigを直すまでRenderできないので、Cronを失敗させない
+			log.Warningf(ctx, "skip overviewer job. world = %s, error = %v", minecraft.World, err)
+			continue
 		}
-		ds := compute.NewDisksService(s)
-		ope, err := a.createDiskFromSnapshot(ctx, ds, *minecraft)
 		if err != nil {
-			log.Errorf(ctx, "ERROR create disk: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			log.Errorf(ctx, "ERROR start overviewer job. world = %s, error = %v", minecraft.World, err)
+			failed++
 		}
+	}
+	if failed > 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
 
-		_, err = a.CallCreateInstance(ctx, minecraft.Key, ope.Name)
-		if err != nil {
-			log.Errorf(ctx, "ERROR call create instance tq: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+// startJob is OverviewerJobを保存して、最初のStepのTQを登録する
+// 同じWorldのJobが動いている場合はconflictErrorを返す
+func (a *OverviewerAPI) startJob(ctx context.Context, job *OverviewerJob) error {
+	if isReservedOverviewerOutputPrefix(job.outputPrefix()) {
+		return invalidRequestError(fmt.Sprintf("outputPrefix %s is reserved. set outputPrefix of %s overviewer config.", job.outputPrefix(), job.World)).WithDetail("outputPrefix", job.outputPrefix())
+	}
+	ids, _, err := datastore.AllocateIDs(ctx, "OverviewerJob", nil, 1)
+	if err != nil {
+		return err
+	}
+	job.Key = datastore.NewKey(ctx, "OverviewerJob", "", ids, nil)
+	job.ID = ids
+
+	tq := OverviewerTQApi{}
+	return datastore.RunInTransaction(ctx, func(c context.Context) error {
+		if err := putOverviewerJob(c, job); err != nil {
+			return err
+		}
+		_, err := tq.CallStep(c, job.Key, 0)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+// OverviewerJobListResponse is GET /api/1/minecraft/{world}/overviewer のResponse
+type OverviewerJobListResponse struct {
+	Items []*OverviewerJob `json:"items"`
+}
+
+// OverviewerApiPostParam is POST /api/1/minecraft/{world}/overviewer のRequest Body
+type OverviewerApiPostParam struct {
+	Snapshot string `json:"snapshot"` // 空の場合はLatestSnapshot
+}
+
+// list overviewer jobs
+// 動いているJobも終わったJobも新しい順に返す
+func (a *OverviewerAPI) List(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	limit, err := parseLimit(r, 20, 100)
+	if err != nil {
+		return err
+	}
+
+	res := OverviewerJobListResponse{
+		Items: make([]*OverviewerJob, 0),
+	}
+	q := datastore.NewQuery("OverviewerJob").Filter("World =", p["world"]).Order("-CreatedAt").Limit(limit)
+	for t := q.Run(ctx); ; {
+		var entity OverviewerJob
+		key, err := t.Next(&entity)
+		if err == datastore.Done {
+			break
 		}
-		err = minecraft.UpdateOverviewerSnapshot(ctx, minecraft.Key)
 		if err != nil {
-			log.Errorf(ctx, "ERROR Update OverviewerSnapshot: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			return internalError(err)
 		}
+		entity.Key = key
+		entity.ID = key.IntID()
+		res.Items = append(res.Items, &entity)
+	}
+
+	writeJSON(w, http.StatusOK, res)
+	return nil
+}
+
+// start overviewer job
+// Cronを待たずにSnapshotをRenderする。Render設定はCronと同じOverviewerConfigを使う
+func (a *OverviewerAPI) Post(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	var param OverviewerApiPostParam
+	err := json.NewDecoder(r.Body).Decode(&param)
+	if err != nil && err != io.EOF {
+		return invalidRequestError("invalid request.").WithDetail("cause", err.Error())
+	}
+	defer r.Body.Close()
+
+	key, err := minecraftKey(ctx, p, "")
+	if err != nil {
+		return err
+	}
+	ev := auditEventFromContext(ctx)
+	ev.Target = key.StringID()
+	minecraft, err := getMinecraft(ctx, key)
+	if err != nil {
+		return err
+	}
+	sn := param.Snapshot
+	if len(sn) < 1 {
+		sn = minecraft.LatestSnapshot
+	}
+	if len(sn) < 1 {
+		return conflictError(fmt.Sprintf("%s has no snapshot.", minecraft.World))
+	}
+	// CloneしたWorldのLatestSnapshotはClone元のWorldのSnapshotなので、LatestSnapshotはそのまま使える
+	if sn != minecraft.LatestSnapshot && snapshotBelongsTo(sn, minecraft.World) == false {
+		return invalidRequestError(fmt.Sprintf("snapshot is not %s snapshot.", minecraft.World)).WithDetail("snapshot", sn)
+	}
+
+	s, err := newComputeService(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+	_, err = compute.NewSnapshotsService(s).Get(PROJECT_NAME, sn).Do()
+	if isNotFoundError(err) {
+		return notFoundError(fmt.Sprintf("%s is not found.", sn)).WithDetail("snapshot", sn)
+	}
+	if err != nil {
+		return internalError(err)
+	}
+
+	config, err := getOverviewerConfig(ctx, minecraft.World)
+	if err != nil {
+		return internalError(err)
+	}
+	job := newOverviewerJob(minecraft, config, time.Now())
+	job.Snapshot = sn
+	job.Trigger = OverviewerJobTriggerAPI
+	err = a.startJob(ctx, &job)
+	if ae, ok := err.(*APIError); ok {
+		return ae
 	}
+	if err != nil {
+		return internalError(err)
+	}
+	ev.SetDiff(nil, job)
+
+	writeJSON(w, http.StatusAccepted, job)
+	return nil
 }
 
 // create disk from snapshot
-func (a *OverviewerAPI) createDiskFromSnapshot(ctx context.Context, ds *compute.DisksService, minecraft Minecraft) (*compute.Operation, error) {
-	name := fmt.Sprintf(OverViewerWorldDiskFormat, INSTANCE_NAME, minecraft.World)
+func (a *OverviewerAPI) createDiskFromSnapshot(ctx context.Context, ds *compute.DisksService, job OverviewerJob) (*compute.Operation, error) {
+	name := fmt.Sprintf(OverViewerWorldDiskFormat, INSTANCE_NAME, job.World)
 	d := &compute.Disk{
 		Name:           name,
 		SizeGb:         100,
-		SourceSnapshot: "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/global/snapshots/" + minecraft.LatestSnapshot,
-		Type:           "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/zones/" + minecraft.Zone + "/diskTypes/pd-ssd",
+		SourceSnapshot: "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/global/snapshots/" + job.Snapshot,
+		Type:           "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/zones/" + job.Zone + "/diskTypes/pd-ssd",
 	}
 
-	ope, err := ds.Insert(PROJECT_NAME, minecraft.Zone, d).Do()
+	ope, err := ds.Insert(PROJECT_NAME, job.Zone, d).Do()
 	if err != nil {
 		log.Errorf(ctx, "ERROR insert disk: %s", err)
 		return nil, err
@@ -118,17 +448,21 @@ func (a *OverviewerAPI) createDiskFromSnapshot(ctx context.Context, ds *compute.
 }
 
 // create gce instance
-func (a *OverviewerAPI) createInstance(ctx context.Context, is *compute.InstancesService, minecraft Minecraft) (string, error) {
-	name := OverviewerInstanceName + "-" + minecraft.World
-	worldDiskName := fmt.Sprintf(OverViewerWorldDiskFormat, INSTANCE_NAME, minecraft.World)
+// RenderとUploadの進み具合はMetadataのoverviewer-stateで返ってくる
+func (a *OverviewerAPI) createInstance(ctx context.Context, is *compute.InstancesService, job OverviewerJob) (*compute.Operation, error) {
+	name := overviewerInstanceName(job.World)
+	worldDiskName := fmt.Sprintf(OverViewerWorldDiskFormat, INSTANCE_NAME, job.World)
 	log.Infof(ctx, "create instance name = %s", name)
 
 	startupScriptURL := "gs://sinmetalcraft-minecraft-shell/minecraft-overviewer-startup-script.sh"
 	stateValue := "new"
+	jobID := strconv.FormatInt(job.ID, 10)
+	config := job.config()
+	output := fmt.Sprintf("gs://%s/%s", OverviewerBucket, job.outputPrefix())
 	newIns := &compute.Instance{
 		Name:        name,
-		Zone:        "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/zones/" + minecraft.Zone,
-		MachineType: "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/zones/" + minecraft.Zone + "/machineTypes/n1-highcpu-4",
+		Zone:        "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/zones/" + job.Zone,
+		MachineType: "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/zones/" + job.Zone + "/machineTypes/n1-highcpu-4",
 		Disks: []*compute.AttachedDisk{
 			&compute.AttachedDisk{
 				AutoDelete: true,
@@ -137,7 +471,7 @@ func (a *OverviewerAPI) createInstance(ctx context.Context, is *compute.Instance
 				Mode:       "READ_WRITE",
 				InitializeParams: &compute.AttachedDiskInitializeParams{
 					SourceImage: "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/global/images/family/minecraft-overviewer",
-					DiskType:    "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/zones/" + minecraft.Zone + "/diskTypes/pd-ssd",
+					DiskType:    "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/zones/" + job.Zone + "/diskTypes/pd-ssd",
 					DiskSizeGb:  100,
 				},
 			},
@@ -146,7 +480,7 @@ func (a *OverviewerAPI) createInstance(ctx context.Context, is *compute.Instance
 				Boot:       false,
 				DeviceName: worldDiskName,
 				Mode:       "READ_WRITE",
-				Source:     "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/zones/" + minecraft.Zone + "/disks/" + worldDiskName,
+				Source:     "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/zones/" + job.Zone + "/disks/" + worldDiskName,
 			},
 		},
 		CanIpForward: false,
@@ -172,7 +506,7 @@ func (a *OverviewerAPI) createInstance(ctx context.Context, is *compute.Instance
 				},
 				&compute.MetadataItems{
 					Key:   "world",
-					Value: &minecraft.World,
+					Value: &job.World,
 				},
 				&compute.MetadataItems{
 					Key:   "state",
@@ -180,7 +514,19 @@ func (a *OverviewerAPI) createInstance(ctx context.Context, is *compute.Instance
 				},
 				&compute.MetadataItems{
 					Key:   "minecraft-version",
-					Value: &minecraft.JarVersion,
+					Value: &job.JarVersion,
+				},
+				&compute.MetadataItems{
+					Key:   "overviewer-job",
+					Value: &jobID,
+				},
+				&compute.MetadataItems{
+					Key:   overviewerConfigMetadataKey,
+					Value: &config,
+				},
+				&compute.MetadataItems{
+					Key:   overviewerOutputMetadataKey,
+					Value: &output,
 				},
 			},
 		},
@@ -200,21 +546,21 @@ func (a *OverviewerAPI) createInstance(ctx context.Context, is *compute.Instance
 			Preemptible:       true,
 		},
 	}
-	ope, err := is.Insert(PROJECT_NAME, minecraft.Zone, newIns).Do()
+	ope, err := is.Insert(PROJECT_NAME, job.Zone, newIns).Do()
 	if err != nil {
 		log.Errorf(ctx, "ERROR insert instance: %s", err)
-		return "", err
+		return nil, err
 	}
 	WriteLog(ctx, "INSTNCE_CREATE_OPE", ope)
 
-	return name, nil
+	return ope, nil
 }
 
 // delete instance
-func (a *OverviewerAPI) deleteInstance(ctx context.Context, is *compute.InstancesService, instanceName string) error {
+func (a *OverviewerAPI) deleteInstance(ctx context.Context, is *compute.InstancesService, zone string, instanceName string) error {
 	log.Infof(ctx, "delete instance name = %s", instanceName)
 
-	ope, err := is.Delete(PROJECT_NAME, "asia-northeast1-b", instanceName).Do()
+	ope, err := is.Delete(PROJECT_NAME, zone, instanceName).Do()
 	if err != nil {
 		log.Errorf(ctx, "ERROR delete instance: %s", err)
 		return err
@@ -225,85 +571,3 @@ func (a *OverviewerAPI) deleteInstance(ctx context.Context, is *compute.Instance
 
 	return nil
 }
-
-func (a *OverviewerAPI) CallCreateInstance(c context.Context, minecraftKey *datastore.Key, operationID string) (*taskqueue.Task, error) {
-	log.Infof(c, "Call Minecraft TQ, key = %v, operationID = %s", minecraftKey, operationID)
-	if minecraftKey == nil {
-		return nil, errors.New("key is required")
-	}
-	if len(operationID) < 1 {
-		return nil, errors.New("operationID is required")
-	}
-
-	t := taskqueue.NewPOSTTask("/tq/1/overviewer/instance/create", url.Values{
-		"keyStr":      {minecraftKey.Encode()},
-		"operationID": {operationID},
-	})
-	t.Delay = time.Second * 30
-	return taskqueue.Add(c, t, "minecraft")
-}
-
-// handleTQCreateInstace is Overviewerのためにインスタンスを作成するためのTQ Handler
-// Snapshotから復元されたDiskが作成されたのを確認してから、インスタンスを作成する
-func (a *OverviewerAPI) handleTQCreateInstace(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
-
-	keyStr := r.FormValue("keyStr")
-	operationID := r.FormValue("operationID")
-
-	log.Infof(ctx, "keyStr = %s, operationID = %s", keyStr, operationID)
-
-	key, err := datastore.DecodeKey(keyStr)
-	if err != nil {
-		log.Errorf(ctx, "key decode error. keyStr = %s, err = %s", keyStr, err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	client := &http.Client{
-		Transport: &oauth2.Transport{
-			Source: google.AppEngineTokenSource(ctx, compute.ComputeScope),
-			Base:   &urlfetch.Transport{Context: ctx},
-		},
-	}
-	s, err := compute.New(client)
-	if err != nil {
-		log.Errorf(ctx, "ERROR compute.New: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	nzos := compute.NewZoneOperationsService(s)
-	ope, err := nzos.Get(PROJECT_NAME, "asia-northeast1-b", operationID).Do()
-	if err != nil {
-		log.Errorf(ctx, "ERROR compute Zone Operation Get Error. zone = %s, operation = %s, error = %s", "asia-northeast1-b", operationID, err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	WriteLog(ctx, "__GET_ZONE_COMPUTE_OPE__", ope)
-
-	if ope.Status != "DONE" {
-		log.Infof(ctx, "operation status = %s", ope.Status)
-		w.WriteHeader(http.StatusRequestTimeout)
-		return
-	}
-
-	var entity Minecraft
-	err = datastore.Get(ctx, key, &entity)
-	if err != nil {
-		log.Errorf(ctx, "datastore get error. key = %s. error = %v", key.StringID(), err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	entity.Key = key
-
-	is := compute.NewInstancesService(s)
-	name, err := a.createInstance(ctx, is, entity)
-	if err != nil {
-		log.Errorf(ctx, "instance create error. error = %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	log.Infof(ctx, "instance create done. name = %s", name)
-	w.WriteHeader(http.StatusOK)
-}
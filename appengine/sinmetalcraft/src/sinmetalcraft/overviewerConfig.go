@@ -0,0 +1,392 @@
+package sinmetalcraft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+
+	"golang.org/x/net/context"
+)
+
+func init() {
+	api := OverviewerConfigApi{}
+
+	apiRouter.Handle("GET", "/api/1/minecraft/{world}/overviewer/config", api.Get, requireAdmin)
+	apiRouter.Handle("PUT", "/api/1/minecraft/{world}/overviewer/config", api.Put, requireAdmin, audit(AuditActionWorldOverviewer))
+}
+
+// overviewerConfigMetadataKey is Render用Instanceに設定ファイルを渡すMetadata
+const overviewerConfigMetadataKey = "overviewer-config"
+
+// overviewerOutputMetadataKey is Render用InstanceにUpload先を渡すMetadata
+const overviewerOutputMetadataKey = "overviewer-output"
+
+// OverviewerConfig Dimension
+const (
+	OverviewerDimensionOverworld = "overworld"
+	OverviewerDimensionNether    = "nether"
+	OverviewerDimensionEnd       = "end"
+)
+
+// OverviewerConfig Rendermode
+const (
+	OverviewerRendermodeNormal   = "normal"
+	OverviewerRendermodeDay      = "day"
+	OverviewerRendermodeNight    = "night"
+	OverviewerRendermodeCave     = "cave"
+	OverviewerRendermodeLighting = "lighting"
+)
+
+// overviewerDimensions is 指定できるDimensionの順番
+var overviewerDimensions = []string{
+	OverviewerDimensionOverworld,
+	OverviewerDimensionNether,
+	OverviewerDimensionEnd,
+}
+
+// overviewerRendermodes is DimensionごとのRendermodeと、Overviewerの組み込みRendermodeの対応
+// NetherとEndには夜も地下も無いので、night, caveは指定できない
+var overviewerRendermodes = map[string]map[string]string{
+	OverviewerDimensionOverworld: {
+		OverviewerRendermodeNormal:   "normal",
+		OverviewerRendermodeDay:      "smooth_lighting",
+		OverviewerRendermodeNight:    "smooth_night",
+		OverviewerRendermodeCave:     "cave",
+		OverviewerRendermodeLighting: "lighting",
+	},
+	OverviewerDimensionNether: {
+		OverviewerRendermodeNormal:   "nether",
+		OverviewerRendermodeDay:      "nether_smooth_lighting",
+		OverviewerRendermodeLighting: "nether_lighting",
+	},
+	OverviewerDimensionEnd: {
+		OverviewerRendermodeNormal:   "normal",
+		OverviewerRendermodeDay:      "smooth_lighting",
+		OverviewerRendermodeLighting: "lighting",
+	},
+}
+
+// overviewerTextureVersionPattern is TextureにするMinecraft Clientのversion
+var overviewerTextureVersionPattern = regexp.MustCompile(`^1\.[0-9]+(\.[0-9]+)?$`)
+
+// overviewerOutputPrefixPattern is OverviewerBucketのUpload先として受け付ける形式
+var overviewerOutputPrefixPattern = regexp.MustCompile(`^[a-z0-9]([-_a-z0-9]*[a-z0-9])?(/[a-z0-9]([-_a-z0-9]*[a-z0-9])?)*$`)
+
+// overviewerOutputPrefixMaxLength is OutputPrefixの最大文字数
+const overviewerOutputPrefixMaxLength = 100
+
+// OverviewerConfig is WorldのOverviewerのRender設定
+// Keyは対象のWorld Name。まだ設定していないWorldはoverworldをnormalでRenderする
+type OverviewerConfig struct {
+	Key            *datastore.Key `json:"-" datastore:"-"`
+	World          string         `json:"world"`
+	Dimensions     []string       `json:"dimensions" datastore:",noindex"`
+	Rendermodes    []string       `json:"rendermodes" datastore:",noindex"`    // 全てのDimensionをそれぞれのRendermodeでRenderする
+	TextureVersion string         `json:"textureVersion" datastore:",noindex"` // 空の場合はWorldのJarVersion
+	OutputPrefix   string         `json:"outputPrefix" datastore:",noindex"`   // OverviewerBucketのUpload先。空の場合はWorld Name
+	CreatedAt      time.Time      `json:"createdAt"`
+	UpdatedAt      time.Time      `json:"updatedAt"`
+}
+
+// defaultOverviewerConfig is 設定していないWorldのRender設定
+func defaultOverviewerConfig(world string) OverviewerConfig {
+	return OverviewerConfig{
+		World:       world,
+		Dimensions:  []string{OverviewerDimensionOverworld},
+		Rendermodes: []string{OverviewerRendermodeNormal},
+	}
+}
+
+// textureVersion is TextureにするMinecraft Clientのversion
+func (oc *OverviewerConfig) textureVersion(minecraft Minecraft) string {
+	if len(oc.TextureVersion) > 0 {
+		return oc.TextureVersion
+	}
+	return minecraft.JarVersion
+}
+
+// outputPrefix is OverviewerBucketのUpload先
+func (oc *OverviewerConfig) outputPrefix() string {
+	if len(oc.OutputPrefix) > 0 {
+		return oc.OutputPrefix
+	}
+	return oc.World
+}
+
+// Clone is Cloneした新しいWorldのRender設定を返す
+// OutputPrefixはWorldごとに別にしないといけないので、コピーせずにWorld Nameに戻す
+func (oc *OverviewerConfig) Clone(world string) OverviewerConfig {
+	now := time.Now()
+	return OverviewerConfig{
+		World:          world,
+		Dimensions:     append([]string(nil), oc.Dimensions...),
+		Rendermodes:    append([]string(nil), oc.Rendermodes...),
+		TextureVersion: oc.TextureVersion,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+}
+
+// getOverviewerConfig is WorldのRender設定を返す。まだ設定していない場合はdefaultOverviewerConfigを返す
+func getOverviewerConfig(ctx context.Context, world string) (OverviewerConfig, error) {
+	key := datastore.NewKey(ctx, "OverviewerConfig", world, 0, nil)
+	var entity OverviewerConfig
+	err := datastore.Get(ctx, key, &entity)
+	if err == datastore.ErrNoSuchEntity {
+		entity = defaultOverviewerConfig(world)
+		entity.Key = key
+		return entity, nil
+	}
+	if err != nil {
+		return entity, err
+	}
+	entity.Key = key
+	return entity, nil
+}
+
+// validateOverviewerConfig is Render設定を確認する
+func validateOverviewerConfig(oc OverviewerConfig) error {
+	if len(oc.Dimensions) < 1 {
+		return invalidRequestError("dimensions is required.")
+	}
+	if len(oc.Rendermodes) < 1 {
+		return invalidRequestError("rendermodes is required.")
+	}
+	seen := make(map[string]bool)
+	for _, d := range oc.Dimensions {
+		if _, ok := overviewerRendermodes[d]; !ok {
+			return invalidRequestError(fmt.Sprintf("dimensions is one of %s.", strings.Join(overviewerDimensions, ", "))).WithDetail("dimensions", d)
+		}
+		if seen[d] {
+			return invalidRequestError(fmt.Sprintf("%s is duplicated.", d)).WithDetail("dimensions", d)
+		}
+		seen[d] = true
+	}
+	seen = make(map[string]bool)
+	for _, m := range oc.Rendermodes {
+		if _, ok := overviewerRendermodes[OverviewerDimensionOverworld][m]; !ok {
+			return invalidRequestError("rendermodes is one of normal, day, night, cave, lighting.").WithDetail("rendermodes", m)
+		}
+		if seen[m] {
+			return invalidRequestError(fmt.Sprintf("%s is duplicated.", m)).WithDetail("rendermodes", m)
+		}
+		seen[m] = true
+		for _, d := range oc.Dimensions {
+			if _, ok := overviewerRendermodes[d][m]; !ok {
+				return invalidRequestError(fmt.Sprintf("%s does not support %s.", d, m)).WithDetail("rendermodes", m)
+			}
+		}
+	}
+	if len(oc.TextureVersion) > 0 && !overviewerTextureVersionPattern.MatchString(oc.TextureVersion) {
+		return invalidRequestError("textureVersion is minecraft version like 1.12.2.").WithDetail("textureVersion", oc.TextureVersion)
+	}
+	if len(oc.OutputPrefix) > 0 {
+		if len(oc.OutputPrefix) > overviewerOutputPrefixMaxLength || !overviewerOutputPrefixPattern.MatchString(oc.OutputPrefix) {
+			return invalidRequestError(fmt.Sprintf("outputPrefix is up to %d characters of a-z, 0-9, -, _ separated by /.", overviewerOutputPrefixMaxLength)).WithDetail("outputPrefix", oc.OutputPrefix)
+		}
+	}
+	// 空の場合はWorld NameになるのでclientというWorldも設定が要る
+	if isReservedOverviewerOutputPrefix(oc.outputPrefix()) {
+		return invalidRequestError("outputPrefix client is reserved. set another outputPrefix.").WithDetail("outputPrefix", oc.outputPrefix())
+	}
+	return nil
+}
+
+// isReservedOverviewerOutputPrefix is OverviewerBucketでRenderしたMapを置けないPrefixか
+// OverviewerBucketのclient/にはTextureにするMinecraft Clientを置いている
+func isReservedOverviewerOutputPrefix(prefix string) bool {
+	return prefix == "client" || strings.HasPrefix(prefix, "client/")
+}
+
+// overviewerOutputPrefixOwner is prefixを使っている他のWorldを返す
+// OverviewerConfigが無いWorldやOutputPrefixが空のWorldはWorld Nameを使っている
+func overviewerOutputPrefixOwner(world string, prefix string, worlds []string, configs []OverviewerConfig) (string, bool) {
+	custom := make(map[string]string)
+	for _, oc := range configs {
+		custom[oc.World] = oc.outputPrefix()
+	}
+	for _, w := range worlds {
+		if w == world {
+			continue
+		}
+		p, ok := custom[w]
+		if !ok {
+			p = w
+		}
+		if p == prefix {
+			return w, true
+		}
+	}
+	return "", false
+}
+
+// validateOverviewerOutputPrefix is 他のWorldが同じOutputPrefixを使っていないかを確認する
+// 同じPrefixにRenderすると、お互いのMapを上書きしてしまう
+func validateOverviewerOutputPrefix(ctx context.Context, oc OverviewerConfig) error {
+	keys, err := datastore.NewQuery("Minecraft").KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return internalError(err)
+	}
+	worlds := make([]string, 0, len(keys))
+	for _, k := range keys {
+		worlds = append(worlds, k.StringID())
+	}
+	var configs []OverviewerConfig
+	ckeys, err := datastore.NewQuery("OverviewerConfig").GetAll(ctx, &configs)
+	if err != nil {
+		return internalError(err)
+	}
+	for i := range configs {
+		configs[i].World = ckeys[i].StringID()
+	}
+
+	prefix := oc.outputPrefix()
+	if owner, ok := overviewerOutputPrefixOwner(oc.World, prefix, worlds, configs); ok {
+		return conflictError(fmt.Sprintf("outputPrefix %s is used by %s.", prefix, owner)).WithDetail("outputPrefix", prefix)
+	}
+	return nil
+}
+
+// overviewerRenderName is Overviewerのrendersの名前。Mapの中でLayerの名前になる
+func overviewerRenderName(dimension string, rendermode string) string {
+	return dimension + "-" + rendermode
+}
+
+// renderOverviewerConfig is Render用InstanceがOverviewerに渡す設定ファイル (Python) を作る
+// 値は全てASCIIの英数字と記号なので、Goの%qがそのままPythonの文字列になる
+func renderOverviewerConfig(world string, oc OverviewerConfig, textureVersion string) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "worlds[%q] = %q\n", world, "/home/minecraft/world")
+	fmt.Fprintf(&b, "texturepath = %q\n", fmt.Sprintf("/home/minecraft/minecraft_client.%s.jar", textureVersion))
+	fmt.Fprintf(&b, "outputdir = %q\n", "/home/minecraft/overviewer/output")
+	for _, d := range oc.Dimensions {
+		for _, m := range oc.Rendermodes {
+			b.WriteString("\n")
+			fmt.Fprintf(&b, "renders[%q] = {\n", overviewerRenderName(d, m))
+			fmt.Fprintf(&b, "    \"world\": %q,\n", world)
+			fmt.Fprintf(&b, "    \"title\": %q,\n", fmt.Sprintf("%s %s %s", world, d, m))
+			fmt.Fprintf(&b, "    \"dimension\": %q,\n", d)
+			fmt.Fprintf(&b, "    \"rendermode\": %q,\n", overviewerRendermodes[d][m])
+			b.WriteString("}\n")
+		}
+	}
+	return b.String()
+}
+
+// OverviewerConfigApi is WorldのOverviewerのRender設定を管理するAPI
+type OverviewerConfigApi struct{}
+
+// OverviewerConfigApiPutParam is PUT /api/1/minecraft/{world}/overviewer/config のRequest Body
+// 設定は全体を置き換える
+type OverviewerConfigApiPutParam struct {
+	Dimensions     []string `json:"dimensions"`
+	Rendermodes    []string `json:"rendermodes"`
+	TextureVersion string   `json:"textureVersion"`
+	OutputPrefix   string   `json:"outputPrefix"`
+}
+
+// OverviewerConfigApiResponse is /api/1/minecraft/{world}/overviewer/config のResponse
+type OverviewerConfigApiResponse struct {
+	OverviewerConfig
+	Diff    []AuditDiff `json:"diff"`    // PUTで変わったField
+	Preview string      `json:"preview"` // 次のRenderでOverviewerに渡す設定ファイル
+}
+
+// newOverviewerConfigApiResponse is 設定ファイルのPreviewを付ける
+func newOverviewerConfigApiResponse(oc OverviewerConfig, diff []AuditDiff, minecraft Minecraft) OverviewerConfigApiResponse {
+	return OverviewerConfigApiResponse{
+		OverviewerConfig: oc,
+		Diff:             diff,
+		Preview:          renderOverviewerConfig(minecraft.World, oc, oc.textureVersion(minecraft)),
+	}
+}
+
+// get overviewer config
+func (a *OverviewerConfigApi) Get(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	mkey, err := minecraftKey(ctx, p, "")
+	if err != nil {
+		return err
+	}
+	minecraft, err := getMinecraft(ctx, mkey)
+	if err != nil {
+		return err
+	}
+	entity, err := getOverviewerConfig(ctx, mkey.StringID())
+	if err != nil {
+		return internalError(err)
+	}
+
+	writeJSON(w, http.StatusOK, newOverviewerConfigApiResponse(entity, make([]AuditDiff, 0), minecraft))
+	return nil
+}
+
+// update overviewer config
+// 次のRenderから反映される
+func (a *OverviewerConfigApi) Put(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	var param OverviewerConfigApiPutParam
+	err := json.NewDecoder(r.Body).Decode(&param)
+	if err != nil {
+		return invalidRequestError("invalid request.").WithDetail("cause", err.Error())
+	}
+	defer r.Body.Close()
+
+	mkey, err := minecraftKey(ctx, p, "")
+	if err != nil {
+		return err
+	}
+	ev := auditEventFromContext(ctx)
+	ev.Target = mkey.StringID()
+	minecraft, err := getMinecraft(ctx, mkey)
+	if err != nil {
+		return err
+	}
+	oc := OverviewerConfig{
+		World:          minecraft.World,
+		Dimensions:     param.Dimensions,
+		Rendermodes:    param.Rendermodes,
+		TextureVersion: param.TextureVersion,
+		OutputPrefix:   param.OutputPrefix,
+	}
+	if err := validateOverviewerConfig(oc); err != nil {
+		return err
+	}
+	if err := validateOverviewerOutputPrefix(ctx, oc); err != nil {
+		return err
+	}
+
+	var before, after OverviewerConfig
+	err = datastore.RunInTransaction(ctx, func(c context.Context) error {
+		entity, err := getOverviewerConfig(c, minecraft.World)
+		if err != nil {
+			return err
+		}
+		before = entity
+
+		now := time.Now()
+		oc.Key = entity.Key
+		oc.CreatedAt = entity.CreatedAt
+		if oc.CreatedAt.IsZero() {
+			oc.CreatedAt = now
+		}
+		oc.UpdatedAt = now
+		_, err = datastore.Put(c, oc.Key, &oc)
+		if err != nil {
+			return err
+		}
+		after = oc
+		return nil
+	}, nil)
+	if err != nil {
+		return internalError(err)
+	}
+	ev.SetDiff(before, after)
+
+	writeJSON(w, http.StatusOK, newOverviewerConfigApiResponse(after, auditDiff(before, after), minecraft))
+	return nil
+}
@@ -0,0 +1,144 @@
+package sinmetalcraft
+
+import (
+	"testing"
+)
+
+func TestValidateOverviewerConfig(t *testing.T) {
+	valid := []OverviewerConfig{
+		defaultOverviewerConfig("hoge"),
+		{Dimensions: []string{"overworld"}, Rendermodes: []string{"normal", "day", "night", "cave", "lighting"}},
+		{Dimensions: []string{"overworld", "nether", "end"}, Rendermodes: []string{"day", "lighting"}, TextureVersion: "1.12", OutputPrefix: "maps/hoge-2017_11"},
+		{World: "client", Dimensions: []string{"overworld"}, Rendermodes: []string{"normal"}, OutputPrefix: "maps/client"},
+	}
+	for _, oc := range valid {
+		if err := validateOverviewerConfig(oc); err != nil {
+			t.Errorf("%+v: %v", oc, err)
+		}
+	}
+
+	invalid := []struct {
+		name string
+		oc   OverviewerConfig
+	}{
+		{"no dimension", OverviewerConfig{Rendermodes: []string{"normal"}}},
+		{"no rendermode", OverviewerConfig{Dimensions: []string{"overworld"}}},
+		{"unknown dimension", OverviewerConfig{Dimensions: []string{"aether"}, Rendermodes: []string{"normal"}}},
+		{"unknown rendermode", OverviewerConfig{Dimensions: []string{"overworld"}, Rendermodes: []string{"smooth_lighting"}}},
+		{"duplicated dimension", OverviewerConfig{Dimensions: []string{"overworld", "overworld"}, Rendermodes: []string{"normal"}}},
+		{"duplicated rendermode", OverviewerConfig{Dimensions: []string{"overworld"}, Rendermodes: []string{"day", "day"}}},
+		{"nether night", OverviewerConfig{Dimensions: []string{"overworld", "nether"}, Rendermodes: []string{"night"}}},
+		{"end cave", OverviewerConfig{Dimensions: []string{"end"}, Rendermodes: []string{"cave"}}},
+		{"texture", OverviewerConfig{Dimensions: []string{"overworld"}, Rendermodes: []string{"normal"}, TextureVersion: "latest"}},
+		{"texture quote", OverviewerConfig{Dimensions: []string{"overworld"}, Rendermodes: []string{"normal"}, TextureVersion: `1.12"`}},
+		{"absolute prefix", OverviewerConfig{Dimensions: []string{"overworld"}, Rendermodes: []string{"normal"}, OutputPrefix: "/hoge"}},
+		{"parent prefix", OverviewerConfig{Dimensions: []string{"overworld"}, Rendermodes: []string{"normal"}, OutputPrefix: "hoge/../client"}},
+		{"trailing slash", OverviewerConfig{Dimensions: []string{"overworld"}, Rendermodes: []string{"normal"}, OutputPrefix: "hoge/"}},
+		{"client prefix", OverviewerConfig{Dimensions: []string{"overworld"}, Rendermodes: []string{"normal"}, OutputPrefix: "client/hoge"}},
+		{"client world", defaultOverviewerConfig("client")},
+	}
+	for _, c := range invalid {
+		if err := validateOverviewerConfig(c.oc); err == nil {
+			t.Errorf("%s: must be error", c.name)
+		}
+	}
+}
+
+func TestOverviewerOutputPrefixOwner(t *testing.T) {
+	worlds := []string{"hoge", "fuga", "piyo"}
+	configs := []OverviewerConfig{
+		{World: "fuga", OutputPrefix: "maps/fuga"},
+		{World: "piyo"},
+	}
+	cases := []struct {
+		world  string
+		prefix string
+		owner  string
+	}{
+		{"fuga", "hoge", "hoge"},      // hogeはOverviewerConfigが無いのでWorld Nameを使っている
+		{"hoge", "maps/fuga", "fuga"}, // fugaのOutputPrefix
+		{"hoge", "piyo", "piyo"},      // piyoはOutputPrefixが空なのでWorld Nameを使っている
+		{"hoge", "fuga", ""},          // fugaはOutputPrefixを変えている
+		{"fuga", "maps/fuga", ""},     // 自分のPrefix
+		{"hoge", "maps/hoge", ""},
+	}
+	for _, c := range cases {
+		owner, ok := overviewerOutputPrefixOwner(c.world, c.prefix, worlds, configs)
+		if owner != c.owner || ok != (len(c.owner) > 0) {
+			t.Errorf("%s %s: owner = %q, %v, want %q", c.world, c.prefix, owner, ok, c.owner)
+		}
+	}
+}
+
+func TestRenderOverviewerConfig(t *testing.T) {
+	oc := OverviewerConfig{World: "hoge", Dimensions: []string{"overworld", "nether"}, Rendermodes: []string{"normal", "day"}}
+	got := renderOverviewerConfig("hoge", oc, "1.12.2")
+	want := `worlds["hoge"] = "/home/minecraft/world"
+texturepath = "/home/minecraft/minecraft_client.1.12.2.jar"
+outputdir = "/home/minecraft/overviewer/output"
+
+renders["overworld-normal"] = {
+    "world": "hoge",
+    "title": "hoge overworld normal",
+    "dimension": "overworld",
+    "rendermode": "normal",
+}
+
+renders["overworld-day"] = {
+    "world": "hoge",
+    "title": "hoge overworld day",
+    "dimension": "overworld",
+    "rendermode": "smooth_lighting",
+}
+
+renders["nether-normal"] = {
+    "world": "hoge",
+    "title": "hoge nether normal",
+    "dimension": "nether",
+    "rendermode": "nether",
+}
+
+renders["nether-day"] = {
+    "world": "hoge",
+    "title": "hoge nether day",
+    "dimension": "nether",
+    "rendermode": "nether_smooth_lighting",
+}
+`
+	if got != want {
+		t.Errorf("config =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestOverviewerConfigDefaults(t *testing.T) {
+	oc := defaultOverviewerConfig("hoge")
+	minecraft := Minecraft{World: "hoge", JarVersion: "1.12.2"}
+	if oc.textureVersion(minecraft) != "1.12.2" || oc.outputPrefix() != "hoge" {
+		t.Errorf("default = %+v", oc)
+	}
+
+	oc.TextureVersion = "1.11.2"
+	oc.OutputPrefix = "maps/hoge"
+	if oc.textureVersion(minecraft) != "1.11.2" || oc.outputPrefix() != "maps/hoge" {
+		t.Errorf("config = %+v", oc)
+	}
+}
+
+func TestOverviewerConfigClone(t *testing.T) {
+	src := OverviewerConfig{World: "hoge", Dimensions: []string{"overworld", "nether"}, Rendermodes: []string{"day"}, TextureVersion: "1.12", OutputPrefix: "maps/hoge"}
+	c := src.Clone("hoge-test")
+	if c.World != "hoge-test" {
+		t.Errorf("World = %s, want hoge-test", c.World)
+	}
+	if len(c.Dimensions) != 2 || c.Dimensions[1] != "nether" || len(c.Rendermodes) != 1 || c.TextureVersion != "1.12" {
+		t.Errorf("Clone = %+v", c)
+	}
+	// OutputPrefixは他のWorldと重ねられないので、コピーしない
+	if c.OutputPrefix != "" || c.outputPrefix() != "hoge-test" {
+		t.Errorf("OutputPrefix = %q, want empty", c.OutputPrefix)
+	}
+	c.Dimensions[0] = "end"
+	if src.Dimensions[0] != "overworld" {
+		t.Errorf("src Dimensions = %v", src.Dimensions)
+	}
+}
@@ -0,0 +1,403 @@
+package sinmetalcraft
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+
+	"google.golang.org/api/compute/v1"
+
+	"golang.org/x/net/context"
+)
+
+// overviewerRenderTimeout is InstanceがRenderを終えるのを待つ時間
+const overviewerRenderTimeout = 6 * time.Hour
+
+// overviewerUploadTimeout is InstanceがRenderした結果をUploadし終えるのを待つ時間
+const overviewerUploadTimeout = 2 * time.Hour
+
+func init() {
+	api := OverviewerTQApi{}
+
+	http.HandleFunc("/tq/1/overviewer/step", api.Step)
+}
+
+// OverviewerTQApi is OverviewerJobのStatusを1つずつ進めるTQ
+//
+// creating_disk -> creating_instance -> rendering -> uploading -> done
+//
+// 途中で失敗した場合はInstanceとDiskを消して、Errorを設定したfailedになる
+// failedになったJobは、overviewerMaxAttempts回まで間を空けて新しいJobで試し直す
+// WorldのOverviewerSnapshotはdoneになった時だけ進める
+type OverviewerTQApi struct{}
+
+// CallStep is OverviewerJobのStatusを進めるTQを登録する
+func (a *OverviewerTQApi) CallStep(c context.Context, key *datastore.Key, delay time.Duration) (*taskqueue.Task, error) {
+	log.Infof(c, "Call Overviewer Step TQ, key = %v", key)
+	if key == nil {
+		return nil, errors.New("key is required")
+	}
+
+	t := taskqueue.NewPOSTTask("/tq/1/overviewer/step", url.Values{
+		"keyStr": {key.Encode()},
+	})
+	t.Delay = delay
+	return taskqueue.Add(c, t, "minecraft")
+}
+
+// Step is OverviewerJobの今のStatusの処理を行い、終わっていれば次のStatusに進める
+func (a *OverviewerTQApi) Step(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	keyStr := r.FormValue("keyStr")
+	log.Infof(ctx, "keyStr = %s", keyStr)
+
+	key, err := datastore.DecodeKey(keyStr)
+	if err != nil {
+		log.Errorf(ctx, "key decode error. keyStr = %s, err = %s", keyStr, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var job OverviewerJob
+	err = datastore.Get(ctx, key, &job)
+	if err != nil {
+		log.Errorf(ctx, "datastore get error. key = %d. error = %v", key.IntID(), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	job.Key = key
+	job.ID = key.IntID()
+	log.Infof(ctx, "overviewer job world = %s, status = %s", job.World, job.Status)
+
+	s, err := newComputeService(ctx)
+	if err != nil {
+		log.Errorf(ctx, "ERROR compute.New: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	switch job.Status {
+	case OverviewerJobStatusCreatingDisk:
+		err = a.createDisk(ctx, r, s, job)
+	case OverviewerJobStatusCreatingInstance:
+		err = a.createInstance(ctx, r, s, job)
+	case OverviewerJobStatusRendering, OverviewerJobStatusUploading:
+		err = a.waitRender(ctx, r, s, job)
+	default:
+		log.Infof(ctx, "nothing to do. status = %s", job.Status)
+	}
+	if err == errOperationWaiting {
+		w.WriteHeader(http.StatusRequestTimeout)
+		return
+	}
+	if err != nil {
+		log.Errorf(ctx, "overviewer step error. status = %s, error = %v", job.Status, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// createDisk is SnapshotからDiskを作り始めて、できあがるのを待つ
+func (a *OverviewerTQApi) createDisk(ctx context.Context, r *http.Request, s *compute.Service, job OverviewerJob) error {
+	if len(job.OperationID) < 1 {
+		oapi := OverviewerAPI{}
+		ope, err := oapi.createDiskFromSnapshot(ctx, compute.NewDisksService(s), job)
+		if err != nil {
+			return a.fail(ctx, r, s, job, fmt.Errorf("disk create error. %v", err))
+		}
+
+		return a.transition(ctx, job, OverviewerJobStatusCreatingDisk, 30*time.Second, func(e *OverviewerJob) {
+			e.OperationID = ope.Name
+		})
+	}
+
+	ope, err := waitZoneOperation(ctx, s, job.Zone, job.OperationID)
+	if err != nil {
+		return err
+	}
+	if ope.Error != nil && len(ope.Error.Errors) > 0 {
+		return a.fail(ctx, r, s, job, fmt.Errorf("disk create error. %s", ope.Error.Errors[0].Message))
+	}
+	return a.transition(ctx, job, OverviewerJobStatusCreatingInstance, 0, func(e *OverviewerJob) {
+		e.OperationID = ""
+		e.DiskCreatedAt = time.Now()
+	})
+}
+
+// createInstance is Diskができたら、RenderするInstanceを作り始めて、起動するのを待つ
+func (a *OverviewerTQApi) createInstance(ctx context.Context, r *http.Request, s *compute.Service, job OverviewerJob) error {
+	if len(job.OperationID) < 1 {
+		oapi := OverviewerAPI{}
+		ope, err := oapi.createInstance(ctx, compute.NewInstancesService(s), job)
+		if err != nil {
+			return a.fail(ctx, r, s, job, fmt.Errorf("instance create error. %v", err))
+		}
+		return a.transition(ctx, job, OverviewerJobStatusCreatingInstance, 30*time.Second, func(e *OverviewerJob) {
+			e.OperationID = ope.Name
+		})
+	}
+
+	ope, err := waitZoneOperation(ctx, s, job.Zone, job.OperationID)
+	if err != nil {
+		return err
+	}
+	if ope.Error != nil && len(ope.Error.Errors) > 0 {
+		return a.fail(ctx, r, s, job, fmt.Errorf("instance create error. %s", ope.Error.Errors[0].Message))
+	}
+	return a.transition(ctx, job, OverviewerJobStatusRendering, time.Minute, func(e *OverviewerJob) {
+		e.OperationID = ""
+		e.InstanceCreatedAt = time.Now()
+	})
+}
+
+// waitRender is InstanceのMetadataのoverviewer-stateを見て、RenderとUploadが終わるのを待つ
+func (a *OverviewerTQApi) waitRender(ctx context.Context, r *http.Request, s *compute.Service, job OverviewerJob) error {
+	ins, err := compute.NewInstancesService(s).Get(PROJECT_NAME, job.Zone, overviewerInstanceName(job.World)).Do()
+	if isNotFoundError(err) {
+		ins, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	status, cause := overviewerProgress(job, ins, now)
+	if cause != nil {
+		return a.fail(ctx, r, s, job, cause)
+	}
+	switch status {
+	case job.Status:
+		return errOperationWaiting
+	case OverviewerJobStatusUploading:
+		return a.transition(ctx, job, status, time.Minute, func(e *OverviewerJob) {
+			e.RenderedAt = now
+		})
+	}
+
+	// OverviewerJobStatusDone
+	// InstanceがdoneにしてもUploadが終わっていないことがあるので、BucketのObjectも確認する
+	o, ok, err := gcsGetObject(newStorageClient(ctx), OverviewerBucket, overviewerIndexObject(job.outputPrefix()))
+	if err != nil {
+		return err
+	}
+	if cause := overviewerUploaded(job, o, ok); cause != nil {
+		return a.fail(ctx, r, s, job, cause)
+	}
+
+	a.deleteInstance(ctx, compute.NewInstancesService(s), job)
+
+	changed, err := a.transitionWith(ctx, job, status, 0, func(e *OverviewerJob) {
+		if e.RenderedAt.IsZero() {
+			e.RenderedAt = now
+		}
+		e.FinishedAt = now
+	}, func(c context.Context, e *OverviewerJob) error {
+		var minecraft Minecraft
+		return minecraft.UpdateOverviewerSnapshot(c, datastore.NewKey(c, "Minecraft", e.World, 0, nil), e.Snapshot)
+	})
+	if err == nil && !changed {
+		return nil
+	}
+
+	ev := newAuditEvent(ctx, r, AuditActionOverviewerDone)
+	ev.Target = job.World
+	ev.SetDiff(nil, map[string]interface{}{"overviewerSnapshot": job.Snapshot, "id": job.ID, "attempt": job.Attempt})
+	ev.Record(ctx, err)
+	return err
+}
+
+// overviewerIndexObject is RenderしたMapの入口のObject Name
+func overviewerIndexObject(prefix string) string {
+	return prefix + "/index.html"
+}
+
+// overviewerUploaded is BucketのObjectがこのJobでUploadされたものかを確認する
+// Instanceを作る前からあるObjectは、前のRenderの結果なので成功とみなさない
+func overviewerUploaded(job OverviewerJob, o *gcsObject, exists bool) error {
+	if !exists {
+		return fmt.Errorf("gs://%s/%s is not found", OverviewerBucket, overviewerIndexObject(job.outputPrefix()))
+	}
+	if o.Updated.Before(job.InstanceCreatedAt) {
+		return fmt.Errorf("gs://%s/%s is not updated since %s", OverviewerBucket, overviewerIndexObject(job.outputPrefix()), job.InstanceCreatedAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// overviewerProgress is Render中のInstanceの状態から、Jobの次のStatusを決める
+// 進んでいない場合はjobのStatusをそのまま返す。失敗している場合はcauseを返す
+func overviewerProgress(job OverviewerJob, ins *compute.Instance, now time.Time) (status string, cause error) {
+	if ins == nil {
+		return "", errors.New("overviewer instance is not found")
+	}
+	switch ins.Status {
+	case "STOPPING", "STOPPED", "SUSPENDED", "TERMINATED":
+		// PreemptibleなのでPreemptされることがある
+		return "", fmt.Errorf("overviewer instance is %s", ins.Status)
+	}
+
+	switch instanceMetadataValue(ins.Metadata, "overviewer-state") {
+	case "error":
+		return "", fmt.Errorf("render error. %s", instanceMetadataValue(ins.Metadata, "overviewer-error"))
+	case "done":
+		return OverviewerJobStatusDone, nil
+	case "uploading":
+		status = OverviewerJobStatusUploading
+	default:
+		status = OverviewerJobStatusRendering
+	}
+	if status != job.Status {
+		return status, nil
+	}
+
+	timeout := overviewerRenderTimeout
+	if status == OverviewerJobStatusUploading {
+		timeout = overviewerUploadTimeout
+	}
+	if now.Sub(job.UpdatedAt) > timeout {
+		return "", fmt.Errorf("%s timeout. %s", status, timeout)
+	}
+	return status, nil
+}
+
+// fail is Jobを失敗にして、InstanceとDiskを消す
+// 試す回数が残っている場合は、同じTransactionで試し直すJobを作る。使い切った場合はSlackに知らせる
+func (a *OverviewerTQApi) fail(ctx context.Context, r *http.Request, s *compute.Service, job OverviewerJob, cause error) error {
+	log.Warningf(ctx, "overviewer job failed. world = %s, status = %s, attempt = %d, error = %v", job.World, job.Status, job.Attempt, cause)
+
+	if !a.deleteInstance(ctx, compute.NewInstancesService(s), job) {
+		// Instanceを作る前に失敗した場合は、AutoDeleteされずにDiskが残っている
+		ope, err := compute.NewDisksService(s).Delete(PROJECT_NAME, job.Zone, fmt.Sprintf(OverViewerWorldDiskFormat, INSTANCE_NAME, job.World)).Do()
+		if err != nil && !isNotFoundError(err) {
+			log.Warningf(ctx, "ERROR delete disk: %s", err)
+		}
+		if ope != nil {
+			WriteLog(ctx, "INSTNCE_DISK_DELETE_OPE", ope)
+		}
+	}
+
+	now := time.Now()
+	retry, ok := newOverviewerRetryJob(job, now)
+	if ok {
+		id, _, err := datastore.AllocateIDs(ctx, "OverviewerJob", nil, 1)
+		if err != nil {
+			return err
+		}
+		retry.Key = datastore.NewKey(ctx, "OverviewerJob", "", id, nil)
+		retry.ID = id
+	}
+
+	changed, err := a.transitionWith(ctx, job, OverviewerJobStatusFailed, 0, func(e *OverviewerJob) {
+		e.Error = cause.Error()
+		e.FinishedAt = now
+	}, func(c context.Context, e *OverviewerJob) error {
+		if !ok {
+			return nil
+		}
+		// Diskを消し終わるのを待つため、最初のStepも遅らせる
+		if err := putOverviewerJob(c, &retry); err != nil {
+			return err
+		}
+		_, err := a.CallStep(c, retry.Key, overviewerRetryBackoff(job.Attempt))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return nil
+	}
+
+	ev := newAuditEvent(ctx, r, AuditActionOverviewerDone)
+	ev.Target = job.World
+	ev.SetDiff(nil, map[string]interface{}{"snapshot": job.Snapshot, "id": job.ID, "attempt": job.Attempt})
+	ev.Record(ctx, cause)
+
+	if ok {
+		log.Infof(ctx, "overviewer job will retry. world = %s, id = %d, attempt = %d, after = %s", retry.World, retry.ID, retry.Attempt, overviewerRetryBackoff(job.Attempt))
+		return nil
+	}
+	notifyOverviewerFailed(ctx, job, cause)
+	return nil
+}
+
+// notifyOverviewerFailed is 試す回数を使い切ったRenderをSlackに知らせる
+// Slackに送れなくてもJobは止めない
+func notifyOverviewerFailed(ctx context.Context, job OverviewerJob, cause error) {
+	notifySlack(ctx, fmt.Sprintf("overviewer render of world %s (%s) failed %d times. %v", job.World, job.Snapshot, job.Attempt, cause), "#d00000")
+}
+
+// deleteInstance is RenderするInstanceを消す。消し始めた場合はtrue、既に無い場合はfalseを返す
+func (a *OverviewerTQApi) deleteInstance(ctx context.Context, is *compute.InstancesService, job OverviewerJob) bool {
+	ope, err := is.Delete(PROJECT_NAME, job.Zone, overviewerInstanceName(job.World)).Do()
+	if err != nil {
+		if !isNotFoundError(err) {
+			log.Warningf(ctx, "ERROR delete instance: %s", err)
+			return true
+		}
+		return false
+	}
+	WriteLog(ctx, "INSTNCE_DELETE_OPE", ope)
+	return true
+}
+
+// transition is OverviewerJobをStatusに進めて、次のStepのTQを登録する
+// TQのRetryで同じStepが二重に実行された場合は、StatusがjobのStatusと違うので何もしない
+func (a *OverviewerTQApi) transition(ctx context.Context, job OverviewerJob, status string, delay time.Duration, f func(e *OverviewerJob)) error {
+	_, err := a.transitionWith(ctx, job, status, delay, f, nil)
+	return err
+}
+
+// transitionWith is transitionと同じTransactionでthenを実行する
+// WorldやRetryのJobなど、別のEntity Groupも一緒に更新するためにXGにする
+// Jobを進めた場合はtrueを返す
+func (a *OverviewerTQApi) transitionWith(ctx context.Context, job OverviewerJob, status string, delay time.Duration, f func(e *OverviewerJob), then func(c context.Context, e *OverviewerJob) error) (bool, error) {
+	var changed bool
+	err := datastore.RunInTransaction(ctx, func(c context.Context) error {
+		changed = false
+		var current OverviewerJob
+		err := datastore.Get(c, job.Key, &current)
+		if err != nil {
+			return err
+		}
+		if current.Status != job.Status || current.OperationID != job.OperationID {
+			log.Warningf(c, "overviewer job is changed. %s -> %s", job.Status, current.Status)
+			return nil
+		}
+
+		current.Status = status
+		current.UpdatedAt = time.Now()
+		if f != nil {
+			f(&current)
+		}
+		_, err = datastore.Put(c, job.Key, &current)
+		if err != nil {
+			return err
+		}
+		if then != nil {
+			if err := then(c, &current); err != nil {
+				return err
+			}
+		}
+		changed = true
+		if current.Finished() {
+			return nil
+		}
+		_, err = a.CallStep(c, job.Key, delay)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	return changed, err
+}
+
+// overviewerInstanceName is WorldをRenderするInstanceのName
+func overviewerInstanceName(world string) string {
+	return OverviewerInstanceName + "-" + world
+}
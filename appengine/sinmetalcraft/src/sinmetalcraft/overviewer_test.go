@@ -0,0 +1,146 @@
+package sinmetalcraft
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+func TestOverviewerTargets(t *testing.T) {
+	worlds := []*Minecraft{
+		{World: "hoge", LatestSnapshot: "minecraft-world-hoge-20171102-000000", OverviewerSnapshot: "minecraft-world-hoge-20171101-000000"},
+		{World: "fuga", LatestSnapshot: "minecraft-world-fuga-20171101-000000", OverviewerSnapshot: "minecraft-world-fuga-20171101-000000"},
+		// 作ったばかりでSnapshotが無い
+		{World: "new"},
+		{World: "running", LatestSnapshot: "minecraft-world-running-20171102-000000"},
+	}
+
+	targets := overviewerTargets(worlds, map[string]bool{"running": true})
+	if len(targets) != 1 || targets[0].World != "hoge" {
+		t.Errorf("targets = %+v", targets)
+	}
+}
+
+func TestNewOverviewerJob(t *testing.T) {
+	now := time.Date(2017, 11, 4, 5, 0, 0, 0, time.UTC)
+	minecraft := Minecraft{World: "hoge", Zone: "asia-northeast1-b", LatestSnapshot: "minecraft-world-hoge-20171104-000000", JarVersion: "1.12.2"}
+	job := newOverviewerJob(minecraft, defaultOverviewerConfig("hoge"), now)
+	if job.World != "hoge" || job.Zone != "asia-northeast1-b" || job.Snapshot != "minecraft-world-hoge-20171104-000000" || job.JarVersion != "1.12.2" || job.outputPrefix() != "hoge" {
+		t.Errorf("job = %+v", job)
+	}
+	if job.Status != OverviewerJobStatusCreatingDisk || job.Attempt != 1 || job.Finished() || !job.CreatedAt.Equal(now) {
+		t.Errorf("job = %+v", job)
+	}
+	if !strings.Contains(job.Config, `"rendermode": "normal"`) {
+		t.Errorf("config = %s", job.Config)
+	}
+
+	config := OverviewerConfig{World: "hoge", Dimensions: []string{"nether"}, Rendermodes: []string{"lighting"}, TextureVersion: "1.11.2", OutputPrefix: "maps/hoge"}
+	job = newOverviewerJob(minecraft, config, now)
+	if job.JarVersion != "1.11.2" || job.outputPrefix() != "maps/hoge" || !strings.Contains(job.Config, `"rendermode": "nether_lighting"`) {
+		t.Errorf("job = %+v", job)
+	}
+	job.Trigger = OverviewerJobTriggerAPI
+	retry, _ := newOverviewerRetryJob(job, now)
+	if retry.OutputPrefix != job.OutputPrefix || retry.Config != job.Config || retry.Trigger != OverviewerJobTriggerAPI {
+		t.Errorf("retry = %+v", retry)
+	}
+}
+
+func overviewerTestInstance(status string, state string, errMessage string) *compute.Instance {
+	ins := &compute.Instance{Name: "overviewer-hoge", Status: status, Metadata: &compute.Metadata{}}
+	for _, kv := range [][2]string{{"overviewer-state", state}, {"overviewer-error", errMessage}} {
+		if len(kv[1]) > 0 {
+			v := kv[1]
+			ins.Metadata.Items = append(ins.Metadata.Items, &compute.MetadataItems{Key: kv[0], Value: &v})
+		}
+	}
+	return ins
+}
+
+func TestOverviewerProgress(t *testing.T) {
+	now := time.Date(2017, 11, 4, 12, 0, 0, 0, time.UTC)
+	rendering := OverviewerJob{Status: OverviewerJobStatusRendering, UpdatedAt: now.Add(-time.Hour)}
+	uploading := OverviewerJob{Status: OverviewerJobStatusUploading, UpdatedAt: now.Add(-time.Hour)}
+
+	cases := []struct {
+		name    string
+		job     OverviewerJob
+		ins     *compute.Instance
+		want    string
+		wantErr bool
+	}{
+		{"not found", rendering, nil, "", true},
+		{"preempted", rendering, overviewerTestInstance("TERMINATED", "", ""), "", true},
+		{"starting", rendering, overviewerTestInstance("RUNNING", "", ""), OverviewerJobStatusRendering, false},
+		{"rendering", rendering, overviewerTestInstance("RUNNING", "rendering", ""), OverviewerJobStatusRendering, false},
+		{"uploading", rendering, overviewerTestInstance("RUNNING", "uploading", ""), OverviewerJobStatusUploading, false},
+		{"done while rendering", rendering, overviewerTestInstance("RUNNING", "done", ""), OverviewerJobStatusDone, false},
+		{"done", uploading, overviewerTestInstance("RUNNING", "done", ""), OverviewerJobStatusDone, false},
+		{"error", rendering, overviewerTestInstance("RUNNING", "error", "overviewer.py failed"), "", true},
+		{"render timeout", OverviewerJob{Status: OverviewerJobStatusRendering, UpdatedAt: now.Add(-7 * time.Hour)}, overviewerTestInstance("RUNNING", "rendering", ""), "", true},
+		{"upload timeout", OverviewerJob{Status: OverviewerJobStatusUploading, UpdatedAt: now.Add(-3 * time.Hour)}, overviewerTestInstance("RUNNING", "uploading", ""), "", true},
+	}
+	for _, c := range cases {
+		status, err := overviewerProgress(c.job, c.ins, now)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: error = %v", c.name, err)
+			continue
+		}
+		if status != c.want {
+			t.Errorf("%s: status = %s, want %s", c.name, status, c.want)
+		}
+	}
+
+	_, err := overviewerProgress(rendering, overviewerTestInstance("RUNNING", "error", "overviewer.py failed"), now)
+	if err == nil || err.Error() != "render error. overviewer.py failed" {
+		t.Errorf("error = %v", err)
+	}
+}
+
+func TestNewOverviewerRetryJob(t *testing.T) {
+	now := time.Date(2017, 11, 4, 12, 0, 0, 0, time.UTC)
+	failed := OverviewerJob{ID: 10, World: "hoge", Zone: "asia-northeast1-b", Snapshot: "minecraft-world-hoge-20171104-000000", JarVersion: "1.12.2", Attempt: 1, Status: OverviewerJobStatusFailed, Error: "render error."}
+
+	retry, ok := newOverviewerRetryJob(failed, now)
+	if !ok {
+		t.Fatal("first failure must be retried")
+	}
+	if retry.Attempt != 2 || retry.RetryOf != 10 || retry.Snapshot != failed.Snapshot || retry.Status != OverviewerJobStatusCreatingDisk || len(retry.Error) > 0 {
+		t.Errorf("retry = %+v", retry)
+	}
+
+	failed.Attempt = overviewerMaxAttempts
+	if _, ok := newOverviewerRetryJob(failed, now); ok {
+		t.Error("last attempt must not be retried")
+	}
+
+	if d := overviewerRetryBackoff(1); d != 15*time.Minute {
+		t.Errorf("backoff(1) = %s", d)
+	}
+	if d := overviewerRetryBackoff(2); d != 30*time.Minute {
+		t.Errorf("backoff(2) = %s", d)
+	}
+}
+
+func TestOverviewerUploaded(t *testing.T) {
+	started := time.Date(2017, 11, 4, 5, 10, 0, 0, time.UTC)
+	job := OverviewerJob{World: "hoge", InstanceCreatedAt: started}
+
+	if err := overviewerUploaded(job, nil, false); err == nil {
+		t.Error("missing index.html must be error")
+	}
+	if err := overviewerUploaded(job, &gcsObject{Updated: started.Add(-24 * time.Hour)}, true); err == nil {
+		t.Error("index.html of previous render must be error")
+	}
+	if err := overviewerUploaded(job, &gcsObject{Updated: started.Add(2 * time.Hour)}, true); err != nil {
+		t.Errorf("uploaded: %v", err)
+	}
+
+	job.OutputPrefix = "maps/hoge"
+	if err := overviewerUploaded(job, nil, false); err == nil || !strings.Contains(err.Error(), "gs://sinmetalcraft-overviewer/maps/hoge/index.html") {
+		t.Errorf("error = %v", err)
+	}
+}
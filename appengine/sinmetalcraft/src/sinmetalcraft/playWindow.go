@@ -0,0 +1,112 @@
+package sinmetalcraft
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// playWindowLocation is PlayWindowの時間のTime Zone。cron.yamlと同じAsia/Tokyo
+var playWindowLocation = time.FixedZone("Asia/Tokyo", 9*60*60)
+
+// playWindowPattern is "sat,sun 10:00-23:00" のようなPlayWindow
+var playWindowPattern = regexp.MustCompile(`^([a-z,]+) ([0-9]{2}):([0-9]{2})-([0-9]{2}):([0-9]{2})$`)
+
+var playWindowDays = map[string][]time.Weekday{
+	"daily":    {time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekends": {time.Saturday, time.Sunday},
+	"sun":      {time.Sunday},
+	"mon":      {time.Monday},
+	"tue":      {time.Tuesday},
+	"wed":      {time.Wednesday},
+	"thu":      {time.Thursday},
+	"fri":      {time.Friday},
+	"sat":      {time.Saturday},
+}
+
+// playWindow is Playerが遊ぶ時間帯
+// EndがStart以下の場合は、次の日のEndまで続く
+type playWindow struct {
+	Days  map[time.Weekday]bool
+	Start int // 0:00からの分
+	End   int // 0:00からの分。24:00は1440
+}
+
+// parsePlayWindow is "daily 20:00-24:00" や "fri 21:00-02:00" をparseする
+func parsePlayWindow(s string) (playWindow, error) {
+	m := playWindowPattern.FindStringSubmatch(s)
+	if m == nil {
+		return playWindow{}, fmt.Errorf("play window is like \"sat,sun 10:00-23:00\". %q", s)
+	}
+	pw := playWindow{Days: make(map[time.Weekday]bool)}
+	for _, d := range strings.Split(m[1], ",") {
+		days, ok := playWindowDays[d]
+		if !ok {
+			return playWindow{}, fmt.Errorf("unknown day %q. day is daily, weekdays, weekends or sun-sat", d)
+		}
+		for _, wd := range days {
+			pw.Days[wd] = true
+		}
+	}
+	var err error
+	pw.Start, err = playWindowMinutes(m[2], m[3], 23)
+	if err != nil {
+		return playWindow{}, err
+	}
+	pw.End, err = playWindowMinutes(m[4], m[5], 24)
+	if err != nil {
+		return playWindow{}, err
+	}
+	if pw.Start == pw.End {
+		return playWindow{}, fmt.Errorf("play window is empty. %q", s)
+	}
+	return pw, nil
+}
+
+func playWindowMinutes(hour string, minute string, maxHour int) (int, error) {
+	h, _ := strconv.Atoi(hour)
+	m, _ := strconv.Atoi(minute)
+	if h > maxHour || m > 59 || (h == 24 && m > 0) {
+		return 0, fmt.Errorf("invalid time %s:%s", hour, minute)
+	}
+	return h*60 + m, nil
+}
+
+// Contains is tがPlayWindowの中か
+func (pw playWindow) Contains(t time.Time) bool {
+	t = t.In(playWindowLocation)
+	minutes := t.Hour()*60 + t.Minute()
+	if pw.Start < pw.End {
+		return pw.Days[t.Weekday()] && pw.Start <= minutes && minutes < pw.End
+	}
+	// 日を跨ぐ場合は、今日始まった分と昨日始まった分を見る
+	yesterday := t.AddDate(0, 0, -1).Weekday()
+	return (pw.Days[t.Weekday()] && pw.Start <= minutes) || (pw.Days[yesterday] && minutes < pw.End)
+}
+
+// validatePlayWindows is MinecraftのPlayWindowsを確認する
+func validatePlayWindows(windows []string) error {
+	for _, w := range windows {
+		if _, err := parsePlayWindow(w); err != nil {
+			return invalidRequestError(err.Error()).WithDetail("playWindows", windows)
+		}
+	}
+	return nil
+}
+
+// inPlayWindow is tがいずれかのPlayWindowの中か。parseできないものは無視する
+func inPlayWindow(windows []string, t time.Time) bool {
+	for _, w := range windows {
+		pw, err := parsePlayWindow(w)
+		if err != nil {
+			continue
+		}
+		if pw.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package sinmetalcraft
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePlayWindow(t *testing.T) {
+	for _, s := range []string{"daily 20:00-24:00", "sat,sun 10:00-23:00", "weekdays 19:30-23:00", "fri,sat 21:00-02:00"} {
+		if _, err := parsePlayWindow(s); err != nil {
+			t.Errorf("%s should be valid. err = %v", s, err)
+		}
+	}
+	for _, s := range []string{"", "daily", "sunday 10:00-23:00", "daily 10:00-10:00", "daily 24:00-25:00", "daily 10:60-11:00", "daily 9:00-10:00", "Sat 10:00-23:00"} {
+		if _, err := parsePlayWindow(s); err == nil {
+			t.Errorf("%s should be invalid", s)
+		}
+	}
+}
+
+func TestInPlayWindow(t *testing.T) {
+	jst := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, playWindowLocation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	cases := []struct {
+		windows []string
+		t       time.Time
+		want    bool
+	}{
+		// 2017-11-04 is Saturday
+		{[]string{"sat,sun 10:00-23:00"}, jst("2017-11-04 10:00"), true},
+		{[]string{"sat,sun 10:00-23:00"}, jst("2017-11-04 23:00"), false},
+		{[]string{"sat,sun 10:00-23:00"}, jst("2017-11-03 12:00"), false},
+		{[]string{"daily 20:00-24:00"}, jst("2017-11-06 23:59"), true},
+		{[]string{"weekdays 19:00-23:00"}, jst("2017-11-05 20:00"), false},
+		// 金曜の夜から土曜の2:00まで
+		{[]string{"fri 21:00-02:00"}, jst("2017-11-04 01:30"), true},
+		{[]string{"fri 21:00-02:00"}, jst("2017-11-05 01:30"), false},
+		{[]string{"fri 21:00-02:00"}, jst("2017-11-03 22:00"), true},
+		// UTCで渡されてもJSTで判定する
+		{[]string{"sat 10:00-11:00"}, jst("2017-11-04 10:30").UTC(), true},
+		{[]string{"broken", "sat 10:00-11:00"}, jst("2017-11-04 10:30"), true},
+		{nil, jst("2017-11-04 10:30"), false},
+	}
+	for _, c := range cases {
+		if got := inPlayWindow(c.windows, c.t); got != c.want {
+			t.Errorf("inPlayWindow(%v, %s) = %v, want %v", c.windows, c.t, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,523 @@
+package sinmetalcraft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/appengine/datastore"
+
+	"golang.org/x/net/context"
+)
+
+func init() {
+	api := WorldPluginApi{}
+
+	apiRouter.Handle("GET", "/api/1/minecraft/{world}/plugins", api.List, requireAdmin)
+	apiRouter.Handle("POST", "/api/1/minecraft/{world}/plugins", api.Post, requireAdmin, audit(AuditActionPluginCreate))
+	apiRouter.Handle("PUT", "/api/1/minecraft/{world}/plugins/{name}", api.Put, requireAdmin, audit(AuditActionPluginUpdate))
+	apiRouter.Handle("DELETE", "/api/1/minecraft/{world}/plugins/{name}", api.Delete, requireAdmin, audit(AuditActionPluginDelete))
+}
+
+// WorldPluginBucket is UploadされたPlugin, ModのJarを置くBucket
+const WorldPluginBucket = "sinmetalcraft-minecraft-plugin"
+
+// pluginsMetadataKey is Startup ScriptにInstallするPlugin, Modを渡すInstanceのMetadata
+const pluginsMetadataKey = "server-plugins"
+
+const worldPluginUploadExpiration = 1 * time.Hour
+
+// WorldPlugin Source
+const (
+	WorldPluginSourceURL    = "url"
+	WorldPluginSourceUpload = "upload"
+)
+
+var (
+	worldPluginNamePattern    = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,63}$`)
+	worldPluginVersionPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.+-]{0,63}$`)
+	worldPluginSHA256Pattern  = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// WorldPlugin is WorldのServerに入れるPlugin (paper) かMod (fabric, forge)
+// Keyは "{world}/{name}"。Startup Scriptが起動する度にSHA256を確認しながらInstallする
+type WorldPlugin struct {
+	Key              *datastore.Key `json:"-" datastore:"-"`
+	World            string         `json:"world"`
+	Name             string         `json:"name" datastore:",noindex"`
+	Version          string         `json:"version" datastore:",noindex"`
+	MinecraftVersion string         `json:"minecraftVersion" datastore:",noindex"` // Pluginが対応しているMinecraftのVersion。空の場合は確認しない
+	Source           string         `json:"source" datastore:",noindex"`           // url or upload
+	URL              string         `json:"url" datastore:",noindex"`              // https:// か、uploadの場合はWorldPluginBucketの gs://
+	SHA256           string         `json:"sha256" datastore:",noindex"`
+	Enabled          bool           `json:"enabled" datastore:",noindex"` // falseの場合は消さずに、Installだけしない
+	Warnings         []string       `json:"warnings" datastore:"-"`
+	CreatedAt        time.Time      `json:"createdAt" datastore:",noindex"`
+	UpdatedAt        time.Time      `json:"updatedAt" datastore:",noindex"`
+}
+
+// FileName is Serverのplugins, modsに置くJarの名前
+func (wp *WorldPlugin) FileName() string {
+	return fmt.Sprintf("%s-%s.jar", wp.Name, wp.Version)
+}
+
+// Object is uploadの場合のWorldPluginBucketのObject Name
+func (wp *WorldPlugin) Object() string {
+	return fmt.Sprintf("%s/%s", wp.World, wp.FileName())
+}
+
+// Clone is Cloneした新しいWorldのPluginを返す
+// uploadのPluginもURLはClone元のObjectのままなので、Jarはコピーしない
+func (wp *WorldPlugin) Clone(world string) WorldPlugin {
+	now := time.Now()
+	return WorldPlugin{
+		World:            world,
+		Name:             wp.Name,
+		Version:          wp.Version,
+		MinecraftVersion: wp.MinecraftVersion,
+		Source:           wp.Source,
+		URL:              wp.URL,
+		SHA256:           wp.SHA256,
+		Enabled:          wp.Enabled,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+}
+
+// worldPluginKey is WorldPluginのKey
+func worldPluginKey(ctx context.Context, world string, name string) *datastore.Key {
+	return datastore.NewKey(ctx, "WorldPlugin", world+"/"+name, 0, nil)
+}
+
+// validate is WorldPluginの値を確認する。URLはsourceがurlの場合だけ確認する
+func (wp *WorldPlugin) validate() error {
+	if !worldPluginNamePattern.MatchString(wp.Name) {
+		return invalidRequestError("invalid plugin name.").WithDetail("name", wp.Name)
+	}
+	if !worldPluginVersionPattern.MatchString(wp.Version) {
+		return invalidRequestError("invalid plugin version.").WithDetail("version", wp.Version)
+	}
+	if len(wp.MinecraftVersion) > 0 && !worldPluginVersionPattern.MatchString(wp.MinecraftVersion) {
+		return invalidRequestError("invalid minecraftVersion.").WithDetail("minecraftVersion", wp.MinecraftVersion)
+	}
+	if !worldPluginSHA256Pattern.MatchString(wp.SHA256) {
+		return invalidRequestError("sha256 is 64 lowercase hex characters.").WithDetail("sha256", wp.SHA256)
+	}
+	if wp.Source == WorldPluginSourceURL && (!strings.HasPrefix(wp.URL, "https://") || strings.ContainsAny(wp.URL, " \t\r\n")) {
+		return invalidRequestError("url must be https.").WithDetail("url", wp.URL)
+	}
+	return nil
+}
+
+// pluginWarnings is Pluginを入れても動かなそうな場合の警告
+func pluginWarnings(minecraft Minecraft, wp WorldPlugin) []string {
+	warnings := make([]string, 0)
+	if serverTypeOf(minecraft) == ServerTypeVanilla {
+		warnings = append(warnings, "vanilla server does not load plugins or mods.")
+	}
+	if len(wp.MinecraftVersion) > 0 && !minecraftVersionMatch(wp.MinecraftVersion, minecraft.JarVersion) {
+		warnings = append(warnings, fmt.Sprintf("%s is for minecraft %s, but %s is %s.", wp.Name, wp.MinecraftVersion, minecraft.World, minecraft.JarVersion))
+	}
+	return warnings
+}
+
+// minecraftVersionMatch is Pluginが対応しているVersionにjarVersionが含まれるか
+// "1.12" と "1.12.x" は1.12の全てのPatchに対応しているとみなす
+func minecraftVersionMatch(declared string, jarVersion string) bool {
+	if declared == jarVersion {
+		return true
+	}
+	family := strings.TrimSuffix(declared, ".x")
+	if family == jarVersion {
+		return true
+	}
+	return releaseVersionPattern.MatchString(family) && strings.Count(family, ".") == 1 && strings.HasPrefix(jarVersion, family+".")
+}
+
+// pluginDir is Startup ScriptがPluginを置くDirectory。vanillaの場合は空
+func pluginDir(minecraft Minecraft) string {
+	switch serverTypeOf(minecraft) {
+	case ServerTypePaper:
+		return "plugins"
+	case ServerTypeFabric, ServerTypeForge:
+		return "mods"
+	}
+	return ""
+}
+
+// listWorldPlugins is WorldのPluginをName順に返す
+func listWorldPlugins(ctx context.Context, world string) ([]*WorldPlugin, error) {
+	var l []*WorldPlugin
+	keys, err := datastore.NewQuery("WorldPlugin").Filter("World =", world).GetAll(ctx, &l)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		l[i].Key = key
+	}
+	sort.Sort(worldPluginsByName(l))
+	return l, nil
+}
+
+type worldPluginsByName []*WorldPlugin
+
+func (l worldPluginsByName) Len() int           { return len(l) }
+func (l worldPluginsByName) Less(i, j int) bool { return l[i].Name < l[j].Name }
+func (l worldPluginsByName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// renderPlugins is Startup Scriptに渡す "FILE SHA256 URL" の行
+// 無効なPluginは含めないので、Startup Scriptが前回Installしたものを消す
+func renderPlugins(plugins []*WorldPlugin) string {
+	var b bytes.Buffer
+	for _, p := range plugins {
+		if !p.Enabled {
+			continue
+		}
+		fmt.Fprintf(&b, "%s %s %s\n", p.FileName(), p.SHA256, p.URL)
+	}
+	return b.String()
+}
+
+// mergeWorldPlugin is Queryの結果に、まだQueryに出てこないかもしれない変更を反映する
+// wpがnilの場合はnameのPluginを消す
+func mergeWorldPlugin(plugins []*WorldPlugin, name string, wp *WorldPlugin) []*WorldPlugin {
+	l := make([]*WorldPlugin, 0, len(plugins)+1)
+	for _, p := range plugins {
+		if p.Name != name {
+			l = append(l, p)
+		}
+	}
+	if wp != nil {
+		l = append(l, wp)
+	}
+	sort.Sort(worldPluginsByName(l))
+	return l
+}
+
+// pluginMetadata is Instanceに設定するPluginのMetadata
+func pluginMetadata(ctx context.Context, minecraft Minecraft) (map[string]string, error) {
+	plugins, err := listWorldPlugins(ctx, minecraft.World)
+	if err != nil {
+		return nil, err
+	}
+	return renderPluginMetadata(minecraft, plugins), nil
+}
+
+func renderPluginMetadata(minecraft Minecraft, plugins []*WorldPlugin) map[string]string {
+	return map[string]string{
+		pluginsMetadataKey:  renderPlugins(plugins),
+		"server-plugin-dir": pluginDir(minecraft),
+	}
+}
+
+// updatePluginMetadata is Instanceがある場合はMetadataを書き換えて、次に起動した時にInstallされるようにする
+// nameのPluginはwpに置き換える。書き換えた場合はtrueを返す
+func updatePluginMetadata(ctx context.Context, minecraft Minecraft, name string, wp *WorldPlugin) (bool, error) {
+	if minecraft.Status != "exists" && minecraft.Status != "stopping" {
+		return false, nil
+	}
+	plugins, err := listWorldPlugins(ctx, minecraft.World)
+	if err != nil {
+		return false, err
+	}
+	md := renderPluginMetadata(minecraft, mergeWorldPlugin(plugins, name, wp))
+	s, err := newComputeService(ctx)
+	if err != nil {
+		return false, err
+	}
+	_, err = setInstanceMetadataItems(ctx, compute.NewInstancesService(s), minecraft, md)
+	if isNotFoundError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// WorldPluginApi is WorldのPlugin, Modを管理するAPI
+type WorldPluginApi struct{}
+
+// WorldPluginApiPostParam is POST /api/1/minecraft/{world}/plugins のRequest Body
+// urlを省略した場合はuploadになり、ResponseのuploadUrlにJarをPUTする
+type WorldPluginApiPostParam struct {
+	Name             string `json:"name"`
+	Version          string `json:"version"`
+	MinecraftVersion string `json:"minecraftVersion"`
+	URL              string `json:"url"`
+	SHA256           string `json:"sha256"`
+	Enabled          *bool  `json:"enabled"` // 省略した場合はtrue
+}
+
+// WorldPluginApiPutParam is PUT /api/1/minecraft/{world}/plugins/{name} のRequest Body
+// 省略したFieldは変えない。VersionかSHA256を変える場合はurlを、uploadの場合は空で送ってUploadし直す
+type WorldPluginApiPutParam struct {
+	Version          *string `json:"version"`
+	MinecraftVersion *string `json:"minecraftVersion"`
+	URL              *string `json:"url"`
+	SHA256           *string `json:"sha256"`
+	Enabled          *bool   `json:"enabled"`
+}
+
+// WorldPluginListResponse is GET /api/1/minecraft/{world}/plugins のResponse
+type WorldPluginListResponse struct {
+	Items []*WorldPlugin `json:"items"`
+}
+
+// WorldPluginApiResponse is POST, PUTのResponse
+// uploadの場合はuploadUrlにContent-Typeを付けてJarをPUTする
+type WorldPluginApiResponse struct {
+	Plugin          WorldPlugin `json:"plugin"`
+	UploadURL       string      `json:"uploadUrl,omitempty"`
+	ContentType     string      `json:"contentType,omitempty"`
+	ExpiresAt       *time.Time  `json:"expiresAt,omitempty"`
+	RestartRequired bool        `json:"restartRequired"` // Instanceがあるので、次に起動した時に反映される
+}
+
+// list plugins
+func (a *WorldPluginApi) List(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	mkey, err := minecraftKey(ctx, p, "")
+	if err != nil {
+		return err
+	}
+	minecraft, err := getMinecraft(ctx, mkey)
+	if err != nil {
+		return err
+	}
+	plugins, err := listWorldPlugins(ctx, minecraft.World)
+	if err != nil {
+		return internalError(err)
+	}
+
+	res := WorldPluginListResponse{
+		Items: make([]*WorldPlugin, 0, len(plugins)),
+	}
+	for _, wp := range plugins {
+		wp.Warnings = pluginWarnings(minecraft, *wp)
+		res.Items = append(res.Items, wp)
+	}
+
+	writeJSON(w, http.StatusOK, res)
+	return nil
+}
+
+// add plugin
+func (a *WorldPluginApi) Post(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	var param WorldPluginApiPostParam
+	err := json.NewDecoder(r.Body).Decode(&param)
+	if err != nil {
+		return invalidRequestError("invalid request.").WithDetail("cause", err.Error())
+	}
+	defer r.Body.Close()
+
+	mkey, err := minecraftKey(ctx, p, "")
+	if err != nil {
+		return err
+	}
+	ev := auditEventFromContext(ctx)
+	ev.Target = mkey.StringID()
+	minecraft, err := getMinecraft(ctx, mkey)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	entity := WorldPlugin{
+		World:            minecraft.World,
+		Name:             param.Name,
+		Version:          param.Version,
+		MinecraftVersion: param.MinecraftVersion,
+		Source:           WorldPluginSourceURL,
+		URL:              param.URL,
+		SHA256:           param.SHA256,
+		Enabled:          param.Enabled == nil || *param.Enabled,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+	if len(param.URL) < 1 {
+		entity.Source = WorldPluginSourceUpload
+		entity.URL = fmt.Sprintf("gs://%s/%s", WorldPluginBucket, entity.Object())
+	}
+	if err := entity.validate(); err != nil {
+		return err
+	}
+
+	key := worldPluginKey(ctx, minecraft.World, entity.Name)
+	err = datastore.RunInTransaction(ctx, func(c context.Context) error {
+		var current WorldPlugin
+		err := datastore.Get(c, key, &current)
+		if err == nil {
+			return conflictError(fmt.Sprintf("%s already has %s.", minecraft.World, entity.Name)).WithDetail("name", entity.Name)
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err = datastore.Put(c, key, &entity)
+		return err
+	}, nil)
+	if ae, ok := err.(*APIError); ok {
+		return ae
+	}
+	if err != nil {
+		return internalError(err)
+	}
+	entity.Key = key
+	ev.SetDiff(nil, entity)
+
+	res, err := a.response(ctx, minecraft, entity)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusCreated, res)
+	return nil
+}
+
+// update plugin. enabledだけ変えると、消さずに無効にできる
+func (a *WorldPluginApi) Put(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	var param WorldPluginApiPutParam
+	err := json.NewDecoder(r.Body).Decode(&param)
+	if err != nil {
+		return invalidRequestError("invalid request.").WithDetail("cause", err.Error())
+	}
+	defer r.Body.Close()
+
+	mkey, err := minecraftKey(ctx, p, "")
+	if err != nil {
+		return err
+	}
+	ev := auditEventFromContext(ctx)
+	ev.Target = mkey.StringID()
+	minecraft, err := getMinecraft(ctx, mkey)
+	if err != nil {
+		return err
+	}
+
+	key := worldPluginKey(ctx, minecraft.World, p["name"])
+	var before, after WorldPlugin
+	err = datastore.RunInTransaction(ctx, func(c context.Context) error {
+		var entity WorldPlugin
+		err := datastore.Get(c, key, &entity)
+		if err == datastore.ErrNoSuchEntity {
+			return notFoundError(fmt.Sprintf("%s plugin %s is not found.", minecraft.World, p["name"]))
+		}
+		if err != nil {
+			return err
+		}
+		before = entity
+
+		if param.Version != nil {
+			entity.Version = *param.Version
+		}
+		if param.MinecraftVersion != nil {
+			entity.MinecraftVersion = *param.MinecraftVersion
+		}
+		if param.SHA256 != nil {
+			entity.SHA256 = *param.SHA256
+		}
+		if param.Enabled != nil {
+			entity.Enabled = *param.Enabled
+		}
+		if param.URL != nil {
+			entity.Source = WorldPluginSourceURL
+			entity.URL = *param.URL
+			if len(entity.URL) < 1 {
+				entity.Source = WorldPluginSourceUpload
+			}
+		}
+		if entity.Source == WorldPluginSourceUpload {
+			entity.URL = fmt.Sprintf("gs://%s/%s", WorldPluginBucket, entity.Object())
+		}
+		if err := entity.validate(); err != nil {
+			return err
+		}
+		entity.UpdatedAt = time.Now()
+		_, err = datastore.Put(c, key, &entity)
+		if err != nil {
+			return err
+		}
+		after = entity
+		return nil
+	}, nil)
+	if ae, ok := err.(*APIError); ok {
+		return ae
+	}
+	if err != nil {
+		return internalError(err)
+	}
+	after.Key = key
+	ev.SetDiff(before, after)
+
+	res, err := a.response(ctx, minecraft, after)
+	if err != nil {
+		return err
+	}
+	// 中身が変わらないUploadは、もう一度UploadしなくてもJarが残っている
+	if after.Source == WorldPluginSourceUpload && before.Source == WorldPluginSourceUpload && after.URL == before.URL && after.SHA256 == before.SHA256 {
+		res.UploadURL, res.ContentType, res.ExpiresAt = "", "", nil
+	}
+	writeJSON(w, http.StatusOK, res)
+	return nil
+}
+
+// delete plugin
+func (a *WorldPluginApi) Delete(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	mkey, err := minecraftKey(ctx, p, "")
+	if err != nil {
+		return err
+	}
+	ev := auditEventFromContext(ctx)
+	ev.Target = mkey.StringID()
+	minecraft, err := getMinecraft(ctx, mkey)
+	if err != nil {
+		return err
+	}
+
+	key := worldPluginKey(ctx, minecraft.World, p["name"])
+	var entity WorldPlugin
+	err = datastore.Get(ctx, key, &entity)
+	if err == datastore.ErrNoSuchEntity {
+		return notFoundError(fmt.Sprintf("%s plugin %s is not found.", minecraft.World, p["name"]))
+	}
+	if err != nil {
+		return internalError(err)
+	}
+	if err := datastore.Delete(ctx, key); err != nil {
+		return internalError(err)
+	}
+	ev.SetDiff(entity, nil)
+
+	restart, err := updatePluginMetadata(ctx, minecraft, entity.Name, nil)
+	if err != nil {
+		return internalError(err)
+	}
+
+	writeJSON(w, http.StatusOK, WorldPluginApiResponse{Plugin: entity, RestartRequired: restart})
+	return nil
+}
+
+// response is Instanceを更新して、uploadの場合はSigned URLを付ける
+func (a *WorldPluginApi) response(ctx context.Context, minecraft Minecraft, entity WorldPlugin) (WorldPluginApiResponse, error) {
+	entity.Warnings = pluginWarnings(minecraft, entity)
+	res := WorldPluginApiResponse{Plugin: entity}
+
+	restart, err := updatePluginMetadata(ctx, minecraft, entity.Name, &entity)
+	if err != nil {
+		return res, internalError(err)
+	}
+	res.RestartRequired = restart
+
+	if entity.Source == WorldPluginSourceUpload {
+		expiresAt := time.Now().Add(worldPluginUploadExpiration)
+		u, err := appEngineSignedURL(ctx, "PUT", WorldPluginBucket, entity.Object(), "application/java-archive", expiresAt)
+		if err != nil {
+			return res, internalError(err)
+		}
+		res.UploadURL = u
+		res.ContentType = "application/java-archive"
+		res.ExpiresAt = &expiresAt
+	}
+	return res, nil
+}
@@ -0,0 +1,104 @@
+package sinmetalcraft
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWorldPluginValidate(t *testing.T) {
+	sha := strings.Repeat("a", 64)
+	cases := []struct {
+		name   string
+		plugin WorldPlugin
+		ok     bool
+	}{
+		{"url", WorldPlugin{Name: "WorldEdit", Version: "6.1.9", Source: WorldPluginSourceURL, URL: "https://example.com/worldedit.jar", SHA256: sha}, true},
+		{"upload", WorldPlugin{Name: "jei", Version: "1.12.2-4.16.1", Source: WorldPluginSourceUpload, URL: "gs://sinmetalcraft-minecraft-plugin/hoge/jei.jar", SHA256: sha}, true},
+		{"http", WorldPlugin{Name: "WorldEdit", Version: "6.1.9", Source: WorldPluginSourceURL, URL: "http://example.com/worldedit.jar", SHA256: sha}, false},
+		{"name", WorldPlugin{Name: "../WorldEdit", Version: "6.1.9", Source: WorldPluginSourceURL, URL: "https://example.com/worldedit.jar", SHA256: sha}, false},
+		{"version", WorldPlugin{Name: "WorldEdit", Version: "", Source: WorldPluginSourceURL, URL: "https://example.com/worldedit.jar", SHA256: sha}, false},
+		{"sha256", WorldPlugin{Name: "WorldEdit", Version: "6.1.9", Source: WorldPluginSourceURL, URL: "https://example.com/worldedit.jar", SHA256: "abc"}, false},
+	}
+	for _, c := range cases {
+		err := c.plugin.validate()
+		if c.ok && err != nil {
+			t.Errorf("%s err = %v", c.name, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("%s should be error", c.name)
+		}
+	}
+}
+
+func TestMinecraftVersionMatch(t *testing.T) {
+	cases := []struct {
+		declared   string
+		jarVersion string
+		want       bool
+	}{
+		{"1.12.2", "1.12.2", true},
+		{"1.12.1", "1.12.2", false},
+		{"1.12", "1.12.2", true},
+		{"1.12.x", "1.12", true},
+		{"1.12", "1.13", false},
+		{"1.1", "1.12.2", false},
+		{"17w45a", "17w45a", true},
+	}
+	for _, c := range cases {
+		if got := minecraftVersionMatch(c.declared, c.jarVersion); got != c.want {
+			t.Errorf("minecraftVersionMatch(%q, %q) = %v, want %v", c.declared, c.jarVersion, got, c.want)
+		}
+	}
+}
+
+func TestPluginWarnings(t *testing.T) {
+	wp := WorldPlugin{Name: "jei", MinecraftVersion: "1.12.2"}
+	if w := pluginWarnings(Minecraft{World: "hoge", JarVersion: "1.12.2", ServerType: ServerTypeForge}, wp); len(w) != 0 {
+		t.Errorf("forge 1.12.2 warnings = %v", w)
+	}
+	if w := pluginWarnings(Minecraft{World: "hoge", JarVersion: "1.13", ServerType: ServerTypeForge}, wp); len(w) != 1 {
+		t.Errorf("forge 1.13 warnings = %v", w)
+	}
+	if w := pluginWarnings(Minecraft{World: "hoge", JarVersion: "1.13"}, wp); len(w) != 2 {
+		t.Errorf("vanilla 1.13 warnings = %v", w)
+	}
+}
+
+func TestRenderPlugins(t *testing.T) {
+	sha := strings.Repeat("a", 64)
+	plugins := []*WorldPlugin{
+		{Name: "b", Version: "1", URL: "https://example.com/b.jar", SHA256: sha, Enabled: true},
+		{Name: "c", Version: "1", URL: "https://example.com/c.jar", SHA256: sha, Enabled: false},
+	}
+	// aの追加とbの削除がQueryにまだ出てこない場合
+	plugins = mergeWorldPlugin(plugins, "a", &WorldPlugin{Name: "a", Version: "2.0", URL: "gs://sinmetalcraft-minecraft-plugin/hoge/a-2.0.jar", SHA256: sha, Enabled: true})
+	got := renderPlugins(plugins)
+	want := "a-2.0.jar " + sha + " gs://sinmetalcraft-minecraft-plugin/hoge/a-2.0.jar\n" +
+		"b-1.jar " + sha + " https://example.com/b.jar\n"
+	if got != want {
+		t.Errorf("renderPlugins = %q, want %q", got, want)
+	}
+	if got := renderPlugins(mergeWorldPlugin(plugins, "b", nil)); strings.Contains(got, "b-1.jar") {
+		t.Errorf("deleted plugin is rendered. %q", got)
+	}
+
+	md := renderPluginMetadata(Minecraft{ServerType: ServerTypePaper}, plugins)
+	if md["server-plugin-dir"] != "plugins" || md[pluginsMetadataKey] != want {
+		t.Errorf("metadata = %v", md)
+	}
+	if md := renderPluginMetadata(Minecraft{}, plugins); md["server-plugin-dir"] != "" {
+		t.Errorf("vanilla plugin dir = %q", md["server-plugin-dir"])
+	}
+}
+
+func TestWorldPluginClone(t *testing.T) {
+	src := WorldPlugin{World: "hoge", Name: "jei", Version: "1.12.2-4.16.1", Source: WorldPluginSourceUpload, URL: "gs://sinmetalcraft-minecraft-plugin/hoge/jei-1.12.2-4.16.1.jar", SHA256: strings.Repeat("a", 64), Enabled: true}
+	c := src.Clone("hoge-test")
+	if c.World != "hoge-test" || c.Name != src.Name || c.Version != src.Version || c.Enabled != true {
+		t.Errorf("Clone = %+v", c)
+	}
+	// uploadのJarはClone元のObjectを参照する
+	if c.URL != src.URL || c.SHA256 != src.SHA256 {
+		t.Errorf("URL = %s, want %s", c.URL, src.URL)
+	}
+}
@@ -0,0 +1,353 @@
+package sinmetalcraft
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"google.golang.org/api/compute/v1"
+
+	"golang.org/x/net/context"
+)
+
+func init() {
+	api := PreemptionApi{}
+
+	http.HandleFunc("/cron/1/minecraft/preemption", api.Cron)
+	apiRouter.Handle("GET", "/api/1/minecraft/{world}/preemptions", api.List, requireAdmin)
+}
+
+// preemptionOperationFilter is GCEがPreemptした時に作られるZone Operation
+const preemptionOperationFilter = "operationType eq compute.instances.preempted"
+
+// preemptionLogMessage is Shutdown ScriptがPreemptされた時にPlayerに送るメッセージ
+// Cloud LoggingからPub/Subで届くので、Cronを待たずにPreemptを見つけるのに使う
+const preemptionLogMessage = "this server is being preempted by GCE"
+
+// preemptionRestartTimeout is PreemptされたInstanceがTERMINATEDになるのを待つ時間
+// 過ぎた場合は再起動を諦める
+const preemptionRestartTimeout = 10 * time.Minute
+
+// Preemption Status
+const (
+	PreemptionStatusRecorded   = "recorded"   // PlayWindowの外なので、再起動しない
+	PreemptionStatusRestarting = "restarting" // TERMINATEDになるのを待って再起動する
+	PreemptionStatusRestarted  = "restarted"
+	PreemptionStatusSkipped    = "skipped" // Overviewerか、再起動できる状態にならなかったか、PlayWindowが終わった
+	PreemptionStatusFailed     = "failed"
+)
+
+// Preemption is GCEにPreemptされたInstanceの記録
+// KeyはPreemptのZone Operation Nameなので、CronとLogの両方で見つけても1つになる
+type Preemption struct {
+	Key          *datastore.Key `json:"-" datastore:"-"`
+	OperationID  string         `json:"operationID" datastore:"-"`
+	World        string         `json:"world"`
+	Instance     string         `json:"instance" datastore:",noindex"`
+	InstanceID   string         `json:"instanceID" datastore:",noindex"`
+	Zone         string         `json:"zone" datastore:",noindex"`
+	PreemptedAt  time.Time      `json:"preemptedAt"`
+	InPlayWindow bool           `json:"inPlayWindow" datastore:",noindex"` // PreemptされたのがPlayWindowの中か
+	Status       string         `json:"status" datastore:",noindex"`
+	Error        string         `json:"error" datastore:",noindex"`
+	CreatedAt    time.Time      `json:"createdAt"`
+	UpdatedAt    time.Time      `json:"updatedAt"`
+}
+
+// PreemptionListResponse is GET /api/1/minecraft/{world}/preemptions のResponse
+type PreemptionListResponse struct {
+	Items []*Preemption `json:"items"`
+}
+
+// Message is Slackに送るPreemptionの状態
+func (p *Preemption) Message() string {
+	var m string
+	switch p.Status {
+	case PreemptionStatusRecorded:
+		m = fmt.Sprintf("%s was preempted by GCE. outside play window, not restarting.", p.Instance)
+	case PreemptionStatusRestarting:
+		m = fmt.Sprintf("%s was preempted by GCE. restarting from world disk.", p.Instance)
+	case PreemptionStatusRestarted:
+		m = fmt.Sprintf("%s restarted after preemption.", p.Instance)
+	case PreemptionStatusSkipped:
+		m = fmt.Sprintf("%s was preempted by GCE. not restarting. %s", p.Instance, p.Error)
+	case PreemptionStatusFailed:
+		m = fmt.Sprintf("%s restart after preemption failed. cause = %s", p.Instance, p.Error)
+	default:
+		m = p.Status
+	}
+	return fmt.Sprintf("[%s] %s", p.World, m)
+}
+
+// preemptedInstance is Preempt OperationのTargetLinkからInstance NameとWorld Nameを返す
+// Minecraft ServerでもOverviewerでも無い場合はokがfalse
+func preemptedInstance(ope *compute.Operation) (instance string, world string, overviewer bool, ok bool) {
+	instance = path.Base(ope.TargetLink)
+	switch {
+	case strings.HasPrefix(instance, INSTANCE_NAME+"-"):
+		return instance, instance[len(INSTANCE_NAME+"-"):], false, true
+	case strings.HasPrefix(instance, OverviewerInstanceName+"-"):
+		return instance, instance[len(OverviewerInstanceName+"-"):], true, true
+	}
+	return instance, "", false, false
+}
+
+// newPreemption is Preempt OperationとWorldからPreemptionを作る
+// PlayWindowの中でPreemptされたMinecraft Serverだけを再起動する
+func newPreemption(ope *compute.Operation, minecraft Minecraft, overviewer bool, now time.Time) Preemption {
+	instance, world, _, _ := preemptedInstance(ope)
+	p := Preemption{
+		OperationID: ope.Name,
+		World:       world,
+		Instance:    instance,
+		InstanceID:  fmt.Sprint(ope.TargetId),
+		Zone:        path.Base(ope.Zone),
+		PreemptedAt: now,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if t, err := time.Parse(time.RFC3339, ope.InsertTime); err == nil {
+		p.PreemptedAt = t
+	}
+	p.InPlayWindow = inPlayWindow(minecraft.PlayWindows, p.PreemptedAt)
+
+	switch {
+	case overviewer:
+		// OverviewerはOverviewerJobが失敗にして試し直すので、ここでは再起動しない
+		p.Status = PreemptionStatusSkipped
+		p.Error = "overviewer is not restarted."
+	case minecraft.Status != "exists":
+		p.Status = PreemptionStatusSkipped
+		p.Error = fmt.Sprintf("world status is %s.", minecraft.Status)
+	case p.InPlayWindow:
+		p.Status = PreemptionStatusRestarting
+	default:
+		p.Status = PreemptionStatusRecorded
+	}
+	return p
+}
+
+// latestPreemption is WorldのPreemptionの中で一番新しいものを返す。無い場合はnil
+func latestPreemption(ctx context.Context, world string) (*Preemption, error) {
+	var l []*Preemption
+	_, err := datastore.NewQuery("Preemption").Filter("World =", world).Order("-PreemptedAt").Limit(1).GetAll(ctx, &l)
+	if err != nil {
+		return nil, err
+	}
+	if len(l) < 1 {
+		return nil, nil
+	}
+	return l[0], nil
+}
+
+// preemptionRestartPending is PreemptionTQがこれから再起動するPreemptionか
+func preemptionRestartPending(p *Preemption) bool {
+	return p != nil && p.Status == PreemptionStatusRestarting
+}
+
+// preemptionOperationRecent is Preempt OperationがpreemptionRestartTimeoutより新しいか
+// Zone Operationの履歴には古いPreemptも残っているので、初めてDeployした時やCronが止まっていた後に
+// PlayWindowの外でWorldを起動しないように、古いものは記録しない
+func preemptionOperationRecent(ope *compute.Operation, now time.Time) bool {
+	t, err := time.Parse(time.RFC3339, ope.InsertTime)
+	if err != nil {
+		return false
+	}
+	return now.Sub(t) <= preemptionRestartTimeout
+}
+
+// checkPreemptions is ZoneのPreempt Operationを全Page見て、まだ記録していない新しいものを記録する
+func checkPreemptions(ctx context.Context, r *http.Request, s *compute.Service, zone string) error {
+	now := time.Now()
+	call := compute.NewZoneOperationsService(s).List(PROJECT_NAME, zone).Filter(preemptionOperationFilter)
+	for {
+		ol, err := call.Do()
+		if err != nil {
+			return err
+		}
+		for _, ope := range ol.Items {
+			if !preemptionOperationRecent(ope, now) {
+				continue
+			}
+			if err := recordPreemption(ctx, r, ope); err != nil {
+				return err
+			}
+		}
+		if len(ol.NextPageToken) < 1 {
+			return nil
+		}
+		call = call.PageToken(ol.NextPageToken)
+	}
+}
+
+// recordPreemption is Preemptを記録して、Slackに知らせる
+// PlayWindowの中の場合は再起動するTQを登録する。既に記録している場合は何もしない
+func recordPreemption(ctx context.Context, r *http.Request, ope *compute.Operation) error {
+	_, world, overviewer, ok := preemptedInstance(ope)
+	if !ok {
+		log.Infof(ctx, "%s is not minecraft instance.", ope.TargetLink)
+		return nil
+	}
+	var minecraft Minecraft
+	err := datastore.Get(ctx, datastore.NewKey(ctx, "Minecraft", world, 0, nil), &minecraft)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	if err == datastore.ErrNoSuchEntity {
+		minecraft.Status = "not_exists"
+	}
+
+	key := datastore.NewKey(ctx, "Preemption", ope.Name, 0, nil)
+	p := newPreemption(ope, minecraft, overviewer, time.Now())
+	var created bool
+	err = datastore.RunInTransaction(ctx, func(c context.Context) error {
+		created = false
+		var current Preemption
+		err := datastore.Get(c, key, &current)
+		if err == nil {
+			return nil
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err = datastore.Put(c, key, &p)
+		if err != nil {
+			return err
+		}
+		created = true
+		if p.Status != PreemptionStatusRestarting {
+			return nil
+		}
+		tq := PreemptionTQApi{}
+		_, err = tq.CallRestart(c, key, 30*time.Second)
+		return err
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if !created {
+		return nil
+	}
+	log.Infof(ctx, "preemption recorded. instance = %s, status = %s", p.Instance, p.Status)
+
+	ev := newAuditEvent(ctx, r, AuditActionServerPreempted)
+	ev.Target = world
+	ev.SetDiff(nil, p)
+	ev.Record(ctx, nil)
+
+	notifyPreemption(ctx, p)
+	return nil
+}
+
+// watchPreemptionLog is Shutdown ScriptのPreemptのログを見つけたら、そのWorldのZoneのPreemptを確認する
+func watchPreemptionLog(ctx context.Context, r *http.Request, psd PubSubData) error {
+	if !strings.Contains(psd.StructPayload.Log, preemptionLogMessage) {
+		return nil
+	}
+	id, ok := logResourceID(psd.Metadata.Labels)
+	if !ok {
+		return nil
+	}
+
+	var minecrafts []Minecraft
+	_, err := datastore.NewQuery("Minecraft").Filter("ResourceID =", id).Limit(1).GetAll(ctx, &minecrafts)
+	if err != nil {
+		return err
+	}
+	if len(minecrafts) < 1 {
+		log.Infof(ctx, "minecraft is not found. resourceID = %d", id)
+		return nil
+	}
+
+	s, err := newComputeService(ctx)
+	if err != nil {
+		return err
+	}
+	return checkPreemptions(ctx, r, s, minecrafts[0].Zone)
+}
+
+// notifyPreemption is Preemptionの状態をSlackに送る
+// Slackに送れなくても再起動は止めない
+func notifyPreemption(ctx context.Context, p Preemption) {
+	color := "#daa038"
+	switch p.Status {
+	case PreemptionStatusRestarted:
+		color = "#36a64f"
+	case PreemptionStatusFailed:
+		color = "#d00000"
+	}
+
+	notifySlack(ctx, p.Message(), color)
+}
+
+// PreemptionApi is GCEのPreemptを見つけて記録するAPI
+type PreemptionApi struct{}
+
+// /cron/1/minecraft/preemption handler
+// 起動しているWorldのZoneのPreempt Operationを確認する
+func (a *PreemptionApi) Cron(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	var minecrafts []Minecraft
+	_, err := datastore.NewQuery("Minecraft").Filter("Status =", "exists").GetAll(ctx, &minecrafts)
+	if err != nil {
+		log.Errorf(ctx, "ERROR Minecraft Query: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	zones := make(map[string]bool)
+	for _, m := range minecrafts {
+		if len(m.Zone) > 0 {
+			zones[m.Zone] = true
+		}
+	}
+
+	s, err := newComputeService(ctx)
+	if err != nil {
+		log.Errorf(ctx, "ERROR compute.New: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var hasError bool
+	for zone := range zones {
+		if err := checkPreemptions(ctx, r, s, zone); err != nil {
+			hasError = true
+			log.Errorf(ctx, "ERROR check preemptions. zone = %s, error = %v", zone, err)
+		}
+	}
+
+	if hasError {
+		w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// list preemptions of world
+func (a *PreemptionApi) List(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	limit, err := parseLimit(r, 20, 100)
+	if err != nil {
+		return err
+	}
+
+	res := PreemptionListResponse{
+		Items: make([]*Preemption, 0),
+	}
+	keys, err := datastore.NewQuery("Preemption").Filter("World =", p["world"]).Order("-PreemptedAt").Limit(limit).GetAll(ctx, &res.Items)
+	if err != nil {
+		return internalError(err)
+	}
+	for i, key := range keys {
+		res.Items[i].Key = key
+		res.Items[i].OperationID = key.StringID()
+	}
+
+	writeJSON(w, http.StatusOK, res)
+	return nil
+}
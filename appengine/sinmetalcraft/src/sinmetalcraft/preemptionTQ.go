@@ -0,0 +1,170 @@
+package sinmetalcraft
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+
+	"google.golang.org/api/compute/v1"
+
+	"golang.org/x/net/context"
+)
+
+func init() {
+	api := PreemptionTQApi{}
+
+	http.HandleFunc("/tq/1/preemption/restart", api.Restart)
+}
+
+// PreemptionTQApi is PlayWindowの中でPreemptされたWorldを再起動するTQ
+//
+// restarting -> restarted
+//
+// InstanceがTERMINATEDになるまで待ち、World Diskが付いたまま起動し直す
+type PreemptionTQApi struct{}
+
+// CallRestart is Preemptされたworldを再起動するTQを登録する
+func (a *PreemptionTQApi) CallRestart(c context.Context, key *datastore.Key, delay time.Duration) (*taskqueue.Task, error) {
+	log.Infof(c, "Call Preemption Restart TQ, key = %v", key)
+	if key == nil {
+		return nil, errors.New("key is required")
+	}
+
+	t := taskqueue.NewPOSTTask("/tq/1/preemption/restart", url.Values{
+		"keyStr": {key.Encode()},
+	})
+	t.Delay = delay
+	return taskqueue.Add(c, t, "minecraft")
+}
+
+// Restart is InstanceがTERMINATEDになっていれば起動する
+func (a *PreemptionTQApi) Restart(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	keyStr := r.FormValue("keyStr")
+	log.Infof(ctx, "keyStr = %s", keyStr)
+
+	key, err := datastore.DecodeKey(keyStr)
+	if err != nil {
+		log.Errorf(ctx, "key decode error. keyStr = %s, err = %s", keyStr, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var entity Preemption
+	err = datastore.Get(ctx, key, &entity)
+	if err != nil {
+		log.Errorf(ctx, "datastore get error. key = %s. error = %v", key.StringID(), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	entity.Key = key
+	if entity.Status != PreemptionStatusRestarting {
+		// TQがRetryされた時に、二重に起動しない
+		log.Infof(ctx, "nothing to do. status = %s", entity.Status)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	s, err := newComputeService(ctx)
+	if err != nil {
+		log.Errorf(ctx, "ERROR compute.New: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = a.restart(ctx, r, s, entity, time.Now())
+	if err == errOperationWaiting {
+		w.WriteHeader(http.StatusRequestTimeout)
+		return
+	}
+	if err != nil {
+		log.Errorf(ctx, "preemption restart error. instance = %s, error = %v", entity.Instance, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// restart is Preemptされた後のInstanceの状態を見て、起動するか諦める
+func (a *PreemptionTQApi) restart(ctx context.Context, r *http.Request, s *compute.Service, entity Preemption, now time.Time) error {
+	minecraft, err := getMinecraft(ctx, datastore.NewKey(ctx, "Minecraft", entity.World, 0, nil))
+	if err != nil {
+		return a.finish(ctx, r, entity, PreemptionStatusFailed, err)
+	}
+	if minecraft.Status != "exists" {
+		// 待っている間にServerを止めた
+		return a.finish(ctx, r, entity, PreemptionStatusSkipped, fmt.Errorf("world status is %s.", minecraft.Status))
+	}
+
+	is := compute.NewInstancesService(s)
+	ins, err := is.Get(PROJECT_NAME, entity.Zone, entity.Instance).Do()
+	if isNotFoundError(err) {
+		return a.finish(ctx, r, entity, PreemptionStatusFailed, errors.New("instance is not found."))
+	}
+	if err != nil {
+		return err
+	}
+	if ins.Status != "TERMINATED" {
+		if now.Sub(entity.PreemptedAt) > preemptionRestartTimeout {
+			return a.finish(ctx, r, entity, PreemptionStatusSkipped, fmt.Errorf("instance is %s after %s.", ins.Status, preemptionRestartTimeout))
+		}
+		log.Infof(ctx, "instance status = %s", ins.Status)
+		return errOperationWaiting
+	}
+
+	// TERMINATEDになるのを待っている間やTQがRetryされている間に、PlayWindowが終わっていることがある
+	if !inPlayWindow(minecraft.PlayWindows, now) {
+		return a.finish(ctx, r, entity, PreemptionStatusSkipped, errors.New("play window is over."))
+	}
+	_, err = startInstance(ctx, is, minecraft)
+	if err != nil {
+		return a.finish(ctx, r, entity, PreemptionStatusFailed, err)
+	}
+	return a.finish(ctx, r, entity, PreemptionStatusRestarted, nil)
+}
+
+// finish is Preemptionを終わりのStatusにして、Slackに知らせる
+func (a *PreemptionTQApi) finish(ctx context.Context, r *http.Request, entity Preemption, status string, cause error) error {
+	var current Preemption
+	var changed bool
+	err := datastore.RunInTransaction(ctx, func(c context.Context) error {
+		changed = false
+		err := datastore.Get(c, entity.Key, &current)
+		if err != nil {
+			return err
+		}
+		if current.Status != PreemptionStatusRestarting {
+			return nil
+		}
+		current.Status = status
+		if cause != nil {
+			current.Error = cause.Error()
+		}
+		current.UpdatedAt = time.Now()
+		_, err = datastore.Put(c, entity.Key, &current)
+		changed = err == nil
+		return err
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return nil
+	}
+
+	if status != PreemptionStatusSkipped {
+		ev := newAuditEvent(ctx, r, AuditActionServerRestart)
+		ev.Target = current.World
+		ev.Record(ctx, cause)
+	}
+	notifyPreemption(ctx, current)
+	return nil
+}
@@ -0,0 +1,93 @@
+package sinmetalcraft
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+func TestNewPreemption(t *testing.T) {
+	ope := &compute.Operation{
+		Name:          "systemevent-1509760800000-abc",
+		OperationType: "compute.instances.preempted",
+		TargetId:      1234567890,
+		TargetLink:    "https://www.googleapis.com/compute/v1/projects/sinmetalcraft/zones/asia-northeast1-b/instances/minecraft-survival",
+		Zone:          "https://www.googleapis.com/compute/v1/projects/sinmetalcraft/zones/asia-northeast1-b",
+		InsertTime:    "2017-11-04T12:00:00.000+09:00",
+	}
+	now := time.Date(2017, 11, 4, 3, 5, 0, 0, time.UTC)
+	minecraft := Minecraft{World: "survival", Status: "exists", PlayWindows: []string{"sat,sun 10:00-23:00"}}
+
+	p := newPreemption(ope, minecraft, false, now)
+	if p.World != "survival" || p.Instance != "minecraft-survival" || p.Zone != "asia-northeast1-b" || p.InstanceID != "1234567890" {
+		t.Errorf("preemption = %+v", p)
+	}
+	if !p.InPlayWindow || p.Status != PreemptionStatusRestarting {
+		t.Errorf("in play window status = %s, inPlayWindow = %v", p.Status, p.InPlayWindow)
+	}
+
+	minecraft.PlayWindows = []string{"weekdays 19:00-23:00"}
+	if p := newPreemption(ope, minecraft, false, now); p.Status != PreemptionStatusRecorded {
+		t.Errorf("outside play window status = %s", p.Status)
+	}
+
+	minecraft.PlayWindows = []string{"sat,sun 10:00-23:00"}
+	minecraft.Status = "stopping"
+	if p := newPreemption(ope, minecraft, false, now); p.Status != PreemptionStatusSkipped {
+		t.Errorf("stopping world status = %s", p.Status)
+	}
+
+	ope.TargetLink = "https://www.googleapis.com/compute/v1/projects/sinmetalcraft/zones/asia-northeast1-b/instances/overviewer-survival"
+	_, world, overviewer, ok := preemptedInstance(ope)
+	if world != "survival" || !overviewer || !ok {
+		t.Errorf("overviewer = %s, %v, %v", world, overviewer, ok)
+	}
+	minecraft.Status = "exists"
+	if p := newPreemption(ope, minecraft, overviewer, now); p.Status != PreemptionStatusSkipped {
+		t.Errorf("overviewer status = %s", p.Status)
+	}
+
+	ope.TargetLink = "https://www.googleapis.com/compute/v1/projects/sinmetalcraft/zones/asia-northeast1-b/instances/hoge"
+	if _, _, _, ok := preemptedInstance(ope); ok {
+		t.Errorf("hoge should not be minecraft instance")
+	}
+}
+
+func TestPreemptionOperationRecent(t *testing.T) {
+	now := time.Date(2017, 11, 4, 3, 5, 0, 0, time.UTC)
+	cases := []struct {
+		insertTime string
+		want       bool
+	}{
+		{"2017-11-04T12:00:00.000+09:00", true},
+		{"2017-11-04T11:55:00.000+09:00", true},
+		// 初めてDeployした時に残っている古いPreempt
+		{"2017-11-04T11:54:59.000+09:00", false},
+		{"2017-10-28T12:00:00.000+09:00", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		if got := preemptionOperationRecent(&compute.Operation{InsertTime: c.insertTime}, now); got != c.want {
+			t.Errorf("%q: recent = %v, want %v", c.insertTime, got, c.want)
+		}
+	}
+}
+
+func TestPreemptionRestartPending(t *testing.T) {
+	cases := []struct {
+		p    *Preemption
+		want bool
+	}{
+		{nil, false},
+		{&Preemption{Status: PreemptionStatusRestarting}, true},
+		{&Preemption{Status: PreemptionStatusRestarted}, false},
+		{&Preemption{Status: PreemptionStatusRecorded}, false},
+		{&Preemption{Status: PreemptionStatusFailed}, false},
+	}
+	for _, c := range cases {
+		if got := preemptionRestartPending(c.p); got != c.want {
+			t.Errorf("preemptionRestartPending(%+v) = %v, want %v", c.p, got, c.want)
+		}
+	}
+}
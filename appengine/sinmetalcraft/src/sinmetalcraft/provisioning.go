@@ -0,0 +1,276 @@
+package sinmetalcraft
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+
+	"golang.org/x/net/context"
+)
+
+// minecraftMachineType is Minecraft ServerのInstanceのMachine Type
+const minecraftMachineType = "n1-highmem-2"
+
+// Minecraft Provisioning
+const (
+	ProvisioningPreemptible = "preemptible"
+	ProvisioningStandard    = "standard"
+)
+
+// preemptionFallbackDefaultCount is AppConfigで指定が無い場合に、standard VMに切り替えるPreempt回数
+const preemptionFallbackDefaultCount = 2
+
+// preemptionFallbackDefaultWindow is AppConfigで指定が無い場合に、Preempt回数を数える期間
+const preemptionFallbackDefaultWindow = 24 * time.Hour
+
+// machineTypePrice is asia-northeast1のMachine Typeの1時間の価格 (USD)
+type machineTypePrice struct {
+	Standard    float64
+	Preemptible float64
+}
+
+var machineTypePrices = map[string]machineTypePrice{
+	"n1-highmem-2": {Standard: 0.1558, Preemptible: 0.0330},
+	"n1-highcpu-4": {Standard: 0.1864, Preemptible: 0.0400},
+}
+
+// regionZones is Capacityが足りない時に試すRegionのZone
+var regionZones = map[string][]string{
+	"asia-northeast1": {"asia-northeast1-a", "asia-northeast1-b", "asia-northeast1-c"},
+	"us-central1":     {"us-central1-a", "us-central1-b", "us-central1-c", "us-central1-f"},
+	"us-west1":        {"us-west1-a", "us-west1-b", "us-west1-c"},
+}
+
+// capacityErrorReasons is ZoneにInstanceを作るだけのCapacityが無い時のError Reason
+var capacityErrorReasons = map[string]bool{
+	"ZONE_RESOURCE_POOL_EXHAUSTED":              true,
+	"ZONE_RESOURCE_POOL_EXHAUSTED_WITH_DETAILS": true,
+	"resourcePoolExhausted":                     true,
+}
+
+// instanceProvisioning is createInstanceで作るInstanceの種類と、その理由
+type instanceProvisioning struct {
+	Preemptible bool
+	Reason      string // standard VMにした理由
+}
+
+// Name is Minecraft.Provisioningの値
+func (p instanceProvisioning) Name() string {
+	if p.Preemptible {
+		return ProvisioningPreemptible
+	}
+	return ProvisioningStandard
+}
+
+// Scheduling is Provisioningに合わせたInstanceのScheduling
+// standard VMの場合はHost Maintenanceで止まらないようにMigrateする
+func (p instanceProvisioning) Scheduling() *compute.Scheduling {
+	if p.Preemptible {
+		return &compute.Scheduling{
+			AutomaticRestart:  false,
+			OnHostMaintenance: "TERMINATE",
+			Preemptible:       true,
+		}
+	}
+	return &compute.Scheduling{
+		AutomaticRestart:  true,
+		OnHostMaintenance: "MIGRATE",
+		Preemptible:       false,
+	}
+}
+
+// preemptionFallback is standard VMに切り替えるPreempt回数と、数える期間を返す
+func (ac *AppConfig) preemptionFallback() (int, time.Duration) {
+	count := preemptionFallbackDefaultCount
+	if ac.PreemptionFallbackCount > 0 {
+		count = ac.PreemptionFallbackCount
+	}
+	window := preemptionFallbackDefaultWindow
+	if ac.PreemptionFallbackWindowHours > 0 {
+		window = time.Duration(ac.PreemptionFallbackWindowHours) * time.Hour
+	}
+	return count, window
+}
+
+// preemptionCountSince is 何時からのPreemptを数えるか
+// standard VMに切り替えた後は、それより前のPreemptを数えないので、次のCold Startでpreemptibleに戻る
+func preemptionCountSince(minecraft Minecraft, window time.Duration, now time.Time) time.Time {
+	since := now.Add(-window)
+	if minecraft.StandardFallbackAt.After(since) {
+		return minecraft.StandardFallbackAt
+	}
+	return since
+}
+
+// decideProvisioning is 最近のPreempt回数から、preemptibleで作るかstandardで作るかを決める
+func decideProvisioning(ctx context.Context, minecraft Minecraft) (instanceProvisioning, error) {
+	acs := AppConfigService{}
+	config, err := acs.Get(ctx)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return instanceProvisioning{}, err
+	}
+	count, window := config.preemptionFallback()
+
+	since := preemptionCountSince(minecraft, window, time.Now())
+	keys, err := datastore.NewQuery("Preemption").Filter("World =", minecraft.World).Filter("PreemptedAt >", since).Order("-PreemptedAt").KeysOnly().Limit(count).GetAll(ctx, nil)
+	if err != nil {
+		return instanceProvisioning{}, err
+	}
+	if len(keys) >= count {
+		return instanceProvisioning{
+			Reason: fmt.Sprintf("preempted %d times in %s.", len(keys), window),
+		}, nil
+	}
+	return instanceProvisioning{Preemptible: true}, nil
+}
+
+// isCapacityError is ZoneのCapacityが足りずにInstanceを作れなかったか
+func isCapacityError(err error) bool {
+	gerr, ok := err.(*googleapi.Error)
+	if !ok {
+		return false
+	}
+	for _, item := range gerr.Errors {
+		if capacityErrorReasons[item.Reason] {
+			return true
+		}
+	}
+	return strings.Contains(gerr.Message, "does not have enough resources available")
+}
+
+// isCapacityOperationError is ZoneのCapacityが足りずにInsertのOperationが失敗したか
+// Insertを受け付けた後にCapacityが足りないことが分かると、Operationの方にErrorが入る
+func isCapacityOperationError(ope *compute.Operation) bool {
+	if ope == nil || ope.Error == nil {
+		return false
+	}
+	for _, item := range ope.Error.Errors {
+		if capacityErrorReasons[item.Code] || strings.Contains(item.Message, "does not have enough resources available") {
+			return true
+		}
+	}
+	return false
+}
+
+// alternateZone is zoneと同じRegionで、まだ試していないZoneを返す
+func alternateZone(zone string, tried []string) (string, bool) {
+	i := strings.LastIndex(zone, "-")
+	if i < 0 {
+		return "", false
+	}
+	for _, z := range regionZones[zone[:i]] {
+		if z == zone {
+			continue
+		}
+		var done bool
+		for _, t := range tried {
+			if t == z {
+				done = true
+			}
+		}
+		if !done {
+			return z, true
+		}
+	}
+	return "", false
+}
+
+// standardCostDifference is standard VMにした時に1時間で増える価格 (USD)
+func standardCostDifference(machineType string) (float64, bool) {
+	p, ok := machineTypePrices[machineType]
+	if !ok {
+		return 0, false
+	}
+	return p.Standard - p.Preemptible, true
+}
+
+// standardFallbackMessage is standard VMにしたことをSlackに知らせるメッセージ
+func standardFallbackMessage(world string, p instanceProvisioning) string {
+	m := fmt.Sprintf("[%s] starting on standard VM instead of preemptible. %s", world, p.Reason)
+	if d, ok := standardCostDifference(minecraftMachineType); ok {
+		m += fmt.Sprintf(" %s costs about $%.3f/hour ($%.0f/month) more.", minecraftMachineType, d, d*24*30)
+	}
+	return m + " next cold start will use preemptible again."
+}
+
+// recordProvisioning is MinecraftにInstanceの種類を記録し、standard VMにした場合はSlackに知らせる
+func recordProvisioning(ctx context.Context, minecraft Minecraft, p instanceProvisioning) error {
+	key := datastore.NewKey(ctx, "Minecraft", minecraft.World, 0, nil)
+	err := datastore.RunInTransaction(ctx, func(c context.Context) error {
+		var entity Minecraft
+		err := datastore.Get(c, key, &entity)
+		if err != nil {
+			return err
+		}
+		entity.Provisioning = p.Name()
+		if !p.Preemptible {
+			entity.StandardFallbackAt = time.Now()
+		}
+		entity.UpdatedAt = time.Now()
+		_, err = datastore.Put(c, key, &entity)
+		return err
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if p.Preemptible {
+		return nil
+	}
+
+	m := standardFallbackMessage(minecraft.World, p)
+	log.Infof(ctx, "%s", m)
+	notifySlack(ctx, m, "#daa038")
+	return nil
+}
+
+// moveToAlternateZone is ZoneのCapacityが足りない時に、同じRegionの別のZoneにWorld Diskを作り直す
+// Diskができたら、ServerTQApi.CreateInstanceがそのZoneでInstanceを作る
+func moveToAlternateZone(ctx context.Context, s *compute.Service, minecraft Minecraft, tried []string) (string, error) {
+	tried = append(tried, minecraft.Zone)
+	zone, ok := alternateZone(minecraft.Zone, tried)
+	if !ok {
+		return "", fmt.Errorf("no capacity in region of %s. tried %s", minecraft.Zone, strings.Join(tried, ","))
+	}
+	from := minecraft.Zone
+
+	err := datastore.RunInTransaction(ctx, func(c context.Context) error {
+		var entity Minecraft
+		err := datastore.Get(c, minecraft.Key, &entity)
+		if err != nil {
+			return err
+		}
+		entity.Zone = zone
+		entity.UpdatedAt = time.Now()
+		_, err = datastore.Put(c, minecraft.Key, &entity)
+		return err
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+	minecraft.Zone = zone
+
+	ds := compute.NewDisksService(s)
+	ope, err := createDiskFromSnapshot(ctx, ds, minecraft)
+	if err != nil {
+		return "", err
+	}
+	// 元のZoneのDiskはSnapshotから作っただけで使っていないので消す
+	_, err = ds.Delete(PROJECT_NAME, from, fmt.Sprintf("%s-world-%s", INSTANCE_NAME, minecraft.World)).Do()
+	if err != nil && !isNotFoundError(err) {
+		log.Warningf(ctx, "ERROR delete disk in %s: %v", from, err)
+	}
+
+	stqAPI := ServerTQApi{}
+	_, err = stqAPI.CallCreateInstance(ctx, minecraft.Key, ope.Name, tried...)
+	if err != nil {
+		return "", err
+	}
+	notifySlack(ctx, fmt.Sprintf("[%s] no capacity in %s. moving world to %s.", minecraft.World, from, zone), "#daa038")
+	return zone, nil
+}
@@ -0,0 +1,107 @@
+package sinmetalcraft
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+func TestIsCapacityError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{&googleapi.Error{Code: 503, Errors: []googleapi.ErrorItem{{Reason: "ZONE_RESOURCE_POOL_EXHAUSTED"}}}, true},
+		{&googleapi.Error{Code: 503, Message: "The zone 'projects/sinmetalcraft/zones/asia-northeast1-b' does not have enough resources available to fulfill the request."}, true},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "quotaExceeded"}}}, false},
+		{errors.New("ZONE_RESOURCE_POOL_EXHAUSTED"), false},
+		{nil, false},
+	}
+	for _, c := range cases {
+		if got := isCapacityError(c.err); got != c.want {
+			t.Errorf("isCapacityError(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestIsCapacityOperationError(t *testing.T) {
+	cases := []struct {
+		ope  *compute.Operation
+		want bool
+	}{
+		{&compute.Operation{Error: &compute.OperationError{Errors: []*compute.OperationErrorErrors{{Code: "ZONE_RESOURCE_POOL_EXHAUSTED"}}}}, true},
+		{&compute.Operation{Error: &compute.OperationError{Errors: []*compute.OperationErrorErrors{{Code: "RESOURCE_OPERATION_RATE_EXCEEDED"}, {Code: "ZONE_RESOURCE_POOL_EXHAUSTED_WITH_DETAILS"}}}}, true},
+		{&compute.Operation{Error: &compute.OperationError{Errors: []*compute.OperationErrorErrors{{Message: "The zone 'projects/sinmetalcraft/zones/asia-northeast1-b' does not have enough resources available to fulfill the request."}}}}, true},
+		{&compute.Operation{Error: &compute.OperationError{Errors: []*compute.OperationErrorErrors{{Code: "QUOTA_EXCEEDED"}}}}, false},
+		{&compute.Operation{}, false},
+		{nil, false},
+	}
+	for i, c := range cases {
+		if got := isCapacityOperationError(c.ope); got != c.want {
+			t.Errorf("%d: isCapacityOperationError = %v, want %v", i, got, c.want)
+		}
+	}
+}
+
+func TestAlternateZone(t *testing.T) {
+	zone, ok := alternateZone("asia-northeast1-b", []string{"asia-northeast1-b"})
+	if !ok || zone != "asia-northeast1-a" {
+		t.Errorf("alternateZone = %s, %v", zone, ok)
+	}
+	zone, ok = alternateZone("asia-northeast1-a", []string{"asia-northeast1-b", "asia-northeast1-a"})
+	if !ok || zone != "asia-northeast1-c" {
+		t.Errorf("alternateZone = %s, %v", zone, ok)
+	}
+	if zone, ok := alternateZone("asia-northeast1-c", []string{"asia-northeast1-a", "asia-northeast1-b", "asia-northeast1-c"}); ok {
+		t.Errorf("all zones are tried. alternateZone = %s", zone)
+	}
+	if zone, ok := alternateZone("europe-west1-b", nil); ok {
+		t.Errorf("unknown region. alternateZone = %s", zone)
+	}
+}
+
+func TestPreemptionCountSince(t *testing.T) {
+	now := time.Date(2017, 11, 4, 12, 0, 0, 0, time.UTC)
+	if got := preemptionCountSince(Minecraft{}, 24*time.Hour, now); !got.Equal(now.Add(-24 * time.Hour)) {
+		t.Errorf("since = %s", got)
+	}
+	// standard VMにした後のPreemptだけを数える
+	fallback := now.Add(-1 * time.Hour)
+	if got := preemptionCountSince(Minecraft{StandardFallbackAt: fallback}, 24*time.Hour, now); !got.Equal(fallback) {
+		t.Errorf("since = %s, want %s", got, fallback)
+	}
+	old := now.Add(-48 * time.Hour)
+	if got := preemptionCountSince(Minecraft{StandardFallbackAt: old}, 24*time.Hour, now); !got.Equal(now.Add(-24 * time.Hour)) {
+		t.Errorf("since = %s", got)
+	}
+}
+
+func TestPreemptionFallbackConfig(t *testing.T) {
+	count, window := (&AppConfig{}).preemptionFallback()
+	if count != preemptionFallbackDefaultCount || window != preemptionFallbackDefaultWindow {
+		t.Errorf("default = %d, %s", count, window)
+	}
+	count, window = (&AppConfig{PreemptionFallbackCount: 3, PreemptionFallbackWindowHours: 6}).preemptionFallback()
+	if count != 3 || window != 6*time.Hour {
+		t.Errorf("config = %d, %s", count, window)
+	}
+}
+
+func TestStandardFallbackMessage(t *testing.T) {
+	m := standardFallbackMessage("hoge", instanceProvisioning{Reason: "preempted 2 times in 24h0m0s."})
+	if !strings.Contains(m, "$0.123/hour") || !strings.Contains(m, "preemptible again") {
+		t.Errorf("message = %s", m)
+	}
+	p := instanceProvisioning{Preemptible: true}
+	if p.Name() != ProvisioningPreemptible || !p.Scheduling().Preemptible {
+		t.Errorf("preemptible = %s, %+v", p.Name(), p.Scheduling())
+	}
+	p = instanceProvisioning{}
+	if s := p.Scheduling(); p.Name() != ProvisioningStandard || s.Preemptible || s.OnHostMaintenance != "MIGRATE" {
+		t.Errorf("standard = %s, %+v", p.Name(), s)
+	}
+}
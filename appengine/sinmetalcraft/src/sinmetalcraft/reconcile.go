@@ -0,0 +1,583 @@
+package sinmetalcraft
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"google.golang.org/api/compute/v1"
+
+	"golang.org/x/net/context"
+)
+
+func init() {
+	api := ReconcileApi{}
+
+	http.HandleFunc("/cron/1/minecraft/reconcile", api.Cron)
+	apiRouter.Handle("POST", "/api/1/reconcile", api.Post, requireAdmin)
+}
+
+// reconcileGracePeriod is TQの途中かもしれないので、更新されてからこの時間が経つまではWorldとDiskを直さない
+const reconcileGracePeriod = time.Hour
+
+// ReconcileFinding Kind
+const (
+	ReconcileKindStatus          = "status"           // Minecraft.StatusがInstanceの有無と違う
+	ReconcileKindStuckOperation  = "stuck_operation"  // OperationがDONEにならないまま止まっている
+	ReconcileKindResourceID      = "resource_id"      // Minecraft.ResourceIDがInstanceのIDと違う
+	ReconcileKindZone            = "zone"             // InstanceがMinecraft.Zoneと違うZoneにある
+	ReconcileKindLatestSnapshot  = "latest_snapshot"  // LatestSnapshotより新しいSnapshotがある
+	ReconcileKindMissingSnapshot = "missing_snapshot" // LatestSnapshotが無い
+	ReconcileKindOrphanInstance  = "orphan_instance"  // Worldが無いInstance
+	ReconcileKindOrphanDisk      = "orphan_disk"      // Instanceに付いていないWorld Disk
+)
+
+// ReconcileFinding is DatastoreとGCEが食い違っているもの
+// Fixが空のものは自動で直さないので、Slackで知らせて人が見る
+type ReconcileFinding struct {
+	Kind     string `json:"kind"`
+	World    string `json:"world"`
+	Resource string `json:"resource"` // Instance, Disk, Snapshot Name
+	Zone     string `json:"zone"`
+	Message  string `json:"message"`
+	Fix      string `json:"fix"`   // 直す内容。空の場合は報告だけ
+	Fixed    bool   `json:"fixed"` // dry runの場合は常にfalse
+	Error    string `json:"error"`
+
+	patch func(m *Minecraft) // Minecraftを直す
+}
+
+// ReconcileReport is Reconcileの結果
+type ReconcileReport struct {
+	DryRun     bool               `json:"dryRun"`
+	Worlds     int                `json:"worlds"`
+	Instances  int                `json:"instances"`
+	Disks      int                `json:"disks"`
+	Snapshots  int                `json:"snapshots"`
+	Findings   []ReconcileFinding `json:"findings"`
+	Fixed      int                `json:"fixed"`
+	Unresolved int                `json:"unresolved"`
+	CreatedAt  time.Time          `json:"createdAt"`
+}
+
+// Message is Slackに送るReportの要約
+func (r *ReconcileReport) Message() string {
+	if r.DryRun {
+		return fmt.Sprintf("reconcile (dry run): %d findings. %d can be fixed, %d need attention.", len(r.Findings), len(r.Findings)-r.Unresolved, r.Unresolved)
+	}
+	return fmt.Sprintf("reconcile: %d findings. fixed %d, %d need attention.", len(r.Findings), r.Fixed, r.Unresolved)
+}
+
+// summarize is FixedとUnresolvedを数える
+func (r *ReconcileReport) summarize() {
+	r.Fixed = 0
+	r.Unresolved = 0
+	for _, f := range r.Findings {
+		if f.Fixed {
+			r.Fixed++
+		}
+		if len(f.Fix) < 1 || len(f.Error) > 0 {
+			r.Unresolved++
+		}
+	}
+}
+
+// isStale is 更新されてからreconcileGracePeriodが過ぎているか
+func isStale(t time.Time, now time.Time) bool {
+	return now.Sub(t) >= reconcileGracePeriod
+}
+
+// parseCreationTimestamp is GCEのCreationTimestamp (RFC3339) を読む。読めない場合はzero
+func parseCreationTimestamp(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// operationInFlight is Operationを待っている途中か。作ったばかりのWorldはOperationStatusが空
+func operationInFlight(m Minecraft) bool {
+	return len(m.OperationStatus) > 0 && m.OperationStatus != "DONE"
+}
+
+// markNotExists is Instanceが無いWorldをInstanceが無い状態にする
+func markNotExists(m *Minecraft) {
+	m.Status = "not_exists"
+	m.ResourceID = 0
+	m.IPAddr = ""
+	m.JoinableAt = time.Time{}
+	m.OperationStatus = "DONE"
+}
+
+// reconcile is WorldとGCEのInstance, Disk, Snapshotを比べて、食い違っているものを返す
+// Datastoreを書き換えないので、dry runでもそのまま使える
+func reconcile(worlds []Minecraft, instances []*compute.Instance, disks []*compute.Disk, snapshots []*compute.Snapshot, now time.Time) []ReconcileFinding {
+	findings := make([]ReconcileFinding, 0)
+
+	worldMap := make(map[string]Minecraft)
+	worldNames := make([]string, 0, len(worlds))
+	for _, w := range worlds {
+		worldMap[w.World] = w
+		worldNames = append(worldNames, w.World)
+	}
+	sort.Strings(worldNames)
+
+	instanceMap := make(map[string]*compute.Instance)
+	instanceNames := make([]string, 0, len(instances))
+	for _, ins := range instances {
+		instanceMap[ins.Name] = ins
+		instanceNames = append(instanceNames, ins.Name)
+	}
+	sort.Strings(instanceNames)
+
+	diskMap := make(map[string]*compute.Disk)
+	diskNames := make([]string, 0, len(disks))
+	for _, d := range disks {
+		diskMap[d.Name] = d
+		diskNames = append(diskNames, d.Name)
+	}
+	sort.Strings(diskNames)
+
+	worldSnapshots := make(map[string][]*compute.Snapshot)
+	snapshotNames := make(map[string]bool)
+	for _, sn := range snapshots {
+		snapshotNames[sn.Name] = true
+		if world := snapshotWorld(sn.Name); len(world) > 0 {
+			worldSnapshots[world] = append(worldSnapshots[world], sn)
+		}
+	}
+
+	for _, name := range worldNames {
+		w := worldMap[name]
+		ins := instanceMap[INSTANCE_NAME+"-"+w.World]
+		stale := isStale(w.UpdatedAt, now)
+
+		if ins != nil {
+			zone := path.Base(ins.Zone)
+			if len(zone) > 0 && zone != w.Zone {
+				findings = append(findings, ReconcileFinding{
+					Kind:     ReconcileKindZone,
+					World:    w.World,
+					Resource: ins.Name,
+					Zone:     zone,
+					Message:  fmt.Sprintf("instance is in %s but world zone is %s.", zone, w.Zone),
+					Fix:      fmt.Sprintf("set zone to %s.", zone),
+					patch:    func(m *Minecraft) { m.Zone = zone },
+				})
+			}
+			id := int64(ins.Id)
+			ip := instanceNatIP(ins)
+			switch {
+			case w.Status != "exists" && stale:
+				findings = append(findings, ReconcileFinding{
+					Kind:     ReconcileKindStatus,
+					World:    w.World,
+					Resource: ins.Name,
+					Zone:     zone,
+					Message:  fmt.Sprintf("status is %s but instance is %s.", w.Status, ins.Status),
+					Fix:      "set status to exists.",
+					patch: func(m *Minecraft) {
+						m.Status = "exists"
+						m.ResourceID = id
+						m.IPAddr = ip
+						m.OperationStatus = "DONE"
+					},
+				})
+			case w.Status == "exists" && w.ResourceID != id && stale:
+				findings = append(findings, ReconcileFinding{
+					Kind:     ReconcileKindResourceID,
+					World:    w.World,
+					Resource: ins.Name,
+					Zone:     zone,
+					Message:  fmt.Sprintf("resourceID is %d but instance id is %d.", w.ResourceID, id),
+					Fix:      fmt.Sprintf("set resourceID to %d.", id),
+					patch: func(m *Minecraft) {
+						m.ResourceID = id
+						m.IPAddr = ip
+					},
+				})
+			case w.Status == "exists" && operationInFlight(w) && stale:
+				findings = append(findings, ReconcileFinding{
+					Kind:     ReconcileKindStuckOperation,
+					World:    w.World,
+					Resource: ins.Name,
+					Zone:     zone,
+					Message:  fmt.Sprintf("%s operation is %s since %s.", w.OperationType, w.OperationStatus, w.UpdatedAt.Format(time.RFC3339)),
+					Fix:      "set operation status to DONE.",
+					patch:    func(m *Minecraft) { m.OperationStatus = "DONE" },
+				})
+			}
+		} else if stale && (w.Status != "not_exists" || operationInFlight(w)) {
+			kind := ReconcileKindStatus
+			message := fmt.Sprintf("status is %s but instance does not exist.", w.Status)
+			if w.Status == "not_exists" {
+				kind = ReconcileKindStuckOperation
+				message = fmt.Sprintf("%s operation is %s since %s.", w.OperationType, w.OperationStatus, w.UpdatedAt.Format(time.RFC3339))
+			}
+			findings = append(findings, ReconcileFinding{
+				Kind:     kind,
+				World:    w.World,
+				Resource: INSTANCE_NAME + "-" + w.World,
+				Zone:     w.Zone,
+				Message:  message,
+				Fix:      "set status to not_exists.",
+				patch:    markNotExists,
+			})
+		}
+
+		if ins == nil {
+			disk := fmt.Sprintf("%s-world-%s", INSTANCE_NAME, w.World)
+			if d, ok := diskMap[disk]; ok && len(d.Users) < 1 && isStale(parseCreationTimestamp(d.CreationTimestamp), now) {
+				// Snapshotを作る前のDiskかもしれないので消さない
+				findings = append(findings, ReconcileFinding{
+					Kind:     ReconcileKindOrphanDisk,
+					World:    w.World,
+					Resource: d.Name,
+					Zone:     path.Base(d.Zone),
+					Message:  "world disk is not attached to any instance. snapshot it or delete it by hand.",
+				})
+			}
+		}
+
+		findings = append(findings, reconcileSnapshots(w, ins != nil, worldSnapshots[w.World], snapshotNames)...)
+	}
+
+	for _, name := range instanceNames {
+		ins := instanceMap[name]
+		zone := path.Base(ins.Zone)
+		switch {
+		case strings.HasPrefix(name, OverviewerInstanceName+"-"):
+			// 止まったまま残っているOverviewerのInstanceはGCが消す
+		case strings.HasPrefix(name, INSTANCE_NAME+"-"):
+			world := name[len(INSTANCE_NAME+"-"):]
+			if _, ok := worldMap[world]; !ok {
+				findings = append(findings, ReconcileFinding{
+					Kind:     ReconcileKindOrphanInstance,
+					World:    world,
+					Resource: name,
+					Zone:     zone,
+					Message:  fmt.Sprintf("instance is %s but world does not exist.", ins.Status),
+				})
+			}
+		}
+	}
+
+	overviewerDiskPrefix := fmt.Sprintf(OverViewerWorldDiskFormat, INSTANCE_NAME, "")
+	worldDiskPrefix := fmt.Sprintf("%s-world-", INSTANCE_NAME)
+	for _, name := range diskNames {
+		d := diskMap[name]
+		if len(d.Users) > 0 || !isStale(parseCreationTimestamp(d.CreationTimestamp), now) {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(name, overviewerDiskPrefix):
+			// Instanceに付いていないOverviewerのDiskはGCが消す
+		case strings.HasPrefix(name, worldDiskPrefix):
+			world := name[len(worldDiskPrefix):]
+			if _, ok := worldMap[world]; !ok {
+				findings = append(findings, ReconcileFinding{
+					Kind:     ReconcileKindOrphanDisk,
+					World:    world,
+					Resource: name,
+					Zone:     path.Base(d.Zone),
+					Message:  "world disk is not attached to any instance and world does not exist.",
+				})
+			}
+		}
+	}
+
+	return findings
+}
+
+// reconcileSnapshots is WorldのLatestSnapshotとSnapshotを比べる
+// Instanceを消した後にLatestSnapshotを保存できなかった場合は、Labelの無い一番新しいSnapshotにする
+func reconcileSnapshots(w Minecraft, running bool, snapshots []*compute.Snapshot, snapshotNames map[string]bool) []ReconcileFinding {
+	var newest string
+	for _, sn := range snapshots {
+		if sn.Status != "READY" || len(sn.Labels["label"]) > 0 {
+			continue
+		}
+		// Snapshot Nameの末尾は日時なので、Nameの順で新しさが分かる
+		if sn.Name > newest {
+			newest = sn.Name
+		}
+	}
+
+	findings := make([]ReconcileFinding, 0)
+	if len(w.LatestSnapshot) > 0 && !snapshotNames[w.LatestSnapshot] {
+		f := ReconcileFinding{
+			Kind:     ReconcileKindMissingSnapshot,
+			World:    w.World,
+			Resource: w.LatestSnapshot,
+			Message:  "latest snapshot does not exist.",
+		}
+		if len(newest) > 0 && !running {
+			f.Fix = fmt.Sprintf("set latest snapshot to %s.", newest)
+			f.patch = func(m *Minecraft) { m.LatestSnapshot = newest }
+		}
+		return append(findings, f)
+	}
+	// 起動中はvacuumがSnapshotを作ってからInstanceを消す途中かもしれないので直さない
+	if !running && len(newest) > 0 && newest > w.LatestSnapshot {
+		findings = append(findings, ReconcileFinding{
+			Kind:     ReconcileKindLatestSnapshot,
+			World:    w.World,
+			Resource: newest,
+			Message:  fmt.Sprintf("%s is newer than latest snapshot %s.", newest, w.LatestSnapshot),
+			Fix:      fmt.Sprintf("set latest snapshot to %s.", newest),
+			patch:    func(m *Minecraft) { m.LatestSnapshot = newest },
+		})
+	}
+	return findings
+}
+
+// ReconcileApi is DatastoreのWorldとGCEの食い違いを見つけて直す
+type ReconcileApi struct{}
+
+// Cron is /cron/1/minecraft/reconcile handler
+// dryRun=true の場合は直さずにSlackに知らせるだけ
+func (a *ReconcileApi) Cron(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	dryRun, _ := strconv.ParseBool(r.FormValue("dryRun"))
+	report, err := a.run(ctx, r, dryRun)
+	if err != nil {
+		log.Errorf(ctx, "ERROR reconcile: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	WriteLog(ctx, "RECONCILE_REPORT", report)
+	if len(report.Findings) > 0 {
+		notifyReconcile(ctx, report)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Post is POST /api/1/reconcile
+// ?dryRun=true の場合は直さずに見つけたものを返す
+func (a *ReconcileApi) Post(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	var dryRun bool
+	if v := r.FormValue("dryRun"); len(v) > 0 {
+		var err error
+		dryRun, err = strconv.ParseBool(v)
+		if err != nil {
+			return invalidRequestError("dryRun is true or false.").WithDetail("dryRun", v)
+		}
+	}
+
+	report, err := a.run(ctx, r, dryRun)
+	if err != nil {
+		return internalError(err)
+	}
+	writeJSON(w, http.StatusOK, report)
+	return nil
+}
+
+// run is World, Instance, Disk, Snapshotを集めてreconcileし、dry runでなければ直す
+func (a *ReconcileApi) run(ctx context.Context, r *http.Request, dryRun bool) (*ReconcileReport, error) {
+	var worlds []Minecraft
+	keys, err := datastore.NewQuery("Minecraft").GetAll(ctx, &worlds)
+	if err != nil {
+		return nil, err
+	}
+	zones := map[string]bool{"asia-northeast1-b": true}
+	for i := range worlds {
+		worlds[i].Key = keys[i]
+		worlds[i].World = keys[i].StringID()
+		if len(worlds[i].Zone) > 0 {
+			zones[worlds[i].Zone] = true
+		}
+	}
+
+	s, err := newComputeService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	is := compute.NewInstancesService(s)
+	ds := compute.NewDisksService(s)
+	var instances []*compute.Instance
+	var disks []*compute.Disk
+	for zone := range zones {
+		l, err := listAllInstances(is, zone)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, l...)
+
+		dl, err := listAllDisks(ds, zone)
+		if err != nil {
+			return nil, err
+		}
+		disks = append(disks, dl...)
+	}
+	snapshots, err := listAllWorldSnapshots(compute.NewSnapshotsService(s))
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ReconcileReport{
+		DryRun:    dryRun,
+		Worlds:    len(worlds),
+		Instances: len(instances),
+		Disks:     len(disks),
+		Snapshots: len(snapshots),
+		Findings:  reconcile(worlds, instances, disks, snapshots, time.Now()),
+		CreatedAt: time.Now(),
+	}
+	if !dryRun {
+		for i := range report.Findings {
+			f := &report.Findings[i]
+			if len(f.Fix) < 1 {
+				continue
+			}
+			err := a.fix(ctx, r, worlds, f)
+			if err != nil {
+				log.Warningf(ctx, "ERROR reconcile %s %s: %v", f.Kind, f.Resource, err)
+				f.Error = err.Error()
+				continue
+			}
+			f.Fixed = true
+		}
+	}
+	report.summarize()
+	return report, nil
+}
+
+// fix is Findingを1つ直す
+// WorldはReconcileの後にTQが更新したかもしれないので、UpdatedAtが変わっていたら直さない
+func (a *ReconcileApi) fix(ctx context.Context, r *http.Request, worlds []Minecraft, f *ReconcileFinding) error {
+	if f.patch == nil {
+		return nil
+	}
+
+	var observed Minecraft
+	for _, w := range worlds {
+		if w.World == f.World {
+			observed = w
+		}
+	}
+	if observed.Key == nil {
+		return fmt.Errorf("%s is not found", f.World)
+	}
+
+	ev := newAuditEvent(ctx, r, AuditActionWorldReconcile)
+	ev.Target = f.World
+	var before, after Minecraft
+	err := datastore.RunInTransaction(ctx, func(c context.Context) error {
+		var entity Minecraft
+		err := datastore.Get(c, observed.Key, &entity)
+		if err != nil {
+			return err
+		}
+		if !entity.UpdatedAt.Equal(observed.UpdatedAt) {
+			return fmt.Errorf("%s was updated at %s after reconcile started", f.World, entity.UpdatedAt.Format(time.RFC3339))
+		}
+		before = entity
+		f.patch(&entity)
+		entity.UpdatedAt = time.Now()
+		_, err = datastore.Put(c, observed.Key, &entity)
+		if err != nil {
+			return err
+		}
+		after = entity
+		return nil
+	}, nil)
+	ev.SetDiff(before, after)
+	ev.Record(ctx, err)
+	if err != nil {
+		return err
+	}
+	// 同じWorldのFindingが続く場合に、自分の更新で止まらないようにする
+	for i := range worlds {
+		if worlds[i].World == f.World {
+			worlds[i].UpdatedAt = after.UpdatedAt
+		}
+	}
+	return nil
+}
+
+// listAllInstances is ZoneのInstanceを全Page取得する
+func listAllInstances(is *compute.InstancesService, zone string) ([]*compute.Instance, error) {
+	var items []*compute.Instance
+	call := is.List(PROJECT_NAME, zone)
+	for {
+		l, err := call.Do()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, l.Items...)
+		if len(l.NextPageToken) < 1 {
+			return items, nil
+		}
+		call = call.PageToken(l.NextPageToken)
+	}
+}
+
+// listAllDisks is ZoneのDiskを全Page取得する
+func listAllDisks(ds *compute.DisksService, zone string) ([]*compute.Disk, error) {
+	var items []*compute.Disk
+	call := ds.List(PROJECT_NAME, zone)
+	for {
+		l, err := call.Do()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, l.Items...)
+		if len(l.NextPageToken) < 1 {
+			return items, nil
+		}
+		call = call.PageToken(l.NextPageToken)
+	}
+}
+
+// listAllWorldSnapshots is World DiskのSnapshotを全Page取得する
+func listAllWorldSnapshots(ss *compute.SnapshotsService) ([]*compute.Snapshot, error) {
+	var items []*compute.Snapshot
+	call := ss.List(PROJECT_NAME).Filter(fmt.Sprintf("name eq %s-world-.*", INSTANCE_NAME))
+	for {
+		l, err := call.Do()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, l.Items...)
+		if len(l.NextPageToken) < 1 {
+			return items, nil
+		}
+		call = call.PageToken(l.NextPageToken)
+	}
+}
+
+// notifyReconcile is Reconcileで見つけたものをSlackに送る
+// Slackに送れなくてもReconcileは止めない
+func notifyReconcile(ctx context.Context, report *ReconcileReport) {
+	color := "#36a64f"
+	if report.Unresolved > 0 || report.DryRun {
+		color = "#daa038"
+	}
+	fields := make([]SlackField, 0)
+	for _, f := range report.Findings {
+		value := f.Message
+		switch {
+		case len(f.Error) > 0:
+			value += " fix failed: " + f.Error
+		case f.Fixed:
+			value += " fixed: " + f.Fix
+		case len(f.Fix) > 0:
+			value += " would fix: " + f.Fix
+		}
+		fields = append(fields, SlackField{
+			Title: fmt.Sprintf("[%s] %s %s: %s", f.World, f.Kind, f.Resource, value),
+		})
+	}
+
+	notifySlack(ctx, report.Message(), color, fields...)
+}
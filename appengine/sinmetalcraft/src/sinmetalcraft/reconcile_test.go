@@ -0,0 +1,205 @@
+package sinmetalcraft
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+const reconcileTestZone = "https://www.googleapis.com/compute/v1/projects/sinmetalcraft/zones/asia-northeast1-b"
+
+func findReconcile(findings []ReconcileFinding, kind string, world string) (ReconcileFinding, bool) {
+	for _, f := range findings {
+		if f.Kind == kind && f.World == world {
+			return f, true
+		}
+	}
+	return ReconcileFinding{}, false
+}
+
+func TestReconcileStatus(t *testing.T) {
+	now := time.Date(2017, 11, 4, 12, 0, 0, 0, time.UTC)
+	old := now.Add(-2 * time.Hour)
+	worlds := []Minecraft{
+		// TQが途中で止まって、Instanceが無いのにexistsのまま
+		{World: "gone", Zone: "asia-northeast1-b", Status: "exists", ResourceID: 1, IPAddr: "104.198.1.1", OperationType: "delete", OperationStatus: "RUNNING", UpdatedAt: old},
+		// Instanceがあるのにnot_exists
+		{World: "running", Zone: "asia-northeast1-b", Status: "not_exists", OperationStatus: "DONE", UpdatedAt: old},
+		// 更新したばかりなのでTQの途中かもしれない
+		{World: "starting", Zone: "asia-northeast1-b", Status: "not_exists", OperationType: "insert", OperationStatus: "RUNNING", UpdatedAt: now.Add(-10 * time.Minute)},
+		// 作ったばかりのWorldはOperationStatusが空
+		{World: "new", Zone: "asia-northeast1-b", Status: "not_exists", UpdatedAt: old},
+		{World: "ok", Zone: "asia-northeast1-b", Status: "exists", ResourceID: 3, OperationStatus: "DONE", UpdatedAt: old},
+	}
+	instances := []*compute.Instance{
+		&compute.Instance{Name: "minecraft-running", Zone: reconcileTestZone, Status: "RUNNING", Id: 2, NetworkInterfaces: []*compute.NetworkInterface{
+			&compute.NetworkInterface{AccessConfigs: []*compute.AccessConfig{&compute.AccessConfig{NatIP: "104.198.2.2"}}},
+		}},
+		&compute.Instance{Name: "minecraft-ok", Zone: reconcileTestZone, Status: "RUNNING", Id: 3},
+	}
+
+	findings := reconcile(worlds, instances, nil, nil, now)
+	if len(findings) != 2 {
+		t.Fatalf("findings = %+v", findings)
+	}
+
+	f, ok := findReconcile(findings, ReconcileKindStatus, "gone")
+	if !ok || f.patch == nil {
+		t.Fatalf("gone is not found. findings = %+v", findings)
+	}
+	m := worlds[0]
+	f.patch(&m)
+	if m.Status != "not_exists" || m.ResourceID != 0 || len(m.IPAddr) > 0 || m.OperationStatus != "DONE" {
+		t.Errorf("patched gone = %+v", m)
+	}
+
+	f, ok = findReconcile(findings, ReconcileKindStatus, "running")
+	if !ok || f.patch == nil {
+		t.Fatalf("running is not found. findings = %+v", findings)
+	}
+	m = worlds[1]
+	f.patch(&m)
+	if m.Status != "exists" || m.ResourceID != 2 || m.IPAddr != "104.198.2.2" {
+		t.Errorf("patched running = %+v", m)
+	}
+}
+
+func TestReconcileInstance(t *testing.T) {
+	now := time.Date(2017, 11, 4, 12, 0, 0, 0, time.UTC)
+	old := now.Add(-2 * time.Hour)
+	worlds := []Minecraft{
+		{World: "moved", Zone: "asia-northeast1-b", Status: "exists", ResourceID: 1, OperationStatus: "DONE", UpdatedAt: old},
+		{World: "recreated", Zone: "asia-northeast1-b", Status: "exists", ResourceID: 1, OperationStatus: "DONE", UpdatedAt: old},
+		{World: "stuck", Zone: "asia-northeast1-b", Status: "exists", ResourceID: 3, OperationType: "reset", OperationStatus: "PENDING", UpdatedAt: old},
+	}
+	instances := []*compute.Instance{
+		&compute.Instance{Name: "minecraft-moved", Zone: "https://www.googleapis.com/compute/v1/projects/sinmetalcraft/zones/asia-northeast1-a", Status: "RUNNING", Id: 1},
+		&compute.Instance{Name: "minecraft-recreated", Zone: reconcileTestZone, Status: "RUNNING", Id: 2},
+		&compute.Instance{Name: "minecraft-stuck", Zone: reconcileTestZone, Status: "RUNNING", Id: 3},
+		&compute.Instance{Name: "minecraft-unknown", Zone: reconcileTestZone, Status: "RUNNING", Id: 4},
+		&compute.Instance{Name: "overviewer-moved", Zone: reconcileTestZone, Status: "TERMINATED", Id: 5},
+		&compute.Instance{Name: "overviewer-stuck", Zone: reconcileTestZone, Status: "RUNNING", Id: 6},
+	}
+
+	// 止まったまま残っているOverviewerのInstanceはGCが消すので、Reconcileでは見ない
+	findings := reconcile(worlds, instances, nil, nil, now)
+	if len(findings) != 4 {
+		t.Fatalf("findings = %+v", findings)
+	}
+
+	f, ok := findReconcile(findings, ReconcileKindZone, "moved")
+	if !ok || f.Zone != "asia-northeast1-a" {
+		t.Fatalf("zone finding = %+v", f)
+	}
+	m := worlds[0]
+	f.patch(&m)
+	if m.Zone != "asia-northeast1-a" {
+		t.Errorf("patched zone = %s", m.Zone)
+	}
+
+	f, ok = findReconcile(findings, ReconcileKindResourceID, "recreated")
+	if !ok {
+		t.Fatalf("resource id finding is not found. findings = %+v", findings)
+	}
+	m = worlds[1]
+	f.patch(&m)
+	if m.ResourceID != 2 {
+		t.Errorf("patched resourceID = %d", m.ResourceID)
+	}
+
+	if _, ok := findReconcile(findings, ReconcileKindStuckOperation, "stuck"); !ok {
+		t.Errorf("stuck operation is not found. findings = %+v", findings)
+	}
+	f, ok = findReconcile(findings, ReconcileKindOrphanInstance, "unknown")
+	if !ok || len(f.Fix) > 0 {
+		t.Errorf("orphan instance must be reported only. finding = %+v", f)
+	}
+}
+
+func TestReconcileDisk(t *testing.T) {
+	now := time.Date(2017, 11, 4, 12, 0, 0, 0, time.UTC)
+	old := now.Add(-2 * time.Hour).Format(time.RFC3339)
+	worlds := []Minecraft{
+		{World: "hoge", Zone: "asia-northeast1-b", Status: "not_exists", OperationStatus: "DONE", UpdatedAt: now.Add(-2 * time.Hour)},
+	}
+	disks := []*compute.Disk{
+		&compute.Disk{Name: "minecraft-world-hoge", Zone: reconcileTestZone, CreationTimestamp: old},
+		&compute.Disk{Name: "minecraft-world-fuga", Zone: reconcileTestZone, CreationTimestamp: old},
+		&compute.Disk{Name: "minecraft-overviewer-world-hoge", Zone: reconcileTestZone, CreationTimestamp: old},
+		// 作ったばかりなので、Instanceを作るTQを待っている
+		&compute.Disk{Name: "minecraft-overviewer-world-fuga", Zone: reconcileTestZone, CreationTimestamp: now.Add(-5 * time.Minute).Format(time.RFC3339)},
+		&compute.Disk{Name: "minecraft-overviewer-world-piyo", Zone: reconcileTestZone, CreationTimestamp: old, Users: []string{"overviewer-piyo"}},
+	}
+
+	// OverviewerのDiskはGCが消すので、Reconcileでは見ない
+	findings := reconcile(worlds, nil, disks, nil, now)
+	if len(findings) != 2 {
+		t.Fatalf("findings = %+v", findings)
+	}
+	if f, ok := findReconcile(findings, ReconcileKindOrphanDisk, "hoge"); !ok || len(f.Fix) > 0 {
+		t.Errorf("world disk must be reported only. finding = %+v", f)
+	}
+	if f, ok := findReconcile(findings, ReconcileKindOrphanDisk, "fuga"); !ok || len(f.Fix) > 0 {
+		t.Errorf("world disk must be reported only. finding = %+v", f)
+	}
+}
+
+func TestReconcileSnapshots(t *testing.T) {
+	now := time.Date(2017, 11, 4, 12, 0, 0, 0, time.UTC)
+	old := now.Add(-2 * time.Hour)
+	worlds := []Minecraft{
+		// Instanceを消した後にLatestSnapshotを保存できなかった
+		{World: "hoge", Zone: "asia-northeast1-b", Status: "not_exists", OperationStatus: "DONE", LatestSnapshot: "minecraft-world-hoge-20171101-000000", UpdatedAt: old},
+		{World: "fuga", Zone: "asia-northeast1-b", Status: "not_exists", OperationStatus: "DONE", LatestSnapshot: "minecraft-world-fuga-20171101-000000", UpdatedAt: old},
+		// 起動中はvacuumの途中かもしれない
+		{World: "piyo", Zone: "asia-northeast1-b", Status: "exists", ResourceID: 1, OperationStatus: "DONE", LatestSnapshot: "minecraft-world-piyo-20171101-000000", UpdatedAt: old},
+		{World: "gone", Zone: "asia-northeast1-b", Status: "not_exists", OperationStatus: "DONE", LatestSnapshot: "minecraft-world-gone-20171101-000000", UpdatedAt: old},
+	}
+	instances := []*compute.Instance{
+		&compute.Instance{Name: "minecraft-piyo", Zone: reconcileTestZone, Status: "RUNNING", Id: 1},
+	}
+	snapshots := []*compute.Snapshot{
+		&compute.Snapshot{Name: "minecraft-world-hoge-20171101-000000", Status: "READY"},
+		&compute.Snapshot{Name: "minecraft-world-hoge-20171103-000000", Status: "READY"},
+		&compute.Snapshot{Name: "minecraft-world-hoge-20171104-000000", Status: "CREATING"},
+		&compute.Snapshot{Name: "minecraft-world-fuga-20171101-000000", Status: "READY"},
+		// Upgrade前のSnapshotなどLabelの付いたものは使わない
+		&compute.Snapshot{Name: "minecraft-world-fuga-20171102-000000", Status: "READY", Labels: map[string]string{"label": "pre-upgrade"}},
+		&compute.Snapshot{Name: "minecraft-world-piyo-20171101-000000", Status: "READY"},
+		&compute.Snapshot{Name: "minecraft-world-piyo-20171104-110000", Status: "READY"},
+	}
+
+	findings := reconcile(worlds, instances, nil, snapshots, now)
+	if len(findings) != 2 {
+		t.Fatalf("findings = %+v", findings)
+	}
+	f, ok := findReconcile(findings, ReconcileKindLatestSnapshot, "hoge")
+	if !ok {
+		t.Fatalf("latest snapshot finding is not found. findings = %+v", findings)
+	}
+	m := worlds[0]
+	f.patch(&m)
+	if m.LatestSnapshot != "minecraft-world-hoge-20171103-000000" {
+		t.Errorf("patched latest snapshot = %s", m.LatestSnapshot)
+	}
+	f, ok = findReconcile(findings, ReconcileKindMissingSnapshot, "gone")
+	if !ok || len(f.Fix) > 0 {
+		t.Errorf("missing snapshot without other snapshot must be reported only. finding = %+v", f)
+	}
+}
+
+func TestReconcileReportSummarize(t *testing.T) {
+	r := ReconcileReport{Findings: []ReconcileFinding{
+		{Kind: ReconcileKindStatus, Fix: "set status to not_exists.", Fixed: true},
+		{Kind: ReconcileKindStatus, Fix: "set status to exists.", Error: "hoge was updated"},
+		{Kind: ReconcileKindOrphanInstance},
+	}}
+	r.summarize()
+	if r.Fixed != 1 || r.Unresolved != 2 {
+		t.Errorf("fixed = %d, unresolved = %d", r.Fixed, r.Unresolved)
+	}
+	if got := r.Message(); got != "reconcile: 3 findings. fixed 1, 2 need attention." {
+		t.Errorf("message = %s", got)
+	}
+}
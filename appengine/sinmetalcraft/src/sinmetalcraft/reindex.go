@@ -0,0 +1,73 @@
+package sinmetalcraft
+
+import (
+	"net/http"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"golang.org/x/net/context"
+)
+
+func init() {
+	api := ReindexApi{}
+
+	apiRouter.Handle("POST", "/api/1/reindex", api.Post, requireAdmin)
+}
+
+// ReindexReport is POST /api/1/reindex のResponse
+type ReindexReport struct {
+	Worlds    int       `json:"worlds"`
+	Reindexed int       `json:"reindexed"`
+	Failed    []string  `json:"failed"` // Putに失敗したWorld
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ReindexApi is noindexからindexにしたPropertyを、既にあるEntityにも反映する
+// Status, Zone, JarVersionをindexにする前に作ったMinecraftは、Putし直すまでQueryに出てこない
+type ReindexApi struct{}
+
+// Post is POST /api/1/reindex
+// 全てのMinecraftをそのままPutし直す。UpdatedAtは変えない
+func (a *ReindexApi) Post(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	// Kindだけのqueryはindexが無くても全てのEntityを返す
+	keys, err := datastore.NewQuery("Minecraft").KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return internalError(err)
+	}
+
+	report := ReindexReport{
+		Worlds:    len(keys),
+		Failed:    []string{},
+		CreatedAt: time.Now(),
+	}
+	for _, key := range keys {
+		err := reindexMinecraft(ctx, key)
+		if err != nil {
+			log.Errorf(ctx, "ERROR reindex %s: %v", key.StringID(), err)
+			report.Failed = append(report.Failed, key.StringID())
+			continue
+		}
+		report.Reindexed++
+	}
+	writeJSON(w, http.StatusOK, report)
+	return nil
+}
+
+// reindexMinecraft is MinecraftをPutし直して、今のStructのindex設定で書き直す
+// TQが同じWorldを更新しているかもしれないので、Transactionの中で読んでそのまま書く
+func reindexMinecraft(ctx context.Context, key *datastore.Key) error {
+	return datastore.RunInTransaction(ctx, func(c context.Context) error {
+		var entity Minecraft
+		err := datastore.Get(c, key, &entity)
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = datastore.Put(c, key, &entity)
+		return err
+	}, nil)
+}
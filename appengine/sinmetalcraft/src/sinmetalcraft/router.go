@@ -0,0 +1,153 @@
+package sinmetalcraft
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/user"
+
+	"golang.org/x/net/context"
+)
+
+// apiRouter is /api/1/* のRouter
+// 各APIはinit()でここにRouteを登録する
+var apiRouter = NewRouter()
+
+func init() {
+	http.Handle("/api/1/", apiRouter)
+}
+
+// Params is Pathの {name} に対応する値
+type Params map[string]string
+
+// APIHandlerFunc is Routerに登録するHandler
+// errorを返すとRouterがAPIErrorとしてResponseを書く
+type APIHandlerFunc func(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error
+
+// Middleware is APIHandlerFuncを包んで前処理を行う
+type Middleware func(APIHandlerFunc) APIHandlerFunc
+
+type route struct {
+	method   string
+	segments []string
+	handler  APIHandlerFunc
+}
+
+// Router is Method, PathでHandlerを振り分ける
+// Pathは "/api/1/minecraft/{world}" のように {name} でParamsを受け取れる
+type Router struct {
+	routes     []*route
+	newContext func(r *http.Request) context.Context
+}
+
+// NewRouter is Routerを作成する
+func NewRouter() *Router {
+	return &Router{
+		newContext: appengine.NewContext,
+	}
+}
+
+// Handle is Routeを登録する
+// middlewaresは先頭から順に実行される
+func (rt *Router) Handle(method string, pattern string, h APIHandlerFunc, middlewares ...Middleware) {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	rt.routes = append(rt.routes, &route{
+		method:   method,
+		segments: splitPath(pattern),
+		handler:  h,
+	})
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := rt.newContext(r)
+
+	segments := splitPath(r.URL.Path)
+	var allow []string
+	for _, route := range rt.routes {
+		p, ok := route.match(segments)
+		if !ok {
+			continue
+		}
+		if route.method != r.Method {
+			allow = append(allow, route.method)
+			continue
+		}
+		if err := route.handler(ctx, w, r, p); err != nil {
+			writeError(ctx, w, err)
+		}
+		return
+	}
+
+	if len(allow) > 0 {
+		sort.Strings(allow)
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+		writeError(ctx, w, NewAPIError(http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, r.Method+" is not allowed").WithDetail("allow", allow))
+		return
+	}
+	writeError(ctx, w, notFoundError(r.URL.Path+" is not found"))
+}
+
+func (rt *route) match(segments []string) (Params, bool) {
+	if len(rt.segments) != len(segments) {
+		return nil, false
+	}
+	p := Params{}
+	for i, s := range rt.segments {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			if len(segments[i]) < 1 {
+				return nil, false
+			}
+			p[s[1:len(s)-1]] = segments[i]
+			continue
+		}
+		if s != segments[i] {
+			return nil, false
+		}
+	}
+	return p, true
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+// userFromRequest is Middlewareがログインユーザを取得する時に使う
+// testで差し替えられるように変数にしている
+var userFromRequest = currentUser
+
+// requireLogin is ログインしていない場合は401を返す
+func requireLogin(h APIHandlerFunc) APIHandlerFunc {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+		if userFromRequest(ctx, r) == nil {
+			return unauthorizedError(ctx)
+		}
+		return h(ctx, w, r, p)
+	}
+}
+
+// requireAdmin is ログインしていない場合は401を、Adminでない場合は403を返す
+func requireAdmin(h APIHandlerFunc) APIHandlerFunc {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+		u := userFromRequest(ctx, r)
+		if u == nil {
+			return unauthorizedError(ctx)
+		}
+		if u.Admin == false {
+			return NewAPIError(http.StatusForbidden, ErrCodeForbidden, "admin only")
+		}
+		return h(ctx, w, r, p)
+	}
+}
+
+// unauthorizedError is details.loginURL にLogin URLを入れた401を返す
+func unauthorizedError(ctx context.Context) error {
+	loginURL, err := user.LoginURL(ctx, "")
+	if err != nil {
+		return internalError(err)
+	}
+	return NewAPIError(http.StatusUnauthorized, ErrCodeUnauthorized, "login required").WithDetail("loginURL", loginURL)
+}
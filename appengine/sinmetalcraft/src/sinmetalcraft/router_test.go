@@ -0,0 +1,85 @@
+package sinmetalcraft
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/appengine/user"
+
+	"golang.org/x/net/context"
+)
+
+func TestRouteMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		path    string
+		ok      bool
+		world   string
+	}{
+		{"/api/1/minecraft", "/api/1/minecraft", true, ""},
+		{"/api/1/minecraft", "/api/1/minecraft/", true, ""},
+		{"/api/1/minecraft/{world}", "/api/1/minecraft/hoge", true, "hoge"},
+		{"/api/1/minecraft/{world}", "/api/1/minecraft", false, ""},
+		{"/api/1/minecraft/{world}/snapshots", "/api/1/minecraft/hoge/snapshots", true, "hoge"},
+		{"/api/1/minecraft/{world}/snapshots", "/api/1/minecraft/hoge/servers", false, ""},
+		{"/api/1/minecraft/{world}/snapshots", "/api/1/minecraft//snapshots", false, ""},
+	}
+	for _, c := range cases {
+		rt := route{segments: splitPath(c.pattern)}
+		p, ok := rt.match(splitPath(c.path))
+		if ok != c.ok {
+			t.Errorf("%s match %s = %v, want %v", c.pattern, c.path, ok, c.ok)
+			continue
+		}
+		if ok && p["world"] != c.world {
+			t.Errorf("%s match %s world = %q, want %q", c.pattern, c.path, p["world"], c.world)
+		}
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	defer func(f func(ctx context.Context, r *http.Request) *user.User) {
+		userFromRequest = f
+	}(userFromRequest)
+
+	var called bool
+	h := requireAdmin(func(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+		called = true
+		return nil
+	})
+
+	cases := []struct {
+		user   *user.User
+		status int
+		called bool
+	}{
+		{&user.User{Email: "hoge@example.com"}, http.StatusForbidden, false},
+		{&user.User{Email: "admin@example.com", Admin: true}, 0, true},
+	}
+	for _, c := range cases {
+		called = false
+		u := c.user
+		userFromRequest = func(ctx context.Context, r *http.Request) *user.User {
+			return u
+		}
+		r := httptest.NewRequest("GET", "/api/1/server", nil)
+		err := h(context.Background(), httptest.NewRecorder(), r, Params{})
+		if called != c.called {
+			t.Errorf("%s called = %v, want %v", u.Email, called, c.called)
+		}
+		if c.status == 0 {
+			if err != nil {
+				t.Errorf("%s err = %v", u.Email, err)
+			}
+			continue
+		}
+		ae, ok := err.(*APIError)
+		if !ok {
+			t.Fatalf("%s err = %v, want *APIError", u.Email, err)
+		}
+		if ae.Status != c.status || ae.Code != ErrCodeForbidden {
+			t.Errorf("%s err = %v", u.Email, ae)
+		}
+	}
+}
@@ -5,342 +5,190 @@ import (
 	"fmt"
 	"net/http"
 
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/urlfetch"
-	"google.golang.org/appengine/user"
-
 	"google.golang.org/api/compute/v1"
 
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
+	"golang.org/x/net/context"
 )
 
 func init() {
 	api := ServerApi{}
 
-	http.HandleFunc("/api/1/server", api.Handler)
+	apiRouter.Handle("GET", "/api/1/server", api.List, requireAdmin)
+	apiRouter.Handle("POST", "/api/1/server", api.Post, requireAdmin, audit(AuditActionServerCreate))
+	apiRouter.Handle("PUT", "/api/1/server", api.Put, requireAdmin, audit(AuditActionServerUpdate))
+	apiRouter.Handle("DELETE", "/api/1/server", api.Delete, requireLogin, audit(AuditActionServerDelete))
 }
 
 type ServerApi struct{}
 
+type ServerApiPostParam struct {
+	KeyStr string `json:"key"`
+}
+
 type ServerApiPutParam struct {
 	KeyStr    string `json:"key"`
 	Operation string `json:"operation"`
 }
 
-func (a *ServerApi) Handler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "POST" {
-		a.Post(w, r)
-	} else if r.Method == "PUT" {
-		a.Put(w, r)
-	} else if r.Method == "GET" {
-		a.List(w, r)
-	} else if r.Method == "DELETE" {
-		a.Delete(w, r)
-	} else {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-	}
+// ServerApiResponse is ServerApiがInstanceの操作を受け付けた時のResponse
+type ServerApiResponse struct {
+	Message string `json:"message"`
 }
 
 // create new instance
-func (a *ServerApi) Post(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
-
-	var form map[string]string
-	err := json.NewDecoder(r.Body).Decode(&form)
+func (a *ServerApi) Post(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	var param ServerApiPostParam
+	err := json.NewDecoder(r.Body).Decode(&param)
 	if err != nil {
-		log.Infof(ctx, "rquest body, %v", r.Body)
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"message": "invalid request."}`))
-		return
+		return invalidRequestError("invalid request.").WithDetail("cause", err.Error())
 	}
 	defer r.Body.Close()
 
-	if len(form["key"]) < 1 {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"message": "key is required."}`))
-		return
-	}
-	key, err := datastore.DecodeKey(form["key"])
+	key, err := minecraftKey(ctx, p, param.KeyStr)
 	if err != nil {
-		log.Infof(ctx, "decode key error. param = %s, err = %s", form["key"], err.Error())
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"message": "invalid key."}`))
-		return
+		return err
 	}
+	ev := auditEventFromContext(ctx)
+	ev.Target = key.StringID()
+	ev.SetDiff(nil, param)
 
-	var minecraft Minecraft
-	err = datastore.Get(ctx, key, &minecraft)
-	if err == datastore.ErrNoSuchEntity {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf(`{"message": "%s is not found."}`, form["key"])))
-		return
-	}
+	minecraft, err := getMinecraft(ctx, key)
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf(`{"message": "%s"}`, err.Error())))
-		return
+		return err
 	}
-	minecraft.Key = key
 
-	client := &http.Client{
-		Transport: &oauth2.Transport{
-			Source: google.AppEngineTokenSource(ctx, compute.ComputeScope),
-			Base:   &urlfetch.Transport{Context: ctx},
-		},
-	}
-	s, err := compute.New(client)
+	s, err := newComputeService(ctx)
 	if err != nil {
-		log.Errorf(ctx, "ERROR compute.New: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return internalError(err)
 	}
 	ds := compute.NewDisksService(s)
 	ope, err := createDiskFromSnapshot(ctx, ds, minecraft)
 	if err != nil {
-		log.Errorf(ctx, "ERROR create disk: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return internalError(err)
 	}
 
 	stqAPI := ServerTQApi{}
 	_, err = stqAPI.CallCreateInstance(ctx, minecraft.Key, ope.Name)
 	if err != nil {
-		log.Errorf(ctx, "ERROR call create instance tq: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return internalError(err)
 	}
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(http.StatusCreated)
-	w.Write([]byte(fmt.Sprintf(`{"message" : "%s create done!"}`, minecraft.World)))
+	writeJSON(w, http.StatusCreated, ServerApiResponse{Message: fmt.Sprintf("%s create done!", minecraft.World)})
+	return nil
 }
 
-// reset or start instance
-func (a *ServerApi) Put(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
-
+// start, reset or stop instance
+func (a *ServerApi) Put(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
 	var param ServerApiPutParam
 	err := json.NewDecoder(r.Body).Decode(&param)
 	if err != nil {
-		log.Infof(ctx, "rquest body, %v", r.Body)
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"message": "invalid request."}`))
-		return
+		return invalidRequestError("invalid request.").WithDetail("cause", err.Error())
 	}
 	defer r.Body.Close()
 
-	key, err := datastore.DecodeKey(param.KeyStr)
+	key, err := minecraftKey(ctx, p, param.KeyStr)
 	if err != nil {
-		log.Infof(ctx, "invalid key, %v", r.Body)
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"message": "invalid key."}`))
-		return
+		return err
 	}
 
-	if param.Operation != "start" && param.Operation != "reset" {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"invalid request" : "operation param is start or reset"}`))
-		return
-	}
+	ev := auditEventFromContext(ctx)
+	ev.Target = key.StringID()
+	ev.SetDiff(nil, param)
 
-	var minecraft Minecraft
-	err = datastore.Get(ctx, key, &minecraft)
-	if err == datastore.ErrNoSuchEntity {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf(`{"message": "%s is not found."}`, param.KeyStr)))
-		return
+	if param.Operation != "start" && param.Operation != "reset" && param.Operation != "stop" {
+		return invalidRequestError("operation param is start, reset or stop").WithDetail("operation", param.Operation)
 	}
+	ev.Action = "server." + param.Operation
+
+	minecraft, err := getMinecraft(ctx, key)
 	if err != nil {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf(`{"message": "%s"}`, err.Error())))
-		return
+		return err
 	}
-	minecraft.Key = key
 
-	client := &http.Client{
-		Transport: &oauth2.Transport{
-			Source: google.AppEngineTokenSource(ctx, compute.ComputeScope),
-			Base:   &urlfetch.Transport{Context: ctx},
-		},
-	}
-	s, err := compute.New(client)
+	s, err := newComputeService(ctx)
 	if err != nil {
-		log.Errorf(ctx, "ERROR compute.New: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return internalError(err)
 	}
 	is := compute.NewInstancesService(s)
 
 	var name string
-	if param.Operation == "start" {
+	switch param.Operation {
+	case "start":
 		name, err = startInstance(ctx, is, minecraft)
-		if err != nil {
-			log.Errorf(ctx, "ERROR compute Instances Start: %s", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-	} else if param.Operation == "reset" {
+	case "reset":
 		name, err = resetInstance(ctx, is, minecraft)
-		if err != nil {
-			log.Errorf(ctx, "ERROR compute Instances Reset: %s", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+	case "stop":
+		if minecraft.Status != "exists" {
+			return conflictError(fmt.Sprintf("%s is not running.", minecraft.World)).WithDetail("status", minecraft.Status)
 		}
-	} else {
-		log.Errorf(ctx, `{"invalid request" : "operation param is start or reset"}`)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"invalid request" : "operation param is start or reset"}`))
-		return
+		name, err = stopInstance(ctx, is, minecraft)
+	}
+	if err != nil {
+		return internalError(err)
 	}
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf(`{"message": "%s %s done!"}`, name, param.Operation)))
+	writeJSON(w, http.StatusOK, ServerApiResponse{Message: fmt.Sprintf("%s %s done!", name, param.Operation)})
+	return nil
 }
 
 // delete instance
-func (a *ServerApi) Delete(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
-
-	u := user.Current(ctx)
-	if u == nil {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(http.StatusUnauthorized)
-		loginURL, err := user.LoginURL(ctx, "")
-		if err != nil {
-			log.Errorf(ctx, "get user login URL error, %s", err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		w.Write([]byte(fmt.Sprintf(`{"loginURL":"%s"}`, loginURL)))
-		return
-	}
-
-	keyStr := r.FormValue("key")
-
-	key, err := datastore.DecodeKey(keyStr)
+func (a *ServerApi) Delete(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	key, err := minecraftKey(ctx, p, r.FormValue("key"))
 	if err != nil {
-		log.Infof(ctx, "invalid key, %v", r.Body)
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"message": "invalid key."}`))
-		return
+		return err
 	}
+	auditEventFromContext(ctx).Target = key.StringID()
 
-	var minecraft Minecraft
-	err = datastore.Get(ctx, key, &minecraft)
-	if err == datastore.ErrNoSuchEntity {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf(`{"message": "%s is not found."}`, keyStr)))
-		return
-	}
+	minecraft, err := getMinecraft(ctx, key)
 	if err != nil {
-		log.Errorf(ctx, "ERROR, Get Minecraft error = %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return err
 	}
-	minecraft.Key = key
 
-	client := &http.Client{
-		Transport: &oauth2.Transport{
-			Source: google.AppEngineTokenSource(ctx, compute.ComputeScope),
-			Base:   &urlfetch.Transport{Context: ctx},
-		},
-	}
-	s, err := compute.New(client)
+	s, err := newComputeService(ctx)
 	if err != nil {
-		log.Errorf(ctx, "ERROR compute.New: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return internalError(err)
 	}
 	is := compute.NewInstancesService(s)
 
 	name, err := deleteInstance(ctx, is, minecraft)
 	if err != nil {
-		log.Errorf(ctx, "ERROR compute Instances Delete: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return internalError(err)
 	}
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(fmt.Sprintf(`{"message": "%s delete done!"}`, name)))
+	writeJSON(w, http.StatusOK, ServerApiResponse{Message: fmt.Sprintf("%s delete done!", name)})
+	return nil
 }
 
 // list instance
-func (a *ServerApi) List(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
-
-	u := user.Current(ctx)
-	if u == nil {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(http.StatusUnauthorized)
-		loginURL, err := user.LoginURL(ctx, "")
-		if err != nil {
-			log.Errorf(ctx, "get user login URL error, %s", err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		w.Write([]byte(fmt.Sprintf(`{"loginURL":"%s"}`, loginURL)))
-		return
-	}
-	if user.IsAdmin(ctx) == false {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(http.StatusForbidden)
-		return
-	}
-
-	client := &http.Client{
-		Transport: &oauth2.Transport{
-			Source: google.AppEngineTokenSource(ctx, compute.ComputeScope),
-			Base:   &urlfetch.Transport{Context: ctx},
-		},
-	}
-	s, err := compute.New(client)
+func (a *ServerApi) List(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	s, err := newComputeService(ctx)
 	if err != nil {
-		log.Errorf(ctx, "ERROR compute.New: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return internalError(err)
 	}
 	is := compute.NewInstancesService(s)
 	instances, cursor, err := listInstance(ctx, is, "asia-northeast1-b")
 	if err != nil {
-		log.Errorf(ctx, "ERROR compute.Instance List: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return internalError(err)
 	}
 
-	var res []MinecraftApiResponse
+	res := make([]MinecraftApiResponse, 0)
 	for _, item := range instances {
+		var natIP string
+		if len(item.NetworkInterfaces) > 0 && len(item.NetworkInterfaces[0].AccessConfigs) > 0 {
+			natIP = item.NetworkInterfaces[0].AccessConfigs[0].NatIP
+		}
 		res = append(res, MinecraftApiResponse{
 			InstanceName:      item.Name,
 			Zone:              item.Zone,
-			IPAddr:            item.NetworkInterfaces[0].AccessConfigs[0].NatIP,
+			IPAddr:            natIP,
 			Status:            item.Status,
 			CreationTimestamp: item.CreationTimestamp,
 		})
 	}
 
-	apiRes := MinecraftApiListResponse{
+	writeJSON(w, http.StatusOK, MinecraftApiListResponse{
 		Items:  res,
 		Cursor: cursor,
-	}
-
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(apiRes)
+	})
+	return nil
 }
@@ -0,0 +1,357 @@
+package sinmetalcraft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/appengine/datastore"
+
+	"golang.org/x/net/context"
+)
+
+func init() {
+	api := ServerPropertiesApi{}
+
+	apiRouter.Handle("GET", "/api/1/minecraft/{world}/properties", api.Get, requireAdmin)
+	apiRouter.Handle("PUT", "/api/1/minecraft/{world}/properties", api.Put, requireAdmin, audit(AuditActionWorldProperties))
+}
+
+// serverPropertiesMetadataKey is Startup Scriptにserver.propertiesを渡すInstanceのMetadata
+const serverPropertiesMetadataKey = "server-properties"
+
+// serverPropertyType is server.propertiesの値の種類
+type serverPropertyType int
+
+const (
+	serverPropertyString serverPropertyType = iota
+	serverPropertyBool
+	serverPropertyInt
+	serverPropertyEnum
+)
+
+// serverPropertySpec is 値を確認するserver.propertiesのKeyの定義
+type serverPropertySpec struct {
+	Type   serverPropertyType
+	Min    int      // serverPropertyInt
+	Max    int      // serverPropertyInt, serverPropertyStringの場合は文字数
+	Values []string // serverPropertyEnum
+}
+
+// serverPropertySpecs is 型を確認するserver.propertiesのKey
+// ここに無いKeyも設定できるが、値は文字列として扱う
+// difficulty, gamemodeは1.13までは数字、1.14からは名前で書くので両方受け付ける
+var serverPropertySpecs = map[string]serverPropertySpec{
+	"allow-flight":         {Type: serverPropertyBool},
+	"allow-nether":         {Type: serverPropertyBool},
+	"difficulty":           {Type: serverPropertyEnum, Values: []string{"peaceful", "easy", "normal", "hard", "0", "1", "2", "3"}},
+	"enable-command-block": {Type: serverPropertyBool},
+	"enforce-whitelist":    {Type: serverPropertyBool},
+	"force-gamemode":       {Type: serverPropertyBool},
+	"gamemode":             {Type: serverPropertyEnum, Values: []string{"survival", "creative", "adventure", "spectator", "0", "1", "2", "3"}},
+	"generate-structures":  {Type: serverPropertyBool},
+	"hardcore":             {Type: serverPropertyBool},
+	"level-seed":           {Type: serverPropertyString, Max: 64},
+	"level-type":           {Type: serverPropertyString, Max: 64},
+	"max-players":          {Type: serverPropertyInt, Min: 1, Max: 1000},
+	"max-world-size":       {Type: serverPropertyInt, Min: 1, Max: 29999984},
+	"motd":                 {Type: serverPropertyString, Max: 150},
+	"online-mode":          {Type: serverPropertyBool},
+	"op-permission-level":  {Type: serverPropertyInt, Min: 1, Max: 4},
+	"player-idle-timeout":  {Type: serverPropertyInt, Min: 0, Max: 10080},
+	"pvp":                  {Type: serverPropertyBool},
+	"simulation-distance":  {Type: serverPropertyInt, Min: 3, Max: 32},
+	"spawn-animals":        {Type: serverPropertyBool},
+	"spawn-monsters":       {Type: serverPropertyBool},
+	"spawn-npcs":           {Type: serverPropertyBool},
+	"spawn-protection":     {Type: serverPropertyInt, Min: 0, Max: 1000},
+	"view-distance":        {Type: serverPropertyInt, Min: 3, Max: 32},
+	"white-list":           {Type: serverPropertyBool},
+}
+
+// serverPropertiesManaged is Startup ScriptやInstanceの構成で決まっているので、変えられないKey
+var serverPropertiesManaged = map[string]bool{
+	"level-name":    true,
+	"server-ip":     true,
+	"server-port":   true,
+	"query.port":    true,
+	"enable-rcon":   true,
+	"rcon.port":     true,
+	"rcon.password": true,
+}
+
+// serverPropertyKeyPattern is server.propertiesのKeyとして受け付ける形式
+var serverPropertyKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9]*([.-][a-z0-9]+)*$`)
+
+// serverPropertyMaxLength is serverPropertySpecsに無いKeyの値の最大文字数
+const serverPropertyMaxLength = 256
+
+// ServerProperties is Worldのserver.propertiesに設定する値
+// Keyは対象のWorld Name
+// Instanceを作る時と、Instanceがある場合は変更した時にMetadataに書き、次にServerが起動した時に反映される
+type ServerProperties struct {
+	Key            *datastore.Key    `json:"-" datastore:"-"`
+	World          string            `json:"world"`
+	Properties     map[string]string `json:"properties" datastore:"-"`
+	PropertiesJSON string            `json:"-" datastore:",noindex"`
+	CreatedAt      time.Time         `json:"createdAt"`
+	UpdatedAt      time.Time         `json:"updatedAt"`
+}
+
+func (sp *ServerProperties) Load(ps []datastore.Property) error {
+	if err := datastore.LoadStruct(sp, ps); err != nil {
+		return err
+	}
+	sp.Properties = make(map[string]string)
+	if len(sp.PropertiesJSON) < 1 {
+		return nil
+	}
+	return json.Unmarshal([]byte(sp.PropertiesJSON), &sp.Properties)
+}
+
+func (sp *ServerProperties) Save() ([]datastore.Property, error) {
+	b, err := json.Marshal(sp.Properties)
+	if err != nil {
+		return nil, err
+	}
+	sp.PropertiesJSON = string(b)
+
+	return datastore.SaveStruct(sp)
+}
+
+// Clone is Cloneした新しいWorldのserver.propertiesを返す
+func (sp *ServerProperties) Clone(world string) ServerProperties {
+	properties := make(map[string]string)
+	for k, v := range sp.Properties {
+		properties[k] = v
+	}
+	now := time.Now()
+	return ServerProperties{
+		World:      world,
+		Properties: properties,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+}
+
+// getServerProperties is Worldのserver.propertiesを返す。まだ設定していない場合は空のPropertiesを返す
+func getServerProperties(ctx context.Context, world string) (ServerProperties, error) {
+	key := datastore.NewKey(ctx, "ServerProperties", world, 0, nil)
+	var entity ServerProperties
+	err := datastore.Get(ctx, key, &entity)
+	if err == datastore.ErrNoSuchEntity {
+		return ServerProperties{Key: key, World: world, Properties: make(map[string]string)}, nil
+	}
+	if err != nil {
+		return entity, err
+	}
+	entity.Key = key
+	return entity, nil
+}
+
+// validateServerProperty is server.propertiesの1つのKeyと値を確認する
+func validateServerProperty(key string, value string) error {
+	if serverPropertiesManaged[key] {
+		return invalidRequestError(fmt.Sprintf("%s is managed by sinmetalcraft.", key)).WithDetail("key", key)
+	}
+	if !serverPropertyKeyPattern.MatchString(key) {
+		return invalidRequestError("invalid property key.").WithDetail("key", key)
+	}
+	if !utf8.ValidString(value) || strings.IndexFunc(value, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0 {
+		return invalidRequestError(fmt.Sprintf("%s has control characters.", key)).WithDetail("key", key)
+	}
+
+	spec, ok := serverPropertySpecs[key]
+	if !ok {
+		spec = serverPropertySpec{Type: serverPropertyString, Max: serverPropertyMaxLength}
+	}
+	switch spec.Type {
+	case serverPropertyBool:
+		if value != "true" && value != "false" {
+			return invalidRequestError(fmt.Sprintf("%s is true or false.", key)).WithDetail(key, value)
+		}
+	case serverPropertyInt:
+		n, err := strconv.Atoi(value)
+		if err != nil || n < spec.Min || n > spec.Max {
+			return invalidRequestError(fmt.Sprintf("%s is an integer from %d to %d.", key, spec.Min, spec.Max)).WithDetail(key, value)
+		}
+	case serverPropertyEnum:
+		for _, v := range spec.Values {
+			if v == value {
+				return nil
+			}
+		}
+		return invalidRequestError(fmt.Sprintf("%s is one of %s.", key, strings.Join(spec.Values, ", "))).WithDetail(key, value)
+	case serverPropertyString:
+		if utf8.RuneCountInString(value) > spec.Max {
+			return invalidRequestError(fmt.Sprintf("%s is up to %d characters.", key, spec.Max)).WithDetail(key, value)
+		}
+	}
+	return nil
+}
+
+// validateServerProperties is 全てのKeyを確認する。Errorが分かりやすいようにKeyの順に確認する
+func validateServerProperties(properties map[string]string) error {
+	keys := make([]string, 0, len(properties))
+	for k := range properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := validateServerProperty(k, properties[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderServerProperties is Startup Scriptがserver.propertiesに書き込む "key=value" の行をKeyの順に返す
+// server.propertiesはISO-8859-1で読まれるので、ASCII以外は \uXXXX にする
+func renderServerProperties(properties map[string]string) string {
+	var b bytes.Buffer
+	for _, item := range metadataItems(properties) {
+		b.WriteString(item.Key)
+		b.WriteString("=")
+		b.WriteString(escapeServerProperty(*item.Value))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func escapeServerProperty(value string) string {
+	var b bytes.Buffer
+	for i, r := range value {
+		switch {
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r == ' ' && i == 0:
+			// 先頭の空白はJavaが読む時に捨ててしまう
+			b.WriteString(`\ `)
+		case r > 0x7e:
+			// BMPの外の文字はSurrogate Pairにする
+			if r1, r2 := utf16.EncodeRune(r); r1 != utf8.RuneError {
+				fmt.Fprintf(&b, `\u%04x\u%04x`, r1, r2)
+			} else {
+				fmt.Fprintf(&b, `\u%04x`, r)
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// ServerPropertiesApi is Worldのserver.propertiesを管理するAPI
+type ServerPropertiesApi struct{}
+
+// ServerPropertiesApiPutParam is PUT /api/1/minecraft/{world}/properties のRequest Body
+// Propertiesは全体を置き換える。含めなかったKeyはServerのDefaultに戻る
+type ServerPropertiesApiPutParam struct {
+	Properties map[string]string `json:"properties"`
+}
+
+// ServerPropertiesApiResponse is /api/1/minecraft/{world}/properties のResponse
+type ServerPropertiesApiResponse struct {
+	ServerProperties
+	Diff            []AuditDiff `json:"diff"`            // PUTで変わったKey
+	RestartRequired bool        `json:"restartRequired"` // Instanceがあるので、次に起動した時に反映される
+}
+
+// get server.properties
+func (a *ServerPropertiesApi) Get(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	mkey, err := minecraftKey(ctx, p, "")
+	if err != nil {
+		return err
+	}
+	if _, err := getMinecraft(ctx, mkey); err != nil {
+		return err
+	}
+	entity, err := getServerProperties(ctx, mkey.StringID())
+	if err != nil {
+		return internalError(err)
+	}
+
+	writeJSON(w, http.StatusOK, ServerPropertiesApiResponse{ServerProperties: entity, Diff: make([]AuditDiff, 0)})
+	return nil
+}
+
+// update server.properties
+// 設定全体を置き換える。消したKeyは次に起動した時にServerのDefaultに戻る
+func (a *ServerPropertiesApi) Put(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	var param ServerPropertiesApiPutParam
+	err := json.NewDecoder(r.Body).Decode(&param)
+	if err != nil {
+		return invalidRequestError("invalid request.").WithDetail("cause", err.Error())
+	}
+	defer r.Body.Close()
+	if param.Properties == nil {
+		param.Properties = make(map[string]string)
+	}
+	if err := validateServerProperties(param.Properties); err != nil {
+		return err
+	}
+
+	mkey, err := minecraftKey(ctx, p, "")
+	if err != nil {
+		return err
+	}
+	ev := auditEventFromContext(ctx)
+	ev.Target = mkey.StringID()
+	minecraft, err := getMinecraft(ctx, mkey)
+	if err != nil {
+		return err
+	}
+
+	var before, after ServerProperties
+	err = datastore.RunInTransaction(ctx, func(c context.Context) error {
+		entity, err := getServerProperties(c, minecraft.World)
+		if err != nil {
+			return err
+		}
+		before = entity
+
+		now := time.Now()
+		if entity.CreatedAt.IsZero() {
+			entity.CreatedAt = now
+		}
+		entity.Properties = param.Properties
+		entity.UpdatedAt = now
+		_, err = datastore.Put(c, entity.Key, &entity)
+		if err != nil {
+			return err
+		}
+		after = entity
+		return nil
+	}, nil)
+	if err != nil {
+		return internalError(err)
+	}
+	diff := auditDiff(before.Properties, after.Properties)
+	ev.SetDiff(before.Properties, after.Properties)
+
+	// Instanceが無い場合は、作る時にMetadataに書く
+	var restart bool
+	if len(diff) > 0 && (minecraft.Status == "exists" || minecraft.Status == "stopping") {
+		s, err := newComputeService(ctx)
+		if err != nil {
+			return internalError(err)
+		}
+		_, err = setInstanceMetadata(ctx, compute.NewInstancesService(s), minecraft, serverPropertiesMetadataKey, renderServerProperties(after.Properties))
+		if err != nil && !isNotFoundError(err) {
+			return internalError(err)
+		}
+		restart = err == nil
+	}
+
+	writeJSON(w, http.StatusOK, ServerPropertiesApiResponse{ServerProperties: after, Diff: diff, RestartRequired: restart})
+	return nil
+}
@@ -0,0 +1,75 @@
+package sinmetalcraft
+
+import (
+	"testing"
+)
+
+func TestValidateServerProperty(t *testing.T) {
+	cases := []struct {
+		key   string
+		value string
+		ok    bool
+	}{
+		{"difficulty", "hard", true},
+		{"difficulty", "2", true},
+		{"difficulty", "nightmare", false},
+		{"gamemode", "creative", true},
+		{"view-distance", "10", true},
+		{"view-distance", "2", false},
+		{"view-distance", "ten", false},
+		{"max-players", "1000", true},
+		{"max-players", "1001", false},
+		{"pvp", "false", true},
+		{"pvp", "no", false},
+		{"motd", "sinmetalcraft へようこそ", true},
+		{"motd", "line1\nline2", false},
+		{"level-seed", "-4172144997902289642", true},
+		{"resource-pack", "https://example.com/pack.zip", true},
+		{"level-name", "hoge", false},
+		{"server-port", "25566", false},
+		{"rcon.password", "hoge", false},
+		{"Invalid Key", "hoge", false},
+	}
+	for _, c := range cases {
+		err := validateServerProperty(c.key, c.value)
+		if c.ok && err != nil {
+			t.Errorf("validateServerProperty(%q, %q) err = %v", c.key, c.value, err)
+		}
+		if !c.ok {
+			if _, isAPIError := err.(*APIError); !isAPIError {
+				t.Errorf("validateServerProperty(%q, %q) err = %v, want APIError", c.key, c.value, err)
+			}
+		}
+	}
+}
+
+func TestRenderServerProperties(t *testing.T) {
+	got := renderServerProperties(map[string]string{
+		"pvp":        "false",
+		"motd":       "ようこそ 🎮",
+		"difficulty": "hard",
+		"level-seed": ` C:\seed`,
+	})
+	want := "difficulty=hard\n" +
+		`level-seed=\ C:\\seed` + "\n" +
+		`motd=\u3088\u3046\u3053\u305d \ud83c\udfae` + "\n" +
+		"pvp=false\n"
+	if got != want {
+		t.Errorf("renderServerProperties = %q, want %q", got, want)
+	}
+	if s := renderServerProperties(map[string]string{}); s != "" {
+		t.Errorf("renderServerProperties empty = %q", s)
+	}
+}
+
+func TestServerPropertiesClone(t *testing.T) {
+	src := ServerProperties{World: "hoge", Properties: map[string]string{"difficulty": "hard"}}
+	c := src.Clone("hoge-test")
+	if c.World != "hoge-test" || c.Properties["difficulty"] != "hard" {
+		t.Errorf("Clone = %+v", c)
+	}
+	c.Properties["difficulty"] = "peaceful"
+	if src.Properties["difficulty"] != "hard" {
+		t.Errorf("src Properties = %v", src.Properties)
+	}
+}
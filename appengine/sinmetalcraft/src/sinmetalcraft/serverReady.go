@@ -0,0 +1,332 @@
+package sinmetalcraft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/socket"
+	"google.golang.org/appengine/taskqueue"
+
+	"golang.org/x/net/context"
+)
+
+// minecraftServerPort is Minecraft ServerのPort
+const minecraftServerPort = 25565
+
+// serverReadyTimeout is Instanceが起動してから、Pingに答えるのを待つ時間
+// World Generationが入ると数分かかるので長めにしている
+const serverReadyTimeout = 15 * time.Minute
+
+// serverPingTimeout is Server List Ping 1回のTimeout
+const serverPingTimeout = 5 * time.Second
+
+// slpMaxPacketLength is Server List PingのResponseとして受け取るPacketの最大長
+const slpMaxPacketLength = 1 << 21
+
+func init() {
+	api := ServerReadyTQApi{}
+
+	http.HandleFunc("/tq/1/minecraft/ready", api.Handler)
+}
+
+// serverStatus is Server List PingのResponseのうち、Slackに出すもの
+type serverStatus struct {
+	Version struct {
+		Name     string `json:"name"`
+		Protocol int    `json:"protocol"`
+	} `json:"version"`
+	Players struct {
+		Max    int `json:"max"`
+		Online int `json:"online"`
+	} `json:"players"`
+}
+
+// writeVarInt is Minecraft ProtocolのVarIntを書く
+func writeVarInt(b *bytes.Buffer, v int32) {
+	u := uint32(v)
+	for {
+		if u&^0x7F == 0 {
+			b.WriteByte(byte(u))
+			return
+		}
+		b.WriteByte(byte(u&0x7F | 0x80))
+		u >>= 7
+	}
+}
+
+// readVarInt is Minecraft ProtocolのVarIntを読む
+func readVarInt(r io.ByteReader) (int32, error) {
+	var v uint32
+	for i := uint(0); i < 5; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		v |= uint32(b&0x7F) << (7 * i)
+		if b&0x80 == 0 {
+			return int32(v), nil
+		}
+	}
+	return 0, errors.New("varint is too big")
+}
+
+// writePacket is Packet IDとdataを長さ付きのPacketにして書く
+func writePacket(w io.Writer, id int32, data []byte) error {
+	var body bytes.Buffer
+	writeVarInt(&body, id)
+	body.Write(data)
+
+	var p bytes.Buffer
+	writeVarInt(&p, int32(body.Len()))
+	p.Write(body.Bytes())
+	_, err := w.Write(p.Bytes())
+	return err
+}
+
+// pingServer is Server List Pingを送って、ServerのStatusを返す
+// https://wiki.vg/Server_List_Ping
+func pingServer(rw io.ReadWriter, host string, port uint16) (serverStatus, error) {
+	var hs bytes.Buffer
+	writeVarInt(&hs, -1) // Statusを聞くだけなのでProtocol Versionは何でも良い
+	writeVarInt(&hs, int32(len(host)))
+	hs.WriteString(host)
+	binary.Write(&hs, binary.BigEndian, port)
+	writeVarInt(&hs, 1) // next state: status
+	if err := writePacket(rw, 0x00, hs.Bytes()); err != nil {
+		return serverStatus{}, err
+	}
+	if err := writePacket(rw, 0x00, nil); err != nil {
+		return serverStatus{}, err
+	}
+
+	r := bufio.NewReader(rw)
+	length, err := readVarInt(r)
+	if err != nil {
+		return serverStatus{}, err
+	}
+	if length < 1 || length > slpMaxPacketLength {
+		return serverStatus{}, fmt.Errorf("invalid packet length %d", length)
+	}
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return serverStatus{}, err
+	}
+	pr := bytes.NewReader(packet)
+	id, err := readVarInt(pr)
+	if err != nil {
+		return serverStatus{}, err
+	}
+	if id != 0x00 {
+		return serverStatus{}, fmt.Errorf("unexpected packet id %d", id)
+	}
+	n, err := readVarInt(pr)
+	if err != nil {
+		return serverStatus{}, err
+	}
+	if n < 0 || int(n) > pr.Len() {
+		return serverStatus{}, fmt.Errorf("invalid json length %d", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(pr, body); err != nil {
+		return serverStatus{}, err
+	}
+
+	var st serverStatus
+	if err := json.Unmarshal(body, &st); err != nil {
+		return serverStatus{}, err
+	}
+	return st, nil
+}
+
+// dialAndPingServer is App EngineのSocket APIでServerに繋いでServer List Pingを送る
+func dialAndPingServer(ctx context.Context, ip string) (serverStatus, error) {
+	conn, err := socket.DialTimeout(ctx, "tcp", net.JoinHostPort(ip, strconv.Itoa(minecraftServerPort)), serverPingTimeout)
+	if err != nil {
+		return serverStatus{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(serverPingTimeout))
+	return pingServer(conn, ip, minecraftServerPort)
+}
+
+// joinableHost is Playerが繋ぐHost。DNSを設定している場合はWorldのRecord、無い場合はIP
+func joinableHost(minecraft Minecraft, c worldDNS, dnsConfigured bool) string {
+	if dnsConfigured {
+		return strings.TrimSuffix(c.RecordName(minecraft.World), ".")
+	}
+	return minecraft.IPAddr
+}
+
+// joinableMessage is Serverに繋げるようになったことを知らせるメッセージ
+func joinableMessage(minecraft Minecraft, host string, st *serverStatus) string {
+	m := fmt.Sprintf("world %s is up at %s", minecraft.World, net.JoinHostPort(host, strconv.Itoa(minecraftServerPort)))
+	if st != nil {
+		m += fmt.Sprintf(" (%s, %d/%d players)", st.Version.Name, st.Players.Online, st.Players.Max)
+	}
+	return m
+}
+
+// ServerReadyTQApi is Instanceが起動した後、Minecraft ServerがPingに答えるのを待つTQ
+type ServerReadyTQApi struct{}
+
+// CallServerReady is Instanceが起動したWorldのServerがPingに答えるまで待つTQを登録する
+// resourceIDは起動したInstanceのID。待っている間にInstanceが作り直された場合は何もしない
+func (a *ServerReadyTQApi) CallServerReady(c context.Context, minecraftKey *datastore.Key, resourceID int64, startedAt time.Time) (*taskqueue.Task, error) {
+	log.Infof(c, "Call Server Ready TQ, key = %v, resourceID = %d", minecraftKey, resourceID)
+	if minecraftKey == nil {
+		return nil, errors.New("key is required")
+	}
+
+	t := taskqueue.NewPOSTTask("/tq/1/minecraft/ready", url.Values{
+		"keyStr":     {minecraftKey.Encode()},
+		"resourceID": {strconv.FormatInt(resourceID, 10)},
+		"startedAt":  {strconv.FormatInt(startedAt.Unix(), 10)},
+	})
+	t.Delay = time.Second * 30
+	return taskqueue.Add(c, t, "minecraft")
+}
+
+// Handler is /tq/1/minecraft/ready handler
+// Pingに答えるか、ログで "Done" が見つかるまで408を返してTQにRetryさせる
+func (a *ServerReadyTQApi) Handler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	keyStr := r.FormValue("keyStr")
+	resourceID, _ := strconv.ParseInt(r.FormValue("resourceID"), 10, 64)
+	startedAtUnix, _ := strconv.ParseInt(r.FormValue("startedAt"), 10, 64)
+	startedAt := time.Unix(startedAtUnix, 0)
+
+	log.Infof(ctx, "keyStr = %s, resourceID = %d, startedAt = %s", keyStr, resourceID, startedAt)
+
+	key, err := datastore.DecodeKey(keyStr)
+	if err != nil {
+		log.Errorf(ctx, "key decode error. keyStr = %s, err = %s", keyStr, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var entity Minecraft
+	err = datastore.Get(ctx, key, &entity)
+	if err == datastore.ErrNoSuchEntity {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err != nil {
+		log.Errorf(ctx, "datastore get error. key = %s. error = %v", key.StringID(), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	entity.Key = key
+	if entity.Status != "exists" || entity.ResourceID != resourceID || !entity.JoinableAt.IsZero() {
+		log.Infof(ctx, "%s is already joinable or not running. status = %s, resourceID = %d", entity.World, entity.Status, entity.ResourceID)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if len(entity.IPAddr) < 1 {
+		log.Warningf(ctx, "%s has no ip address", entity.World)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	st, err := dialAndPingServer(ctx, entity.IPAddr)
+	if err != nil {
+		if time.Since(startedAt) < serverReadyTimeout {
+			log.Infof(ctx, "%s does not answer yet. %v", entity.World, err)
+			w.WriteHeader(http.StatusRequestTimeout)
+			return
+		}
+		log.Warningf(ctx, "%s did not answer in %s. %v", entity.World, serverReadyTimeout, err)
+		notifySlack(ctx, fmt.Sprintf("world %s did not answer ping in %s after the instance started. check the server log.", entity.World, serverReadyTimeout), "#d00000")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	err = markJoinable(ctx, entity, &st)
+	if err != nil {
+		log.Errorf(ctx, "ERROR mark joinable: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// markJoinable is MinecraftのJoinableAtを記録し、Slackに知らせる
+// PingとログのどちらかでJoinableになるので、先に記録した方だけが知らせる
+func markJoinable(ctx context.Context, minecraft Minecraft, st *serverStatus) error {
+	var marked bool
+	err := datastore.RunInTransaction(ctx, func(c context.Context) error {
+		marked = false
+		var entity Minecraft
+		err := datastore.Get(c, minecraft.Key, &entity)
+		if err != nil {
+			return err
+		}
+		if entity.ResourceID != minecraft.ResourceID || !entity.JoinableAt.IsZero() {
+			return nil
+		}
+		entity.JoinableAt = time.Now()
+		entity.UpdatedAt = time.Now()
+		_, err = datastore.Put(c, minecraft.Key, &entity)
+		if err != nil {
+			return err
+		}
+		marked = true
+		return nil
+	}, nil)
+	if err != nil || !marked {
+		return err
+	}
+
+	var c worldDNS
+	var dnsConfigured bool
+	acs := AppConfigService{}
+	config, err := acs.Get(ctx)
+	if err == nil {
+		c, dnsConfigured = config.dnsConfig()
+	}
+	m := joinableMessage(minecraft, joinableHost(minecraft, c, dnsConfigured), st)
+	log.Infof(ctx, "%s", m)
+	notifySlack(ctx, m, "#36a64f")
+	return nil
+}
+
+// watchServerReadyLog is Serverのログで "Done" を見つけたら、Pingを待たずにJoinableにする
+func watchServerReadyLog(ctx context.Context, psd PubSubData) error {
+	if classifyServerLog(psd.StructPayload.Log) != serverLogDone {
+		return nil
+	}
+	id, ok := logResourceID(psd.Metadata.Labels)
+	if !ok {
+		return nil
+	}
+
+	var minecrafts []Minecraft
+	keys, err := datastore.NewQuery("Minecraft").Filter("ResourceID =", id).Limit(1).GetAll(ctx, &minecrafts)
+	if err != nil {
+		return err
+	}
+	if len(minecrafts) < 1 {
+		log.Infof(ctx, "minecraft is not found. resourceID = %d", id)
+		return nil
+	}
+	minecraft := minecrafts[0]
+	minecraft.Key = keys[0]
+	if minecraft.Status != "exists" || !minecraft.JoinableAt.IsZero() || len(minecraft.IPAddr) < 1 {
+		return nil
+	}
+	return markJoinable(ctx, minecraft, nil)
+}
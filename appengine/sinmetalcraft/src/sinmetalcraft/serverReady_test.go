@@ -0,0 +1,130 @@
+package sinmetalcraft
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestVarInt(t *testing.T) {
+	cases := []struct {
+		v    int32
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{1, []byte{0x01}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{25565, []byte{0xdd, 0xc7, 0x01}},
+		{-1, []byte{0xff, 0xff, 0xff, 0xff, 0x0f}},
+	}
+	for _, c := range cases {
+		var b bytes.Buffer
+		writeVarInt(&b, c.v)
+		if !bytes.Equal(b.Bytes(), c.want) {
+			t.Errorf("writeVarInt(%d) = %x, want %x", c.v, b.Bytes(), c.want)
+		}
+		got, err := readVarInt(bytes.NewReader(c.want))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.v {
+			t.Errorf("readVarInt(%x) = %d, want %d", c.want, got, c.v)
+		}
+	}
+	if _, err := readVarInt(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0x01})); err == nil {
+		t.Error("too big varint must be error")
+	}
+}
+
+// fakeMinecraftServer is Server List PingのHandshakeとStatus Requestを読んで、statusJSONを返す
+func fakeMinecraftServer(t *testing.T, conn net.Conn, statusJSON string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		length, err := readVarInt(r)
+		if err != nil {
+			t.Errorf("read packet length: %v", err)
+			return
+		}
+		if _, err := r.Discard(int(length)); err != nil {
+			t.Errorf("read packet: %v", err)
+			return
+		}
+	}
+	var data bytes.Buffer
+	writeVarInt(&data, int32(len(statusJSON)))
+	data.WriteString(statusJSON)
+	if err := writePacket(conn, 0x00, data.Bytes()); err != nil {
+		t.Errorf("write packet: %v", err)
+	}
+}
+
+func TestPingServer(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeMinecraftServer(t, server, `{"version":{"name":"1.12.2","protocol":340},"players":{"max":20,"online":3},"description":{"text":"sinmetalcraft"}}`)
+
+	st, err := pingServer(client, "104.198.1.1", minecraftServerPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Version.Name != "1.12.2" || st.Version.Protocol != 340 || st.Players.Online != 3 || st.Players.Max != 20 {
+		t.Errorf("status = %+v", st)
+	}
+}
+
+func TestPingServerHandshake(t *testing.T) {
+	var req bytes.Buffer
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader(nil), &req}
+	pingServer(rw, "world-1.sinmetal.org", minecraftServerPort)
+
+	r := bufio.NewReader(&req)
+	length, _ := readVarInt(r)
+	hs := make([]byte, length)
+	r.Read(hs)
+	want := append([]byte{0x00, 0xff, 0xff, 0xff, 0xff, 0x0f, 20}, []byte("world-1.sinmetal.org")...)
+	want = append(want, 0x63, 0xdd, 0x01)
+	if !bytes.Equal(hs, want) {
+		t.Errorf("handshake = %x, want %x", hs, want)
+	}
+	rest, _ := ioutil.ReadAll(r)
+	if !bytes.Equal(rest, []byte{0x01, 0x00}) {
+		t.Errorf("status request = %x", rest)
+	}
+}
+
+func TestPingServerInvalidResponse(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeMinecraftServer(t, server, `not json`)
+	if _, err := pingServer(client, "104.198.1.1", minecraftServerPort); err == nil {
+		t.Error("invalid json must be error")
+	}
+}
+
+func TestJoinableMessage(t *testing.T) {
+	minecraft := Minecraft{World: "world-1", IPAddr: "104.198.1.1"}
+	c := worldDNS{Domain: "sinmetal.org"}
+
+	if got := joinableHost(minecraft, c, false); got != "104.198.1.1" {
+		t.Errorf("host = %s", got)
+	}
+	host := joinableHost(minecraft, c, true)
+	if host != "world-1.sinmetal.org" {
+		t.Errorf("host = %s", host)
+	}
+	if got := joinableMessage(minecraft, host, nil); got != "world world-1 is up at world-1.sinmetal.org:25565" {
+		t.Errorf("message = %s", got)
+	}
+	var st serverStatus
+	st.Version.Name = "1.12.2"
+	st.Players.Max = 20
+	if got := joinableMessage(minecraft, "104.198.1.1", &st); got != "world world-1 is up at 104.198.1.1:25565 (1.12.2, 0/20 players)" {
+		t.Errorf("message = %s", got)
+	}
+}
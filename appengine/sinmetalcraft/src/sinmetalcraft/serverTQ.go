@@ -3,6 +3,7 @@ package sinmetalcraft
 import (
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"google.golang.org/appengine"
@@ -24,11 +25,14 @@ func init() {
 
 	http.HandleFunc("/tq/1/server/instance/create", api.CreateInstance)
 	http.HandleFunc("/tq/1/server/instance/delete", api.DeleteInstance)
+	http.HandleFunc("/tq/1/server/instance/snapshot", api.SnapshotInstance)
 }
 
 type ServerTQApi struct{}
 
-func (a *ServerTQApi) CallCreateInstance(c context.Context, minecraftKey *datastore.Key, operationID string) (*taskqueue.Task, error) {
+// CallCreateInstance is World Diskができるのを待ってからInstanceを作成するTQを登録する
+// triedZonesはCapacityが足りずにInstanceを作れなかったZone
+func (a *ServerTQApi) CallCreateInstance(c context.Context, minecraftKey *datastore.Key, operationID string, triedZones ...string) (*taskqueue.Task, error) {
 	log.Infof(c, "Call Minecraft TQ, key = %v, operationID = %s", minecraftKey, operationID)
 	if minecraftKey == nil {
 		return nil, errors.New("key is required")
@@ -40,6 +44,7 @@ func (a *ServerTQApi) CallCreateInstance(c context.Context, minecraftKey *datast
 	t := taskqueue.NewPOSTTask("/tq/1/server/instance/create", url.Values{
 		"keyStr":      {minecraftKey.Encode()},
 		"operationID": {operationID},
+		"triedZones":  {strings.Join(triedZones, ",")},
 	})
 	t.Delay = time.Second * 30
 	return taskqueue.Add(c, t, "minecraft")
@@ -63,13 +68,35 @@ func (a *ServerTQApi) CallDeleteInstance(c context.Context, minecraftKey *datast
 	return taskqueue.Add(c, t, "minecraft")
 }
 
+// CallSnapshotInstance is Instanceの停止を待ってからWorld DiskのSnapshotを作成するTQを登録する
+func (a *ServerTQApi) CallSnapshotInstance(c context.Context, minecraftKey *datastore.Key, operationID string) (*taskqueue.Task, error) {
+	log.Infof(c, "Call Minecraft TQ, key = %v, operationID = %s", minecraftKey, operationID)
+	if minecraftKey == nil {
+		return nil, errors.New("key is required")
+	}
+	if len(operationID) < 1 {
+		return nil, errors.New("operationID is required")
+	}
+
+	t := taskqueue.NewPOSTTask("/tq/1/server/instance/snapshot", url.Values{
+		"keyStr":      {minecraftKey.Encode()},
+		"operationID": {operationID},
+	})
+	t.Delay = time.Second * 30
+	return taskqueue.Add(c, t, "minecraft")
+}
+
 func (a *ServerTQApi) CreateInstance(w http.ResponseWriter, r *http.Request) {
 	ctx := appengine.NewContext(r)
 
 	keyStr := r.FormValue("keyStr")
 	operationID := r.FormValue("operationID")
+	var triedZones []string
+	if v := r.FormValue("triedZones"); len(v) > 0 {
+		triedZones = strings.Split(v, ",")
+	}
 
-	log.Infof(ctx, "keyStr = %s, operationID = %s", keyStr, operationID)
+	log.Infof(ctx, "keyStr = %s, operationID = %s, triedZones = %v", keyStr, operationID, triedZones)
 
 	key, err := datastore.DecodeKey(keyStr)
 	if err != nil {
@@ -78,44 +105,48 @@ func (a *ServerTQApi) CreateInstance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	client := &http.Client{
-		Transport: &oauth2.Transport{
-			Source: google.AppEngineTokenSource(ctx, compute.ComputeScope),
-			Base:   &urlfetch.Transport{Context: ctx},
-		},
-	}
-	s, err := compute.New(client)
+	var entity Minecraft
+	err = datastore.Get(ctx, key, &entity)
 	if err != nil {
-		log.Errorf(ctx, "ERROR compute.New: %s", err)
+		log.Errorf(ctx, "datastore get error. key = %s. error = %v", key.StringID(), err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	nzos := compute.NewZoneOperationsService(s)
-	ope, err := nzos.Get(PROJECT_NAME, "asia-northeast1-b", operationID).Do()
+	entity.Key = key
+
+	s, err := newComputeService(ctx)
 	if err != nil {
-		log.Errorf(ctx, "ERROR compute Zone Operation Get Error. zone = %s, operation = %s, error = %s", "asia-northeast1-b", operationID, err.Error())
+		log.Errorf(ctx, "ERROR compute.New: %s", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	WriteLog(ctx, "__GET_ZONE_COMPUTE_OPE__", ope)
-
-	if ope.Status != "DONE" {
-		log.Infof(ctx, "operation status = %s", ope.Status)
+	// 別のZoneに移した場合もあるので、DiskのOperationはWorldのZoneで見る
+	_, err = waitZoneOperation(ctx, s, entity.Zone, operationID)
+	if err == errOperationWaiting {
 		w.WriteHeader(http.StatusRequestTimeout)
 		return
 	}
-
-	var entity Minecraft
-	err = datastore.Get(ctx, key, &entity)
 	if err != nil {
-		log.Errorf(ctx, "datastore get error. key = %s. error = %v", key.StringID(), err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	entity.Key = key
 
 	is := compute.NewInstancesService(s)
-	name, err := createInstance(ctx, is, entity)
+	name, err := createInstance(ctx, is, entity, triedZones...)
+	ev := newAuditEvent(ctx, r, AuditActionInstanceCreate)
+	ev.Target = key.StringID()
+	if isCapacityError(err) {
+		log.Warningf(ctx, "no capacity in %s. %v", entity.Zone, err)
+		var zone string
+		zone, err = moveToAlternateZone(ctx, s, entity, triedZones)
+		if err == nil {
+			ev.SetDiff(map[string]string{"zone": entity.Zone}, map[string]string{"zone": zone})
+			ev.Record(ctx, nil)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+	ev.Record(ctx, err)
 	if err != nil {
 		log.Errorf(ctx, "instance create error. error = %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -154,10 +185,18 @@ func (a *ServerTQApi) DeleteInstance(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	// Capacityが足りずに別のZoneに移したWorldもあるので、WorldのZoneでOperationを見る
+	var current Minecraft
+	err = datastore.Get(ctx, key, &current)
+	if err != nil {
+		log.Errorf(ctx, "datastore get error. key = %s. error = %v", key.StringID(), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 	nzos := compute.NewZoneOperationsService(s)
-	ope, err := nzos.Get(PROJECT_NAME, "asia-northeast1-b", operationID).Do()
+	ope, err := nzos.Get(PROJECT_NAME, current.Zone, operationID).Do()
 	if err != nil {
-		log.Errorf(ctx, "ERROR compute Zone Operation Get Error. zone = %s, operation = %s, error = %s", "asia-northeast1-b", operationID, err.Error())
+		log.Errorf(ctx, "ERROR compute Zone Operation Get Error. zone = %s, operation = %s, error = %s", current.Zone, operationID, err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -169,17 +208,20 @@ func (a *ServerTQApi) DeleteInstance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var entity Minecraft
+	ev := newAuditEvent(ctx, r, AuditActionInstanceDelete)
+	ev.Target = key.StringID()
+	var before, entity Minecraft
 	err = datastore.RunInTransaction(ctx, func(c context.Context) error {
-		err := datastore.Get(ctx, key, &entity)
+		err := datastore.Get(c, key, &entity)
 		if err != nil {
 			return err
 		}
+		before = entity
 
 		entity.LatestSnapshot = latestSnapshot
 		entity.UpdatedAt = time.Now()
 
-		_, err = datastore.Put(ctx, key, &entity)
+		_, err = datastore.Put(c, key, &entity)
 		if err != nil {
 			return err
 		}
@@ -188,8 +230,18 @@ func (a *ServerTQApi) DeleteInstance(w http.ResponseWriter, r *http.Request) {
 	}, nil)
 	entity.Key = key
 
+	ev.SetDiff(before, entity)
+	if err != nil {
+		// LatestSnapshotを保存できないままInstanceを消すと、次の起動で古いSnapshotを使うので、TQのRetryでやり直す
+		ev.Record(ctx, err)
+		log.Errorf(ctx, "Minecraft Put Error. error = %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
 	is := compute.NewInstancesService(s)
 	name, err := deleteInstance(ctx, is, entity)
+	ev.Record(ctx, err)
 	if err != nil {
 		log.Errorf(ctx, "instance delete error. error = %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -199,3 +251,68 @@ func (a *ServerTQApi) DeleteInstance(w http.ResponseWriter, r *http.Request) {
 	log.Infof(ctx, "instance delete done. name = %s", name)
 	w.WriteHeader(http.StatusOK)
 }
+
+// SnapshotInstance is stopしたInstanceのWorld DiskのSnapshotを作成する
+// Snapshot作成後は DeleteInstance でInstanceを削除する
+func (a *ServerTQApi) SnapshotInstance(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	keyStr := r.FormValue("keyStr")
+	operationID := r.FormValue("operationID")
+
+	log.Infof(ctx, "keyStr = %s, operationID = %s", keyStr, operationID)
+
+	key, err := datastore.DecodeKey(keyStr)
+	if err != nil {
+		log.Errorf(ctx, "key decode error. keyStr = %s, err = %s", keyStr, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	s, err := newComputeService(ctx)
+	if err != nil {
+		log.Errorf(ctx, "ERROR compute.New: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// Capacityが足りずに別のZoneに移したWorldもあるので、WorldのZoneでOperationを見る
+	var current Minecraft
+	err = datastore.Get(ctx, key, &current)
+	if err != nil {
+		log.Errorf(ctx, "datastore get error. key = %s. error = %v", key.StringID(), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	nzos := compute.NewZoneOperationsService(s)
+	ope, err := nzos.Get(PROJECT_NAME, current.Zone, operationID).Do()
+	if err != nil {
+		log.Errorf(ctx, "ERROR compute Zone Operation Get Error. zone = %s, operation = %s, error = %s", current.Zone, operationID, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	WriteLog(ctx, "__GET_ZONE_COMPUTE_OPE__", ope)
+
+	if ope.Status != "DONE" {
+		log.Infof(ctx, "operation status = %s", ope.Status)
+		w.WriteHeader(http.StatusRequestTimeout)
+		return
+	}
+
+	entity := current
+	entity.Key = key
+
+	ds := compute.NewDisksService(s)
+	sn, err := createWorldSnapshot(ctx, ds, entity)
+	ev := newAuditEvent(ctx, r, AuditActionSnapshotCreate)
+	ev.Target = key.StringID()
+	ev.SetDiff(nil, map[string]string{"snapshot": sn})
+	ev.Record(ctx, err)
+	if err != nil {
+		log.Errorf(ctx, "snapshot create error. error = %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof(ctx, "snapshot create done. name = %s", sn)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,173 @@
+package sinmetalcraft
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// Minecraft ServerType
+// 空の場合はvanillaとして扱う
+const (
+	ServerTypeVanilla = "vanilla"
+	ServerTypePaper   = "paper"
+	ServerTypeFabric  = "fabric"
+	ServerTypeForge   = "forge"
+)
+
+// fabricInstallerVersion is Fabric Loaderを入れるのに使うFabric InstallerのVersion
+// InstallerはLoaderのVersionを引数で受け取るので、Worldごとに変える必要は無い
+const fabricInstallerVersion = "0.11.2"
+
+// serverBuildPatterns is ServerTypeごとのServerBuildの形式
+// paperはBuild番号、fabricはLoaderのVersion、forgeはForgeのVersion
+var serverBuildPatterns = map[string]*regexp.Regexp{
+	ServerTypePaper:  regexp.MustCompile(`^[0-9]+$`),
+	ServerTypeFabric: regexp.MustCompile(`^[0-9]+\.[0-9]+\.[0-9]+$`),
+	ServerTypeForge:  regexp.MustCompile(`^[0-9]+(\.[0-9]+){1,3}$`),
+}
+
+// releaseVersionPattern is 1.12.2 のようなReleaseのVersion
+var releaseVersionPattern = regexp.MustCompile(`^1\.([0-9]+)(\.[0-9]+)?$`)
+
+// forgeMaxMinorVersion is 起動できるForgeのMinecraftのMinor Version
+// 1.17以降のForgeはJava 16以上が要るが、minecraftのImageにはまだ入っていない
+const forgeMaxMinorVersion = 16
+
+// fabricMinMinorVersion is Fabric LoaderがサポートしているMinecraftのMinor Version
+const fabricMinMinorVersion = 14
+
+// releaseMinorVersion is ReleaseのVersionのMinor Version。Releaseで無い場合はfalseを返す
+func releaseMinorVersion(jarVersion string) (int, bool) {
+	m := releaseVersionPattern.FindStringSubmatch(jarVersion)
+	if m == nil {
+		return 0, false
+	}
+	minor, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, false
+	}
+	return minor, true
+}
+
+// serverTypeOf is WorldのServerType。Catalogを作る前のWorldは空なのでvanillaにする
+func serverTypeOf(minecraft Minecraft) string {
+	if len(minecraft.ServerType) < 1 {
+		return ServerTypeVanilla
+	}
+	return minecraft.ServerType
+}
+
+// validateServerType is ServerTypeとServerBuildの組み合わせを確認する
+func validateServerType(serverType string, serverBuild string, jarVersion string) error {
+	if len(serverType) < 1 || serverType == ServerTypeVanilla {
+		if len(serverBuild) > 0 {
+			return invalidRequestError("serverBuild is not used with vanilla.").WithDetail("serverBuild", serverBuild)
+		}
+		return nil
+	}
+	p, ok := serverBuildPatterns[serverType]
+	if !ok {
+		return invalidRequestError(fmt.Sprintf("serverType is %s, %s, %s or %s.", ServerTypeVanilla, ServerTypePaper, ServerTypeFabric, ServerTypeForge)).WithDetail("serverType", serverType)
+	}
+	if !p.MatchString(serverBuild) {
+		return invalidRequestError(fmt.Sprintf("serverBuild is invalid for %s.", serverType)).WithDetail("serverBuild", serverBuild)
+	}
+	minor, release := releaseMinorVersion(jarVersion)
+	switch serverType {
+	case ServerTypeForge:
+		if !release {
+			return invalidRequestError("forge supports only release versions.").WithDetail("jarVersion", jarVersion)
+		}
+		if minor > forgeMaxMinorVersion {
+			return invalidRequestError(fmt.Sprintf("forge supports up to 1.%d. newer forge needs java 16 or later.", forgeMaxMinorVersion)).WithDetail("jarVersion", jarVersion)
+		}
+	case ServerTypeFabric:
+		if release && minor < fabricMinMinorVersion {
+			return invalidRequestError(fmt.Sprintf("fabric supports 1.%d or later.", fabricMinMinorVersion)).WithDetail("jarVersion", jarVersion)
+		}
+	}
+	return nil
+}
+
+// serverLaunch is Startup Scriptに渡すServerの入れ方と起動方法
+// InstanceのMetadataに server-* として設定する
+type serverLaunch struct {
+	Type         string // server-type
+	Build        string // server-build
+	Download     string // server-download: Server JarかInstallerのURL。gs:// かhttps://
+	DownloadFile string // server-download-file: Downloadしたファイルの名前
+	InstallArgs  string // server-install-args: 空で無い場合は java -jar DownloadFile InstallArgs でInstallする
+	LaunchArgs   string // server-launch-args: java のMemoryの指定より後ろの引数
+}
+
+// resolveServerLaunch is WorldのServerTypeから、Startup Scriptが何を取ってきてどう起動するかを決める
+// vanillaはMirrorしたServer Jarをそのまま起動する。他のTypeもInstallに使うので、Server Jarは常に取ってくる
+func resolveServerLaunch(minecraft Minecraft) (serverLaunch, error) {
+	v := minecraft.JarVersion
+	b := minecraft.ServerBuild
+	jar := fmt.Sprintf("minecraft_server.%s.jar", v)
+
+	switch serverTypeOf(minecraft) {
+	case ServerTypeVanilla:
+		return serverLaunch{
+			Type:         ServerTypeVanilla,
+			Download:     fmt.Sprintf("gs://%s/%s", MinecraftJarBucket, jar),
+			DownloadFile: jar,
+			LaunchArgs:   fmt.Sprintf("-jar %s nogui", jar),
+		}, nil
+	case ServerTypePaper:
+		f := fmt.Sprintf("paper-%s-%s.jar", v, b)
+		return serverLaunch{
+			Type:         ServerTypePaper,
+			Build:        b,
+			Download:     fmt.Sprintf("https://api.papermc.io/v2/projects/paper/versions/%s/builds/%s/downloads/%s", v, b, f),
+			DownloadFile: f,
+			LaunchArgs:   fmt.Sprintf("-jar %s nogui", f),
+		}, nil
+	case ServerTypeFabric:
+		// InstallerはServer Jarを server.jar として探すので、Startup ScriptでCopyしておく
+		f := fmt.Sprintf("fabric-installer-%s.jar", fabricInstallerVersion)
+		return serverLaunch{
+			Type:         ServerTypeFabric,
+			Build:        b,
+			Download:     fmt.Sprintf("https://maven.fabricmc.net/net/fabricmc/fabric-installer/%s/%s", fabricInstallerVersion, f),
+			DownloadFile: f,
+			InstallArgs:  fmt.Sprintf("server -mcversion %s -loader %s", v, b),
+			LaunchArgs:   "-jar fabric-server-launch.jar nogui",
+		}, nil
+	case ServerTypeForge:
+		minor, ok := releaseMinorVersion(v)
+		if !ok {
+			return serverLaunch{}, fmt.Errorf("forge supports only release versions. jarVersion = %s", v)
+		}
+		fv := v + "-" + b
+		l := serverLaunch{
+			Type:         ServerTypeForge,
+			Build:        b,
+			Download:     fmt.Sprintf("https://maven.minecraftforge.net/net/minecraftforge/forge/%s/forge-%s-installer.jar", fv, fv),
+			DownloadFile: fmt.Sprintf("forge-%s-installer.jar", fv),
+			InstallArgs:  "--installServer",
+			LaunchArgs:   fmt.Sprintf("-jar forge-%s.jar nogui", fv),
+		}
+		// 1.17以降のInstallerはJarではなく引数のファイルを作る
+		// Java 16以上が要るので、validateServerTypeでforgeMaxMinorVersionより新しいVersionは受け付けていない
+		if minor >= 17 {
+			l.LaunchArgs = fmt.Sprintf("@libraries/net/minecraftforge/forge/%s/unix_args.txt nogui", fv)
+		}
+		return l, nil
+	}
+	return serverLaunch{}, fmt.Errorf("unknown server type. %s", minecraft.ServerType)
+}
+
+// Metadata is InstanceのMetadataに設定するserver-*
+func (l serverLaunch) Metadata() map[string]string {
+	return map[string]string{
+		"server-type":          l.Type,
+		"server-build":         l.Build,
+		"server-download":      l.Download,
+		"server-download-file": l.DownloadFile,
+		"server-install-args":  l.InstallArgs,
+		"server-launch-args":   l.LaunchArgs,
+	}
+}
@@ -0,0 +1,122 @@
+package sinmetalcraft
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateServerType(t *testing.T) {
+	cases := []struct {
+		serverType  string
+		serverBuild string
+		jarVersion  string
+		ok          bool
+	}{
+		{"", "", "1.12.2", true},
+		{ServerTypeVanilla, "", "17w45a", true},
+		{ServerTypeVanilla, "1", "1.12.2", false},
+		{ServerTypePaper, "1620", "1.12.2", true},
+		{ServerTypePaper, "", "1.12.2", false},
+		{ServerTypePaper, "latest", "1.12.2", false},
+		{ServerTypeFabric, "0.14.21", "1.18.2", true},
+		{ServerTypeFabric, "14", "1.18.2", false},
+		{ServerTypeFabric, "0.14.21", "1.14", true},
+		{ServerTypeFabric, "0.14.21", "1.12.2", false},
+		{ServerTypeForge, "14.23.5.2859", "1.12.2", true},
+		{ServerTypeForge, "36.2.39", "1.16.5", true},
+		// 1.17以降のForgeはJava 16以上が要る
+		{ServerTypeForge, "40.2.0", "1.18.2", false},
+		{ServerTypeForge, "14.23.5.2859", "17w45a", false},
+		{"spigot", "1", "1.12.2", false},
+	}
+	for _, c := range cases {
+		err := validateServerType(c.serverType, c.serverBuild, c.jarVersion)
+		if c.ok && err != nil {
+			t.Errorf("validateServerType(%q, %q, %q) err = %v", c.serverType, c.serverBuild, c.jarVersion, err)
+		}
+		if !c.ok {
+			if _, isAPIError := err.(*APIError); !isAPIError {
+				t.Errorf("validateServerType(%q, %q, %q) err = %v, want APIError", c.serverType, c.serverBuild, c.jarVersion, err)
+			}
+		}
+	}
+}
+
+func TestResolveServerLaunch(t *testing.T) {
+	cases := []struct {
+		minecraft Minecraft
+		download  string
+		install   string
+		launch    string
+	}{
+		{
+			Minecraft{JarVersion: "1.12.2"},
+			"gs://sinmetalcraft-minecraft-jar/minecraft_server.1.12.2.jar",
+			"",
+			"-jar minecraft_server.1.12.2.jar nogui",
+		},
+		{
+			Minecraft{JarVersion: "1.12.2", ServerType: ServerTypePaper, ServerBuild: "1620"},
+			"https://api.papermc.io/v2/projects/paper/versions/1.12.2/builds/1620/downloads/paper-1.12.2-1620.jar",
+			"",
+			"-jar paper-1.12.2-1620.jar nogui",
+		},
+		{
+			Minecraft{JarVersion: "1.18.2", ServerType: ServerTypeFabric, ServerBuild: "0.14.21"},
+			"https://maven.fabricmc.net/net/fabricmc/fabric-installer/0.11.2/fabric-installer-0.11.2.jar",
+			"server -mcversion 1.18.2 -loader 0.14.21",
+			"-jar fabric-server-launch.jar nogui",
+		},
+		{
+			Minecraft{JarVersion: "1.12.2", ServerType: ServerTypeForge, ServerBuild: "14.23.5.2859"},
+			"https://maven.minecraftforge.net/net/minecraftforge/forge/1.12.2-14.23.5.2859/forge-1.12.2-14.23.5.2859-installer.jar",
+			"--installServer",
+			"-jar forge-1.12.2-14.23.5.2859.jar nogui",
+		},
+		{
+			Minecraft{JarVersion: "1.18.2", ServerType: ServerTypeForge, ServerBuild: "40.2.0"},
+			"https://maven.minecraftforge.net/net/minecraftforge/forge/1.18.2-40.2.0/forge-1.18.2-40.2.0-installer.jar",
+			"--installServer",
+			"@libraries/net/minecraftforge/forge/1.18.2-40.2.0/unix_args.txt nogui",
+		},
+	}
+	for _, c := range cases {
+		l, err := resolveServerLaunch(c.minecraft)
+		if err != nil {
+			t.Errorf("%s err = %v", serverTypeOf(c.minecraft), err)
+			continue
+		}
+		if l.Type != serverTypeOf(c.minecraft) || l.Build != c.minecraft.ServerBuild {
+			t.Errorf("%s type = %s, build = %s", serverTypeOf(c.minecraft), l.Type, l.Build)
+		}
+		if l.Download != c.download || !strings.HasSuffix(l.Download, "/"+l.DownloadFile) {
+			t.Errorf("%s download = %s, file = %s, want %s", serverTypeOf(c.minecraft), l.Download, l.DownloadFile, c.download)
+		}
+		if l.InstallArgs != c.install || l.LaunchArgs != c.launch {
+			t.Errorf("%s install = %q, launch = %q, want %q, %q", serverTypeOf(c.minecraft), l.InstallArgs, l.LaunchArgs, c.install, c.launch)
+		}
+	}
+
+	if _, err := resolveServerLaunch(Minecraft{JarVersion: "17w45a", ServerType: ServerTypeForge, ServerBuild: "1.0"}); err == nil {
+		t.Errorf("forge snapshot should be error")
+	}
+}
+
+func TestServerLaunchMetadata(t *testing.T) {
+	l, err := resolveServerLaunch(Minecraft{JarVersion: "1.12.2"})
+	if err != nil {
+		t.Fatalf("resolveServerLaunch err = %v", err)
+	}
+	items := metadataItems(l.Metadata())
+	var keys []string
+	for _, item := range items {
+		keys = append(keys, item.Key)
+	}
+	want := "server-build,server-download,server-download-file,server-install-args,server-launch-args,server-type"
+	if strings.Join(keys, ",") != want {
+		t.Errorf("keys = %v, want %s", keys, want)
+	}
+	if *items[5].Value != ServerTypeVanilla {
+		t.Errorf("server-type = %s", *items[5].Value)
+	}
+}
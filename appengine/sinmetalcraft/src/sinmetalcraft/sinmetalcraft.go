@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,11 +16,13 @@ import (
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/urlfetch"
-	"google.golang.org/appengine/user"
 
 	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
 
 	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
 )
 
 const PROJECT_NAME = "sinmetalcraft"
@@ -28,7 +32,14 @@ func init() {
 	api := MinecraftApi{}
 
 	http.HandleFunc("/minecraft", handlerMinecraftLog)
-	http.HandleFunc("/api/1/minecraft", api.Handler)
+	apiRouter.Handle("GET", "/api/1/minecraft", api.List)
+	apiRouter.Handle("POST", "/api/1/minecraft", api.Post, requireAdmin, audit(AuditActionWorldCreate))
+	apiRouter.Handle("PUT", "/api/1/minecraft", api.Put, requireAdmin, audit(AuditActionWorldUpdate))
+	apiRouter.Handle("DELETE", "/api/1/minecraft", api.Delete, requireAdmin, audit(AuditActionWorldDelete))
+	apiRouter.Handle("GET", "/api/1/minecraft/{world}", api.Get)
+	apiRouter.Handle("PUT", "/api/1/minecraft/{world}", api.Put, requireAdmin, audit(AuditActionWorldUpdate))
+	apiRouter.Handle("DELETE", "/api/1/minecraft/{world}", api.Delete, requireAdmin, audit(AuditActionWorldDelete))
+	apiRouter.Handle("POST", "/api/1/minecraft/{world}/clone", api.Clone, requireAdmin, audit(AuditActionWorldClone))
 }
 
 type Minecraft struct {
@@ -36,18 +47,40 @@ type Minecraft struct {
 	KeyStr             string         `json:"key" datastore:"-"`
 	World              string         `json:"world"`
 	ResourceID         int64          `json:"resourceID"`
-	Zone               string         `json:"zone" datastore:",unindexed"`
+	Zone               string         `json:"zone"`
 	IPAddr             string         `json:"ipAddr" datastore:",unindexed"`
-	Status             string         `json:"status" datastore:",unindexed"`
+	Status             string         `json:"status"`
 	OperationType      string         `json:"operationType" datastore:",unindexed"`
-	OperationStatus    string         `json:"operationstatus" datastore:",unindexed"`
-	LatestSnapshot     string         `json:"latestSnpshot" datastore:",unindexed"`
-	JarVersion         string         `json:"jarVersion" datastore:",unindexed"`
-	OverviewerSnapshot string         `json:"overViewerSnapshot" datastore:",unindexed"` // Minecraft Overviewerを作成済みのsnapshot name
+	OperationStatus    string         `json:"operationStatus" datastore:",unindexed"`
+	LatestSnapshot     string         `json:"latestSnapshot" datastore:",unindexed"`
+	JarVersion         string         `json:"jarVersion"`
+	ServerType         string         `json:"serverType" datastore:",noindex"`           // vanilla, paper, fabric or forge。空の場合はvanilla
+	ServerBuild        string         `json:"serverBuild" datastore:",noindex"`          // paperのBuild番号, fabricのLoader Version, forgeのVersion
+	OverviewerSnapshot string         `json:"overviewerSnapshot" datastore:",unindexed"` // Minecraft Overviewerを作成済みのsnapshot name
+	Provisioning       string         `json:"provisioning" datastore:",noindex"`         // preemptible or standard。最後に作ったInstanceの種類。空の場合はpreemptible
+	StandardFallbackAt time.Time      `json:"standardFallbackAt" datastore:",noindex"`   // 繰り返しPreemptされてstandard VMにした時間。これより前のPreemptは数えない
+	PlayWindows        []string       `json:"playWindows" datastore:",noindex"`          // "sat,sun 10:00-23:00" のような遊ぶ時間帯。この中でPreemptされると再起動する
+	JoinableAt         time.Time      `json:"joinableAt" datastore:",noindex"`           // 今のInstanceのServerがPingに答えた、またはログに "Done" が出た時間。起動中はzero
 	CreatedAt          time.Time      `json:"createdAt"`
 	UpdatedAt          time.Time      `json:"updatedAt"`
 }
 
+// MinecraftListParam is GET /api/1/minecraft のQuery Parameter
+type MinecraftListParam struct {
+	Limit      int
+	Cursor     string
+	Status     string
+	Zone       string
+	JarVersion string
+}
+
+// MinecraftListResponse is GET /api/1/minecraft のResponse
+type MinecraftListResponse struct {
+	Items   []*Minecraft `json:"items"`
+	Cursor  string       `json:"cursor"`
+	HasNext bool         `json:"hasNext"`
+}
+
 type MinecraftApiListResponse struct {
 	Items  []MinecraftApiResponse `json:"items"`
 	Cursor string                 `json:"cursor"`
@@ -56,7 +89,7 @@ type MinecraftApiListResponse struct {
 type MinecraftApiResponse struct {
 	InstanceName      string `json:"instanceName"`
 	Zone              string `json:"zone"`
-	IPAddr            string `json:"iPAddr"`
+	IPAddr            string `json:"ipAddr"`
 	Status            string `json:"status"`
 	CreationTimestamp string `json:"creationTimestamp"`
 }
@@ -93,53 +126,29 @@ type PubSubBody struct {
 
 type MinecraftApi struct{}
 
-// /api/1/minecraft handler
-func (a *MinecraftApi) Handler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "POST" {
-		a.Post(w, r)
-	} else if r.Method == "PUT" {
-		a.Put(w, r)
-	} else if r.Method == "GET" {
-		a.List(w, r)
-	} else if r.Method == "DELETE" {
-		a.Delete(w, r)
-	} else {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-	}
-}
-
 // create world data
-func (a *MinecraftApi) Post(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
-
-	u := user.Current(ctx)
-	if u == nil {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(http.StatusUnauthorized)
-		loginURL, err := user.LoginURL(ctx, "")
-		if err != nil {
-			log.Errorf(ctx, "get user login URL error, %s", err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		w.Write([]byte(fmt.Sprintf(`{"loginURL":"%s"}`, loginURL)))
-		return
-	}
-	if user.IsAdmin(ctx) == false {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(http.StatusForbidden)
-		return
-	}
-
+func (a *MinecraftApi) Post(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
 	var minecraft Minecraft
 	err := json.NewDecoder(r.Body).Decode(&minecraft)
 	if err != nil {
-		log.Infof(ctx, "rquest body, %v", r.Body)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"message": "invalid request."}`))
-		return
+		return invalidRequestError("invalid request.").WithDetail("cause", err.Error())
 	}
 	defer r.Body.Close()
+	if err := validateWorldName(minecraft.World); err != nil {
+		return err
+	}
+	if err := validateJarVersion(ctx, minecraft.JarVersion); err != nil {
+		return err
+	}
+	if err := validateServerType(minecraft.ServerType, minecraft.ServerBuild, minecraft.JarVersion); err != nil {
+		return err
+	}
+	if err := validatePlayWindows(minecraft.PlayWindows); err != nil {
+		return err
+	}
+	minecraft.ServerType = serverTypeOf(minecraft)
+	ev := auditEventFromContext(ctx)
+	ev.Target = minecraft.World
 
 	key := datastore.NewKey(ctx, "Minecraft", minecraft.World, 0, nil)
 	err = datastore.RunInTransaction(ctx, func(c context.Context) error {
@@ -161,69 +170,71 @@ func (a *MinecraftApi) Post(w http.ResponseWriter, r *http.Request) {
 		return nil
 	}, nil)
 	if err != nil {
-		log.Errorf(ctx, "Minecraft Put Error. error = %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return internalError(err)
 	}
 	minecraft.KeyStr = key.Encode()
+	ev.SetDiff(nil, minecraft)
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(minecraft)
+	writeJSON(w, http.StatusCreated, minecraft)
+	return nil
 }
 
 // update world data
-func (a *MinecraftApi) Put(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
-
-	u := user.Current(ctx)
-	if u == nil {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(http.StatusUnauthorized)
-		loginURL, err := user.LoginURL(ctx, "")
-		if err != nil {
-			log.Errorf(ctx, "get user login URL error, %s", err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		w.Write([]byte(fmt.Sprintf(`{"loginURL":"%s"}`, loginURL)))
-		return
-	}
-	if user.IsAdmin(ctx) == false {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(http.StatusForbidden)
-		return
-	}
-
+func (a *MinecraftApi) Put(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
 	var minecraft Minecraft
 	err := json.NewDecoder(r.Body).Decode(&minecraft)
 	if err != nil {
-		log.Infof(ctx, "rquest body, %v", r.Body)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"message": "invalid request."}`))
-		return
+		return invalidRequestError("invalid request.").WithDetail("cause", err.Error())
 	}
 	defer r.Body.Close()
 
-	key, err := datastore.DecodeKey(minecraft.KeyStr)
+	key, err := minecraftKey(ctx, p, minecraft.KeyStr)
 	if err != nil {
-		log.Infof(ctx, "invalid key, %v", r.Body)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"message": "invalid key."}`))
-		return
+		return err
 	}
-	minecraft.Key = key
+	ev := auditEventFromContext(ctx)
+	ev.Target = key.StringID()
 
+	current, err := getMinecraft(ctx, key)
+	if err != nil {
+		return err
+	}
+	// Catalogを作る前のVersionのWorldもあるので、変える時だけ確認する
+	if minecraft.JarVersion != current.JarVersion {
+		if err := validateJarVersion(ctx, minecraft.JarVersion); err != nil {
+			return err
+		}
+	}
+	// serverTypeを送ってこないClientもあるので、その場合は今のServerTypeのままにする
+	if len(minecraft.ServerType) < 1 {
+		minecraft.ServerType = current.ServerType
+		minecraft.ServerBuild = current.ServerBuild
+	}
+	if err := validateServerType(minecraft.ServerType, minecraft.ServerBuild, minecraft.JarVersion); err != nil {
+		return err
+	}
+	// playWindowsを送ってこないClientもあるので、その場合は今のPlayWindowsのままにする。消す場合は [] を送る
+	if minecraft.PlayWindows == nil {
+		minecraft.PlayWindows = current.PlayWindows
+	}
+	if err := validatePlayWindows(minecraft.PlayWindows); err != nil {
+		return err
+	}
+
+	var before, entity Minecraft
 	err = datastore.RunInTransaction(ctx, func(c context.Context) error {
-		var entity Minecraft
 		err := datastore.Get(ctx, key, &entity)
-		if err != datastore.ErrNoSuchEntity && err != nil {
+		if err != nil {
 			return err
 		}
+		before = entity
 
 		entity.IPAddr = minecraft.IPAddr
 		entity.Zone = minecraft.Zone
 		entity.JarVersion = minecraft.JarVersion
+		entity.ServerType = serverTypeOf(minecraft)
+		entity.ServerBuild = minecraft.ServerBuild
+		entity.PlayWindows = minecraft.PlayWindows
 		entity.UpdatedAt = time.Now()
 		_, err = datastore.Put(ctx, key, &entity)
 		if err != nil {
@@ -232,91 +243,248 @@ func (a *MinecraftApi) Put(w http.ResponseWriter, r *http.Request) {
 
 		return nil
 	}, nil)
+	if err == datastore.ErrNoSuchEntity {
+		return notFoundError(fmt.Sprintf("%s is not found.", key.StringID()))
+	}
 	if err != nil {
-		log.Errorf(ctx, "Minecraft Put Error. error = %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return internalError(err)
 	}
+	entity.Key = key
+	entity.KeyStr = key.Encode()
+	ev.SetDiff(before, entity)
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(minecraft)
+	if entity.JarVersion != before.JarVersion || entity.ServerType != before.ServerType || entity.ServerBuild != before.ServerBuild {
+		err = updateLaunchMetadata(ctx, entity)
+		if err != nil {
+			return internalError(err)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, entity)
+	return nil
+}
+
+// updateLaunchMetadata is Instanceがある場合は起動方法とPluginのMetadataを書き換えて、次に起動した時に反映されるようにする
+// Instanceが無い場合は、作る時にMetadataに書く
+func updateLaunchMetadata(ctx context.Context, minecraft Minecraft) error {
+	if minecraft.Status != "exists" && minecraft.Status != "stopping" {
+		return nil
+	}
+	launch, err := resolveServerLaunch(minecraft)
+	if err != nil {
+		return err
+	}
+	plugins, err := pluginMetadata(ctx, minecraft)
+	if err != nil {
+		return err
+	}
+	md := launch.Metadata()
+	md["minecraft-version"] = minecraft.JarVersion
+	for k, v := range plugins {
+		md[k] = v
+	}
+	s, err := newComputeService(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = setInstanceMetadataItems(ctx, compute.NewInstancesService(s), minecraft, md)
+	if isNotFoundError(err) {
+		return nil
+	}
+	return err
 }
 
 // delete world data
-func (a *MinecraftApi) Delete(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+func (a *MinecraftApi) Delete(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	key, err := minecraftKey(ctx, p, r.FormValue("key"))
+	if err != nil {
+		return err
+	}
+
+	ev := auditEventFromContext(ctx)
+	ev.Target = key.StringID()
 
-	u := user.Current(ctx)
-	if u == nil {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(http.StatusUnauthorized)
-		loginURL, err := user.LoginURL(ctx, "")
+	var before *Minecraft
+	err = datastore.RunInTransaction(ctx, func(c context.Context) error {
+		var entity Minecraft
+		err := datastore.Get(ctx, key, &entity)
+		if err == datastore.ErrNoSuchEntity {
+			before = nil
+			return nil
+		}
 		if err != nil {
-			log.Errorf(ctx, "get user login URL error, %s", err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			return err
 		}
-		w.Write([]byte(fmt.Sprintf(`{"loginURL":"%s"}`, loginURL)))
-		return
-	}
-	if user.IsAdmin(ctx) == false {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		w.WriteHeader(http.StatusForbidden)
-		return
+		before = &entity
+
+		return datastore.Delete(ctx, key)
+	}, nil)
+	if err != nil {
+		return internalError(err)
 	}
+	ev.SetDiff(before, nil)
 
-	keyStr := r.FormValue("key")
+	writeJSON(w, http.StatusOK, struct{}{})
+	return nil
+}
 
-	key, err := datastore.DecodeKey(keyStr)
+// get world data
+func (a *MinecraftApi) Get(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	key, err := minecraftKey(ctx, p, "")
 	if err != nil {
-		log.Infof(ctx, "invalid key, %v", r.Body)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"message": "invalid key."}`))
-		return
+		return err
 	}
 
-	err = datastore.RunInTransaction(ctx, func(c context.Context) error {
-		return datastore.Delete(ctx, key)
-	}, nil)
+	entity, err := getMinecraft(ctx, key)
 	if err != nil {
-		log.Errorf(ctx, "Minecraft Delete Error. error = %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(`{}`)
+	writeJSON(w, http.StatusOK, entity)
+	return nil
 }
 
 // list world data
-func (a *MinecraftApi) List(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+func (a *MinecraftApi) List(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	param, err := parseMinecraftListParam(r)
+	if err != nil {
+		return err
+	}
 
-	q := datastore.NewQuery("Minecraft").Order("-UpdatedAt")
+	q := param.Query()
+	if len(param.Cursor) > 0 {
+		c, err := datastore.DecodeCursor(param.Cursor)
+		if err != nil {
+			return invalidRequestError("invalid cursor.").WithDetail("cursor", param.Cursor)
+		}
+		q = q.Start(c)
+	}
 
-	list := make([]*Minecraft, 0)
-	for t := q.Run(ctx); ; {
+	res := MinecraftListResponse{
+		Items: make([]*Minecraft, 0),
+	}
+	t := q.Run(ctx)
+	for len(res.Items) < param.Limit {
 		var entity Minecraft
 		key, err := t.Next(&entity)
 		if err == datastore.Done {
 			break
 		}
 		if err != nil {
-			log.Errorf(ctx, "Minecraft Query Error. error = %s", err.Error())
-			w.Header().Set("Content-Type", "application/json; charset=utf-8")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			return internalError(err)
 		}
 		entity.Key = key
 		entity.KeyStr = key.Encode()
-		list = append(list, &entity)
+		entity.ServerType = serverTypeOf(entity)
+		res.Items = append(res.Items, &entity)
+	}
+	if len(res.Items) == param.Limit {
+		c, err := t.Cursor()
+		if err != nil {
+			return internalError(err)
+		}
+		// Limit+1件目が取れれば続きがある
+		var next Minecraft
+		_, err = t.Next(&next)
+		if err != nil && err != datastore.Done {
+			return internalError(err)
+		}
+		if err == nil {
+			res.Cursor = c.String()
+			res.HasNext = true
+		}
 	}
 
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(list)
+	if res.HasNext {
+		w.Header().Set("X-SinmetalCraft-Cursor", res.Cursor)
+	}
+	writeJSON(w, http.StatusOK, res)
+	return nil
+}
+
+const (
+	minecraftListDefaultLimit = 20
+	minecraftListMaxLimit     = 100
+)
+
+// parseMinecraftListParam is Query ParameterからMinecraftListParamを作る
+// cursorはQuery Parameterが無い場合は X-SinmetalCraft-Cursor Headerを使う
+func parseMinecraftListParam(r *http.Request) (MinecraftListParam, error) {
+	param := MinecraftListParam{
+		Cursor:     r.FormValue("cursor"),
+		Status:     r.FormValue("status"),
+		Zone:       r.FormValue("zone"),
+		JarVersion: r.FormValue("jarVersion"),
+	}
+	if len(param.Cursor) < 1 {
+		param.Cursor = r.Header.Get("X-SinmetalCraft-Cursor")
+	}
+	limit, err := parseLimit(r, minecraftListDefaultLimit, minecraftListMaxLimit)
+	if err != nil {
+		return param, err
+	}
+	param.Limit = limit
+	return param, nil
+}
+
+// parseLimit is Query Parameterのlimitを返す。無い場合はdefaultLimitを返す
+func parseLimit(r *http.Request, defaultLimit int, maxLimit int) (int, error) {
+	v := r.FormValue("limit")
+	if len(v) < 1 {
+		return defaultLimit, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < 1 || limit > maxLimit {
+		return 0, invalidRequestError(fmt.Sprintf("limit is 1 - %d.", maxLimit)).WithDetail("limit", v)
+	}
+	return limit, nil
+}
+
+// Query is UpdatedAtの降順でFilterを掛けたQueryを返す
+// Limitより1件多く取得して、続きがあるかを判定する
+func (param MinecraftListParam) Query() *datastore.Query {
+	q := datastore.NewQuery("Minecraft")
+	if len(param.Status) > 0 {
+		q = q.Filter("Status =", param.Status)
+	}
+	if len(param.Zone) > 0 {
+		q = q.Filter("Zone =", param.Zone)
+	}
+	if len(param.JarVersion) > 0 {
+		q = q.Filter("JarVersion =", param.JarVersion)
+	}
+	return q.Order("-UpdatedAt").Limit(param.Limit + 1)
+}
+
+// minecraftKey is Pathの {world} か、EncodeされたKeyからMinecraftのKeyを作る
+func minecraftKey(ctx context.Context, p Params, keyStr string) (*datastore.Key, error) {
+	if world := p["world"]; len(world) > 0 {
+		return datastore.NewKey(ctx, "Minecraft", world, 0, nil), nil
+	}
+	if len(keyStr) < 1 {
+		return nil, invalidRequestError("key is required.")
+	}
+	key, err := datastore.DecodeKey(keyStr)
+	if err != nil || key.Kind() != "Minecraft" {
+		return nil, invalidRequestError("invalid key.")
+	}
+	return key, nil
+}
+
+// getMinecraft is Minecraft Entityを取得する。存在しない場合は404のAPIErrorを返す
+func getMinecraft(ctx context.Context, key *datastore.Key) (Minecraft, error) {
+	var entity Minecraft
+	err := datastore.Get(ctx, key, &entity)
+	if err == datastore.ErrNoSuchEntity {
+		return entity, notFoundError(fmt.Sprintf("%s is not found.", key.StringID()))
+	}
+	if err != nil {
+		return entity, internalError(err)
+	}
+	entity.Key = key
+	entity.KeyStr = key.Encode()
+	entity.ServerType = serverTypeOf(entity)
+	return entity, nil
 }
 
 // handle cloud pub/sub request
@@ -364,6 +532,20 @@ func handlerMinecraftLog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = watchWorldUpgradeLog(ctx, r, psd)
+	if err != nil {
+		// Upgrade中でなくてもログはSlackに流したいので、ここでは止めない
+		log.Errorf(ctx, "ERROR watch world upgrade log: %v", err)
+	}
+	err = watchPreemptionLog(ctx, r, psd)
+	if err != nil {
+		log.Errorf(ctx, "ERROR watch preemption log: %v", err)
+	}
+	err = watchServerReadyLog(ctx, psd)
+	if err != nil {
+		log.Errorf(ctx, "ERROR watch server ready log: %v", err)
+	}
+
 	var sm SlackMessage
 	fields := make([]SlackField, 0)
 
@@ -397,6 +579,29 @@ func handlerMinecraftLog(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// newComputeService is App EngineのService AccountでCompute Engine APIを叩くServiceを作る
+func newComputeService(ctx context.Context) (*compute.Service, error) {
+	client := &http.Client{
+		Transport: &oauth2.Transport{
+			Source: google.AppEngineTokenSource(ctx, compute.ComputeScope),
+			Base:   &urlfetch.Transport{Context: ctx},
+		},
+	}
+	return compute.New(client)
+}
+
+// isNotFoundError is Google APIが404を返したか
+func isNotFoundError(err error) bool {
+	gerr, ok := err.(*googleapi.Error)
+	return ok && gerr.Code == http.StatusNotFound
+}
+
+// isAlreadyExistsError is 同じNameのResourceが既にある場合のCompute APIのErrorかどうか
+func isAlreadyExistsError(err error) bool {
+	gerr, ok := err.(*googleapi.Error)
+	return ok && gerr.Code == http.StatusConflict
+}
+
 // list gce instance
 func listInstance(ctx context.Context, is *compute.InstancesService, zone string) ([]*compute.Instance, string, error) {
 	ilc := is.List(PROJECT_NAME, zone)
@@ -428,7 +633,17 @@ func createDiskFromSnapshot(ctx context.Context, ds *compute.DisksService, minec
 }
 
 // create gce instance
-func createInstance(ctx context.Context, is *compute.InstancesService, minecraft Minecraft) (string, error) {
+// triedZonesはCapacityが足りずにInstanceを作れなかったZoneで、InsertのOperationが失敗した時に別のZoneを探すのに使う
+func createInstance(ctx context.Context, is *compute.InstancesService, minecraft Minecraft, triedZones ...string) (string, error) {
+	provisioning, err := decideProvisioning(ctx, minecraft)
+	if err != nil {
+		return "", err
+	}
+	return createInstanceWith(ctx, is, minecraft, provisioning, triedZones)
+}
+
+// createInstanceWith is provisioningの種類でInstanceを作成する
+func createInstanceWith(ctx context.Context, is *compute.InstancesService, minecraft Minecraft, provisioning instanceProvisioning, triedZones []string) (string, error) {
 	name := INSTANCE_NAME + "-" + minecraft.World
 	worldDiskName := fmt.Sprintf("%s-world-%s", INSTANCE_NAME, minecraft.World)
 	log.Infof(ctx, "create instance name = %s", name)
@@ -436,10 +651,27 @@ func createInstance(ctx context.Context, is *compute.InstancesService, minecraft
 	startupScriptURL := "gs://sinmetalcraft-minecraft-shell/minecraftserver-startup-script.sh"
 	shutdownScriptURL := "gs://sinmetalcraft-minecraft-shell/minecraftserver-shutdown-script.sh"
 	stateValue := "new"
+	launch, err := resolveServerLaunch(minecraft)
+	if err != nil {
+		return "", err
+	}
+	properties, err := getServerProperties(ctx, minecraft.World)
+	if err != nil {
+		return "", err
+	}
+	plugins, err := pluginMetadata(ctx, minecraft)
+	if err != nil {
+		return "", err
+	}
+	md := launch.Metadata()
+	md[serverPropertiesMetadataKey] = renderServerProperties(properties.Properties)
+	for k, v := range plugins {
+		md[k] = v
+	}
 	newIns := &compute.Instance{
 		Name:        name,
 		Zone:        "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/zones/" + minecraft.Zone,
-		MachineType: "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/zones/" + minecraft.Zone + "/machineTypes/n1-highmem-2",
+		MachineType: "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/zones/" + minecraft.Zone + "/machineTypes/" + minecraftMachineType,
 		Disks: []*compute.AttachedDisk{
 			&compute.AttachedDisk{
 				AutoDelete: true,
@@ -509,20 +741,29 @@ func createInstance(ctx context.Context, is *compute.InstancesService, minecraft
 				},
 			},
 		},
-		Scheduling: &compute.Scheduling{
-			AutomaticRestart:  false,
-			OnHostMaintenance: "TERMINATE",
-			Preemptible:       true,
-		},
+		Scheduling: provisioning.Scheduling(),
 	}
+	newIns.Metadata.Items = append(newIns.Metadata.Items, metadataItems(md)...)
 	ope, err := is.Insert(PROJECT_NAME, minecraft.Zone, newIns).Do()
+	if err != nil && provisioning.Preemptible && isCapacityError(err) {
+		log.Warningf(ctx, "preemptible capacity is unavailable in %s. retry with standard VM. %s", minecraft.Zone, err)
+		provisioning = instanceProvisioning{Reason: fmt.Sprintf("preemptible capacity is unavailable in %s.", minecraft.Zone)}
+		newIns.Scheduling = provisioning.Scheduling()
+		ope, err = is.Insert(PROJECT_NAME, minecraft.Zone, newIns).Do()
+	}
 	if err != nil {
 		log.Errorf(ctx, "ERROR insert instance: %s", err)
 		return "", err
 	}
 	WriteLog(ctx, "INSTNCE_CREATE_OPE", ope)
 
-	_, err = CallMinecraftTQ(ctx, minecraft.Key, ope.Name)
+	err = recordProvisioning(ctx, minecraft, provisioning)
+	if err != nil {
+		// Instanceは作れているので、記録できなくても止めない
+		log.Errorf(ctx, "ERROR record provisioning: %v", err)
+	}
+
+	_, err = CallMinecraftTQ(ctx, minecraft.Key, ope.Name, triedZones...)
 	if err != nil {
 		return name, err
 	}
@@ -570,6 +811,162 @@ func resetInstance(ctx context.Context, is *compute.InstancesService, minecraft
 	return name, nil
 }
 
+// stop instance
+// 停止後はWorld DiskのSnapshotを作成して、Instanceを削除する
+func stopInstance(ctx context.Context, is *compute.InstancesService, minecraft Minecraft) (string, error) {
+	name := INSTANCE_NAME + "-" + minecraft.World
+	log.Infof(ctx, "stop instance name = %s", name)
+
+	ope, err := is.Stop(PROJECT_NAME, minecraft.Zone, name).Do()
+	if err != nil {
+		log.Errorf(ctx, "ERROR stop instance: %s", err)
+		return "", err
+	}
+	WriteLog(ctx, "INSTNCE_STOP_OPE", ope)
+
+	err = datastore.RunInTransaction(ctx, func(c context.Context) error {
+		var entity Minecraft
+		err := datastore.Get(c, minecraft.Key, &entity)
+		if err != nil {
+			return err
+		}
+
+		entity.Status = "stopping"
+		entity.OperationStatus = ope.Status
+		entity.OperationType = ope.OperationType
+		entity.UpdatedAt = time.Now()
+		_, err = datastore.Put(c, minecraft.Key, &entity)
+		return err
+	}, nil)
+	if err != nil {
+		return name, err
+	}
+
+	stqAPI := ServerTQApi{}
+	_, err = stqAPI.CallSnapshotInstance(ctx, minecraft.Key, ope.Name)
+	if err != nil {
+		return name, err
+	}
+
+	return name, nil
+}
+
+// createWorldSnapshot is World DiskのSnapshotを作成して、Snapshot作成後にInstanceを削除するTQを登録する
+func createWorldSnapshot(ctx context.Context, ds *compute.DisksService, minecraft Minecraft) (string, error) {
+	sn := worldSnapshotName(minecraft.World, time.Now())
+	ope, err := insertWorldSnapshot(ctx, ds, minecraft, sn, "")
+	if err != nil {
+		return "", err
+	}
+
+	tq := ServerTQApi{}
+	_, err = tq.CallDeleteInstance(ctx, minecraft.Key, ope.Name, sn)
+
+	return sn, err
+}
+
+// worldSnapshotName is minecraft-world-<world>-<yyyyMMdd>-<HHmmss> を返す
+func worldSnapshotName(world string, t time.Time) string {
+	return fmt.Sprintf("%s-world-%s-%s", INSTANCE_NAME, world, t.Format("20060102-150405"))
+}
+
+// insertWorldSnapshot is World DiskのSnapshotを作成する
+// labelを指定した場合はSnapshotのLabel "label" に設定する
+func insertWorldSnapshot(ctx context.Context, ds *compute.DisksService, minecraft Minecraft, sn string, label string) (*compute.Operation, error) {
+	log.Infof(ctx, "create snapshot %s", sn)
+
+	s := &compute.Snapshot{
+		Name: sn,
+	}
+	if len(label) > 0 {
+		s.Labels = map[string]string{"label": label}
+	}
+
+	disk := fmt.Sprintf("%s-world-%s", INSTANCE_NAME, minecraft.World)
+	ope, err := ds.CreateSnapshot(PROJECT_NAME, minecraft.Zone, disk, s).Do()
+	if err != nil {
+		log.Errorf(ctx, "ERROR insert snapshot: %s", err)
+		return nil, err
+	}
+	WriteLog(ctx, "INSTNCE_SNAPSHOT_OPE", ope)
+
+	return ope, nil
+}
+
+// setInstanceMetadata is WorldのInstanceのMetadataを1つ追加、更新する
+func setInstanceMetadata(ctx context.Context, is *compute.InstancesService, minecraft Minecraft, key string, value string) (*compute.Operation, error) {
+	return setInstanceMetadataItems(ctx, is, minecraft, map[string]string{key: value})
+}
+
+// setInstanceMetadataItems is WorldのInstanceのMetadataをまとめて追加、更新する
+// 1回のSetMetadataで書くので、途中までしか変わらないことは無い
+func setInstanceMetadataItems(ctx context.Context, is *compute.InstancesService, minecraft Minecraft, items map[string]string) (*compute.Operation, error) {
+	name := INSTANCE_NAME + "-" + minecraft.World
+
+	ins, err := is.Get(PROJECT_NAME, minecraft.Zone, name).Do()
+	if err != nil {
+		log.Errorf(ctx, "ERROR get instance: %s", err)
+		return nil, err
+	}
+	md := ins.Metadata
+	if md == nil {
+		md = &compute.Metadata{}
+	}
+	for _, item := range metadataItems(items) {
+		var found bool
+		for _, current := range md.Items {
+			if current.Key == item.Key {
+				current.Value = item.Value
+				found = true
+			}
+		}
+		if !found {
+			md.Items = append(md.Items, item)
+		}
+	}
+
+	ope, err := is.SetMetadata(PROJECT_NAME, minecraft.Zone, name, md).Do()
+	if err != nil {
+		log.Errorf(ctx, "ERROR set metadata: %s", err)
+		return nil, err
+	}
+	WriteLog(ctx, "INSTNCE_SET_METADATA_OPE", ope)
+
+	return ope, nil
+}
+
+// metadataItems is mapをKeyの順に並べたMetadataにする
+func metadataItems(m map[string]string) []*compute.MetadataItems {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	items := make([]*compute.MetadataItems, 0, len(keys))
+	for _, k := range keys {
+		v := m[k]
+		items = append(items, &compute.MetadataItems{
+			Key:   k,
+			Value: &v,
+		})
+	}
+	return items
+}
+
+// instanceMetadataValue is Metadataからkeyの値を返す。無い場合は空文字を返す
+func instanceMetadataValue(md *compute.Metadata, key string) string {
+	if md == nil {
+		return ""
+	}
+	for _, item := range md.Items {
+		if item.Key == key && item.Value != nil {
+			return *item.Value
+		}
+	}
+	return ""
+}
+
 // delete instance
 func deleteInstance(ctx context.Context, is *compute.InstancesService, minecraft Minecraft) (string, error) {
 	name := INSTANCE_NAME + "-" + minecraft.World
@@ -639,6 +1036,36 @@ func PostToSlack(ctx context.Context, url string, message SlackMessage) (resp *h
 		bytes.NewReader(body))
 }
 
+// notifySlack is AppConfigのSlackにtextを送る。fieldsはAttachmentに付ける
+// Slackに送れなくても呼んだ処理は止めない
+func notifySlack(ctx context.Context, text string, color string, fields ...SlackField) {
+	acs := AppConfigService{}
+	config, err := acs.Get(ctx)
+	if err != nil {
+		log.Warningf(ctx, "ERROR App Config Get: %v", err)
+		return
+	}
+	if fields == nil {
+		fields = make([]SlackField, 0)
+	}
+	_, err = PostToSlack(ctx, config.SlackPostUrl, SlackMessage{
+		UserName: "sinmetalcraft",
+		IconUrl:  "https://storage.googleapis.com/sinmetalcraft-image/minecraft.jpeg",
+		Attachments: []SlackAttachment{
+			SlackAttachment{
+				Color:      color,
+				AuthorName: "sinmetalcraft",
+				AuthorIcon: "https://storage.googleapis.com/sinmetalcraft-image/minecraft.jpeg",
+				Title:      text,
+				Fields:     fields,
+			},
+		},
+	})
+	if err != nil {
+		log.Warningf(ctx, "ERROR Post Slack: %v", err)
+	}
+}
+
 func WriteLog(ctx context.Context, key string, v interface{}) {
 	body, err := json.Marshal(v)
 	if err != nil {
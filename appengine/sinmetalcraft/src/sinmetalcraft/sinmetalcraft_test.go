@@ -1,6 +1,8 @@
 package sinmetalcraft
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -21,3 +23,35 @@ func TestPubSubBodyDecode(t *testing.T) {
 	}
 	t.Logf("Pub Sub Data = %v", psd)
 }
+
+func TestParseMinecraftListParam(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/1/minecraft?limit=5&status=exists&zone=asia-northeast1-b&jarVersion=1.12.2", nil)
+	r.Header.Set("X-SinmetalCraft-Cursor", "header-cursor")
+	param, err := parseMinecraftListParam(r)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	expected := MinecraftListParam{Limit: 5, Cursor: "header-cursor", Status: "exists", Zone: "asia-northeast1-b", JarVersion: "1.12.2"}
+	if param != expected {
+		t.Fatalf("param = %+v, want %+v", param, expected)
+	}
+
+	r = httptest.NewRequest("GET", "/api/1/minecraft?cursor=query-cursor", nil)
+	r.Header.Set("X-SinmetalCraft-Cursor", "header-cursor")
+	param, err = parseMinecraftListParam(r)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if param.Limit != minecraftListDefaultLimit || param.Cursor != "query-cursor" {
+		t.Fatalf("param = %+v", param)
+	}
+
+	for _, limit := range []string{"0", "101", "hoge"} {
+		r = httptest.NewRequest("GET", "/api/1/minecraft?limit="+limit, nil)
+		_, err = parseMinecraftListParam(r)
+		ae, ok := err.(*APIError)
+		if !ok || ae.Status != http.StatusBadRequest {
+			t.Errorf("limit = %s, err = %v", limit, err)
+		}
+	}
+}
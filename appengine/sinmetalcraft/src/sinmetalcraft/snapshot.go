@@ -0,0 +1,224 @@
+package sinmetalcraft
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+
+	"golang.org/x/net/context"
+)
+
+func init() {
+	api := SnapshotApi{}
+
+	apiRouter.Handle("GET", "/api/1/snapshot", api.List, requireAdmin)
+	apiRouter.Handle("GET", "/api/1/minecraft/{world}/snapshots", api.List, requireAdmin)
+	apiRouter.Handle("POST", "/api/1/minecraft/{world}/snapshots", api.Post, requireAdmin, audit(AuditActionSnapshotCreate))
+}
+
+// SnapshotApi is WorldのDiskのSnapshotを扱うAPI
+type SnapshotApi struct{}
+
+type SnapshotApiListResponse struct {
+	Items  []SnapshotApiResponse `json:"items"`
+	Cursor string                `json:"cursor"`
+}
+
+type SnapshotApiResponse struct {
+	Name              string `json:"name"`
+	World             string `json:"world"`
+	Label             string `json:"label"`
+	Status            string `json:"status"`
+	DiskSizeGb        int64  `json:"diskSizeGb"`
+	StorageBytes      int64  `json:"storageBytes"`
+	CreationTimestamp string `json:"creationTimestamp"`
+}
+
+// list world snapshot
+func (a *SnapshotApi) List(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	world := p["world"]
+	if len(world) < 1 {
+		world = r.FormValue("world")
+	}
+
+	s, err := newComputeService(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+	ss := compute.NewSnapshotsService(s)
+
+	prefix := fmt.Sprintf("%s-world-", INSTANCE_NAME)
+	if len(world) > 0 {
+		prefix = fmt.Sprintf("%s-world-%s-", INSTANCE_NAME, world)
+	}
+	call := ss.List(PROJECT_NAME).Filter(fmt.Sprintf("name eq %s.*", prefix))
+	if len(r.FormValue("cursor")) > 0 {
+		call = call.PageToken(r.FormValue("cursor"))
+	}
+	sl, err := call.Do()
+	if err != nil {
+		return internalError(err)
+	}
+
+	res := make([]SnapshotApiResponse, 0)
+	for _, item := range sl.Items {
+		if len(world) > 0 && snapshotBelongsTo(item.Name, world) == false {
+			// "hoge" の時に "hoge-fuga" のSnapshotもFilterに引っかかるので除く
+			continue
+		}
+		res = append(res, SnapshotApiResponse{
+			Name:              item.Name,
+			World:             snapshotWorld(item.Name),
+			Label:             item.Labels["label"],
+			Status:            item.Status,
+			DiskSizeGb:        item.DiskSizeGb,
+			StorageBytes:      item.StorageBytes,
+			CreationTimestamp: item.CreationTimestamp,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, SnapshotApiListResponse{
+		Items:  res,
+		Cursor: sl.NextPageToken,
+	})
+	return nil
+}
+
+// SnapshotApiPostParam is POST /api/1/minecraft/{world}/snapshots のRequest Body
+// Bodyは省略できる
+type SnapshotApiPostParam struct {
+	Label string `json:"label"`
+}
+
+// SnapshotApiPostResponse is Snapshotの作成を受け付けた時のResponse
+// 作成が終わるとWorldのLatestSnapshotがNameになる
+type SnapshotApiPostResponse struct {
+	Name    string `json:"name"`
+	World   string `json:"world"`
+	Label   string `json:"label"`
+	Flush   bool   `json:"flush"` // Serverが起動していたので、WorldをDiskに書き出してからSnapshotを作成する
+	Message string `json:"message"`
+}
+
+// snapshotLabelPattern is GCEのLabelの値として使える文字列
+var snapshotLabelPattern = regexp.MustCompile(`^[a-z0-9_-]{1,63}$`)
+
+// create world snapshot
+// Serverが起動している場合はMetadataのflush-requestでWorldをDiskに書き出してもらってから作成する
+func (a *SnapshotApi) Post(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	var param SnapshotApiPostParam
+	err := json.NewDecoder(r.Body).Decode(&param)
+	if err != nil && err != io.EOF {
+		return invalidRequestError("invalid request.").WithDetail("cause", err.Error())
+	}
+	defer r.Body.Close()
+	if len(param.Label) > 0 && snapshotLabelPattern.MatchString(param.Label) == false {
+		return invalidRequestError("label is lowercase letters, numbers, - and _ (max 63).").WithDetail("label", param.Label)
+	}
+
+	key, err := minecraftKey(ctx, p, "")
+	if err != nil {
+		return err
+	}
+	ev := auditEventFromContext(ctx)
+	ev.Target = key.StringID()
+
+	minecraft, err := getMinecraft(ctx, key)
+	if err != nil {
+		return err
+	}
+	if minecraft.Status == "stopping" {
+		return conflictError(fmt.Sprintf("%s is stopping.", minecraft.World)).WithDetail("status", minecraft.Status)
+	}
+
+	s, err := newComputeService(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+
+	res := SnapshotApiPostResponse{
+		Name:  worldSnapshotName(minecraft.World, time.Now()),
+		World: minecraft.World,
+		Label: param.Label,
+		Flush: minecraft.Status == "exists",
+	}
+	ev.SetDiff(nil, res)
+
+	tq := SnapshotTQApi{}
+	if res.Flush {
+		is := compute.NewInstancesService(s)
+		_, err = setInstanceMetadata(ctx, is, minecraft, "flush-request", res.Name)
+		if err != nil {
+			return internalError(err)
+		}
+		_, err = tq.CallWaitFlush(ctx, key, res.Name, param.Label, time.Now())
+		if err != nil {
+			return internalError(err)
+		}
+	} else {
+		ds := compute.NewDisksService(s)
+		ope, err := insertWorldSnapshot(ctx, ds, minecraft, res.Name, param.Label)
+		if err != nil {
+			return internalError(err)
+		}
+		_, err = tq.CallSnapshotDone(ctx, key, ope.Name, res.Name, false)
+		if err != nil {
+			return internalError(err)
+		}
+	}
+
+	res.Message = fmt.Sprintf("%s create accepted!", res.Name)
+	writeJSON(w, http.StatusAccepted, res)
+	return nil
+}
+
+// snapshotBelongsTo is SnapshotがWorldのDiskから作られたものかを返す
+func snapshotBelongsTo(name string, world string) bool {
+	return len(world) > 0 && snapshotWorld(name) == world
+}
+
+// snapshotWorld is Snapshot Name(minecraft-world-<world>-<yyyyMMdd>-<HHmmss>)からWorld Nameを取り出す
+func snapshotWorld(name string) string {
+	prefix := fmt.Sprintf("%s-world-", INSTANCE_NAME)
+	if strings.HasPrefix(name, prefix) == false {
+		return ""
+	}
+	s := name[len(prefix):]
+	// 末尾の "-20060102-150405" を取り除く
+	if len(s) <= len("-20060102-150405") {
+		return ""
+	}
+	return s[:len(s)-len("-20060102-150405")]
+}
+
+// snapshotTime is Snapshot Nameの末尾(<yyyyMMdd>-<HHmmss>)からSnapshotを作成した時刻を取り出す
+func snapshotTime(name string) (time.Time, bool) {
+	if len(name) <= len("-20060102-150405") {
+		return time.Time{}, false
+	}
+	t, err := time.Parse("20060102-150405", name[len(name)-len("20060102-150405"):])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// snapshotNewer is nameがthanより後に作成されたSnapshotかを返す
+// thanの時刻が分からない場合は、nameの時刻が分かればnameを新しいとする
+func snapshotNewer(name string, than string) bool {
+	t, ok := snapshotTime(name)
+	if !ok {
+		return false
+	}
+	u, ok := snapshotTime(than)
+	if !ok {
+		return true
+	}
+	return t.After(u)
+}
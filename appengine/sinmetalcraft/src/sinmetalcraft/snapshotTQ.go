@@ -0,0 +1,267 @@
+package sinmetalcraft
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+
+	"google.golang.org/api/compute/v1"
+
+	"golang.org/x/net/context"
+)
+
+// snapshotFlushTimeout is flush-doneを待つ時間
+// 過ぎた場合は書き出しを待たずにSnapshotを作成する
+const snapshotFlushTimeout = 3 * time.Minute
+
+func init() {
+	api := SnapshotTQApi{}
+
+	http.HandleFunc("/tq/1/snapshot/flush", api.WaitFlush)
+	http.HandleFunc("/tq/1/snapshot/done", api.SnapshotDone)
+}
+
+// SnapshotTQApi is POST /api/1/minecraft/{world}/snapshots で作成するSnapshotを追跡するTQ
+type SnapshotTQApi struct{}
+
+// CallWaitFlush is InstanceがWorldをDiskに書き出すのを待ってからSnapshotを作成するTQを登録する
+func (a *SnapshotTQApi) CallWaitFlush(c context.Context, minecraftKey *datastore.Key, snapshot string, label string, requestedAt time.Time) (*taskqueue.Task, error) {
+	log.Infof(c, "Call Snapshot Flush TQ, key = %v, snapshot = %s", minecraftKey, snapshot)
+	if minecraftKey == nil {
+		return nil, errors.New("key is required")
+	}
+	if len(snapshot) < 1 {
+		return nil, errors.New("snapshot is required")
+	}
+
+	t := taskqueue.NewPOSTTask("/tq/1/snapshot/flush", url.Values{
+		"keyStr":      {minecraftKey.Encode()},
+		"snapshot":    {snapshot},
+		"label":       {label},
+		"requestedAt": {strconv.FormatInt(requestedAt.Unix(), 10)},
+	})
+	t.Delay = time.Second * 10
+	return taskqueue.Add(c, t, "minecraft")
+}
+
+// CallSnapshotDone is Snapshotの作成が終わったらLatestSnapshotを更新するTQを登録する
+// operationIDが空の場合はOperationではなく、SnapshotのStatusを見る
+func (a *SnapshotTQApi) CallSnapshotDone(c context.Context, minecraftKey *datastore.Key, operationID string, snapshot string, flush bool) (*taskqueue.Task, error) {
+	log.Infof(c, "Call Snapshot Done TQ, key = %v, operationID = %s, snapshot = %s", minecraftKey, operationID, snapshot)
+	if minecraftKey == nil {
+		return nil, errors.New("key is required")
+	}
+
+	t := taskqueue.NewPOSTTask("/tq/1/snapshot/done", url.Values{
+		"keyStr":      {minecraftKey.Encode()},
+		"operationID": {operationID},
+		"snapshot":    {snapshot},
+		"flush":       {strconv.FormatBool(flush)},
+	})
+	t.Delay = time.Second * 30
+	return taskqueue.Add(c, t, "minecraft")
+}
+
+// WaitFlush is Instanceのflush-doneがSnapshot Nameになるのを待ってからSnapshotを作成する
+func (a *SnapshotTQApi) WaitFlush(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	keyStr := r.FormValue("keyStr")
+	sn := r.FormValue("snapshot")
+	label := r.FormValue("label")
+	requestedAt, err := strconv.ParseInt(r.FormValue("requestedAt"), 10, 64)
+	if err != nil {
+		log.Errorf(ctx, "invalid requestedAt. %s", r.FormValue("requestedAt"))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	log.Infof(ctx, "keyStr = %s, snapshot = %s", keyStr, sn)
+
+	key, err := datastore.DecodeKey(keyStr)
+	if err != nil {
+		log.Errorf(ctx, "key decode error. keyStr = %s, err = %s", keyStr, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	minecraft, err := getMinecraft(ctx, key)
+	if err != nil {
+		log.Errorf(ctx, "datastore get error. key = %s. error = %v", key.StringID(), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	s, err := newComputeService(ctx)
+	if err != nil {
+		log.Errorf(ctx, "ERROR compute.New: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	is := compute.NewInstancesService(s)
+	ins, err := is.Get(PROJECT_NAME, minecraft.Zone, INSTANCE_NAME+"-"+minecraft.World).Do()
+	if err != nil {
+		log.Warningf(ctx, "instance get error. snapshot without flush. error = %v", err)
+	} else if instanceMetadataValue(ins.Metadata, "flush-done") != sn {
+		if time.Since(time.Unix(requestedAt, 0)) < snapshotFlushTimeout {
+			log.Infof(ctx, "waiting flush-done. snapshot = %s", sn)
+			w.WriteHeader(http.StatusRequestTimeout)
+			return
+		}
+		log.Warningf(ctx, "flush-done timeout. snapshot without flush. snapshot = %s", sn)
+	}
+
+	ds := compute.NewDisksService(s)
+	var operationID string
+	ope, err := insertWorldSnapshot(ctx, ds, minecraft, sn, label)
+	if isAlreadyExistsError(err) {
+		// 前回のTQがSnapshotを作った後に失敗してRetryした場合は、作ったSnapshotをSnapshotDoneで待つ
+		log.Infof(ctx, "snapshot already exists. snapshot = %s", sn)
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else {
+		operationID = ope.Name
+	}
+	_, err = a.CallSnapshotDone(ctx, key, operationID, sn, true)
+	if err != nil {
+		log.Errorf(ctx, "call snapshot done tq error. error = %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// SnapshotDone is Snapshotの作成が終わったらLatestSnapshotを更新する
+// flushした場合はflush-requestを消して、InstanceにWorldの書き込みを再開させる
+func (a *SnapshotTQApi) SnapshotDone(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	keyStr := r.FormValue("keyStr")
+	operationID := r.FormValue("operationID")
+	sn := r.FormValue("snapshot")
+	flush := r.FormValue("flush") == "true"
+
+	log.Infof(ctx, "keyStr = %s, operationID = %s, snapshot = %s", keyStr, operationID, sn)
+
+	key, err := datastore.DecodeKey(keyStr)
+	if err != nil {
+		log.Errorf(ctx, "key decode error. keyStr = %s, err = %s", keyStr, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	minecraft, err := getMinecraft(ctx, key)
+	if err != nil {
+		log.Errorf(ctx, "datastore get error. key = %s. error = %v", key.StringID(), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	s, err := newComputeService(ctx)
+	if err != nil {
+		log.Errorf(ctx, "ERROR compute.New: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var snapshotErr error
+	if len(operationID) > 0 {
+		nzos := compute.NewZoneOperationsService(s)
+		ope, err := nzos.Get(PROJECT_NAME, minecraft.Zone, operationID).Do()
+		if err != nil {
+			log.Errorf(ctx, "ERROR compute Zone Operation Get Error. zone = %s, operation = %s, error = %s", minecraft.Zone, operationID, err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		WriteLog(ctx, "__GET_ZONE_COMPUTE_OPE__", ope)
+
+		if ope.Status != "DONE" {
+			log.Infof(ctx, "operation status = %s", ope.Status)
+			w.WriteHeader(http.StatusRequestTimeout)
+			return
+		}
+		if ope.Error != nil && len(ope.Error.Errors) > 0 {
+			snapshotErr = errors.New(ope.Error.Errors[0].Message)
+		}
+	} else {
+		snapshot, err := compute.NewSnapshotsService(s).Get(PROJECT_NAME, sn).Do()
+		if err != nil {
+			log.Errorf(ctx, "ERROR compute Snapshot Get Error. snapshot = %s, error = %v", sn, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		done, err := snapshotCreateDone(snapshot, minecraft)
+		if !done {
+			log.Infof(ctx, "snapshot status = %s", snapshot.Status)
+			w.WriteHeader(http.StatusRequestTimeout)
+			return
+		}
+		snapshotErr = err
+	}
+
+	if flush {
+		is := compute.NewInstancesService(s)
+		_, err := setInstanceMetadata(ctx, is, minecraft, "flush-request", "")
+		if err != nil {
+			// Instance側も時間が経てば書き込みを再開するので、ここでは失敗させない
+			log.Warningf(ctx, "flush-request clear error. error = %v", err)
+		}
+	}
+
+	ev := newAuditEvent(ctx, r, AuditActionSnapshotDone)
+	ev.Target = key.StringID()
+	if snapshotErr != nil {
+		log.Errorf(ctx, "snapshot create error. snapshot = %s, error = %v", sn, snapshotErr)
+		ev.Record(ctx, snapshotErr)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var before, entity Minecraft
+	err = datastore.RunInTransaction(ctx, func(c context.Context) error {
+		err := datastore.Get(c, key, &entity)
+		if err != nil {
+			return err
+		}
+		before = entity
+
+		entity.LatestSnapshot = sn
+		entity.UpdatedAt = time.Now()
+		_, err = datastore.Put(c, key, &entity)
+		return err
+	}, nil)
+	ev.SetDiff(before, entity)
+	ev.Record(ctx, err)
+	if err != nil {
+		log.Errorf(ctx, "Minecraft Put Error. error = %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof(ctx, "snapshot create done. name = %s", sn)
+	w.WriteHeader(http.StatusOK)
+}
+
+// snapshotCreateDone is Operationが分からないSnapshotの作成が終わったかを返す
+// 同じNameでもWorldのDisk以外から作ったSnapshotの場合はErrorにする
+func snapshotCreateDone(snapshot *compute.Snapshot, minecraft Minecraft) (bool, error) {
+	disk := fmt.Sprintf("%s-world-%s", INSTANCE_NAME, minecraft.World)
+	if !strings.HasSuffix(snapshot.SourceDisk, "/disks/"+disk) {
+		return true, fmt.Errorf("snapshot %s is not created from %s. sourceDisk = %s", snapshot.Name, disk, snapshot.SourceDisk)
+	}
+	switch snapshot.Status {
+	case "READY":
+		return true, nil
+	case "FAILED", "DELETING":
+		return true, fmt.Errorf("snapshot %s status is %s", snapshot.Name, snapshot.Status)
+	}
+	return false, nil
+}
@@ -0,0 +1,104 @@
+package sinmetalcraft
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+func TestSnapshotWorld(t *testing.T) {
+	now := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	cases := []struct {
+		name  string
+		world string
+	}{
+		{worldSnapshotName("hoge", now), "hoge"},
+		{worldSnapshotName("hoge-fuga", now), "hoge-fuga"},
+		{"minecraft-world-20170102-030405", ""},
+		{"overviewer-world-hoge-20170102-030405", ""},
+	}
+	for _, c := range cases {
+		if w := snapshotWorld(c.name); w != c.world {
+			t.Errorf("snapshotWorld(%s) = %q, want %q", c.name, w, c.world)
+		}
+	}
+}
+
+func TestSnapshotLabelPattern(t *testing.T) {
+	for _, label := range []string{"before-upgrade", "v1_12_2", "a"} {
+		if !snapshotLabelPattern.MatchString(label) {
+			t.Errorf("%s should be valid", label)
+		}
+	}
+	for _, label := range []string{"Before", "before upgrade", "日本語", "a.b", "0123456789012345678901234567890123456789012345678901234567890123"} {
+		if snapshotLabelPattern.MatchString(label) {
+			t.Errorf("%s should be invalid", label)
+		}
+	}
+}
+
+func TestSnapshotBelongsTo(t *testing.T) {
+	now := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	cases := []struct {
+		name  string
+		world string
+		ok    bool
+	}{
+		{worldSnapshotName("hoge", now), "hoge", true},
+		{worldSnapshotName("hoge-fuga", now), "hoge", false},
+		{worldSnapshotName("hoge", now), "hoge-fuga", false},
+		{worldSnapshotName("hoge", now), "", false},
+		{"minecraft-world-hoge", "hoge", false},
+	}
+	for _, c := range cases {
+		if ok := snapshotBelongsTo(c.name, c.world); ok != c.ok {
+			t.Errorf("snapshotBelongsTo(%s, %s) = %v, want %v", c.name, c.world, ok, c.ok)
+		}
+	}
+}
+
+func TestSnapshotNewer(t *testing.T) {
+	now := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	cases := []struct {
+		name string
+		than string
+		want bool
+	}{
+		{worldSnapshotName("hoge", now), worldSnapshotName("hoge", now.Add(-1*time.Second)), true},
+		{worldSnapshotName("hoge", now), worldSnapshotName("hoge", now), false},
+		{worldSnapshotName("hoge", now.Add(-24*time.Hour)), worldSnapshotName("hoge", now), false},
+		// CloneしたWorldはClone元のSnapshotからRenderすることがある
+		{worldSnapshotName("hoge", now), worldSnapshotName("fuga", now.Add(-1*time.Hour)), true},
+		{worldSnapshotName("hoge", now), "", true},
+		{"minecraft-world-hoge", worldSnapshotName("hoge", now), false},
+	}
+	for _, c := range cases {
+		if got := snapshotNewer(c.name, c.than); got != c.want {
+			t.Errorf("snapshotNewer(%s, %s) = %v, want %v", c.name, c.than, got, c.want)
+		}
+	}
+}
+
+func TestSnapshotCreateDone(t *testing.T) {
+	minecraft := Minecraft{World: "hoge"}
+	disk := "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/zones/asia-northeast1-b/disks/minecraft-world-hoge"
+	cases := []struct {
+		name     string
+		snapshot compute.Snapshot
+		done     bool
+		err      bool
+	}{
+		{"creating", compute.Snapshot{SourceDisk: disk, Status: "CREATING"}, false, false},
+		{"uploading", compute.Snapshot{SourceDisk: disk, Status: "UPLOADING"}, false, false},
+		{"ready", compute.Snapshot{SourceDisk: disk, Status: "READY"}, true, false},
+		{"failed", compute.Snapshot{SourceDisk: disk, Status: "FAILED"}, true, true},
+		{"other disk", compute.Snapshot{SourceDisk: disk + "-fuga", Status: "READY"}, true, true},
+	}
+	for _, c := range cases {
+		done, err := snapshotCreateDone(&c.snapshot, minecraft)
+		if done != c.done || (err != nil) != c.err {
+			t.Errorf("%s: done = %v, err = %v", c.name, done, err)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package sinmetalcraft
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+	"google.golang.org/appengine/urlfetch"
+
+	"golang.org/x/net/context"
+)
+
+func init() {
+	api := MinecraftVersionApi{}
+
+	apiRouter.Handle("GET", "/api/1/versions", api.List)
+	http.HandleFunc("/cron/1/versions/sync", api.Sync)
+}
+
+// defaultVersionManifestURL is MojangのVersion Manifest
+// AppConfig.VersionManifestURLを設定すると、Localでは同じ形式のStubを使える
+const defaultVersionManifestURL = "https://launchermeta.mojang.com/mc/game/version_manifest.json"
+
+// MinecraftJarBucket is Server Jarを置くBucket
+// Startup Scriptは minecraft_server.<version>.jar をここから取ってくる
+const MinecraftJarBucket = "sinmetalcraft-minecraft-jar"
+
+// MinecraftVersion Type
+const (
+	MinecraftVersionTypeRelease  = "release"
+	MinecraftVersionTypeSnapshot = "snapshot"
+)
+
+// MinecraftVersion Status
+const (
+	MinecraftVersionStatusListed      = "listed"      // Manifestにあるだけで、JarはまだMirrorしていない
+	MinecraftVersionStatusMirrored    = "mirrored"    // JarをMinecraftJarBucketにMirror済み
+	MinecraftVersionStatusUnavailable = "unavailable" // Server Jarが配布されていない
+	MinecraftVersionStatusFailed      = "failed"
+)
+
+// MinecraftVersion is Version Catalogの1 Version
+// KeyはVersion ID
+type MinecraftVersion struct {
+	ID          string    `json:"id" datastore:"-"`
+	Type        string    `json:"type"`
+	ReleaseTime time.Time `json:"releaseTime"`
+	DetailURL   string    `json:"-" datastore:",noindex"` // ManifestにあるVersion毎のJSONのURL
+	ServerURL   string    `json:"serverUrl" datastore:",noindex"`
+	ServerSHA1  string    `json:"serverSha1" datastore:",noindex"`
+	ServerSize  int64     `json:"serverSize" datastore:",noindex"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error" datastore:",noindex"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt" datastore:",noindex"`
+}
+
+// Object is MinecraftJarBucketのServer JarのObject Name
+func (v *MinecraftVersion) Object() string {
+	return fmt.Sprintf("minecraft_server.%s.jar", v.ID)
+}
+
+// versionManifest is Version Manifestの必要な所だけ
+type versionManifest struct {
+	Latest struct {
+		Release  string `json:"release"`
+		Snapshot string `json:"snapshot"`
+	} `json:"latest"`
+	Versions []versionManifestEntry `json:"versions"`
+}
+
+type versionManifestEntry struct {
+	ID          string    `json:"id"`
+	Type        string    `json:"type"`
+	URL         string    `json:"url"`
+	ReleaseTime time.Time `json:"releaseTime"`
+}
+
+// versionDetail is Version毎のJSONの必要な所だけ
+type versionDetail struct {
+	ID        string `json:"id"`
+	Downloads map[string]struct {
+		SHA1 string `json:"sha1"`
+		Size int64  `json:"size"`
+		URL  string `json:"url"`
+	} `json:"downloads"`
+}
+
+// decodeVersionManifest is Version Manifestを読んで、Catalogに入れるVersionを返す
+// ReleaseとSnapshot以外 (old_beta, old_alpha) はServer Jarが無いので入れない
+func decodeVersionManifest(r io.Reader, now time.Time) ([]*MinecraftVersion, error) {
+	var m versionManifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, err
+	}
+	l := make([]*MinecraftVersion, 0, len(m.Versions))
+	for _, e := range m.Versions {
+		if e.Type != MinecraftVersionTypeRelease && e.Type != MinecraftVersionTypeSnapshot {
+			continue
+		}
+		if len(e.ID) < 1 || len(e.URL) < 1 {
+			return nil, fmt.Errorf("invalid manifest entry. id = %q, url = %q", e.ID, e.URL)
+		}
+		l = append(l, &MinecraftVersion{
+			ID:          e.ID,
+			Type:        e.Type,
+			ReleaseTime: e.ReleaseTime,
+			DetailURL:   e.URL,
+			Status:      MinecraftVersionStatusListed,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		})
+	}
+	return l, nil
+}
+
+// errNoServerJar is VersionのServer Jarが配布されていない
+var errNoServerJar = errors.New("server jar is not distributed")
+
+// decodeVersionDetail is Version毎のJSONからServer JarのURL, SHA1, Sizeを設定する
+func (v *MinecraftVersion) decodeVersionDetail(r io.Reader) error {
+	var d versionDetail
+	if err := json.NewDecoder(r).Decode(&d); err != nil {
+		return err
+	}
+	if d.ID != v.ID {
+		return fmt.Errorf("version detail id is %s, want %s", d.ID, v.ID)
+	}
+	s, ok := d.Downloads["server"]
+	if !ok {
+		return errNoServerJar
+	}
+	if len(s.URL) < 1 || len(s.SHA1) != sha1.Size*2 || s.Size < 1 {
+		return fmt.Errorf("invalid server download. url = %q, sha1 = %q, size = %d", s.URL, s.SHA1, s.Size)
+	}
+	v.ServerURL = s.URL
+	v.ServerSHA1 = s.SHA1
+	v.ServerSize = s.Size
+	return nil
+}
+
+// serverJarChunkSize is Server JarをMirrorする時の1回のサイズ
+// Resumable Uploadは256KiBの倍数で送る必要がある
+const serverJarChunkSize = 8 << 20
+
+// errServerJarChecksum is Downloadしたserver jarのSHA1がManifestと違う
+var errServerJarChecksum = errors.New("server jar sha1 mismatch")
+
+// mirrorServerJar is Server JarをChunkに分けてDownloadしながらUploadする
+// 最後のChunkを送る前にSHA1を確認するので、SHA1が違う場合はObjectが作られない
+func mirrorServerJar(src *http.Client, upload *gcsResumableUpload, v MinecraftVersion, chunkSize int64) error {
+	h := sha1.New()
+	buf := make([]byte, chunkSize)
+	for off := int64(0); off < v.ServerSize; off += chunkSize {
+		end := off + chunkSize
+		if end > v.ServerSize {
+			end = v.ServerSize
+		}
+		p := buf[:end-off]
+		if err := httpReadRange(src, v.ServerURL, off, p); err != nil {
+			return err
+		}
+		h.Write(p)
+		if end == v.ServerSize && hex.EncodeToString(h.Sum(nil)) != v.ServerSHA1 {
+			return errServerJarChecksum
+		}
+		if err := upload.WriteChunk(p, off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serverJarSHA1 is ReaderのSHA1を返す。chunkSizeずつ読むので、gcsObjectReaderのRange Requestを小さくしない
+func serverJarSHA1(r io.ReaderAt, size int64, chunkSize int64) (string, error) {
+	h := sha1.New()
+	_, err := io.CopyBuffer(h, io.NewSectionReader(r, 0, size), make([]byte, chunkSize))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// validateJarVersion is Version Catalogにあり、JarをMirror済みのVersionか確認する
+// StartupScriptはJarが無くてもそのまま起動しようとするので、ここで止める
+func validateJarVersion(ctx context.Context, version string) error {
+	if len(version) < 1 {
+		return invalidRequestError("jarVersion is required.")
+	}
+	var v MinecraftVersion
+	err := datastore.Get(ctx, datastore.NewKey(ctx, "MinecraftVersion", version, 0, nil), &v)
+	if err == datastore.ErrNoSuchEntity {
+		return invalidRequestError(fmt.Sprintf("%s is unknown version. see GET /api/1/versions.", version)).WithDetail("jarVersion", version)
+	}
+	if err != nil {
+		return internalError(err)
+	}
+	if v.Status != MinecraftVersionStatusMirrored {
+		return conflictError(fmt.Sprintf("%s jar is %s.", version, v.Status)).WithDetail("status", v.Status)
+	}
+	return nil
+}
+
+// MinecraftVersionApi is Version Catalog
+type MinecraftVersionApi struct{}
+
+// MinecraftVersionListResponse is GET /api/1/versions のResponse
+type MinecraftVersionListResponse struct {
+	Items []*MinecraftVersion `json:"items"`
+}
+
+// list versions
+// 新しい順に返す。type, statusで絞り込める
+func (a *MinecraftVersionApi) List(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	limit, err := parseLimit(r, 50, 1000)
+	if err != nil {
+		return err
+	}
+	q := datastore.NewQuery("MinecraftVersion").Order("-ReleaseTime").Limit(limit)
+	if v := r.FormValue("type"); len(v) > 0 {
+		q = q.Filter("Type =", v)
+	}
+	if v := r.FormValue("status"); len(v) > 0 {
+		q = q.Filter("Status =", v)
+	}
+
+	res := MinecraftVersionListResponse{
+		Items: make([]*MinecraftVersion, 0),
+	}
+	for t := q.Run(ctx); ; {
+		var entity MinecraftVersion
+		key, err := t.Next(&entity)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return internalError(err)
+		}
+		entity.ID = key.StringID()
+		res.Items = append(res.Items, &entity)
+	}
+
+	writeJSON(w, http.StatusOK, res)
+	return nil
+}
+
+// Sync is /cron/1/versions/sync handler
+// Manifestにある新しいVersionをCatalogに入れて、まだMirrorしていないReleaseのMirrorをTQに積む
+func (a *MinecraftVersionApi) Sync(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	acs := AppConfigService{}
+	config, err := acs.Get(ctx)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		log.Errorf(ctx, "ERROR App Config Get: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	manifestURL := config.VersionManifestURL
+	if len(manifestURL) < 1 {
+		manifestURL = defaultVersionManifestURL
+	}
+
+	fctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	res, err := urlfetch.Client(fctx).Get(manifestURL)
+	if err != nil {
+		log.Errorf(ctx, "ERROR manifest get: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		log.Errorf(ctx, "ERROR manifest get. url = %s, status = %d", manifestURL, res.StatusCode)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	versions, err := decodeVersionManifest(res.Body, time.Now())
+	if err != nil {
+		log.Errorf(ctx, "ERROR manifest decode: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	added, tasks := 0, make([]*taskqueue.Task, 0)
+	tq := MinecraftVersionTQApi{}
+	// GetMulti, PutMultiは500件ずつ
+	for i := 0; i < len(versions); i += 500 {
+		end := i + 500
+		if end > len(versions) {
+			end = len(versions)
+		}
+		keys := make([]*datastore.Key, 0, end-i)
+		for _, v := range versions[i:end] {
+			keys = append(keys, datastore.NewKey(ctx, "MinecraftVersion", v.ID, 0, nil))
+		}
+		current := make([]MinecraftVersion, len(keys))
+		err := datastore.GetMulti(ctx, keys, current)
+		merr, _ := err.(appengine.MultiError)
+		if err != nil && merr == nil {
+			log.Errorf(ctx, "ERROR datastore get multi: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		var newKeys []*datastore.Key
+		var newVersions []*MinecraftVersion
+		for j, key := range keys {
+			v := versions[i+j]
+			if merr == nil || merr[j] == nil {
+				v = &current[j]
+				v.ID = key.StringID()
+			} else if merr[j] == datastore.ErrNoSuchEntity {
+				newKeys = append(newKeys, key)
+				newVersions = append(newVersions, v)
+			} else {
+				log.Errorf(ctx, "ERROR datastore get. key = %s, error = %v", key.StringID(), merr[j])
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			// 前回TQを積んだ後に失敗していても、Statusが進むまで毎回積み直す
+			if v.Type == MinecraftVersionTypeRelease && v.Status == MinecraftVersionStatusListed {
+				tasks = append(tasks, tq.NewMirrorTask(v.ID))
+			}
+		}
+		if len(newKeys) > 0 {
+			_, err = datastore.PutMulti(ctx, newKeys, newVersions)
+			if err != nil {
+				log.Errorf(ctx, "ERROR datastore put multi: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			added += len(newKeys)
+		}
+	}
+	for i := 0; i < len(tasks); i += 100 {
+		end := i + 100
+		if end > len(tasks) {
+			end = len(tasks)
+		}
+		_, err = taskqueue.AddMulti(ctx, tasks[i:end], "version")
+		if err != nil {
+			log.Errorf(ctx, "ERROR taskqueue add multi: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	log.Infof(ctx, "version sync done. manifest = %d, added = %d, mirror tasks = %d", len(versions), added, len(tasks))
+	w.WriteHeader(http.StatusOK)
+}
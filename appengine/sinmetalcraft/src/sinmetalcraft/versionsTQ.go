@@ -0,0 +1,139 @@
+package sinmetalcraft
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+	"google.golang.org/appengine/urlfetch"
+
+	"golang.org/x/net/context"
+)
+
+func init() {
+	api := MinecraftVersionTQApi{}
+
+	http.HandleFunc("/tq/1/versions/mirror", api.Mirror)
+}
+
+// MinecraftVersionTQApi is Server JarをMinecraftJarBucketにMirrorするTQ
+type MinecraftVersionTQApi struct{}
+
+// NewMirrorTask is VersionのServer JarをMirrorするTaskを作る
+// 数が多いので、呼び出し側でまとめて "version" Queueに積む
+func (a *MinecraftVersionTQApi) NewMirrorTask(id string) *taskqueue.Task {
+	return taskqueue.NewPOSTTask("/tq/1/versions/mirror", url.Values{
+		"id": {id},
+	})
+}
+
+// Mirror is Version毎のJSONからServer Jarの場所を調べて、SHA1を確認しながらMirrorする
+// 通信の失敗はTQのRetryに任せ、SHA1が違うなどRetryしても直らない場合はfailedにする
+func (a *MinecraftVersionTQApi) Mirror(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	id := r.FormValue("id")
+	log.Infof(ctx, "id = %s", id)
+
+	key := datastore.NewKey(ctx, "MinecraftVersion", id, 0, nil)
+	var entity MinecraftVersion
+	err := datastore.Get(ctx, key, &entity)
+	if err != nil {
+		log.Errorf(ctx, "datastore get error. key = %s. error = %v", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	entity.ID = id
+	if entity.Status != MinecraftVersionStatusListed {
+		// TQがRetryされた時や、Syncが同じVersionを積み直した時は何もしない
+		log.Infof(ctx, "nothing to do. status = %s", entity.Status)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// TQの期限の10分より前に止める
+	fctx, cancel := context.WithTimeout(ctx, 9*time.Minute)
+	defer cancel()
+	src := &http.Client{Transport: &urlfetch.Transport{Context: fctx}}
+
+	err = a.mirror(fctx, src, &entity)
+	status := MinecraftVersionStatusMirrored
+	switch {
+	case err == errNoServerJar:
+		status = MinecraftVersionStatusUnavailable
+	case err == errServerJarChecksum, err == errServerJarConflict:
+		status = MinecraftVersionStatusFailed
+	case err != nil:
+		log.Errorf(ctx, "server jar mirror error. id = %s, error = %v", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		log.Warningf(ctx, "server jar mirror error. id = %s, error = %v", id, err)
+		entity.Error = err.Error()
+	}
+	entity.Status = status
+	entity.UpdatedAt = time.Now()
+	_, err = datastore.Put(ctx, key, &entity)
+	if err != nil {
+		log.Errorf(ctx, "datastore put error. key = %s. error = %v", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof(ctx, "server jar mirror done. id = %s, status = %s", id, status)
+	w.WriteHeader(http.StatusOK)
+}
+
+// errServerJarConflict is MinecraftJarBucketに同じ名前でサイズかSHA1が違うJarが既にある
+// 手でUploadしたJarを上書きしないように、Mirrorしない
+var errServerJarConflict = errors.New("another server jar already exists")
+
+// mirror is entityにServer Jarの場所を設定して、MinecraftJarBucketにMirrorする
+func (a *MinecraftVersionTQApi) mirror(ctx context.Context, src *http.Client, entity *MinecraftVersion) error {
+	res, err := src.Get(entity.DetailURL)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("version detail get error. url = %s, status = %d", entity.DetailURL, res.StatusCode)
+	}
+	if err := entity.decodeVersionDetail(res.Body); err != nil {
+		return err
+	}
+
+	client := newStorageClient(ctx)
+	size, exists, err := gcsObjectSize(client, MinecraftJarBucket, entity.Object())
+	if err != nil {
+		return err
+	}
+	if exists {
+		// Catalogを作る前に手でUploadしたJar
+		if size != entity.ServerSize {
+			return errServerJarConflict
+		}
+		// サイズが同じでも壊れたJarや別のJarかもしれないので、中身を読んで確かめる
+		obj := &gcsObjectReader{client: client, bucket: MinecraftJarBucket, object: entity.Object(), size: size}
+		sum, err := serverJarSHA1(obj, size, serverJarChunkSize)
+		if err != nil {
+			return err
+		}
+		if sum != entity.ServerSHA1 {
+			return errServerJarConflict
+		}
+		return nil
+	}
+
+	upload, err := gcsStartResumableUpload(client, gcsUploadBaseURL, MinecraftJarBucket, entity.Object(), "application/java-archive", entity.ServerSize)
+	if err != nil {
+		return err
+	}
+	return mirrorServerJar(src, upload, *entity, serverJarChunkSize)
+}
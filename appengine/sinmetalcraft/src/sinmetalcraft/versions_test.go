@@ -0,0 +1,170 @@
+package sinmetalcraft
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeVersionManifest(t *testing.T) {
+	manifest := `{
+  "latest": {"release": "1.12.2", "snapshot": "17w45a"},
+  "versions": [
+    {"id": "17w45a", "type": "snapshot", "url": "https://launchermeta.mojang.com/mc/game/17w45a.json", "time": "2017-11-08T13:22:34+00:00", "releaseTime": "2017-11-08T13:22:34+00:00"},
+    {"id": "1.12.2", "type": "release", "url": "https://launchermeta.mojang.com/mc/game/1.12.2.json", "time": "2017-09-18T08:39:46+00:00", "releaseTime": "2017-09-18T08:39:46+00:00"},
+    {"id": "b1.8.1", "type": "old_beta", "url": "https://launchermeta.mojang.com/mc/game/b1.8.1.json", "time": "2011-09-19T00:00:00+00:00", "releaseTime": "2011-09-19T00:00:00+00:00"}
+  ]
+}`
+	now := time.Now()
+	l, err := decodeVersionManifest(strings.NewReader(manifest), now)
+	if err != nil {
+		t.Fatalf("decodeVersionManifest err = %v", err)
+	}
+	if len(l) != 2 {
+		t.Fatalf("decodeVersionManifest len = %d, want 2", len(l))
+	}
+	v := l[1]
+	if v.ID != "1.12.2" || v.Type != MinecraftVersionTypeRelease || v.DetailURL != "https://launchermeta.mojang.com/mc/game/1.12.2.json" || v.Status != MinecraftVersionStatusListed {
+		t.Errorf("version = %+v", v)
+	}
+	if !v.ReleaseTime.Equal(time.Date(2017, 9, 18, 8, 39, 46, 0, time.UTC)) || !v.CreatedAt.Equal(now) {
+		t.Errorf("releaseTime = %s, createdAt = %s", v.ReleaseTime, v.CreatedAt)
+	}
+	if v.Object() != "minecraft_server.1.12.2.jar" {
+		t.Errorf("Object = %s", v.Object())
+	}
+
+	if _, err := decodeVersionManifest(strings.NewReader(`{"versions":[{"id":"1.12.2","type":"release"}]}`), now); err == nil {
+		t.Errorf("entry without url should be error")
+	}
+}
+
+func TestDecodeVersionDetail(t *testing.T) {
+	sha := strings.Repeat("a", 40)
+	cases := []struct {
+		name   string
+		detail string
+		err    string
+	}{
+		{"server", fmt.Sprintf(`{"id":"1.12.2","downloads":{"client":{"sha1":"%s","size":1,"url":"https://example.com/client.jar"},"server":{"sha1":"%s","size":30222121,"url":"https://example.com/server.jar"}}}`, sha, sha), ""},
+		{"no server", fmt.Sprintf(`{"id":"1.12.2","downloads":{"client":{"sha1":"%s","size":1,"url":"https://example.com/client.jar"}}}`, sha), errNoServerJar.Error()},
+		{"other id", `{"id":"1.12.1","downloads":{}}`, "version detail id"},
+		{"invalid sha1", `{"id":"1.12.2","downloads":{"server":{"sha1":"hoge","size":1,"url":"https://example.com/server.jar"}}}`, "invalid server download"},
+	}
+	for _, c := range cases {
+		v := MinecraftVersion{ID: "1.12.2"}
+		err := v.decodeVersionDetail(strings.NewReader(c.detail))
+		if len(c.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s err = %v, want %s", c.name, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s err = %v", c.name, err)
+			continue
+		}
+		if v.ServerURL != "https://example.com/server.jar" || v.ServerSHA1 != sha || v.ServerSize != 30222121 {
+			t.Errorf("%s version = %+v", c.name, v)
+		}
+	}
+}
+
+// fakeResumableUpload is Cloud StorageのResumable UploadのふりをするServer
+type fakeResumableUpload struct {
+	body     bytes.Buffer
+	finished bool
+	ranges   []string
+}
+
+func (f *fakeResumableUpload) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		if r.FormValue("uploadType") != "resumable" || r.FormValue("name") != "minecraft_server.1.12.2.jar" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Location", "http://"+r.Host+"/session")
+		w.WriteHeader(http.StatusOK)
+	case "PUT":
+		b, _ := ioutil.ReadAll(r.Body)
+		f.body.Write(b)
+		cr := r.Header.Get("Content-Range")
+		f.ranges = append(f.ranges, cr)
+		if strings.HasSuffix(cr, fmt.Sprintf("-%d/%d", f.body.Len()-1, f.body.Len())) {
+			f.finished = true
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusPermanentRedirect)
+	}
+}
+
+func TestMirrorServerJar(t *testing.T) {
+	jar := make([]byte, 600*1024)
+	rand.New(rand.NewSource(1)).Read(jar)
+	sum := sha1.Sum(jar)
+
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "server.jar", time.Time{}, bytes.NewReader(jar))
+	}))
+	defer src.Close()
+
+	v := MinecraftVersion{ID: "1.12.2", ServerURL: src.URL + "/server.jar", ServerSHA1: hex.EncodeToString(sum[:]), ServerSize: int64(len(jar))}
+
+	f := &fakeResumableUpload{}
+	dst := httptest.NewServer(f)
+	defer dst.Close()
+	upload, err := gcsStartResumableUpload(http.DefaultClient, dst.URL, MinecraftJarBucket, v.Object(), "application/java-archive", v.ServerSize)
+	if err != nil {
+		t.Fatalf("gcsStartResumableUpload err = %v", err)
+	}
+	if err := mirrorServerJar(http.DefaultClient, upload, v, 256*1024); err != nil {
+		t.Fatalf("mirrorServerJar err = %v", err)
+	}
+	if !f.finished || !bytes.Equal(f.body.Bytes(), jar) {
+		t.Errorf("uploaded %d bytes, finished = %v", f.body.Len(), f.finished)
+	}
+	want := []string{"bytes 0-262143/614400", "bytes 262144-524287/614400", "bytes 524288-614399/614400"}
+	if strings.Join(f.ranges, ",") != strings.Join(want, ",") {
+		t.Errorf("ranges = %v, want %v", f.ranges, want)
+	}
+
+	// SHA1が違う場合は最後のChunkを送らないので、Objectができない
+	f = &fakeResumableUpload{}
+	dst2 := httptest.NewServer(f)
+	defer dst2.Close()
+	upload, err = gcsStartResumableUpload(http.DefaultClient, dst2.URL, MinecraftJarBucket, v.Object(), "application/java-archive", v.ServerSize)
+	if err != nil {
+		t.Fatalf("gcsStartResumableUpload err = %v", err)
+	}
+	v.ServerSHA1 = strings.Repeat("0", 40)
+	if err := mirrorServerJar(http.DefaultClient, upload, v, 256*1024); err != errServerJarChecksum {
+		t.Errorf("mirrorServerJar err = %v, want %v", err, errServerJarChecksum)
+	}
+	if f.finished || len(f.ranges) != 2 {
+		t.Errorf("finished = %v, ranges = %v", f.finished, f.ranges)
+	}
+}
+
+func TestServerJarSHA1(t *testing.T) {
+	jar := make([]byte, 600*1024)
+	rand.New(rand.NewSource(1)).Read(jar)
+	sum := sha1.Sum(jar)
+
+	got, err := serverJarSHA1(bytes.NewReader(jar), int64(len(jar)), 256*1024)
+	if err != nil {
+		t.Fatalf("serverJarSHA1 err = %v", err)
+	}
+	if got != hex.EncodeToString(sum[:]) {
+		t.Errorf("serverJarSHA1 = %s, want %x", got, sum)
+	}
+}
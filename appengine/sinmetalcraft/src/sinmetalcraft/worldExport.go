@@ -0,0 +1,235 @@
+package sinmetalcraft
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+
+	"google.golang.org/api/compute/v1"
+
+	"golang.org/x/net/context"
+)
+
+func init() {
+	api := WorldExportApi{}
+
+	apiRouter.Handle("GET", "/api/1/minecraft/{world}/exports", api.List, requireAdmin)
+	apiRouter.Handle("POST", "/api/1/minecraft/{world}/exports", api.Post, requireAdmin, audit(AuditActionWorldExport))
+	apiRouter.Handle("GET", "/api/1/minecraft/{world}/exports/{id}", api.Get, requireAdmin)
+}
+
+// WorldExportBucket is Exportしたtar.gzを置くBucket
+// minecraftserver-backup.sh と同じBucketで、Lifecycleで30日後に消える
+const WorldExportBucket = "sinmetalcraft-minecraft-world-dra"
+
+// WorldExportInstanceName is tar.gzを作るInstanceのName Prefix
+const WorldExportInstanceName = "worldexport"
+
+const worldExportDownloadExpiration = 1 * time.Hour
+
+// WorldExport Status
+const (
+	WorldExportStatusCreatingDisk = "creating_disk"
+	WorldExportStatusArchiving    = "archiving"
+	WorldExportStatusCleanup      = "cleanup"
+	WorldExportStatusDone         = "done"
+	WorldExportStatusFailed       = "failed"
+)
+
+// WorldExport is WorldのSnapshotからtar.gzを作る処理の状態
+type WorldExport struct {
+	Key               *datastore.Key `json:"-" datastore:"-"`
+	ID                int64          `json:"id" datastore:"-"`
+	World             string         `json:"world"`
+	Zone              string         `json:"zone" datastore:",noindex"`
+	Snapshot          string         `json:"snapshot" datastore:",noindex"`
+	Object            string         `json:"object" datastore:",noindex"` // WorldExportBucketのObject Name
+	Status            string         `json:"status" datastore:",noindex"`
+	OperationID       string         `json:"operationID" datastore:",noindex"`
+	Size              int64          `json:"size" datastore:",noindex"`
+	Error             string         `json:"error" datastore:",noindex"`
+	DownloadURL       string         `json:"downloadUrl,omitempty" datastore:"-"`
+	DownloadExpiresAt *time.Time     `json:"downloadExpiresAt,omitempty" datastore:"-"`
+	CreatedAt         time.Time      `json:"createdAt"`
+	UpdatedAt         time.Time      `json:"updatedAt" datastore:",noindex"`
+}
+
+// Finished is Exportが終わっているか
+func (we *WorldExport) Finished() bool {
+	return we.Status == WorldExportStatusDone || we.Status == WorldExportStatusFailed
+}
+
+// worldExportObject is Exportしたtar.gzのObject Name
+func worldExportObject(world string, snapshot string, id int64) string {
+	return fmt.Sprintf("exports/%s/%s-%d.tar.gz", world, snapshot, id)
+}
+
+// WorldExportApi is WorldのSnapshotをtar.gzにしてDownloadできるようにするAPI
+type WorldExportApi struct{}
+
+// WorldExportApiPostParam is POST /api/1/minecraft/{world}/exports のRequest Body
+// Bodyは省略できる
+type WorldExportApiPostParam struct {
+	Snapshot string `json:"snapshot"` // 省略した場合はLatestSnapshot
+}
+
+// WorldExportListResponse is GET /api/1/minecraft/{world}/exports のResponse
+type WorldExportListResponse struct {
+	Items []*WorldExport `json:"items"`
+}
+
+// list world exports
+func (a *WorldExportApi) List(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	limit, err := parseLimit(r, 20, 100)
+	if err != nil {
+		return err
+	}
+
+	res := WorldExportListResponse{
+		Items: make([]*WorldExport, 0),
+	}
+	q := datastore.NewQuery("WorldExport").Filter("World =", p["world"]).Order("-CreatedAt").Limit(limit)
+	for t := q.Run(ctx); ; {
+		var entity WorldExport
+		key, err := t.Next(&entity)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return internalError(err)
+		}
+		entity.Key = key
+		entity.ID = key.IntID()
+		res.Items = append(res.Items, &entity)
+	}
+
+	writeJSON(w, http.StatusOK, res)
+	return nil
+}
+
+// get world export
+// 終わっている場合は期限付きのDownload URLを付ける
+func (a *WorldExportApi) Get(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	id, err := strconv.ParseInt(p["id"], 10, 64)
+	if err != nil {
+		return invalidRequestError("invalid id.").WithDetail("id", p["id"])
+	}
+	key := datastore.NewKey(ctx, "WorldExport", "", id, nil)
+	var entity WorldExport
+	err = datastore.Get(ctx, key, &entity)
+	if err == datastore.ErrNoSuchEntity || (err == nil && entity.World != p["world"]) {
+		return notFoundError(fmt.Sprintf("%s export %d is not found.", p["world"], id))
+	}
+	if err != nil {
+		return internalError(err)
+	}
+	entity.Key = key
+	entity.ID = id
+
+	if entity.Status == WorldExportStatusDone {
+		expiresAt := time.Now().Add(worldExportDownloadExpiration)
+		u, err := appEngineSignedURL(ctx, "GET", WorldExportBucket, entity.Object, "", expiresAt)
+		if err != nil {
+			return internalError(err)
+		}
+		entity.DownloadURL = u
+		entity.DownloadExpiresAt = &expiresAt
+	}
+
+	writeJSON(w, http.StatusOK, entity)
+	return nil
+}
+
+// create world export
+func (a *WorldExportApi) Post(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	var param WorldExportApiPostParam
+	err := json.NewDecoder(r.Body).Decode(&param)
+	if err != nil && err != io.EOF {
+		return invalidRequestError("invalid request.").WithDetail("cause", err.Error())
+	}
+	defer r.Body.Close()
+
+	key, err := minecraftKey(ctx, p, "")
+	if err != nil {
+		return err
+	}
+	minecraft, err := getMinecraft(ctx, key)
+	if err != nil {
+		return err
+	}
+	sn := param.Snapshot
+	if len(sn) < 1 {
+		sn = minecraft.LatestSnapshot
+	}
+	if len(sn) < 1 {
+		return conflictError(fmt.Sprintf("%s has no snapshot.", minecraft.World))
+	}
+	// CloneしたWorldのLatestSnapshotはClone元のWorldのSnapshotなので、LatestSnapshotはそのまま使える
+	if sn != minecraft.LatestSnapshot && snapshotBelongsTo(sn, minecraft.World) == false {
+		return invalidRequestError(fmt.Sprintf("snapshot is not %s snapshot.", minecraft.World)).WithDetail("snapshot", sn)
+	}
+
+	s, err := newComputeService(ctx)
+	if err != nil {
+		return internalError(err)
+	}
+	_, err = compute.NewSnapshotsService(s).Get(PROJECT_NAME, sn).Do()
+	if isNotFoundError(err) {
+		return notFoundError(fmt.Sprintf("%s is not found.", sn)).WithDetail("snapshot", sn)
+	}
+	if err != nil {
+		return internalError(err)
+	}
+
+	ids, _, err := datastore.AllocateIDs(ctx, "WorldExport", nil, 1)
+	if err != nil {
+		return internalError(err)
+	}
+	ekey := datastore.NewKey(ctx, "WorldExport", "", ids, nil)
+	now := time.Now()
+	entity := WorldExport{
+		Key:       ekey,
+		ID:        ids,
+		World:     minecraft.World,
+		Zone:      minecraft.Zone,
+		Snapshot:  sn,
+		Object:    worldExportObject(minecraft.World, sn, ids),
+		Status:    WorldExportStatusCreatingDisk,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	ope, err := compute.NewDisksService(s).Insert(PROJECT_NAME, entity.Zone, &compute.Disk{
+		Name:           worldExportResourceName(entity),
+		SizeGb:         100,
+		SourceSnapshot: "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/global/snapshots/" + sn,
+		Type:           "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/zones/" + entity.Zone + "/diskTypes/pd-standard",
+	}).Do()
+	if err != nil {
+		return internalError(err)
+	}
+	WriteLog(ctx, "INSTNCE_DISK_OPE", ope)
+	entity.OperationID = ope.Name
+
+	tq := WorldExportTQApi{}
+	err = datastore.RunInTransaction(ctx, func(c context.Context) error {
+		_, err := datastore.Put(c, ekey, &entity)
+		if err != nil {
+			return err
+		}
+		_, err = tq.CallStep(c, ekey, 30*time.Second)
+		return err
+	}, nil)
+	if err != nil {
+		return internalError(err)
+	}
+	auditEventFromContext(ctx).SetDiff(nil, entity)
+
+	writeJSON(w, http.StatusAccepted, entity)
+	return nil
+}
@@ -0,0 +1,339 @@
+package sinmetalcraft
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+
+	"google.golang.org/api/compute/v1"
+
+	"golang.org/x/net/context"
+)
+
+// worldExportArchiveTimeout is Instanceがtar.gzを作り終えるのを待つ時間
+const worldExportArchiveTimeout = 1 * time.Hour
+
+func init() {
+	api := WorldExportTQApi{}
+
+	http.HandleFunc("/tq/1/export/step", api.Step)
+}
+
+// WorldExportTQApi is WorldExportのStatusを1つずつ進めるTQ
+//
+// creating_disk -> archiving -> cleanup -> done
+//
+// 途中で失敗した場合はErrorを設定してcleanupに進み、最後はfailedになる
+type WorldExportTQApi struct{}
+
+// CallStep is WorldExportのStatusを進めるTQを登録する
+func (a *WorldExportTQApi) CallStep(c context.Context, key *datastore.Key, delay time.Duration) (*taskqueue.Task, error) {
+	log.Infof(c, "Call World Export Step TQ, key = %v", key)
+	if key == nil {
+		return nil, errors.New("key is required")
+	}
+
+	t := taskqueue.NewPOSTTask("/tq/1/export/step", url.Values{
+		"keyStr": {key.Encode()},
+	})
+	t.Delay = delay
+	return taskqueue.Add(c, t, "minecraft")
+}
+
+// Step is WorldExportの今のStatusの処理を行い、終わっていれば次のStatusに進める
+func (a *WorldExportTQApi) Step(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	keyStr := r.FormValue("keyStr")
+	log.Infof(ctx, "keyStr = %s", keyStr)
+
+	key, err := datastore.DecodeKey(keyStr)
+	if err != nil {
+		log.Errorf(ctx, "key decode error. keyStr = %s, err = %s", keyStr, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var entity WorldExport
+	err = datastore.Get(ctx, key, &entity)
+	if err != nil {
+		log.Errorf(ctx, "datastore get error. key = %d. error = %v", key.IntID(), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	entity.Key = key
+	entity.ID = key.IntID()
+	log.Infof(ctx, "world export status = %s", entity.Status)
+
+	s, err := newComputeService(ctx)
+	if err != nil {
+		log.Errorf(ctx, "ERROR compute.New: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	switch entity.Status {
+	case WorldExportStatusCreatingDisk:
+		err = a.createInstance(ctx, r, s, entity)
+	case WorldExportStatusArchiving:
+		err = a.waitArchive(ctx, r, s, entity)
+	case WorldExportStatusCleanup:
+		err = a.cleanup(ctx, s, entity)
+	default:
+		log.Infof(ctx, "nothing to do. status = %s", entity.Status)
+	}
+	if err == errOperationWaiting {
+		w.WriteHeader(http.StatusRequestTimeout)
+		return
+	}
+	if err != nil {
+		log.Errorf(ctx, "world export step error. status = %s, error = %v", entity.Status, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// createInstance is SnapshotからDiskができたら、tar.gzを作るInstanceを作る
+func (a *WorldExportTQApi) createInstance(ctx context.Context, r *http.Request, s *compute.Service, entity WorldExport) error {
+	ope, err := waitZoneOperation(ctx, s, entity.Zone, entity.OperationID)
+	if err != nil {
+		return err
+	}
+	if ope.Error != nil && len(ope.Error.Errors) > 0 {
+		return a.fail(ctx, r, s, entity, fmt.Errorf("disk create error. %s", ope.Error.Errors[0].Message))
+	}
+
+	is := compute.NewInstancesService(s)
+	ope, err = is.Insert(PROJECT_NAME, entity.Zone, worldExportInstance(entity)).Do()
+	if err != nil {
+		log.Errorf(ctx, "ERROR insert instance: %s", err)
+		return err
+	}
+	WriteLog(ctx, "INSTNCE_CREATE_OPE", ope)
+
+	return a.transition(ctx, entity, WorldExportStatusArchiving, time.Minute, func(e *WorldExport) {
+		e.OperationID = ope.Name
+	})
+}
+
+// waitArchive is InstanceがMetadataのexport-stateをdoneにしたら、Instanceを消す
+func (a *WorldExportTQApi) waitArchive(ctx context.Context, r *http.Request, s *compute.Service, entity WorldExport) error {
+	is := compute.NewInstancesService(s)
+	ins, err := is.Get(PROJECT_NAME, entity.Zone, worldExportResourceName(entity)).Do()
+	if isNotFoundError(err) {
+		return a.fail(ctx, r, s, entity, errors.New("export instance is not found"))
+	}
+	if err != nil {
+		return err
+	}
+
+	switch instanceMetadataValue(ins.Metadata, "export-state") {
+	case "done":
+	case "error":
+		return a.fail(ctx, r, s, entity, fmt.Errorf("archive error. %s", instanceMetadataValue(ins.Metadata, "export-error")))
+	default:
+		if time.Since(entity.UpdatedAt) > worldExportArchiveTimeout {
+			return a.fail(ctx, r, s, entity, fmt.Errorf("archive timeout. %s", worldExportArchiveTimeout))
+		}
+		return errOperationWaiting
+	}
+	size, err := strconv.ParseInt(instanceMetadataValue(ins.Metadata, "export-size"), 10, 64)
+	if err != nil {
+		log.Warningf(ctx, "invalid export-size. %v", err)
+	}
+
+	a.deleteInstance(ctx, is, entity)
+
+	ev := newAuditEvent(ctx, r, AuditActionWorldExportDone)
+	ev.Target = entity.World
+	ev.SetDiff(nil, map[string]interface{}{"snapshot": entity.Snapshot, "object": entity.Object, "size": size})
+	ev.Record(ctx, nil)
+
+	return a.transition(ctx, entity, WorldExportStatusCleanup, 30*time.Second, func(e *WorldExport) {
+		e.Size = size
+	})
+}
+
+// cleanup is Instanceが消えたらDiskを消して、Exportを終える
+func (a *WorldExportTQApi) cleanup(ctx context.Context, s *compute.Service, entity WorldExport) error {
+	name := worldExportResourceName(entity)
+	is := compute.NewInstancesService(s)
+	_, err := is.Get(PROJECT_NAME, entity.Zone, name).Do()
+	if err == nil {
+		return errOperationWaiting
+	}
+	if !isNotFoundError(err) {
+		return err
+	}
+
+	// Instanceを作る前に失敗した場合は、AutoDeleteされずにDiskが残っている
+	ope, err := compute.NewDisksService(s).Delete(PROJECT_NAME, entity.Zone, name).Do()
+	if err != nil && !isNotFoundError(err) {
+		log.Errorf(ctx, "ERROR delete disk: %s", err)
+		return err
+	}
+	if ope != nil {
+		WriteLog(ctx, "INSTNCE_DISK_DELETE_OPE", ope)
+	}
+
+	status := WorldExportStatusDone
+	if len(entity.Error) > 0 {
+		status = WorldExportStatusFailed
+		// 途中まで書き込まれたObjectが残っていることがある
+		err := gcsDeleteObject(newStorageClient(ctx), WorldExportBucket, entity.Object)
+		if err != nil {
+			return err
+		}
+	}
+	return a.transition(ctx, entity, status, 0, nil)
+}
+
+// fail is Exportを失敗にしてcleanupに進める
+func (a *WorldExportTQApi) fail(ctx context.Context, r *http.Request, s *compute.Service, entity WorldExport, cause error) error {
+	log.Warningf(ctx, "world export failed. world = %s, status = %s, error = %v", entity.World, entity.Status, cause)
+
+	a.deleteInstance(ctx, compute.NewInstancesService(s), entity)
+
+	ev := newAuditEvent(ctx, r, AuditActionWorldExportDone)
+	ev.Target = entity.World
+	ev.Record(ctx, cause)
+
+	return a.transition(ctx, entity, WorldExportStatusCleanup, 30*time.Second, func(e *WorldExport) {
+		e.Error = cause.Error()
+	})
+}
+
+// deleteInstance is tar.gzを作るInstanceを消す。既に無い場合は何もしない
+func (a *WorldExportTQApi) deleteInstance(ctx context.Context, is *compute.InstancesService, entity WorldExport) {
+	ope, err := is.Delete(PROJECT_NAME, entity.Zone, worldExportResourceName(entity)).Do()
+	if err != nil {
+		if !isNotFoundError(err) {
+			log.Warningf(ctx, "ERROR delete instance: %s", err)
+		}
+		return
+	}
+	WriteLog(ctx, "INSTNCE_DELETE_OPE", ope)
+}
+
+// transition is WorldExportをStatusに進めて、次のStepのTQを登録する
+// TQのRetryで同じStepが二重に実行された場合は、StatusがentityのStatusと違うので何もしない
+func (a *WorldExportTQApi) transition(ctx context.Context, entity WorldExport, status string, delay time.Duration, f func(e *WorldExport)) error {
+	return datastore.RunInTransaction(ctx, func(c context.Context) error {
+		var current WorldExport
+		err := datastore.Get(c, entity.Key, &current)
+		if err != nil {
+			return err
+		}
+		if current.Status != entity.Status {
+			log.Warningf(c, "world export status is changed. %s -> %s", entity.Status, current.Status)
+			return nil
+		}
+
+		current.Status = status
+		current.UpdatedAt = time.Now()
+		if f != nil {
+			f(&current)
+		}
+		_, err = datastore.Put(c, entity.Key, &current)
+		if err != nil {
+			return err
+		}
+		if current.Finished() {
+			return nil
+		}
+		_, err = a.CallStep(c, entity.Key, delay)
+		return err
+	}, nil)
+}
+
+// worldExportResourceName is Exportで使うInstanceとDiskのName
+// 同じWorldのExportが同時に動いてもぶつからないようにIDを付ける
+func worldExportResourceName(entity WorldExport) string {
+	return fmt.Sprintf("%s-%s-%d", WorldExportInstanceName, entity.World, entity.ID)
+}
+
+// worldExportInstance is Diskをtar.gzにしてUploadし、MetadataのExport-stateをdoneにするInstance
+func worldExportInstance(entity WorldExport) *compute.Instance {
+	name := worldExportResourceName(entity)
+	startupScriptURL := "gs://sinmetalcraft-minecraft-shell/minecraft-export-script.sh"
+	object := fmt.Sprintf("gs://%s/%s", WorldExportBucket, entity.Object)
+	metadata := []struct {
+		key   string
+		value string
+	}{
+		{"startup-script-url", startupScriptURL},
+		{"world", entity.World},
+		{"export-disk", name},
+		{"export-object", object},
+	}
+	items := make([]*compute.MetadataItems, 0, len(metadata))
+	for _, m := range metadata {
+		v := m.value
+		items = append(items, &compute.MetadataItems{Key: m.key, Value: &v})
+	}
+
+	return &compute.Instance{
+		Name:        name,
+		Zone:        "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/zones/" + entity.Zone,
+		MachineType: "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/zones/" + entity.Zone + "/machineTypes/n1-standard-1",
+		Disks: []*compute.AttachedDisk{
+			&compute.AttachedDisk{
+				AutoDelete: true,
+				Boot:       true,
+				DeviceName: name + "-boot",
+				Mode:       "READ_WRITE",
+				InitializeParams: &compute.AttachedDiskInitializeParams{
+					SourceImage: "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/global/images/family/minecraft",
+					DiskType:    "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/zones/" + entity.Zone + "/diskTypes/pd-ssd",
+					DiskSizeGb:  100,
+				},
+			},
+			&compute.AttachedDisk{
+				AutoDelete: true,
+				Boot:       false,
+				DeviceName: name,
+				Mode:       "READ_ONLY",
+				Source:     "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/zones/" + entity.Zone + "/disks/" + name,
+			},
+		},
+		CanIpForward: false,
+		NetworkInterfaces: []*compute.NetworkInterface{
+			&compute.NetworkInterface{
+				Network: "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/global/networks/default",
+				AccessConfigs: []*compute.AccessConfig{
+					&compute.AccessConfig{
+						Name: "External NAT",
+						Type: "ONE_TO_ONE_NAT",
+					},
+				},
+			},
+		},
+		Metadata: &compute.Metadata{
+			Items: items,
+		},
+		ServiceAccounts: []*compute.ServiceAccount{
+			&compute.ServiceAccount{
+				Email: "default",
+				Scopes: []string{
+					compute.DevstorageReadWriteScope,
+					compute.ComputeScope,
+					"https://www.googleapis.com/auth/logging.write",
+				},
+			},
+		},
+		Scheduling: &compute.Scheduling{
+			AutomaticRestart:  false,
+			OnHostMaintenance: "TERMINATE",
+			Preemptible:       false,
+		},
+	}
+}
@@ -0,0 +1,29 @@
+package sinmetalcraft
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestWorldExportResourceName(t *testing.T) {
+	cases := []struct {
+		world string
+		id    int64
+		want  string
+	}{
+		{"hoge", 1, "worldexport-hoge-1"},
+		{"hoge-fuga", 5629499534213120, "worldexport-hoge-fuga-5629499534213120"},
+	}
+	for _, c := range cases {
+		if name := worldExportResourceName(WorldExport{World: c.world, ID: c.id}); name != c.want {
+			t.Errorf("worldExportResourceName(%s, %d) = %s, want %s", c.world, c.id, name, c.want)
+		}
+	}
+
+	// GCEのResource Nameは63文字まで
+	world := strings.Repeat("a", worldNameMaxLength)
+	if name := worldExportResourceName(WorldExport{World: world, ID: math.MaxInt64}); len(name) > 63 {
+		t.Errorf("%s is longer than 63. len = %d", name, len(name))
+	}
+}
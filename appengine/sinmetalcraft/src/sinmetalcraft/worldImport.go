@@ -0,0 +1,371 @@
+package sinmetalcraft
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+
+	"golang.org/x/net/context"
+)
+
+func init() {
+	api := WorldImportApi{}
+
+	apiRouter.Handle("GET", "/api/1/minecraft/{world}/import", api.Get, requireAdmin)
+	apiRouter.Handle("POST", "/api/1/minecraft/{world}/import", api.Post, requireAdmin, audit(AuditActionWorldImport))
+	apiRouter.Handle("POST", "/api/1/minecraft/{world}/import/start", api.Start, requireAdmin, audit(AuditActionWorldImportStart))
+}
+
+// WorldImportBucket is UploadされたWorldのArchiveを置くBucket
+const WorldImportBucket = "sinmetalcraft-minecraft-import"
+
+// WorldImportInstanceName is Archiveを展開するInstanceのName Prefix
+// "minecraft-" にするとWorldのInstanceと区別が付かなくなるので別にしている
+const WorldImportInstanceName = "worldimport"
+
+const (
+	worldImportUploadExpiration = 1 * time.Hour
+	worldImportMaxArchiveSize   = 10 << 30
+	worldImportMaxEntries       = 500000
+	worldImportDiskSizeGb       = 100
+
+	// tar.gzは確認に全体を読む必要があるので、TQの1回のRequestで読み切れるSizeにする
+	// zipは末尾のCentral Directoryだけを読むので、worldImportMaxArchiveSizeまで受け付ける
+	worldImportMaxTarGzSize = 1 << 30
+)
+
+// WorldImport Status
+const (
+	WorldImportStatusWaitingUpload = "waiting_upload"
+	WorldImportStatusValidating    = "validating"
+	WorldImportStatusCreatingDisk  = "creating_disk"
+	WorldImportStatusUnpacking     = "unpacking"
+	WorldImportStatusSnapshotting  = "snapshotting"
+	WorldImportStatusCleanup       = "cleanup"
+	WorldImportStatusDone          = "done"
+	WorldImportStatusFailed        = "failed"
+)
+
+// WorldImport Format
+const (
+	WorldImportFormatZip   = "zip"
+	WorldImportFormatTarGz = "tar.gz"
+)
+
+// worldImportContentTypes is Signed URLでUploadする時のContent-Type
+var worldImportContentTypes = map[string]string{
+	WorldImportFormatZip:   "application/zip",
+	WorldImportFormatTarGz: "application/gzip",
+}
+
+// WorldImport is UploadされたArchiveからWorldを作る処理の状態
+// Keyは作成するWorld Name
+type WorldImport struct {
+	Key         *datastore.Key `json:"-" datastore:"-"`
+	World       string         `json:"world"`
+	Zone        string         `json:"zone"`
+	JarVersion  string         `json:"jarVersion"`
+	Format      string         `json:"format"`
+	Object      string         `json:"object"`                           // WorldImportBucketのObject Name
+	ArchiveRoot string         `json:"archiveRoot" datastore:",noindex"` // Archiveの中でlevel.datがあるDirectory
+	Status      string         `json:"status"`
+	OperationID string         `json:"operationID" datastore:",noindex"`
+	Snapshot    string         `json:"snapshot" datastore:",noindex"`
+	Error       string         `json:"error" datastore:",noindex"`
+	CreatedAt   time.Time      `json:"createdAt"`
+	UpdatedAt   time.Time      `json:"updatedAt"`
+}
+
+// Finished is Importが終わっていて、同じWorld Nameで次のImportを始められるか
+func (wi *WorldImport) Finished() bool {
+	return wi.Status == WorldImportStatusDone || wi.Status == WorldImportStatusFailed
+}
+
+// Replaceable is 同じWorld Nameで新しいImportを始めて良いか
+// Uploadされないまま、Signed URLの期限が切れたImportも置き換える
+func (wi *WorldImport) Replaceable(now time.Time) bool {
+	if wi.Finished() {
+		return true
+	}
+	return wi.Status == WorldImportStatusWaitingUpload && now.Sub(wi.UpdatedAt) > worldImportUploadExpiration
+}
+
+// WorldImportApi is UploadされたArchiveからWorldを作るAPI
+type WorldImportApi struct{}
+
+// WorldImportApiPostParam is POST /api/1/minecraft/{world}/import のRequest Body
+type WorldImportApiPostParam struct {
+	Zone       string `json:"zone"`
+	JarVersion string `json:"jarVersion"`
+	Format     string `json:"format"`
+}
+
+// WorldImportApiPostResponse is Archiveを置くSigned URL
+// uploadUrlにContent-Typeを付けてPUTした後、POST /api/1/minecraft/{world}/import/start を呼ぶ
+type WorldImportApiPostResponse struct {
+	Import      WorldImport `json:"import"`
+	UploadURL   string      `json:"uploadUrl"`
+	ContentType string      `json:"contentType"`
+	ExpiresAt   time.Time   `json:"expiresAt"`
+}
+
+// get import status
+func (a *WorldImportApi) Get(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	key := datastore.NewKey(ctx, "WorldImport", p["world"], 0, nil)
+	var entity WorldImport
+	err := datastore.Get(ctx, key, &entity)
+	if err == datastore.ErrNoSuchEntity {
+		return notFoundError(fmt.Sprintf("%s import is not found.", p["world"]))
+	}
+	if err != nil {
+		return internalError(err)
+	}
+
+	writeJSON(w, http.StatusOK, entity)
+	return nil
+}
+
+// create import and upload url
+func (a *WorldImportApi) Post(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	var param WorldImportApiPostParam
+	err := json.NewDecoder(r.Body).Decode(&param)
+	if err != nil {
+		return invalidRequestError("invalid request.").WithDetail("cause", err.Error())
+	}
+	defer r.Body.Close()
+
+	world := p["world"]
+	if err := validateWorldName(world); err != nil {
+		return err
+	}
+	contentType, ok := worldImportContentTypes[param.Format]
+	if !ok {
+		return invalidRequestError(fmt.Sprintf("format is %s or %s.", WorldImportFormatZip, WorldImportFormatTarGz)).WithDetail("format", param.Format)
+	}
+	if len(param.Zone) < 1 {
+		return invalidRequestError("zone is required.")
+	}
+	if err := validateJarVersion(ctx, param.JarVersion); err != nil {
+		return err
+	}
+
+	var m Minecraft
+	err = datastore.Get(ctx, datastore.NewKey(ctx, "Minecraft", world, 0, nil), &m)
+	if err == nil {
+		return conflictError(fmt.Sprintf("%s already exists.", world)).WithDetail("world", world)
+	}
+	if err != datastore.ErrNoSuchEntity {
+		return internalError(err)
+	}
+
+	now := time.Now()
+	entity := WorldImport{
+		World:      world,
+		Zone:       param.Zone,
+		JarVersion: param.JarVersion,
+		Format:     param.Format,
+		Object:     fmt.Sprintf("%s/%d.%s", world, now.Unix(), param.Format),
+		Status:     WorldImportStatusWaitingUpload,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	key := datastore.NewKey(ctx, "WorldImport", world, 0, nil)
+	err = datastore.RunInTransaction(ctx, func(c context.Context) error {
+		var current WorldImport
+		err := datastore.Get(c, key, &current)
+		if err == nil && current.Replaceable(now) == false {
+			return conflictError(fmt.Sprintf("%s import is %s.", world, current.Status)).WithDetail("status", current.Status)
+		}
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err = datastore.Put(c, key, &entity)
+		return err
+	}, nil)
+	if ae, ok := err.(*APIError); ok {
+		return ae
+	}
+	if err != nil {
+		return internalError(err)
+	}
+	auditEventFromContext(ctx).SetDiff(nil, entity)
+
+	expiresAt := now.Add(worldImportUploadExpiration)
+	u, err := appEngineSignedURL(ctx, "PUT", WorldImportBucket, entity.Object, contentType, expiresAt)
+	if err != nil {
+		return internalError(err)
+	}
+
+	writeJSON(w, http.StatusCreated, WorldImportApiPostResponse{
+		Import:      entity,
+		UploadURL:   u,
+		ContentType: contentType,
+		ExpiresAt:   expiresAt,
+	})
+	return nil
+}
+
+// start import after upload
+func (a *WorldImportApi) Start(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	key := datastore.NewKey(ctx, "WorldImport", p["world"], 0, nil)
+
+	tq := WorldImportTQApi{}
+	var before, entity WorldImport
+	err := datastore.RunInTransaction(ctx, func(c context.Context) error {
+		err := datastore.Get(c, key, &entity)
+		if err == datastore.ErrNoSuchEntity {
+			return notFoundError(fmt.Sprintf("%s import is not found.", p["world"]))
+		}
+		if err != nil {
+			return err
+		}
+		before = entity
+		if entity.Status != WorldImportStatusWaitingUpload {
+			return conflictError(fmt.Sprintf("%s import is %s.", entity.World, entity.Status)).WithDetail("status", entity.Status)
+		}
+
+		entity.Status = WorldImportStatusValidating
+		entity.UpdatedAt = time.Now()
+		_, err = datastore.Put(c, key, &entity)
+		if err != nil {
+			return err
+		}
+		// TransactionでTQを登録して、Statusだけ進んでImportが動かない状態にならないようにする
+		_, err = tq.CallStep(c, key, 0)
+		return err
+	}, nil)
+	if ae, ok := err.(*APIError); ok {
+		return ae
+	}
+	if err != nil {
+		return internalError(err)
+	}
+	auditEventFromContext(ctx).SetDiff(before, entity)
+
+	writeJSON(w, http.StatusAccepted, entity)
+	return nil
+}
+
+// worldArchiveEntry is Archiveの中の1つのFile
+type worldArchiveEntry struct {
+	Name string
+	Dir  bool
+	Size int64
+}
+
+// errWorldArchiveEntryType is Regular File, Directory以外 (Symlinkなど) がArchiveに含まれている
+var errWorldArchiveEntryType = errors.New("archive contains symlink or special file")
+
+// worldImportMaxSize is Formatごとに受け付けるArchiveのSize
+func worldImportMaxSize(format string) int64 {
+	if format == WorldImportFormatTarGz {
+		return worldImportMaxTarGzSize
+	}
+	return worldImportMaxArchiveSize
+}
+
+// listZipEntries is zipのCentral Directoryだけを読んでEntryを返す
+func listZipEntries(r io.ReaderAt, size int64) ([]worldArchiveEntry, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]worldArchiveEntry, 0, len(zr.File))
+	for _, f := range zr.File {
+		mode := f.Mode()
+		if mode.IsDir() == false && mode.IsRegular() == false {
+			return nil, errWorldArchiveEntryType
+		}
+		entries = append(entries, worldArchiveEntry{Name: f.Name, Dir: mode.IsDir(), Size: int64(f.UncompressedSize64)})
+		if len(entries) > worldImportMaxEntries {
+			return nil, fmt.Errorf("archive has too many entries. max = %d", worldImportMaxEntries)
+		}
+	}
+	return entries, nil
+}
+
+// listTarGzEntries is tar.gzを先頭から読んでEntryを返す
+// gzipは途中から読めないので全体を読むが、Fileの中身は捨てる
+func listTarGzEntries(r io.Reader) ([]worldArchiveEntry, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+
+	entries := make([]worldArchiveEntry, 0)
+	tr := tar.NewReader(gr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch h.Typeflag {
+		case tar.TypeDir:
+			entries = append(entries, worldArchiveEntry{Name: h.Name, Dir: true})
+		case tar.TypeReg, tar.TypeRegA:
+			entries = append(entries, worldArchiveEntry{Name: h.Name, Size: h.Size})
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			return nil, errWorldArchiveEntryType
+		}
+		if len(entries) > worldImportMaxEntries {
+			return nil, fmt.Errorf("archive has too many entries. max = %d", worldImportMaxEntries)
+		}
+	}
+	return entries, nil
+}
+
+// validateWorldArchive is ArchiveがMinecraftのWorldとして展開できるかを確認して、level.datがあるDirectoryを返す
+// Directoryは "" (Archiveの直下) か "world/" のように1階層までを許す
+func validateWorldArchive(entries []worldArchiveEntry) (string, error) {
+	var total int64
+	roots := make([]string, 0)
+	for _, e := range entries {
+		name := strings.TrimPrefix(e.Name, "./")
+		if strings.HasPrefix(name, "/") || strings.Contains(name, "\\") {
+			return "", fmt.Errorf("archive contains absolute path. name = %s", e.Name)
+		}
+		for _, s := range strings.Split(name, "/") {
+			if s == ".." {
+				return "", fmt.Errorf("archive contains parent directory path. name = %s", e.Name)
+			}
+		}
+		total += e.Size
+		if e.Dir == false && path.Base(name) == "level.dat" && strings.Count(name, "/") <= 1 {
+			roots = append(roots, strings.TrimSuffix(name, "level.dat"))
+		}
+	}
+	if total > worldImportDiskSizeGb<<30*9/10 {
+		return "", fmt.Errorf("archive is too large to unpack. size = %d", total)
+	}
+	if len(roots) == 0 {
+		return "", errors.New("level.dat is not found")
+	}
+	if len(roots) > 1 {
+		return "", fmt.Errorf("archive contains multiple worlds. %v", roots)
+	}
+
+	root := roots[0]
+	for _, e := range entries {
+		name := strings.TrimPrefix(e.Name, "./")
+		if e.Dir == false && strings.HasPrefix(name, root+"region/") && strings.HasSuffix(name, ".mca") {
+			return root, nil
+		}
+	}
+	return "", fmt.Errorf("%sregion/*.mca is not found", root)
+}
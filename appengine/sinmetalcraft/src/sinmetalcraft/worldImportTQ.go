@@ -0,0 +1,495 @@
+package sinmetalcraft
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+
+	"google.golang.org/api/compute/v1"
+
+	"golang.org/x/net/context"
+)
+
+// worldImportUnpackTimeout is Instanceが展開を終えるのを待つ時間
+const worldImportUnpackTimeout = 1 * time.Hour
+
+// errOperationWaiting is GCEの処理が終わっていないので、後でもう一度TQを実行する
+var errOperationWaiting = errors.New("waiting")
+
+func init() {
+	api := WorldImportTQApi{}
+
+	http.HandleFunc("/tq/1/import/step", api.Step)
+}
+
+// WorldImportTQApi is WorldImportのStatusを1つずつ進めるTQ
+//
+// validating -> creating_disk -> unpacking -> snapshotting -> cleanup -> done
+//
+// 途中で失敗した場合はErrorを設定してcleanupに進み、最後はfailedになる
+type WorldImportTQApi struct{}
+
+// CallStep is WorldImportのStatusを進めるTQを登録する
+func (a *WorldImportTQApi) CallStep(c context.Context, key *datastore.Key, delay time.Duration) (*taskqueue.Task, error) {
+	log.Infof(c, "Call World Import Step TQ, key = %v", key)
+	if key == nil {
+		return nil, errors.New("key is required")
+	}
+
+	t := taskqueue.NewPOSTTask("/tq/1/import/step", url.Values{
+		"keyStr": {key.Encode()},
+	})
+	t.Delay = delay
+	return taskqueue.Add(c, t, "minecraft")
+}
+
+// Step is WorldImportの今のStatusの処理を行い、終わっていれば次のStatusに進める
+func (a *WorldImportTQApi) Step(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	keyStr := r.FormValue("keyStr")
+	log.Infof(ctx, "keyStr = %s", keyStr)
+
+	key, err := datastore.DecodeKey(keyStr)
+	if err != nil {
+		log.Errorf(ctx, "key decode error. keyStr = %s, err = %s", keyStr, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var entity WorldImport
+	err = datastore.Get(ctx, key, &entity)
+	if err != nil {
+		log.Errorf(ctx, "datastore get error. key = %s. error = %v", key.StringID(), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	entity.Key = key
+	log.Infof(ctx, "world import status = %s", entity.Status)
+
+	s, err := newComputeService(ctx)
+	if err != nil {
+		log.Errorf(ctx, "ERROR compute.New: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	switch entity.Status {
+	case WorldImportStatusValidating:
+		err = a.validate(ctx, r, s, entity)
+	case WorldImportStatusCreatingDisk:
+		err = a.createInstance(ctx, r, s, entity)
+	case WorldImportStatusUnpacking:
+		err = a.waitUnpack(ctx, r, s, entity)
+	case WorldImportStatusSnapshotting:
+		err = a.createWorld(ctx, r, s, entity)
+	case WorldImportStatusCleanup:
+		err = a.cleanup(ctx, s, entity)
+	default:
+		// TQがRetryされた時に、既に進んだStatusの処理を二重に行わない
+		log.Infof(ctx, "nothing to do. status = %s", entity.Status)
+	}
+	if err == errOperationWaiting {
+		w.WriteHeader(http.StatusRequestTimeout)
+		return
+	}
+	if err != nil {
+		log.Errorf(ctx, "world import step error. status = %s, error = %v", entity.Status, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// validate is UploadされたArchiveを確認して、展開先のDiskを作る
+func (a *WorldImportTQApi) validate(ctx context.Context, r *http.Request, s *compute.Service, entity WorldImport) error {
+	client := newStorageClient(ctx)
+	size, ok, err := gcsObjectSize(client, WorldImportBucket, entity.Object)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return a.fail(ctx, r, s, entity, fmt.Errorf("archive is not uploaded. object = %s", entity.Object))
+	}
+	if max := worldImportMaxSize(entity.Format); size > max {
+		return a.fail(ctx, r, s, entity, fmt.Errorf("archive is too large. size = %d, max = %d", size, max))
+	}
+
+	obj := &gcsObjectReader{client: client, bucket: WorldImportBucket, object: entity.Object, size: size}
+	var entries []worldArchiveEntry
+	switch entity.Format {
+	case WorldImportFormatZip:
+		entries, err = listZipEntries(obj, size)
+	case WorldImportFormatTarGz:
+		entries, err = listTarGzEntries(bufio.NewReaderSize(io.NewSectionReader(obj, 0, size), 8<<20))
+	default:
+		err = fmt.Errorf("unknown format. format = %s", entity.Format)
+	}
+	if err != nil {
+		return a.fail(ctx, r, s, entity, fmt.Errorf("invalid archive. %v", err))
+	}
+	root, err := validateWorldArchive(entries)
+	if err != nil {
+		return a.fail(ctx, r, s, entity, fmt.Errorf("invalid archive. %v", err))
+	}
+	log.Infof(ctx, "archive root = %q, entries = %d", root, len(entries))
+
+	ds := compute.NewDisksService(s)
+	d := &compute.Disk{
+		Name:   worldImportDiskName(entity.World),
+		SizeGb: worldImportDiskSizeGb,
+		Type:   "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/zones/" + entity.Zone + "/diskTypes/pd-ssd",
+	}
+	ope, err := ds.Insert(PROJECT_NAME, entity.Zone, d).Do()
+	if err != nil {
+		log.Errorf(ctx, "ERROR insert disk: %s", err)
+		return err
+	}
+	WriteLog(ctx, "INSTNCE_DISK_OPE", ope)
+
+	return a.transition(ctx, entity, WorldImportStatusCreatingDisk, 30*time.Second, func(e *WorldImport) {
+		e.ArchiveRoot = root
+		e.OperationID = ope.Name
+	})
+}
+
+// createInstance is Diskができたら、Archiveを展開するInstanceを作る
+func (a *WorldImportTQApi) createInstance(ctx context.Context, r *http.Request, s *compute.Service, entity WorldImport) error {
+	ope, err := a.waitOperation(ctx, s, entity)
+	if err != nil {
+		return err
+	}
+	if ope.Error != nil && len(ope.Error.Errors) > 0 {
+		return a.fail(ctx, r, s, entity, fmt.Errorf("disk create error. %s", ope.Error.Errors[0].Message))
+	}
+
+	is := compute.NewInstancesService(s)
+	ope, err = is.Insert(PROJECT_NAME, entity.Zone, worldImportInstance(entity)).Do()
+	if err != nil {
+		log.Errorf(ctx, "ERROR insert instance: %s", err)
+		return err
+	}
+	WriteLog(ctx, "INSTNCE_CREATE_OPE", ope)
+
+	return a.transition(ctx, entity, WorldImportStatusUnpacking, time.Minute, func(e *WorldImport) {
+		e.OperationID = ope.Name
+	})
+}
+
+// waitUnpack is InstanceがMetadataのimport-stateをdoneにしたら、DiskのSnapshotを作る
+func (a *WorldImportTQApi) waitUnpack(ctx context.Context, r *http.Request, s *compute.Service, entity WorldImport) error {
+	is := compute.NewInstancesService(s)
+	ins, err := is.Get(PROJECT_NAME, entity.Zone, worldImportInstanceName(entity.World)).Do()
+	if isNotFoundError(err) {
+		return a.fail(ctx, r, s, entity, errors.New("import instance is not found"))
+	}
+	if err != nil {
+		return err
+	}
+
+	switch instanceMetadataValue(ins.Metadata, "import-state") {
+	case "done":
+	case "error":
+		return a.fail(ctx, r, s, entity, fmt.Errorf("unpack error. %s", instanceMetadataValue(ins.Metadata, "import-error")))
+	default:
+		if time.Since(entity.UpdatedAt) > worldImportUnpackTimeout {
+			return a.fail(ctx, r, s, entity, fmt.Errorf("unpack timeout. %s", worldImportUnpackTimeout))
+		}
+		return errOperationWaiting
+	}
+
+	sn := worldSnapshotName(entity.World, time.Now())
+	ds := compute.NewDisksService(s)
+	ope, err := ds.CreateSnapshot(PROJECT_NAME, entity.Zone, worldImportDiskName(entity.World), &compute.Snapshot{
+		Name:   sn,
+		Labels: map[string]string{"label": "import"},
+	}).Do()
+	if err != nil {
+		log.Errorf(ctx, "ERROR insert snapshot: %s", err)
+		return err
+	}
+	WriteLog(ctx, "INSTNCE_SNAPSHOT_OPE", ope)
+
+	// DiskはAutoDeleteにしていないので、Instanceを消してもSnapshotの作成は続く
+	a.deleteInstance(ctx, is, entity)
+
+	return a.transition(ctx, entity, WorldImportStatusSnapshotting, 30*time.Second, func(e *WorldImport) {
+		e.Snapshot = sn
+		e.OperationID = ope.Name
+	})
+}
+
+// createWorld is Snapshotができたら、LatestSnapshotをSnapshotにしたMinecraftを作る
+func (a *WorldImportTQApi) createWorld(ctx context.Context, r *http.Request, s *compute.Service, entity WorldImport) error {
+	ope, err := a.waitOperation(ctx, s, entity)
+	if err != nil {
+		return err
+	}
+	if ope.Error != nil && len(ope.Error.Errors) > 0 {
+		return a.fail(ctx, r, s, entity, fmt.Errorf("snapshot create error. %s", ope.Error.Errors[0].Message))
+	}
+
+	now := time.Now()
+	minecraft := Minecraft{
+		World:          entity.World,
+		Zone:           entity.Zone,
+		Status:         "not_exists",
+		LatestSnapshot: entity.Snapshot,
+		JarVersion:     entity.JarVersion,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	mkey := datastore.NewKey(ctx, "Minecraft", entity.World, 0, nil)
+	var exists bool
+	err = datastore.RunInTransaction(ctx, func(c context.Context) error {
+		var current Minecraft
+		err := datastore.Get(c, mkey, &current)
+		if err == nil {
+			exists = true
+			return nil
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err = datastore.Put(c, mkey, &minecraft)
+		if err != nil {
+			return err
+		}
+		return a.transitionInTransaction(c, entity, WorldImportStatusCleanup, 0, nil)
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return err
+	}
+	if exists {
+		// Importの途中で同じNameのWorldが作られた。Snapshotはそのまま残す
+		return a.fail(ctx, r, s, entity, fmt.Errorf("%s already exists. snapshot %s is kept", entity.World, entity.Snapshot))
+	}
+
+	ev := newAuditEvent(ctx, r, AuditActionWorldImportDone)
+	ev.Target = entity.World
+	ev.SetDiff(nil, minecraft)
+	ev.Record(ctx, nil)
+
+	log.Infof(ctx, "world import done. world = %s, snapshot = %s", entity.World, entity.Snapshot)
+	return nil
+}
+
+// cleanup is Instanceが消えたらDiskとArchiveを消して、Importを終える
+func (a *WorldImportTQApi) cleanup(ctx context.Context, s *compute.Service, entity WorldImport) error {
+	is := compute.NewInstancesService(s)
+	_, err := is.Get(PROJECT_NAME, entity.Zone, worldImportInstanceName(entity.World)).Do()
+	if err == nil {
+		// 削除中のInstanceにDiskがAttachされていると、Diskを消せない
+		return errOperationWaiting
+	}
+	if !isNotFoundError(err) {
+		return err
+	}
+
+	ds := compute.NewDisksService(s)
+	ope, err := ds.Delete(PROJECT_NAME, entity.Zone, worldImportDiskName(entity.World)).Do()
+	if err != nil && !isNotFoundError(err) {
+		log.Errorf(ctx, "ERROR delete disk: %s", err)
+		return err
+	}
+	if ope != nil {
+		WriteLog(ctx, "INSTNCE_DISK_DELETE_OPE", ope)
+	}
+
+	err = gcsDeleteObject(newStorageClient(ctx), WorldImportBucket, entity.Object)
+	if err != nil {
+		return err
+	}
+
+	status := WorldImportStatusDone
+	if len(entity.Error) > 0 {
+		status = WorldImportStatusFailed
+	}
+	return a.transition(ctx, entity, status, 0, nil)
+}
+
+// fail is Importを失敗にしてcleanupに進める
+func (a *WorldImportTQApi) fail(ctx context.Context, r *http.Request, s *compute.Service, entity WorldImport, cause error) error {
+	log.Warningf(ctx, "world import failed. world = %s, status = %s, error = %v", entity.World, entity.Status, cause)
+
+	a.deleteInstance(ctx, compute.NewInstancesService(s), entity)
+
+	ev := newAuditEvent(ctx, r, AuditActionWorldImportDone)
+	ev.Target = entity.World
+	ev.Record(ctx, cause)
+
+	return a.transition(ctx, entity, WorldImportStatusCleanup, 30*time.Second, func(e *WorldImport) {
+		e.Error = cause.Error()
+	})
+}
+
+// deleteInstance is 展開用のInstanceを消す。既に無い場合は何もしない
+func (a *WorldImportTQApi) deleteInstance(ctx context.Context, is *compute.InstancesService, entity WorldImport) {
+	ope, err := is.Delete(PROJECT_NAME, entity.Zone, worldImportInstanceName(entity.World)).Do()
+	if err != nil {
+		if !isNotFoundError(err) {
+			// cleanupでInstanceが消えるのを待つので、ここでは失敗させない
+			log.Warningf(ctx, "ERROR delete instance: %s", err)
+		}
+		return
+	}
+	WriteLog(ctx, "INSTNCE_DELETE_OPE", ope)
+}
+
+// waitOperation is WorldImportのOperationIDのOperationが終わるのを待つ
+func (a *WorldImportTQApi) waitOperation(ctx context.Context, s *compute.Service, entity WorldImport) (*compute.Operation, error) {
+	return waitZoneOperation(ctx, s, entity.Zone, entity.OperationID)
+}
+
+// waitZoneOperation is Zone OperationがDONEならOperationを、まだならerrOperationWaitingを返す
+func waitZoneOperation(ctx context.Context, s *compute.Service, zone string, operationID string) (*compute.Operation, error) {
+	nzos := compute.NewZoneOperationsService(s)
+	ope, err := nzos.Get(PROJECT_NAME, zone, operationID).Do()
+	if err != nil {
+		log.Errorf(ctx, "ERROR compute Zone Operation Get Error. zone = %s, operation = %s, error = %s", zone, operationID, err.Error())
+		return nil, err
+	}
+	WriteLog(ctx, "__GET_ZONE_COMPUTE_OPE__", ope)
+
+	if ope.Status != "DONE" {
+		log.Infof(ctx, "operation status = %s", ope.Status)
+		return nil, errOperationWaiting
+	}
+	return ope, nil
+}
+
+// transition is WorldImportをStatusに進めて、次のStepのTQを登録する
+func (a *WorldImportTQApi) transition(ctx context.Context, entity WorldImport, status string, delay time.Duration, f func(e *WorldImport)) error {
+	return datastore.RunInTransaction(ctx, func(c context.Context) error {
+		return a.transitionInTransaction(c, entity, status, delay, f)
+	}, nil)
+}
+
+// transitionInTransaction is transitionをTransactionの中で行う
+// TQのRetryで同じStepが二重に実行された場合は、StatusがentityのStatusと違うので何もしない
+func (a *WorldImportTQApi) transitionInTransaction(c context.Context, entity WorldImport, status string, delay time.Duration, f func(e *WorldImport)) error {
+	var current WorldImport
+	err := datastore.Get(c, entity.Key, &current)
+	if err != nil {
+		return err
+	}
+	if current.Status != entity.Status {
+		log.Warningf(c, "world import status is changed. %s -> %s", entity.Status, current.Status)
+		return nil
+	}
+
+	current.Status = status
+	current.UpdatedAt = time.Now()
+	if f != nil {
+		f(&current)
+	}
+	_, err = datastore.Put(c, entity.Key, &current)
+	if err != nil {
+		return err
+	}
+	if current.Finished() {
+		return nil
+	}
+	_, err = a.CallStep(c, entity.Key, delay)
+	return err
+}
+
+// worldImportInstanceName is Archiveを展開するInstanceのName
+func worldImportInstanceName(world string) string {
+	return WorldImportInstanceName + "-" + world
+}
+
+// worldImportDiskName is Archiveを展開するDiskのName
+// WorldのDisk (minecraft-world-<world>) とは別にして、Import中にServerを起動してもぶつからないようにする
+func worldImportDiskName(world string) string {
+	return WorldImportInstanceName + "-world-" + world
+}
+
+// worldImportInstance is Archiveを展開して、MetadataのImport-stateをdoneにしたら止まるInstance
+func worldImportInstance(entity WorldImport) *compute.Instance {
+	name := worldImportInstanceName(entity.World)
+	diskName := worldImportDiskName(entity.World)
+	startupScriptURL := "gs://sinmetalcraft-minecraft-shell/minecraft-import-script.sh"
+	archive := fmt.Sprintf("gs://%s/%s", WorldImportBucket, entity.Object)
+	metadata := []struct {
+		key   string
+		value string
+	}{
+		{"startup-script-url", startupScriptURL},
+		{"world", entity.World},
+		{"archive", archive},
+		{"archive-format", entity.Format},
+		{"archive-root", entity.ArchiveRoot},
+		{"import-disk", diskName},
+	}
+	items := make([]*compute.MetadataItems, 0, len(metadata))
+	for _, m := range metadata {
+		v := m.value
+		items = append(items, &compute.MetadataItems{Key: m.key, Value: &v})
+	}
+
+	return &compute.Instance{
+		Name:        name,
+		Zone:        "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/zones/" + entity.Zone,
+		MachineType: "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/zones/" + entity.Zone + "/machineTypes/n1-standard-1",
+		Disks: []*compute.AttachedDisk{
+			&compute.AttachedDisk{
+				AutoDelete: true,
+				Boot:       true,
+				DeviceName: name,
+				Mode:       "READ_WRITE",
+				InitializeParams: &compute.AttachedDiskInitializeParams{
+					SourceImage: "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/global/images/family/minecraft",
+					DiskType:    "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/zones/" + entity.Zone + "/diskTypes/pd-ssd",
+					DiskSizeGb:  100,
+				},
+			},
+			&compute.AttachedDisk{
+				AutoDelete: false,
+				Boot:       false,
+				DeviceName: diskName,
+				Mode:       "READ_WRITE",
+				Source:     "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/zones/" + entity.Zone + "/disks/" + diskName,
+			},
+		},
+		CanIpForward: false,
+		NetworkInterfaces: []*compute.NetworkInterface{
+			&compute.NetworkInterface{
+				Network: "https://www.googleapis.com/compute/v1/projects/" + PROJECT_NAME + "/global/networks/default",
+				AccessConfigs: []*compute.AccessConfig{
+					&compute.AccessConfig{
+						Name: "External NAT",
+						Type: "ONE_TO_ONE_NAT",
+					},
+				},
+			},
+		},
+		Metadata: &compute.Metadata{
+			Items: items,
+		},
+		ServiceAccounts: []*compute.ServiceAccount{
+			&compute.ServiceAccount{
+				Email: "default",
+				Scopes: []string{
+					compute.DevstorageReadOnlyScope,
+					compute.ComputeScope,
+					"https://www.googleapis.com/auth/logging.write",
+				},
+			},
+		},
+		Scheduling: &compute.Scheduling{
+			AutomaticRestart:  false,
+			OnHostMaintenance: "TERMINATE",
+			Preemptible:       false,
+		},
+	}
+}
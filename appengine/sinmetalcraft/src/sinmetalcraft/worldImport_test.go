@@ -0,0 +1,182 @@
+package sinmetalcraft
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateWorldArchive(t *testing.T) {
+	cases := []struct {
+		name    string
+		entries []string
+		root    string
+		err     string
+	}{
+		{"root", []string{"level.dat", "region/", "region/r.0.0.mca"}, "", ""},
+		{"dir", []string{"world/", "world/level.dat", "world/region/r.0.0.mca", "world/data/villages.dat"}, "world/", ""},
+		{"dot slash", []string{"./level.dat", "./region/r.-1.0.mca"}, "", ""},
+		{"no level.dat", []string{"world/region/r.0.0.mca"}, "", "level.dat is not found"},
+		{"too deep", []string{"a/world/level.dat", "a/world/region/r.0.0.mca"}, "", "level.dat is not found"},
+		{"no region", []string{"world/level.dat", "world/data/villages.dat"}, "", "region/*.mca is not found"},
+		{"other dir region", []string{"world/level.dat", "region/r.0.0.mca"}, "", "region/*.mca is not found"},
+		{"multiple worlds", []string{"a/level.dat", "a/region/r.0.0.mca", "b/level.dat", "b/region/r.0.0.mca"}, "", "multiple worlds"},
+		{"parent", []string{"level.dat", "region/r.0.0.mca", "../.ssh/authorized_keys"}, "", "parent directory"},
+		{"absolute", []string{"level.dat", "region/r.0.0.mca", "/etc/passwd"}, "", "absolute path"},
+	}
+	for _, c := range cases {
+		entries := make([]worldArchiveEntry, 0, len(c.entries))
+		for _, n := range c.entries {
+			entries = append(entries, worldArchiveEntry{Name: n, Dir: strings.HasSuffix(n, "/"), Size: 1})
+		}
+		root, err := validateWorldArchive(entries)
+		if len(c.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s err = %v, want %s", c.name, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s err = %v", c.name, err)
+			continue
+		}
+		if root != c.root {
+			t.Errorf("%s root = %q, want %q", c.name, root, c.root)
+		}
+	}
+}
+
+func TestValidateWorldArchiveSize(t *testing.T) {
+	entries := []worldArchiveEntry{
+		{Name: "level.dat", Size: 1},
+		{Name: "region/r.0.0.mca", Size: worldImportDiskSizeGb << 30},
+	}
+	if _, err := validateWorldArchive(entries); err == nil {
+		t.Errorf("archive larger than disk should be invalid")
+	}
+}
+
+func TestWorldImportReplaceable(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		status    string
+		updatedAt time.Time
+		ok        bool
+	}{
+		{WorldImportStatusDone, now, true},
+		{WorldImportStatusFailed, now, true},
+		{WorldImportStatusWaitingUpload, now, false},
+		{WorldImportStatusWaitingUpload, now.Add(-worldImportUploadExpiration - time.Minute), true},
+		{WorldImportStatusUnpacking, now.Add(-24 * time.Hour), false},
+	}
+	for _, c := range cases {
+		wi := WorldImport{Status: c.status, UpdatedAt: c.updatedAt}
+		if ok := wi.Replaceable(now); ok != c.ok {
+			t.Errorf("%s updatedAt %s Replaceable = %v, want %v", c.status, c.updatedAt, ok, c.ok)
+		}
+	}
+}
+
+func TestListZipEntries(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, n := range []string{"world/", "world/level.dat", "world/region/r.0.0.mca"} {
+		f, err := zw.Create(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(n, "/") {
+			f.Write([]byte("hoge"))
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := listZipEntries(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("listZipEntries err = %v", err)
+	}
+	if len(entries) != 3 || !entries[0].Dir || entries[1].Name != "world/level.dat" || entries[1].Size != 4 {
+		t.Errorf("listZipEntries = %+v", entries)
+	}
+	if root, err := validateWorldArchive(entries); err != nil || root != "world/" {
+		t.Errorf("validateWorldArchive = %q, %v", root, err)
+	}
+}
+
+func TestListTarGzEntries(t *testing.T) {
+	build := func(headers ...*tar.Header) []byte {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gw)
+		for _, h := range headers {
+			if err := tw.WriteHeader(h); err != nil {
+				t.Fatal(err)
+			}
+			tw.Write(bytes.Repeat([]byte("a"), int(h.Size)))
+		}
+		tw.Close()
+		gw.Close()
+		return buf.Bytes()
+	}
+
+	b := build(
+		&tar.Header{Name: "level.dat", Typeflag: tar.TypeReg, Size: 4, Mode: 0644},
+		&tar.Header{Name: "region/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "region/r.0.0.mca", Typeflag: tar.TypeReg, Size: 8, Mode: 0644},
+	)
+	entries, err := listTarGzEntries(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("listTarGzEntries err = %v", err)
+	}
+	if len(entries) != 3 || entries[0].Size != 4 || !entries[1].Dir || entries[2].Size != 8 {
+		t.Errorf("listTarGzEntries = %+v", entries)
+	}
+
+	b = build(
+		&tar.Header{Name: "level.dat", Typeflag: tar.TypeReg, Size: 4, Mode: 0644},
+		&tar.Header{Name: "region", Typeflag: tar.TypeSymlink, Linkname: "/etc", Mode: 0777},
+	)
+	if _, err := listTarGzEntries(bytes.NewReader(b)); err != errWorldArchiveEntryType {
+		t.Errorf("symlink err = %v, want %v", err, errWorldArchiveEntryType)
+	}
+
+	if _, err := listTarGzEntries(strings.NewReader("not gzip")); err == nil {
+		t.Errorf("not gzip should be error")
+	}
+}
+
+func TestSignedURL(t *testing.T) {
+	var signed string
+	sign := func(b []byte) ([]byte, error) {
+		signed = string(b)
+		return []byte("signature"), nil
+	}
+	expires := time.Unix(1500000000, 0)
+
+	s, err := signedURL("app@appspot.gserviceaccount.com", sign, "PUT", "bucket", "hoge/1 2.zip", "application/zip", expires)
+	if err != nil {
+		t.Fatalf("signedURL err = %v", err)
+	}
+	if want := "PUT\n\napplication/zip\n1500000000\n/bucket/hoge/1%202.zip"; signed != want {
+		t.Errorf("string to sign = %q, want %q", signed, want)
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatalf("url parse err = %v", err)
+	}
+	if u.Host != "storage.googleapis.com" || u.EscapedPath() != "/bucket/hoge/1%202.zip" {
+		t.Errorf("url = %s", s)
+	}
+	q := u.Query()
+	if q.Get("GoogleAccessId") != "app@appspot.gserviceaccount.com" || q.Get("Expires") != "1500000000" || q.Get("Signature") != "c2lnbmF0dXJl" {
+		t.Errorf("query = %v", q)
+	}
+}
@@ -0,0 +1,323 @@
+package sinmetalcraft
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"golang.org/x/net/context"
+)
+
+func init() {
+	api := WorldUpgradeApi{}
+
+	apiRouter.Handle("GET", "/api/1/minecraft/{world}/upgrade", api.Get, requireAdmin)
+	apiRouter.Handle("POST", "/api/1/minecraft/{world}/upgrade", api.Post, requireAdmin, audit(AuditActionWorldUpgrade))
+}
+
+// worldUpgradeStartTimeout is 新しいVersionのServerが起動するのを待つ時間
+// 過ぎても "Done" が出ない場合は起動に失敗したとしてRollbackする
+const worldUpgradeStartTimeout = 15 * time.Minute
+
+// worldUpgradeSnapshotLabel is Upgrade前に作るSnapshotのLabel
+const worldUpgradeSnapshotLabel = "pre-upgrade"
+
+// WorldUpgrade Status
+const (
+	WorldUpgradeStatusPreparing    = "preparing"
+	WorldUpgradeStatusStopping     = "stopping"
+	WorldUpgradeStatusSnapshotting = "snapshotting"
+	WorldUpgradeStatusStarting     = "starting"
+	WorldUpgradeStatusVerifying    = "verifying"
+	WorldUpgradeStatusDone         = "done"
+	WorldUpgradeStatusRollingBack  = "rolling_back"
+	WorldUpgradeStatusRestoring    = "restoring"
+	WorldUpgradeStatusRestarting   = "restarting"
+	WorldUpgradeStatusRolledBack   = "rolled_back"
+	WorldUpgradeStatusFailed       = "failed"
+)
+
+// WorldUpgrade is WorldのMinecraft VersionをUpgradeする処理の状態
+// Keyは対象のWorld Name
+type WorldUpgrade struct {
+	Key            *datastore.Key `json:"-" datastore:"-"`
+	World          string         `json:"world"`
+	Zone           string         `json:"zone" datastore:",noindex"`
+	FromVersion    string         `json:"fromVersion" datastore:",noindex"`
+	ToVersion      string         `json:"toVersion" datastore:",noindex"`
+	FromBuild      string         `json:"fromBuild" datastore:",noindex"` // Upgrade前のServerBuild。vanillaの場合は空
+	ToBuild        string         `json:"toBuild" datastore:",noindex"`
+	PreSnapshot    string         `json:"preSnapshot" datastore:",noindex"`    // Rollbackに使うUpgrade前のSnapshot
+	InstanceExists bool           `json:"instanceExists" datastore:",noindex"` // Upgrade前にInstanceがあったか。Rollback後に元に戻す
+	Status         string         `json:"status"`
+	OperationID    string         `json:"operationID" datastore:",noindex"`
+	Error          string         `json:"error" datastore:",noindex"`
+	StartedAt      time.Time      `json:"startedAt" datastore:",noindex"` // 新しいVersionでServerを起動した時間
+	CreatedAt      time.Time      `json:"createdAt"`
+	UpdatedAt      time.Time      `json:"updatedAt"`
+}
+
+// Finished is Upgradeが終わっていて、次のUpgradeを始められるか
+func (wu *WorldUpgrade) Finished() bool {
+	switch wu.Status {
+	case WorldUpgradeStatusDone, WorldUpgradeStatusRolledBack, WorldUpgradeStatusFailed:
+		return true
+	}
+	return false
+}
+
+// StartTimedOut is 新しいVersionのServerの起動を待つ時間を過ぎたか
+func (wu *WorldUpgrade) StartTimedOut(now time.Time) bool {
+	return wu.Status == WorldUpgradeStatusVerifying && now.Sub(wu.StartedAt) > worldUpgradeStartTimeout
+}
+
+// Message is Slackに送るUpgradeの状態
+func (wu *WorldUpgrade) Message() string {
+	var m string
+	switch wu.Status {
+	case WorldUpgradeStatusPreparing:
+		m = fmt.Sprintf("upgrade %s -> %s started.", wu.FromVersion, wu.ToVersion)
+	case WorldUpgradeStatusStopping:
+		m = "stopping server."
+	case WorldUpgradeStatusSnapshotting:
+		m = fmt.Sprintf("creating pre-upgrade snapshot %s.", wu.PreSnapshot)
+	case WorldUpgradeStatusStarting:
+		m = fmt.Sprintf("starting server with %s.", wu.ToVersion)
+	case WorldUpgradeStatusVerifying:
+		m = "waiting for server to start."
+	case WorldUpgradeStatusDone:
+		m = fmt.Sprintf("upgrade to %s done.", wu.ToVersion)
+	case WorldUpgradeStatusRollingBack:
+		m = fmt.Sprintf("upgrade to %s failed. rolling back. cause = %s", wu.ToVersion, wu.Error)
+	case WorldUpgradeStatusRestoring:
+		m = fmt.Sprintf("restoring world from %s.", wu.PreSnapshot)
+	case WorldUpgradeStatusRestarting:
+		m = fmt.Sprintf("restarting server with %s.", wu.FromVersion)
+	case WorldUpgradeStatusRolledBack:
+		m = fmt.Sprintf("rolled back to %s.", wu.FromVersion)
+	case WorldUpgradeStatusFailed:
+		m = fmt.Sprintf("upgrade failed. cause = %s", wu.Error)
+	default:
+		m = wu.Status
+	}
+	return fmt.Sprintf("[%s] %s", wu.World, m)
+}
+
+// WorldUpgradeApi is WorldのMinecraft VersionをUpgradeするAPI
+//
+// Upgrade前のSnapshotを作ってから新しいVersionで起動し、
+// 起動に失敗した場合はSnapshotと元のVersionに戻す
+type WorldUpgradeApi struct{}
+
+// WorldUpgradeApiPostParam is POST /api/1/minecraft/{world}/upgrade のRequest Body
+type WorldUpgradeApiPostParam struct {
+	JarVersion  string `json:"jarVersion"`
+	ServerBuild string `json:"serverBuild"` // vanilla以外の場合に必要。ServerTypeは変えない
+}
+
+// get upgrade status
+func (a *WorldUpgradeApi) Get(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	key := datastore.NewKey(ctx, "WorldUpgrade", p["world"], 0, nil)
+	var entity WorldUpgrade
+	err := datastore.Get(ctx, key, &entity)
+	if err == datastore.ErrNoSuchEntity {
+		return notFoundError(fmt.Sprintf("%s upgrade is not found.", p["world"]))
+	}
+	if err != nil {
+		return internalError(err)
+	}
+
+	writeJSON(w, http.StatusOK, entity)
+	return nil
+}
+
+// start upgrade
+func (a *WorldUpgradeApi) Post(ctx context.Context, w http.ResponseWriter, r *http.Request, p Params) error {
+	var param WorldUpgradeApiPostParam
+	err := json.NewDecoder(r.Body).Decode(&param)
+	if err != nil {
+		return invalidRequestError("invalid request.").WithDetail("cause", err.Error())
+	}
+	defer r.Body.Close()
+	if err := validateJarVersion(ctx, param.JarVersion); err != nil {
+		return err
+	}
+
+	mkey, err := minecraftKey(ctx, p, "")
+	if err != nil {
+		return err
+	}
+	minecraft, err := getMinecraft(ctx, mkey)
+	if err != nil {
+		return err
+	}
+	if err := validateServerType(minecraft.ServerType, param.ServerBuild, param.JarVersion); err != nil {
+		return err
+	}
+	if minecraft.JarVersion == param.JarVersion && minecraft.ServerBuild == param.ServerBuild {
+		return conflictError(fmt.Sprintf("%s is already %s.", minecraft.World, param.JarVersion)).WithDetail("jarVersion", param.JarVersion)
+	}
+	// 起動中、停止中のInstanceを操作するとUpgradeと競合するので、落ち着いている時だけ受け付ける
+	switch minecraft.Status {
+	case "exists":
+	case "", "not_exists":
+		if len(minecraft.LatestSnapshot) < 1 {
+			return conflictError(fmt.Sprintf("%s has no snapshot.", minecraft.World))
+		}
+	default:
+		return conflictError(fmt.Sprintf("%s is %s.", minecraft.World, minecraft.Status)).WithDetail("status", minecraft.Status)
+	}
+
+	now := time.Now()
+	key := datastore.NewKey(ctx, "WorldUpgrade", minecraft.World, 0, nil)
+	entity := WorldUpgrade{
+		Key:            key,
+		World:          minecraft.World,
+		Zone:           minecraft.Zone,
+		FromVersion:    minecraft.JarVersion,
+		ToVersion:      param.JarVersion,
+		FromBuild:      minecraft.ServerBuild,
+		ToBuild:        param.ServerBuild,
+		InstanceExists: minecraft.Status == "exists",
+		Status:         WorldUpgradeStatusPreparing,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+
+	tq := WorldUpgradeTQApi{}
+	err = datastore.RunInTransaction(ctx, func(c context.Context) error {
+		var current WorldUpgrade
+		err := datastore.Get(c, key, &current)
+		if err == nil && current.Finished() == false {
+			return conflictError(fmt.Sprintf("%s upgrade is %s.", current.World, current.Status)).WithDetail("status", current.Status)
+		}
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err = datastore.Put(c, key, &entity)
+		if err != nil {
+			return err
+		}
+		_, err = tq.CallStep(c, key, 0)
+		return err
+	}, nil)
+	if ae, ok := err.(*APIError); ok {
+		return ae
+	}
+	if err != nil {
+		return internalError(err)
+	}
+	auditEventFromContext(ctx).SetDiff(nil, entity)
+	notifyWorldUpgrade(ctx, entity)
+
+	writeJSON(w, http.StatusAccepted, entity)
+	return nil
+}
+
+// serverLogEvent is Minecraft Serverのログから分かるServerの状態
+type serverLogEvent int
+
+const (
+	serverLogNone serverLogEvent = iota
+	serverLogDone
+	serverLogCrashed
+)
+
+// serverLogCrashPatterns is Serverが起動に失敗した、または落ちた時に出るログ
+var serverLogCrashPatterns = []string{
+	"Failed to start the minecraft server",
+	"Encountered an unexpected exception",
+	"This crash report has been saved to",
+	"Exception in server tick loop",
+	"FAILED TO BIND TO PORT",
+	"java.lang.OutOfMemoryError",
+}
+
+// classifyServerLog is Minecraft Serverのログ1行から、起動が終わったか落ちたかを判定する
+// 起動が終わると `Done (3.123s)! For help, type "help"` が出る
+func classifyServerLog(line string) serverLogEvent {
+	for _, p := range serverLogCrashPatterns {
+		if strings.Contains(line, p) {
+			return serverLogCrashed
+		}
+	}
+	if strings.Contains(line, "Done (") && strings.Contains(line, "For help") {
+		return serverLogDone
+	}
+	return serverLogNone
+}
+
+// logResourceID is Cloud LoggingのLabelからInstanceのIDを取り出す
+// Labelはuint64の文字列なので、Minecraft.ResourceIDと同じようにint64にする
+func logResourceID(labels map[string]string) (int64, bool) {
+	v, ok := labels["compute.googleapis.com/resource_id"]
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return int64(id), true
+}
+
+// watchWorldUpgradeLog is Upgrade中のWorldのログを見て、起動が終わったか落ちたかでUpgradeを進める
+func watchWorldUpgradeLog(ctx context.Context, r *http.Request, psd PubSubData) error {
+	event := classifyServerLog(psd.StructPayload.Log)
+	if event == serverLogNone {
+		return nil
+	}
+	id, ok := logResourceID(psd.Metadata.Labels)
+	if !ok {
+		return nil
+	}
+
+	keys, err := datastore.NewQuery("Minecraft").Filter("ResourceID =", id).KeysOnly().Limit(1).GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if len(keys) < 1 {
+		log.Infof(ctx, "minecraft is not found. resourceID = %d", id)
+		return nil
+	}
+
+	var entity WorldUpgrade
+	key := datastore.NewKey(ctx, "WorldUpgrade", keys[0].StringID(), 0, nil)
+	err = datastore.Get(ctx, key, &entity)
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	entity.Key = key
+	if entity.Status != WorldUpgradeStatusVerifying {
+		return nil
+	}
+
+	tq := WorldUpgradeTQApi{}
+	if event == serverLogDone {
+		return tq.done(ctx, r, entity)
+	}
+	return tq.rollback(ctx, entity, fmt.Errorf("server crashed. log = %s", psd.StructPayload.Log))
+}
+
+// notifyWorldUpgrade is Upgradeの状態をSlackに送る
+// Slackに送れなくてもUpgradeは止めない
+func notifyWorldUpgrade(ctx context.Context, entity WorldUpgrade) {
+	color := "#36a64f"
+	switch entity.Status {
+	case WorldUpgradeStatusRollingBack, WorldUpgradeStatusRestoring, WorldUpgradeStatusRestarting, WorldUpgradeStatusRolledBack:
+		color = "#daa038"
+	case WorldUpgradeStatusFailed:
+		color = "#d00000"
+	}
+
+	notifySlack(ctx, entity.Message(), color)
+}
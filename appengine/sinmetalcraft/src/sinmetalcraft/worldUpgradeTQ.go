@@ -0,0 +1,436 @@
+package sinmetalcraft
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+
+	"google.golang.org/api/compute/v1"
+
+	"golang.org/x/net/context"
+)
+
+func init() {
+	api := WorldUpgradeTQApi{}
+
+	http.HandleFunc("/tq/1/upgrade/step", api.Step)
+}
+
+// WorldUpgradeTQApi is WorldUpgradeのStatusを1つずつ進めるTQ
+//
+// preparing -> stopping -> snapshotting -> starting -> verifying -> done
+//
+// Instanceが無い場合はLatestSnapshotをUpgrade前のSnapshotとして、preparingからstartingに進む
+// verifyingはServerのログで "Done" を見つけるとdoneに、落ちたか時間切れでrolling_backに進む
+//
+// rolling_back -> restoring -> restarting -> rolled_back
+//
+// Version変更前に失敗した場合はRollbackせずにfailedになる
+type WorldUpgradeTQApi struct{}
+
+// CallStep is WorldUpgradeのStatusを進めるTQを登録する
+func (a *WorldUpgradeTQApi) CallStep(c context.Context, key *datastore.Key, delay time.Duration) (*taskqueue.Task, error) {
+	log.Infof(c, "Call World Upgrade Step TQ, key = %v", key)
+	if key == nil {
+		return nil, errors.New("key is required")
+	}
+
+	t := taskqueue.NewPOSTTask("/tq/1/upgrade/step", url.Values{
+		"keyStr": {key.Encode()},
+	})
+	t.Delay = delay
+	return taskqueue.Add(c, t, "minecraft")
+}
+
+// Step is WorldUpgradeの今のStatusの処理を行い、終わっていれば次のStatusに進める
+func (a *WorldUpgradeTQApi) Step(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	keyStr := r.FormValue("keyStr")
+	log.Infof(ctx, "keyStr = %s", keyStr)
+
+	key, err := datastore.DecodeKey(keyStr)
+	if err != nil {
+		log.Errorf(ctx, "key decode error. keyStr = %s, err = %s", keyStr, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var entity WorldUpgrade
+	err = datastore.Get(ctx, key, &entity)
+	if err != nil {
+		log.Errorf(ctx, "datastore get error. key = %s. error = %v", key.StringID(), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	entity.Key = key
+	log.Infof(ctx, "world upgrade status = %s", entity.Status)
+
+	s, err := newComputeService(ctx)
+	if err != nil {
+		log.Errorf(ctx, "ERROR compute.New: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	switch entity.Status {
+	case WorldUpgradeStatusPreparing:
+		err = a.prepare(ctx, r, s, entity)
+	case WorldUpgradeStatusStopping:
+		err = a.snapshot(ctx, r, s, entity)
+	case WorldUpgradeStatusSnapshotting:
+		err = a.changeVersion(ctx, r, s, entity)
+	case WorldUpgradeStatusStarting:
+		err = a.start(ctx, r, s, entity)
+	case WorldUpgradeStatusVerifying:
+		err = a.verify(ctx, s, entity)
+	case WorldUpgradeStatusRollingBack:
+		err = a.deleteInstance(ctx, r, s, entity)
+	case WorldUpgradeStatusRestoring:
+		err = a.restore(ctx, r, s, entity)
+	case WorldUpgradeStatusRestarting:
+		err = a.restart(ctx, r, s, entity)
+	default:
+		// TQがRetryされた時に、既に進んだStatusの処理を二重に行わない
+		log.Infof(ctx, "nothing to do. status = %s", entity.Status)
+	}
+	if err == errOperationWaiting {
+		w.WriteHeader(http.StatusRequestTimeout)
+		return
+	}
+	if err != nil {
+		log.Errorf(ctx, "world upgrade step error. status = %s, error = %v", entity.Status, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// prepare is Instanceがあれば停止し、無ければLatestSnapshotから新しいVersionで起動する準備をする
+func (a *WorldUpgradeTQApi) prepare(ctx context.Context, r *http.Request, s *compute.Service, entity WorldUpgrade) error {
+	minecraft, err := getMinecraft(ctx, datastore.NewKey(ctx, "Minecraft", entity.World, 0, nil))
+	if err != nil {
+		return a.fail(ctx, r, entity, err)
+	}
+
+	if entity.InstanceExists {
+		// Shutdown ScriptでWorldを保存してから止まるので、止まった後のDiskをSnapshotにする
+		ope, err := compute.NewInstancesService(s).Stop(PROJECT_NAME, entity.Zone, INSTANCE_NAME+"-"+entity.World).Do()
+		if err != nil {
+			return a.fail(ctx, r, entity, err)
+		}
+		WriteLog(ctx, "INSTNCE_STOP_OPE", ope)
+		_, err = CallMinecraftTQ(ctx, minecraft.Key, ope.Name)
+		if err != nil {
+			return err
+		}
+		return a.transition(ctx, entity, WorldUpgradeStatusStopping, 30*time.Second, func(e *WorldUpgrade) {
+			e.OperationID = ope.Name
+		})
+	}
+
+	entity.PreSnapshot = minecraft.LatestSnapshot
+	minecraft, err = a.updateMinecraft(ctx, entity, entity.ToVersion, entity.ToBuild)
+	if err != nil {
+		return err
+	}
+	ope, err := createDiskFromSnapshot(ctx, compute.NewDisksService(s), minecraft)
+	if err != nil {
+		return a.rollback(ctx, entity, err)
+	}
+	return a.transition(ctx, entity, WorldUpgradeStatusStarting, 30*time.Second, func(e *WorldUpgrade) {
+		e.PreSnapshot = minecraft.LatestSnapshot
+		e.OperationID = ope.Name
+	})
+}
+
+// snapshot is Instanceが止まったら、Upgrade前のSnapshotを作る
+func (a *WorldUpgradeTQApi) snapshot(ctx context.Context, r *http.Request, s *compute.Service, entity WorldUpgrade) error {
+	ope, err := waitZoneOperation(ctx, s, entity.Zone, entity.OperationID)
+	if err != nil {
+		return err
+	}
+	if ope.Error != nil && len(ope.Error.Errors) > 0 {
+		return a.fail(ctx, r, entity, fmt.Errorf("instance stop error. %s", ope.Error.Errors[0].Message))
+	}
+
+	minecraft, err := getMinecraft(ctx, datastore.NewKey(ctx, "Minecraft", entity.World, 0, nil))
+	if err != nil {
+		return a.fail(ctx, r, entity, err)
+	}
+	sn := worldSnapshotName(entity.World, time.Now())
+	ope, err = insertWorldSnapshot(ctx, compute.NewDisksService(s), minecraft, sn, worldUpgradeSnapshotLabel)
+	if err != nil {
+		return a.fail(ctx, r, entity, err)
+	}
+	return a.transition(ctx, entity, WorldUpgradeStatusSnapshotting, 30*time.Second, func(e *WorldUpgrade) {
+		e.PreSnapshot = sn
+		e.OperationID = ope.Name
+	})
+}
+
+// changeVersion is Snapshotができたら、InstanceのMetadataを新しいVersionにする
+func (a *WorldUpgradeTQApi) changeVersion(ctx context.Context, r *http.Request, s *compute.Service, entity WorldUpgrade) error {
+	ope, err := waitZoneOperation(ctx, s, entity.Zone, entity.OperationID)
+	if err != nil {
+		return err
+	}
+	if ope.Error != nil && len(ope.Error.Errors) > 0 {
+		return a.fail(ctx, r, entity, fmt.Errorf("snapshot create error. %s", ope.Error.Errors[0].Message))
+	}
+
+	minecraft, err := a.updateMinecraft(ctx, entity, entity.ToVersion, entity.ToBuild)
+	if err != nil {
+		return err
+	}
+	launch, err := resolveServerLaunch(minecraft)
+	if err != nil {
+		return a.rollback(ctx, entity, err)
+	}
+	md := launch.Metadata()
+	md["minecraft-version"] = entity.ToVersion
+	ope, err = setInstanceMetadataItems(ctx, compute.NewInstancesService(s), minecraft, md)
+	if err != nil {
+		return a.rollback(ctx, entity, err)
+	}
+	return a.transition(ctx, entity, WorldUpgradeStatusStarting, 10*time.Second, func(e *WorldUpgrade) {
+		e.OperationID = ope.Name
+	})
+}
+
+// start is 新しいVersionでServerを起動する
+func (a *WorldUpgradeTQApi) start(ctx context.Context, r *http.Request, s *compute.Service, entity WorldUpgrade) error {
+	ope, err := waitZoneOperation(ctx, s, entity.Zone, entity.OperationID)
+	if err != nil {
+		return err
+	}
+	if ope.Error != nil && len(ope.Error.Errors) > 0 {
+		return a.rollback(ctx, entity, fmt.Errorf("%s error. %s", ope.OperationType, ope.Error.Errors[0].Message))
+	}
+
+	minecraft, err := getMinecraft(ctx, datastore.NewKey(ctx, "Minecraft", entity.World, 0, nil))
+	if err != nil {
+		return err
+	}
+	is := compute.NewInstancesService(s)
+	if entity.InstanceExists {
+		_, err = startInstance(ctx, is, minecraft)
+	} else {
+		_, err = createInstance(ctx, is, minecraft)
+	}
+	if err != nil {
+		return a.rollback(ctx, entity, err)
+	}
+	return a.transition(ctx, entity, WorldUpgradeStatusVerifying, 1*time.Minute, func(e *WorldUpgrade) {
+		e.StartedAt = time.Now()
+	})
+}
+
+// verify is Serverの起動を待つ
+// 起動が終わったかはServerのログで判定するので、ここではInstanceが落ちていないかと時間切れだけを見る
+func (a *WorldUpgradeTQApi) verify(ctx context.Context, s *compute.Service, entity WorldUpgrade) error {
+	if entity.StartTimedOut(time.Now()) {
+		return a.rollback(ctx, entity, fmt.Errorf("server did not start in %s", worldUpgradeStartTimeout))
+	}
+
+	ins, err := compute.NewInstancesService(s).Get(PROJECT_NAME, entity.Zone, INSTANCE_NAME+"-"+entity.World).Do()
+	if isNotFoundError(err) {
+		return a.rollback(ctx, entity, errors.New("instance is not found"))
+	}
+	if err != nil {
+		return err
+	}
+	if ins.Status == "STOPPING" || ins.Status == "TERMINATED" {
+		return a.rollback(ctx, entity, fmt.Errorf("instance is %s", ins.Status))
+	}
+	return errOperationWaiting
+}
+
+// done is 新しいVersionでServerが起動したので、Upgradeを終える
+func (a *WorldUpgradeTQApi) done(ctx context.Context, r *http.Request, entity WorldUpgrade) error {
+	ev := newAuditEvent(ctx, r, AuditActionWorldUpgradeDone)
+	ev.Target = entity.World
+	ev.SetDiff(nil, map[string]string{"jarVersion": entity.ToVersion, "serverBuild": entity.ToBuild})
+	ev.Record(ctx, nil)
+
+	log.Infof(ctx, "world upgrade done. world = %s, version = %s", entity.World, entity.ToVersion)
+	return a.transition(ctx, entity, WorldUpgradeStatusDone, 0, nil)
+}
+
+// deleteInstance is 新しいVersionで動いたDiskを使わないように、Instanceと一緒にWorld Diskを消す
+func (a *WorldUpgradeTQApi) deleteInstance(ctx context.Context, r *http.Request, s *compute.Service, entity WorldUpgrade) error {
+	ope, err := compute.NewInstancesService(s).Delete(PROJECT_NAME, entity.Zone, INSTANCE_NAME+"-"+entity.World).Do()
+	if err != nil && !isNotFoundError(err) {
+		return a.fail(ctx, r, entity, err)
+	}
+	if ope != nil {
+		WriteLog(ctx, "INSTNCE_DELETE_OPE", ope)
+		_, err = CallMinecraftTQ(ctx, datastore.NewKey(ctx, "Minecraft", entity.World, 0, nil), ope.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return a.transition(ctx, entity, WorldUpgradeStatusRestoring, 30*time.Second, nil)
+}
+
+// restore is InstanceとWorld Diskが消えたら、Upgrade前のSnapshotと元のVersionに戻す
+// Upgrade前にInstanceがあった場合は、Upgrade前のSnapshotからDiskを作り直す
+func (a *WorldUpgradeTQApi) restore(ctx context.Context, r *http.Request, s *compute.Service, entity WorldUpgrade) error {
+	_, err := compute.NewInstancesService(s).Get(PROJECT_NAME, entity.Zone, INSTANCE_NAME+"-"+entity.World).Do()
+	if err == nil {
+		return errOperationWaiting
+	}
+	if !isNotFoundError(err) {
+		return err
+	}
+	_, err = compute.NewDisksService(s).Get(PROJECT_NAME, entity.Zone, fmt.Sprintf("%s-world-%s", INSTANCE_NAME, entity.World)).Do()
+	if err == nil {
+		return errOperationWaiting
+	}
+	if !isNotFoundError(err) {
+		return err
+	}
+
+	minecraft, err := a.updateMinecraft(ctx, entity, entity.FromVersion, entity.FromBuild)
+	if err != nil {
+		return err
+	}
+	if entity.InstanceExists == false {
+		return a.rolledBack(ctx, r, entity)
+	}
+
+	ope, err := createDiskFromSnapshot(ctx, compute.NewDisksService(s), minecraft)
+	if err != nil {
+		return a.fail(ctx, r, entity, err)
+	}
+	return a.transition(ctx, entity, WorldUpgradeStatusRestarting, 30*time.Second, func(e *WorldUpgrade) {
+		e.OperationID = ope.Name
+	})
+}
+
+// restart is 戻したDiskと元のVersionでServerを起動する
+func (a *WorldUpgradeTQApi) restart(ctx context.Context, r *http.Request, s *compute.Service, entity WorldUpgrade) error {
+	ope, err := waitZoneOperation(ctx, s, entity.Zone, entity.OperationID)
+	if err != nil {
+		return err
+	}
+	if ope.Error != nil && len(ope.Error.Errors) > 0 {
+		return a.fail(ctx, r, entity, fmt.Errorf("disk create error. %s", ope.Error.Errors[0].Message))
+	}
+
+	minecraft, err := getMinecraft(ctx, datastore.NewKey(ctx, "Minecraft", entity.World, 0, nil))
+	if err != nil {
+		return err
+	}
+	_, err = createInstance(ctx, compute.NewInstancesService(s), minecraft)
+	if err != nil {
+		return a.fail(ctx, r, entity, err)
+	}
+	return a.rolledBack(ctx, r, entity)
+}
+
+// rolledBack is Rollbackを終える
+func (a *WorldUpgradeTQApi) rolledBack(ctx context.Context, r *http.Request, entity WorldUpgrade) error {
+	ev := newAuditEvent(ctx, r, AuditActionWorldUpgradeDone)
+	ev.Target = entity.World
+	ev.SetDiff(nil, map[string]string{"jarVersion": entity.FromVersion, "serverBuild": entity.FromBuild, "snapshot": entity.PreSnapshot})
+	ev.Record(ctx, errors.New(entity.Error))
+
+	return a.transition(ctx, entity, WorldUpgradeStatusRolledBack, 0, nil)
+}
+
+// rollback is 新しいVersionでの起動に失敗したので、Upgrade前に戻す
+func (a *WorldUpgradeTQApi) rollback(ctx context.Context, entity WorldUpgrade, cause error) error {
+	log.Warningf(ctx, "world upgrade rollback. world = %s, status = %s, error = %v", entity.World, entity.Status, cause)
+
+	return a.transition(ctx, entity, WorldUpgradeStatusRollingBack, 0, func(e *WorldUpgrade) {
+		e.Error = cause.Error()
+	})
+}
+
+// fail is Upgradeを失敗にして終える
+// Instanceは止まったままになることがあるので、Slackを見て手で直す
+func (a *WorldUpgradeTQApi) fail(ctx context.Context, r *http.Request, entity WorldUpgrade, cause error) error {
+	log.Errorf(ctx, "world upgrade failed. world = %s, status = %s, error = %v", entity.World, entity.Status, cause)
+
+	ev := newAuditEvent(ctx, r, AuditActionWorldUpgradeDone)
+	ev.Target = entity.World
+	ev.Record(ctx, cause)
+
+	return a.transition(ctx, entity, WorldUpgradeStatusFailed, 0, func(e *WorldUpgrade) {
+		if len(e.Error) > 0 {
+			e.Error = fmt.Sprintf("%s, %s", e.Error, cause.Error())
+			return
+		}
+		e.Error = cause.Error()
+	})
+}
+
+// updateMinecraft is MinecraftのJarVersionとServerBuildを変えて、LatestSnapshotをUpgrade前のSnapshotにする
+func (a *WorldUpgradeTQApi) updateMinecraft(ctx context.Context, entity WorldUpgrade, jarVersion string, serverBuild string) (Minecraft, error) {
+	key := datastore.NewKey(ctx, "Minecraft", entity.World, 0, nil)
+	var minecraft Minecraft
+	err := datastore.RunInTransaction(ctx, func(c context.Context) error {
+		err := datastore.Get(c, key, &minecraft)
+		if err != nil {
+			return err
+		}
+		minecraft.JarVersion = jarVersion
+		minecraft.ServerBuild = serverBuild
+		minecraft.LatestSnapshot = entity.PreSnapshot
+		minecraft.UpdatedAt = time.Now()
+		_, err = datastore.Put(c, key, &minecraft)
+		return err
+	}, nil)
+	minecraft.Key = key
+	minecraft.KeyStr = key.Encode()
+	return minecraft, err
+}
+
+// transition is WorldUpgradeをStatusに進めて、次のStepのTQを登録し、Slackに知らせる
+// TQのRetryで同じStepが二重に実行された場合は、StatusがentityのStatusと違うので何もしない
+func (a *WorldUpgradeTQApi) transition(ctx context.Context, entity WorldUpgrade, status string, delay time.Duration, f func(e *WorldUpgrade)) error {
+	var current WorldUpgrade
+	var changed bool
+	err := datastore.RunInTransaction(ctx, func(c context.Context) error {
+		changed = false
+		err := datastore.Get(c, entity.Key, &current)
+		if err != nil {
+			return err
+		}
+		if current.Status != entity.Status {
+			log.Warningf(c, "world upgrade status is changed. %s -> %s", entity.Status, current.Status)
+			return nil
+		}
+
+		current.Status = status
+		current.UpdatedAt = time.Now()
+		if f != nil {
+			f(&current)
+		}
+		_, err = datastore.Put(c, entity.Key, &current)
+		if err != nil {
+			return err
+		}
+		changed = true
+		if current.Finished() {
+			return nil
+		}
+		_, err = a.CallStep(c, entity.Key, delay)
+		return err
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if changed {
+		notifyWorldUpgrade(ctx, current)
+	}
+	return nil
+}
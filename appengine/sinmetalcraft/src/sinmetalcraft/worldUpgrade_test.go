@@ -0,0 +1,119 @@
+package sinmetalcraft
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClassifyServerLog(t *testing.T) {
+	cases := []struct {
+		line  string
+		event serverLogEvent
+	}{
+		{`[08:15:54] [Server thread/INFO]: Done (3.214s)! For help, type "help" or "?"`, serverLogDone},
+		{`[08:15:54] [Server thread/INFO]: Done (12.5s)! For help, type "help"`, serverLogDone},
+		{`[08:15:50] [Server thread/INFO]: Starting minecraft server version 1.12.2`, serverLogNone},
+		{`[08:15:50] [Server thread/INFO]: <sinmetal> Done (later)`, serverLogNone},
+		{`[08:15:51] [Server thread/ERROR]: Encountered an unexpected exception`, serverLogCrashed},
+		{`[08:15:51] [Server thread/ERROR]: This crash report has been saved to: /home/minecraft/crash-reports/crash.txt`, serverLogCrashed},
+		{`[08:15:51] [Server thread/WARN]: **** FAILED TO BIND TO PORT!`, serverLogCrashed},
+		{`[08:15:51] [Server thread/ERROR]: Failed to start the minecraft server`, serverLogCrashed},
+		{`Exception in thread "main" java.lang.OutOfMemoryError: Java heap space`, serverLogCrashed},
+		{``, serverLogNone},
+	}
+	for _, c := range cases {
+		if event := classifyServerLog(c.line); event != c.event {
+			t.Errorf("classifyServerLog(%q) = %v, want %v", c.line, event, c.event)
+		}
+	}
+}
+
+func TestLogResourceID(t *testing.T) {
+	// Minecraft.ResourceIDと同じように、int64に収まらない値はそのままbitを読み替える
+	id, ok := logResourceID(map[string]string{"compute.googleapis.com/resource_id": "16168982466524916426"})
+	if !ok {
+		t.Fatalf("logResourceID ok = false")
+	}
+	var u uint64 = 16168982466524916426
+	if id != int64(u) {
+		t.Errorf("logResourceID = %d, want %d", id, int64(u))
+	}
+
+	if id, ok := logResourceID(map[string]string{"compute.googleapis.com/resource_id": "123"}); !ok || id != 123 {
+		t.Errorf("logResourceID = %d, %v", id, ok)
+	}
+	if _, ok := logResourceID(map[string]string{"compute.googleapis.com/resource_type": "instance"}); ok {
+		t.Errorf("no resource_id should not be ok")
+	}
+	if _, ok := logResourceID(map[string]string{"compute.googleapis.com/resource_id": "hoge"}); ok {
+		t.Errorf("invalid resource_id should not be ok")
+	}
+}
+
+func TestWorldUpgradeFinished(t *testing.T) {
+	finished := map[string]bool{
+		WorldUpgradeStatusPreparing:    false,
+		WorldUpgradeStatusStopping:     false,
+		WorldUpgradeStatusSnapshotting: false,
+		WorldUpgradeStatusStarting:     false,
+		WorldUpgradeStatusVerifying:    false,
+		WorldUpgradeStatusDone:         true,
+		WorldUpgradeStatusRollingBack:  false,
+		WorldUpgradeStatusRestoring:    false,
+		WorldUpgradeStatusRestarting:   false,
+		WorldUpgradeStatusRolledBack:   true,
+		WorldUpgradeStatusFailed:       true,
+	}
+	for status, want := range finished {
+		wu := WorldUpgrade{Status: status}
+		if wu.Finished() != want {
+			t.Errorf("%s Finished = %v, want %v", status, wu.Finished(), want)
+		}
+	}
+}
+
+func TestWorldUpgradeStartTimedOut(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		status    string
+		startedAt time.Time
+		timedOut  bool
+	}{
+		{WorldUpgradeStatusVerifying, now.Add(-time.Minute), false},
+		{WorldUpgradeStatusVerifying, now.Add(-worldUpgradeStartTimeout - time.Minute), true},
+		{WorldUpgradeStatusDone, now.Add(-worldUpgradeStartTimeout - time.Minute), false},
+	}
+	for _, c := range cases {
+		wu := WorldUpgrade{Status: c.status, StartedAt: c.startedAt}
+		if timedOut := wu.StartTimedOut(now); timedOut != c.timedOut {
+			t.Errorf("%s startedAt %s StartTimedOut = %v, want %v", c.status, c.startedAt, timedOut, c.timedOut)
+		}
+	}
+}
+
+func TestWorldUpgradeMessage(t *testing.T) {
+	wu := WorldUpgrade{
+		World:       "hoge",
+		FromVersion: "1.12.1",
+		ToVersion:   "1.12.2",
+		PreSnapshot: "minecraft-world-hoge-20171001-120000",
+	}
+	cases := []struct {
+		status string
+		error  string
+		want   string
+	}{
+		{WorldUpgradeStatusPreparing, "", "[hoge] upgrade 1.12.1 -> 1.12.2 started."},
+		{WorldUpgradeStatusSnapshotting, "", "minecraft-world-hoge-20171001-120000"},
+		{WorldUpgradeStatusRollingBack, "server crashed", "cause = server crashed"},
+		{WorldUpgradeStatusRolledBack, "server crashed", "[hoge] rolled back to 1.12.1."},
+	}
+	for _, c := range cases {
+		wu.Status = c.status
+		wu.Error = c.error
+		if m := wu.Message(); !strings.Contains(m, c.want) {
+			t.Errorf("%s Message = %q, want %q", c.status, m, c.want)
+		}
+	}
+}
@@ -0,0 +1,1054 @@
+// Package client is sinmetalcraft REST APIのClient
+//
+// appengine/sinmetalcraft/openapi.json に合わせて作っている。
+// APIを変更した時は openapi.json とこのpackageの両方を更新すること。
+// client_test.go で型とopenapi.jsonのschemaがずれていないかを確認している。
+// /apiai は api.ai からのwebhookなのでClientには含めていない。
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultEndpoint is 本番環境のURL
+const DefaultEndpoint = "https://sinmetalcraft.appspot.com"
+
+// Client is sinmetalcraft APIのClient
+type Client struct {
+	Endpoint   string
+	Token      string // OAuth2 Access Token. 空の場合はAuthorization Headerを付けない
+	HTTPClient *http.Client
+}
+
+// New is Clientを作成する
+func New(endpoint string, token string) *Client {
+	if len(endpoint) < 1 {
+		endpoint = DefaultEndpoint
+	}
+	return &Client{
+		Endpoint:   strings.TrimRight(endpoint, "/"),
+		Token:      token,
+		HTTPClient: &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+// Error is APIが2xx以外を返した時のError
+// Bodyが #/components/schemas/Error の場合はCode, Message, Detailsが入る
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Details    map[string]interface{}
+	Body       []byte
+}
+
+// errorResponse is #/components/schemas/Error
+type errorResponse struct {
+	Error struct {
+		Code    string                 `json:"code"`
+		Message string                 `json:"message"`
+		Details map[string]interface{} `json:"details"`
+	} `json:"error"`
+}
+
+func newError(statusCode int, body []byte) *Error {
+	e := &Error{StatusCode: statusCode, Body: body}
+	var er errorResponse
+	if err := json.Unmarshal(body, &er); err == nil {
+		e.Code = er.Error.Code
+		e.Message = er.Error.Message
+		e.Details = er.Error.Details
+	}
+	return e
+}
+
+func (e *Error) Error() string {
+	if len(e.Code) > 0 {
+		return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Code, e.Message)
+	}
+	body := strings.TrimSpace(string(e.Body))
+	if len(body) < 1 {
+		return fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), body)
+}
+
+// Minecraft is #/components/schemas/Minecraft
+type Minecraft struct {
+	Key                string    `json:"key,omitempty"`
+	World              string    `json:"world"`
+	ResourceID         int64     `json:"resourceID,omitempty"`
+	Zone               string    `json:"zone,omitempty"`
+	IPAddr             string    `json:"ipAddr,omitempty"`
+	Status             string    `json:"status,omitempty"`
+	OperationType      string    `json:"operationType,omitempty"`
+	OperationStatus    string    `json:"operationStatus,omitempty"`
+	LatestSnapshot     string    `json:"latestSnapshot,omitempty"`
+	JarVersion         string    `json:"jarVersion,omitempty"`
+	ServerType         string    `json:"serverType,omitempty"`
+	ServerBuild        string    `json:"serverBuild,omitempty"`
+	OverviewerSnapshot string    `json:"overviewerSnapshot,omitempty"`
+	PlayWindows        []string  `json:"playWindows"` // nilの場合はServerが今の値のままにする。消す場合は空のSliceにする
+	Provisioning       string    `json:"provisioning,omitempty"`
+	StandardFallbackAt time.Time `json:"standardFallbackAt"`
+	JoinableAt         time.Time `json:"joinableAt"`
+	CreatedAt          time.Time `json:"createdAt"`
+	UpdatedAt          time.Time `json:"updatedAt"`
+}
+
+// MinecraftList is #/components/schemas/MinecraftList
+type MinecraftList struct {
+	Items   []Minecraft `json:"items"`
+	Cursor  string      `json:"cursor"`
+	HasNext bool        `json:"hasNext"`
+}
+
+// Minecraft ServerType
+const (
+	ServerTypeVanilla = "vanilla"
+	ServerTypePaper   = "paper"
+	ServerTypeFabric  = "fabric"
+	ServerTypeForge   = "forge"
+)
+
+// Instance is #/components/schemas/Instance
+type Instance struct {
+	InstanceName      string `json:"instanceName"`
+	Zone              string `json:"zone"`
+	IPAddr            string `json:"ipAddr"`
+	Status            string `json:"status"`
+	CreationTimestamp string `json:"creationTimestamp"`
+}
+
+// InstanceList is #/components/schemas/InstanceList
+type InstanceList struct {
+	Items  []Instance `json:"items"`
+	Cursor string     `json:"cursor"`
+}
+
+// Snapshot is #/components/schemas/Snapshot
+type Snapshot struct {
+	Name              string `json:"name"`
+	World             string `json:"world"`
+	Label             string `json:"label"`
+	Status            string `json:"status"`
+	DiskSizeGb        int64  `json:"diskSizeGb"`
+	StorageBytes      int64  `json:"storageBytes"`
+	CreationTimestamp string `json:"creationTimestamp"`
+}
+
+// SnapshotList is #/components/schemas/SnapshotList
+type SnapshotList struct {
+	Items  []Snapshot `json:"items"`
+	Cursor string     `json:"cursor"`
+}
+
+// MinecraftCloneRequest is #/components/schemas/MinecraftCloneRequest
+type MinecraftCloneRequest struct {
+	World    string `json:"world"`
+	Snapshot string `json:"snapshot,omitempty"`
+	Zone     string `json:"zone,omitempty"`
+}
+
+// WorldImport is #/components/schemas/WorldImport
+type WorldImport struct {
+	World       string    `json:"world"`
+	Zone        string    `json:"zone"`
+	JarVersion  string    `json:"jarVersion"`
+	Format      string    `json:"format"`
+	Object      string    `json:"object"`
+	ArchiveRoot string    `json:"archiveRoot"`
+	Status      string    `json:"status"`
+	OperationID string    `json:"operationID"`
+	Snapshot    string    `json:"snapshot"`
+	Error       string    `json:"error"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// WorldImport Status
+const (
+	WorldImportStatusDone   = "done"
+	WorldImportStatusFailed = "failed"
+)
+
+// WorldImportPostRequest is #/components/schemas/WorldImportPostRequest
+type WorldImportPostRequest struct {
+	Zone       string `json:"zone"`
+	JarVersion string `json:"jarVersion"`
+	Format     string `json:"format"` // "zip" or "tar.gz"
+}
+
+// WorldImportPostResponse is #/components/schemas/WorldImportPostResponse
+type WorldImportPostResponse struct {
+	Import      WorldImport `json:"import"`
+	UploadURL   string      `json:"uploadUrl"`
+	ContentType string      `json:"contentType"`
+	ExpiresAt   time.Time   `json:"expiresAt"`
+}
+
+// WorldExport is #/components/schemas/WorldExport
+type WorldExport struct {
+	ID                int64      `json:"id"`
+	World             string     `json:"world"`
+	Zone              string     `json:"zone"`
+	Snapshot          string     `json:"snapshot"`
+	Object            string     `json:"object"`
+	Status            string     `json:"status"`
+	OperationID       string     `json:"operationID"`
+	Size              int64      `json:"size"`
+	Error             string     `json:"error"`
+	DownloadURL       string     `json:"downloadUrl,omitempty"`
+	DownloadExpiresAt *time.Time `json:"downloadExpiresAt,omitempty"`
+	CreatedAt         time.Time  `json:"createdAt"`
+	UpdatedAt         time.Time  `json:"updatedAt"`
+}
+
+// WorldExport Status
+const (
+	WorldExportStatusDone   = "done"
+	WorldExportStatusFailed = "failed"
+)
+
+// WorldExportList is #/components/schemas/WorldExportList
+type WorldExportList struct {
+	Items []WorldExport `json:"items"`
+}
+
+// WorldExportPostRequest is #/components/schemas/WorldExportPostRequest
+type WorldExportPostRequest struct {
+	Snapshot string `json:"snapshot,omitempty"`
+}
+
+// WorldUpgrade is #/components/schemas/WorldUpgrade
+type WorldUpgrade struct {
+	World          string    `json:"world"`
+	Zone           string    `json:"zone"`
+	FromVersion    string    `json:"fromVersion"`
+	ToVersion      string    `json:"toVersion"`
+	FromBuild      string    `json:"fromBuild"`
+	ToBuild        string    `json:"toBuild"`
+	PreSnapshot    string    `json:"preSnapshot"`
+	InstanceExists bool      `json:"instanceExists"`
+	Status         string    `json:"status"`
+	OperationID    string    `json:"operationID"`
+	Error          string    `json:"error"`
+	StartedAt      time.Time `json:"startedAt"`
+	CreatedAt      time.Time `json:"createdAt"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+}
+
+// WorldUpgrade Status
+const (
+	WorldUpgradeStatusDone       = "done"
+	WorldUpgradeStatusRolledBack = "rolled_back"
+	WorldUpgradeStatusFailed     = "failed"
+)
+
+// WorldUpgradePostRequest is #/components/schemas/WorldUpgradePostRequest
+type WorldUpgradePostRequest struct {
+	JarVersion  string `json:"jarVersion"`
+	ServerBuild string `json:"serverBuild,omitempty"`
+}
+
+// ServerProperties is #/components/schemas/ServerProperties
+type ServerProperties struct {
+	World           string            `json:"world"`
+	Properties      map[string]string `json:"properties"`
+	Diff            []AuditDiff       `json:"diff"`
+	RestartRequired bool              `json:"restartRequired"`
+	CreatedAt       time.Time         `json:"createdAt"`
+	UpdatedAt       time.Time         `json:"updatedAt"`
+}
+
+// ServerPropertiesPutRequest is #/components/schemas/ServerPropertiesPutRequest
+type ServerPropertiesPutRequest struct {
+	Properties map[string]string `json:"properties"`
+}
+
+// OverviewerConfig is #/components/schemas/OverviewerConfig
+type OverviewerConfig struct {
+	World          string      `json:"world"`
+	Dimensions     []string    `json:"dimensions"`
+	Rendermodes    []string    `json:"rendermodes"`
+	TextureVersion string      `json:"textureVersion"`
+	OutputPrefix   string      `json:"outputPrefix"`
+	Diff           []AuditDiff `json:"diff"`
+	Preview        string      `json:"preview"`
+	CreatedAt      time.Time   `json:"createdAt"`
+	UpdatedAt      time.Time   `json:"updatedAt"`
+}
+
+// OverviewerConfigPutRequest is #/components/schemas/OverviewerConfigPutRequest
+type OverviewerConfigPutRequest struct {
+	Dimensions     []string `json:"dimensions"`
+	Rendermodes    []string `json:"rendermodes"`
+	TextureVersion string   `json:"textureVersion"`
+	OutputPrefix   string   `json:"outputPrefix"`
+}
+
+// OverviewerJob is #/components/schemas/OverviewerJob
+type OverviewerJob struct {
+	ID                int64     `json:"id"`
+	World             string    `json:"world"`
+	Zone              string    `json:"zone"`
+	Snapshot          string    `json:"snapshot"`
+	JarVersion        string    `json:"jarVersion"`
+	OutputPrefix      string    `json:"outputPrefix"`
+	Trigger           string    `json:"trigger"`
+	Attempt           int       `json:"attempt"`
+	RetryOf           int64     `json:"retryOf"`
+	Status            string    `json:"status"`
+	OperationID       string    `json:"operationID"`
+	Error             string    `json:"error"`
+	DiskCreatedAt     time.Time `json:"diskCreatedAt"`
+	InstanceCreatedAt time.Time `json:"instanceCreatedAt"`
+	RenderedAt        time.Time `json:"renderedAt"`
+	FinishedAt        time.Time `json:"finishedAt"`
+	CreatedAt         time.Time `json:"createdAt"`
+	UpdatedAt         time.Time `json:"updatedAt"`
+}
+
+// OverviewerJob Status
+const (
+	OverviewerJobStatusDone   = "done"
+	OverviewerJobStatusFailed = "failed"
+)
+
+// OverviewerJobList is #/components/schemas/OverviewerJobList
+type OverviewerJobList struct {
+	Items []OverviewerJob `json:"items"`
+}
+
+// OverviewerJobPostRequest is #/components/schemas/OverviewerJobPostRequest
+type OverviewerJobPostRequest struct {
+	Snapshot string `json:"snapshot,omitempty"`
+}
+
+// WorldPlugin is #/components/schemas/WorldPlugin
+type WorldPlugin struct {
+	World            string    `json:"world"`
+	Name             string    `json:"name"`
+	Version          string    `json:"version"`
+	MinecraftVersion string    `json:"minecraftVersion"`
+	Source           string    `json:"source"`
+	URL              string    `json:"url"`
+	SHA256           string    `json:"sha256"`
+	Enabled          bool      `json:"enabled"`
+	Warnings         []string  `json:"warnings"`
+	CreatedAt        time.Time `json:"createdAt"`
+	UpdatedAt        time.Time `json:"updatedAt"`
+}
+
+// WorldPluginList is #/components/schemas/WorldPluginList
+type WorldPluginList struct {
+	Items []WorldPlugin `json:"items"`
+}
+
+// WorldPluginPostRequest is #/components/schemas/WorldPluginPostRequest
+// URLを空にするとuploadになり、ResponseのUploadURLにJarをPUTする
+type WorldPluginPostRequest struct {
+	Name             string `json:"name"`
+	Version          string `json:"version"`
+	MinecraftVersion string `json:"minecraftVersion,omitempty"`
+	URL              string `json:"url,omitempty"`
+	SHA256           string `json:"sha256"`
+	Enabled          *bool  `json:"enabled,omitempty"`
+}
+
+// WorldPluginPutRequest is #/components/schemas/WorldPluginPutRequest
+// nilのFieldは変えない
+type WorldPluginPutRequest struct {
+	Version          *string `json:"version,omitempty"`
+	MinecraftVersion *string `json:"minecraftVersion,omitempty"`
+	URL              *string `json:"url,omitempty"`
+	SHA256           *string `json:"sha256,omitempty"`
+	Enabled          *bool   `json:"enabled,omitempty"`
+}
+
+// WorldPluginResponse is #/components/schemas/WorldPluginResponse
+type WorldPluginResponse struct {
+	Plugin          WorldPlugin `json:"plugin"`
+	UploadURL       string      `json:"uploadUrl,omitempty"`
+	ContentType     string      `json:"contentType,omitempty"`
+	ExpiresAt       *time.Time  `json:"expiresAt,omitempty"`
+	RestartRequired bool        `json:"restartRequired"`
+}
+
+// Minecraft Provisioning
+const (
+	ProvisioningPreemptible = "preemptible"
+	ProvisioningStandard    = "standard"
+)
+
+// Preemption Status
+const (
+	PreemptionStatusRecorded   = "recorded"
+	PreemptionStatusRestarting = "restarting"
+	PreemptionStatusRestarted  = "restarted"
+	PreemptionStatusSkipped    = "skipped"
+	PreemptionStatusFailed     = "failed"
+)
+
+// Preemption is #/components/schemas/Preemption
+type Preemption struct {
+	OperationID  string    `json:"operationID"`
+	World        string    `json:"world"`
+	Instance     string    `json:"instance"`
+	InstanceID   string    `json:"instanceID"`
+	Zone         string    `json:"zone"`
+	PreemptedAt  time.Time `json:"preemptedAt"`
+	InPlayWindow bool      `json:"inPlayWindow"`
+	Status       string    `json:"status"`
+	Error        string    `json:"error"`
+	CreatedAt    time.Time `json:"createdAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+// PreemptionList is #/components/schemas/PreemptionList
+type PreemptionList struct {
+	Items []Preemption `json:"items"`
+}
+
+// ReconcileFinding Kind
+const (
+	ReconcileKindStatus          = "status"
+	ReconcileKindStuckOperation  = "stuck_operation"
+	ReconcileKindResourceID      = "resource_id"
+	ReconcileKindZone            = "zone"
+	ReconcileKindLatestSnapshot  = "latest_snapshot"
+	ReconcileKindMissingSnapshot = "missing_snapshot"
+	ReconcileKindOrphanInstance  = "orphan_instance"
+	ReconcileKindOrphanDisk      = "orphan_disk"
+)
+
+// ReconcileFinding is #/components/schemas/ReconcileFinding
+type ReconcileFinding struct {
+	Kind     string `json:"kind"`
+	World    string `json:"world"`
+	Resource string `json:"resource"`
+	Zone     string `json:"zone"`
+	Message  string `json:"message"`
+	Fix      string `json:"fix"`
+	Fixed    bool   `json:"fixed"`
+	Error    string `json:"error"`
+}
+
+// ReconcileReport is #/components/schemas/ReconcileReport
+type ReconcileReport struct {
+	DryRun     bool               `json:"dryRun"`
+	Worlds     int                `json:"worlds"`
+	Instances  int                `json:"instances"`
+	Disks      int                `json:"disks"`
+	Snapshots  int                `json:"snapshots"`
+	Findings   []ReconcileFinding `json:"findings"`
+	Fixed      int                `json:"fixed"`
+	Unresolved int                `json:"unresolved"`
+	CreatedAt  time.Time          `json:"createdAt"`
+}
+
+// GCCandidate Kind
+const (
+	GCKindInstance = "instance"
+	GCKindDisk     = "disk"
+	GCKindSnapshot = "snapshot"
+)
+
+// GCCandidate Action
+const (
+	GCActionPending     = "pending"
+	GCActionDelete      = "delete"
+	GCActionAllowlisted = "allowlisted"
+)
+
+// GCCandidate is #/components/schemas/GCCandidate
+type GCCandidate struct {
+	Kind                 string    `json:"kind"`
+	Name                 string    `json:"name"`
+	Zone                 string    `json:"zone"`
+	World                string    `json:"world"`
+	Reason               string    `json:"reason"`
+	EstimatedMonthlyCost float64   `json:"estimatedMonthlyCost"`
+	Action               string    `json:"action"`
+	FirstSeenAt          time.Time `json:"firstSeenAt"`
+	DeleteAfter          time.Time `json:"deleteAfter"`
+	Deleted              bool      `json:"deleted"`
+	Error                string    `json:"error"`
+	UpdatedAt            time.Time `json:"updatedAt"`
+}
+
+// GCReport is #/components/schemas/GCReport
+type GCReport struct {
+	DryRun               bool          `json:"dryRun"`
+	GracePeriodHours     int           `json:"gracePeriodHours"`
+	Candidates           []GCCandidate `json:"candidates"`
+	Deleted              int           `json:"deleted"`
+	Pending              int           `json:"pending"`
+	Allowlisted          int           `json:"allowlisted"`
+	Failed               int           `json:"failed"`
+	EstimatedMonthlyCost float64       `json:"estimatedMonthlyCost"`
+	CreatedAt            time.Time     `json:"createdAt"`
+}
+
+// ReindexReport is #/components/schemas/ReindexReport
+type ReindexReport struct {
+	Worlds    int       `json:"worlds"`
+	Reindexed int       `json:"reindexed"`
+	Failed    []string  `json:"failed"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// MinecraftVersion is #/components/schemas/MinecraftVersion
+type MinecraftVersion struct {
+	ID          string    `json:"id"`
+	Type        string    `json:"type"`
+	ReleaseTime time.Time `json:"releaseTime"`
+	ServerURL   string    `json:"serverUrl"`
+	ServerSHA1  string    `json:"serverSha1"`
+	ServerSize  int64     `json:"serverSize"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// MinecraftVersionList is #/components/schemas/MinecraftVersionList
+type MinecraftVersionList struct {
+	Items []MinecraftVersion `json:"items"`
+}
+
+// SnapshotPostRequest is #/components/schemas/SnapshotPostRequest
+type SnapshotPostRequest struct {
+	Label string `json:"label,omitempty"`
+}
+
+// SnapshotPostResponse is #/components/schemas/SnapshotPostResponse
+type SnapshotPostResponse struct {
+	Name    string `json:"name"`
+	World   string `json:"world"`
+	Label   string `json:"label"`
+	Flush   bool   `json:"flush"`
+	Message string `json:"message"`
+}
+
+// ServerPostRequest is #/components/schemas/ServerPostRequest
+type ServerPostRequest struct {
+	Key string `json:"key"`
+}
+
+// Server Operation
+const (
+	ServerOperationStart = "start"
+	ServerOperationReset = "reset"
+	ServerOperationStop  = "stop"
+)
+
+// ServerPutRequest is #/components/schemas/ServerPutRequest
+type ServerPutRequest struct {
+	Key       string `json:"key"`
+	Operation string `json:"operation"`
+}
+
+// Message is #/components/schemas/Message
+type Message struct {
+	Message string `json:"message"`
+}
+
+// AuditEvent is #/components/schemas/AuditEvent
+type AuditEvent struct {
+	Key       string      `json:"key"`
+	Actor     string      `json:"actor"`
+	Action    string      `json:"action"`
+	Target    string      `json:"target"`
+	Diff      []AuditDiff `json:"diff"`
+	Outcome   string      `json:"outcome"`
+	Error     string      `json:"error"`
+	CreatedAt time.Time   `json:"createdAt"`
+}
+
+// AuditDiff is #/components/schemas/AuditDiff
+type AuditDiff struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// AuditEventList is #/components/schemas/AuditEventList
+type AuditEventList struct {
+	Items   []AuditEvent `json:"items"`
+	Cursor  string       `json:"cursor"`
+	HasNext bool         `json:"hasNext"`
+}
+
+// AppConfig is #/components/schemas/AppConfig
+type AppConfig struct {
+	ClientId                      string    `json:"clientId"`
+	ClientSecret                  string    `json:"clientSecret"`
+	SlackPostUrl                  string    `json:"slackPostUrl"`
+	APIAIIntentIDRunServer        string    `json:"aPIAIIntentIDRunServer"`
+	VersionManifestURL            string    `json:"versionManifestUrl"`
+	PreemptionFallbackCount       int       `json:"preemptionFallbackCount"`
+	PreemptionFallbackWindowHours int       `json:"preemptionFallbackWindowHours"`
+	DNSProject                    string    `json:"dnsProject"`
+	DNSManagedZone                string    `json:"dnsManagedZone"`
+	DNSDomain                     string    `json:"dnsDomain"`
+	DNSTTL                        int64     `json:"dnsTtl"`
+	GCGracePeriodHours            int       `json:"gcGracePeriodHours"`
+	GCAllowlist                   []string  `json:"gcAllowlist"`
+	CreatedAt                     time.Time `json:"createdAt"`
+	UpdatedAt                     time.Time `json:"updatedAt"`
+}
+
+// ListWorldsOptions is GET /api/1/minecraft のQuery Parameter
+// 空の値は指定しなかったものとして扱う
+type ListWorldsOptions struct {
+	Limit      int
+	Cursor     string
+	Status     string
+	Zone       string
+	JarVersion string
+}
+
+// ListWorlds is GET /api/1/minecraft
+func (c *Client) ListWorlds(ctx context.Context, opts ListWorldsOptions) (MinecraftList, error) {
+	q := url.Values{}
+	if opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if len(opts.Cursor) > 0 {
+		q.Set("cursor", opts.Cursor)
+	}
+	if len(opts.Status) > 0 {
+		q.Set("status", opts.Status)
+	}
+	if len(opts.Zone) > 0 {
+		q.Set("zone", opts.Zone)
+	}
+	if len(opts.JarVersion) > 0 {
+		q.Set("jarVersion", opts.JarVersion)
+	}
+	var l MinecraftList
+	err := c.do(ctx, "GET", "/api/1/minecraft", q, nil, &l)
+	return l, err
+}
+
+// GetWorld is GET /api/1/minecraft/{world}
+func (c *Client) GetWorld(ctx context.Context, world string) (Minecraft, error) {
+	var m Minecraft
+	err := c.do(ctx, "GET", "/api/1/minecraft/"+url.PathEscape(world), nil, nil, &m)
+	return m, err
+}
+
+// CreateWorld is POST /api/1/minecraft
+func (c *Client) CreateWorld(ctx context.Context, m Minecraft) (Minecraft, error) {
+	var res Minecraft
+	err := c.do(ctx, "POST", "/api/1/minecraft", nil, &m, &res)
+	return res, err
+}
+
+// UpdateWorld is PUT /api/1/minecraft
+func (c *Client) UpdateWorld(ctx context.Context, m Minecraft) (Minecraft, error) {
+	var res Minecraft
+	err := c.do(ctx, "PUT", "/api/1/minecraft", nil, &m, &res)
+	return res, err
+}
+
+// CloneWorld is POST /api/1/minecraft/{world}/clone
+func (c *Client) CloneWorld(ctx context.Context, world string, req MinecraftCloneRequest) (Minecraft, error) {
+	var res Minecraft
+	err := c.do(ctx, "POST", "/api/1/minecraft/"+url.PathEscape(world)+"/clone", nil, &req, &res)
+	return res, err
+}
+
+// DeleteWorld is DELETE /api/1/minecraft
+func (c *Client) DeleteWorld(ctx context.Context, key string) error {
+	return c.do(ctx, "DELETE", "/api/1/minecraft", url.Values{"key": {key}}, nil, nil)
+}
+
+// ListServers is GET /api/1/server
+func (c *Client) ListServers(ctx context.Context) (InstanceList, error) {
+	var l InstanceList
+	err := c.do(ctx, "GET", "/api/1/server", nil, nil, &l)
+	return l, err
+}
+
+// CreateServer is POST /api/1/server
+func (c *Client) CreateServer(ctx context.Context, req ServerPostRequest) (Message, error) {
+	var res Message
+	err := c.do(ctx, "POST", "/api/1/server", nil, &req, &res)
+	return res, err
+}
+
+// UpdateServer is PUT /api/1/server
+func (c *Client) UpdateServer(ctx context.Context, req ServerPutRequest) (Message, error) {
+	var res Message
+	err := c.do(ctx, "PUT", "/api/1/server", nil, &req, &res)
+	return res, err
+}
+
+// DeleteServer is DELETE /api/1/server
+func (c *Client) DeleteServer(ctx context.Context, key string) (Message, error) {
+	var res Message
+	err := c.do(ctx, "DELETE", "/api/1/server", url.Values{"key": {key}}, nil, &res)
+	return res, err
+}
+
+// ListSnapshots is GET /api/1/snapshot
+// worldが空の場合は全WorldのSnapshotを返す
+func (c *Client) ListSnapshots(ctx context.Context, world string, cursor string) (SnapshotList, error) {
+	q := url.Values{}
+	if len(world) > 0 {
+		q.Set("world", world)
+	}
+	if len(cursor) > 0 {
+		q.Set("cursor", cursor)
+	}
+	var l SnapshotList
+	err := c.do(ctx, "GET", "/api/1/snapshot", q, nil, &l)
+	return l, err
+}
+
+// ListAuditEventsOptions is GET /api/1/audit のQuery Parameter
+// 空の値は指定しなかったものとして扱う
+type ListAuditEventsOptions struct {
+	Limit   int
+	Cursor  string
+	Actor   string
+	Action  string
+	Target  string
+	Outcome string
+}
+
+// ListAuditEvents is GET /api/1/audit
+func (c *Client) ListAuditEvents(ctx context.Context, opts ListAuditEventsOptions) (AuditEventList, error) {
+	q := url.Values{}
+	if opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	for k, v := range map[string]string{
+		"cursor":  opts.Cursor,
+		"actor":   opts.Actor,
+		"action":  opts.Action,
+		"target":  opts.Target,
+		"outcome": opts.Outcome,
+	} {
+		if len(v) > 0 {
+			q.Set(k, v)
+		}
+	}
+	var l AuditEventList
+	err := c.do(ctx, "GET", "/api/1/audit", q, nil, &l)
+	return l, err
+}
+
+// CreateSnapshot is POST /api/1/minecraft/{world}/snapshots
+func (c *Client) CreateSnapshot(ctx context.Context, world string, req SnapshotPostRequest) (SnapshotPostResponse, error) {
+	var res SnapshotPostResponse
+	err := c.do(ctx, "POST", "/api/1/minecraft/"+url.PathEscape(world)+"/snapshots", nil, &req, &res)
+	return res, err
+}
+
+// GetWorldImport is GET /api/1/minecraft/{world}/import
+func (c *Client) GetWorldImport(ctx context.Context, world string) (WorldImport, error) {
+	var res WorldImport
+	err := c.do(ctx, "GET", "/api/1/minecraft/"+url.PathEscape(world)+"/import", nil, nil, &res)
+	return res, err
+}
+
+// CreateWorldImport is POST /api/1/minecraft/{world}/import
+func (c *Client) CreateWorldImport(ctx context.Context, world string, req WorldImportPostRequest) (WorldImportPostResponse, error) {
+	var res WorldImportPostResponse
+	err := c.do(ctx, "POST", "/api/1/minecraft/"+url.PathEscape(world)+"/import", nil, &req, &res)
+	return res, err
+}
+
+// StartWorldImport is POST /api/1/minecraft/{world}/import/start
+func (c *Client) StartWorldImport(ctx context.Context, world string) (WorldImport, error) {
+	var res WorldImport
+	err := c.do(ctx, "POST", "/api/1/minecraft/"+url.PathEscape(world)+"/import/start", nil, nil, &res)
+	return res, err
+}
+
+// UploadWorldArchive is CreateWorldImportで受け取ったuploadUrlにArchiveをPUTする
+// Archiveは大きいので、HTTPClientのTimeoutは使わずにctxで止める
+func (c *Client) UploadWorldArchive(ctx context.Context, upload WorldImportPostResponse, archive io.Reader, size int64) error {
+	return c.upload(ctx, upload.UploadURL, upload.ContentType, archive, size)
+}
+
+// upload is Signed URLにPUTする。Signed URLなのでAuthorizationは付けない
+func (c *Client) upload(ctx context.Context, uploadURL string, contentType string, body io.Reader, size int64) error {
+	req, err := http.NewRequest("PUT", uploadURL, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+
+	hc := &http.Client{Transport: c.HTTPClient.Transport}
+	res, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return newError(res.StatusCode, b)
+	}
+	return nil
+}
+
+// ListWorldExports is GET /api/1/minecraft/{world}/exports
+func (c *Client) ListWorldExports(ctx context.Context, world string, limit int) (WorldExportList, error) {
+	q := url.Values{}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	var l WorldExportList
+	err := c.do(ctx, "GET", "/api/1/minecraft/"+url.PathEscape(world)+"/exports", q, nil, &l)
+	return l, err
+}
+
+// CreateWorldExport is POST /api/1/minecraft/{world}/exports
+func (c *Client) CreateWorldExport(ctx context.Context, world string, req WorldExportPostRequest) (WorldExport, error) {
+	var res WorldExport
+	err := c.do(ctx, "POST", "/api/1/minecraft/"+url.PathEscape(world)+"/exports", nil, &req, &res)
+	return res, err
+}
+
+// GetWorldExport is GET /api/1/minecraft/{world}/exports/{id}
+func (c *Client) GetWorldExport(ctx context.Context, world string, id int64) (WorldExport, error) {
+	var res WorldExport
+	err := c.do(ctx, "GET", "/api/1/minecraft/"+url.PathEscape(world)+"/exports/"+strconv.FormatInt(id, 10), nil, nil, &res)
+	return res, err
+}
+
+// GetWorldUpgrade is GET /api/1/minecraft/{world}/upgrade
+func (c *Client) GetWorldUpgrade(ctx context.Context, world string) (WorldUpgrade, error) {
+	var res WorldUpgrade
+	err := c.do(ctx, "GET", "/api/1/minecraft/"+url.PathEscape(world)+"/upgrade", nil, nil, &res)
+	return res, err
+}
+
+// CreateWorldUpgrade is POST /api/1/minecraft/{world}/upgrade
+func (c *Client) CreateWorldUpgrade(ctx context.Context, world string, req WorldUpgradePostRequest) (WorldUpgrade, error) {
+	var res WorldUpgrade
+	err := c.do(ctx, "POST", "/api/1/minecraft/"+url.PathEscape(world)+"/upgrade", nil, &req, &res)
+	return res, err
+}
+
+// GetServerProperties is GET /api/1/minecraft/{world}/properties
+func (c *Client) GetServerProperties(ctx context.Context, world string) (ServerProperties, error) {
+	var res ServerProperties
+	err := c.do(ctx, "GET", "/api/1/minecraft/"+url.PathEscape(world)+"/properties", nil, nil, &res)
+	return res, err
+}
+
+// UpdateServerProperties is PUT /api/1/minecraft/{world}/properties
+func (c *Client) UpdateServerProperties(ctx context.Context, world string, req ServerPropertiesPutRequest) (ServerProperties, error) {
+	var res ServerProperties
+	err := c.do(ctx, "PUT", "/api/1/minecraft/"+url.PathEscape(world)+"/properties", nil, &req, &res)
+	return res, err
+}
+
+// GetOverviewerConfig is GET /api/1/minecraft/{world}/overviewer/config
+func (c *Client) GetOverviewerConfig(ctx context.Context, world string) (OverviewerConfig, error) {
+	var res OverviewerConfig
+	err := c.do(ctx, "GET", "/api/1/minecraft/"+url.PathEscape(world)+"/overviewer/config", nil, nil, &res)
+	return res, err
+}
+
+// UpdateOverviewerConfig is PUT /api/1/minecraft/{world}/overviewer/config
+func (c *Client) UpdateOverviewerConfig(ctx context.Context, world string, req OverviewerConfigPutRequest) (OverviewerConfig, error) {
+	var res OverviewerConfig
+	err := c.do(ctx, "PUT", "/api/1/minecraft/"+url.PathEscape(world)+"/overviewer/config", nil, &req, &res)
+	return res, err
+}
+
+// ListOverviewerJobs is GET /api/1/minecraft/{world}/overviewer
+func (c *Client) ListOverviewerJobs(ctx context.Context, world string, limit int) (OverviewerJobList, error) {
+	q := url.Values{}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	var l OverviewerJobList
+	err := c.do(ctx, "GET", "/api/1/minecraft/"+url.PathEscape(world)+"/overviewer", q, nil, &l)
+	return l, err
+}
+
+// CreateOverviewerJob is POST /api/1/minecraft/{world}/overviewer
+func (c *Client) CreateOverviewerJob(ctx context.Context, world string, req OverviewerJobPostRequest) (OverviewerJob, error) {
+	var res OverviewerJob
+	err := c.do(ctx, "POST", "/api/1/minecraft/"+url.PathEscape(world)+"/overviewer", nil, &req, &res)
+	return res, err
+}
+
+// ListWorldPlugins is GET /api/1/minecraft/{world}/plugins
+func (c *Client) ListWorldPlugins(ctx context.Context, world string) (WorldPluginList, error) {
+	var res WorldPluginList
+	err := c.do(ctx, "GET", "/api/1/minecraft/"+url.PathEscape(world)+"/plugins", nil, nil, &res)
+	return res, err
+}
+
+// CreateWorldPlugin is POST /api/1/minecraft/{world}/plugins
+func (c *Client) CreateWorldPlugin(ctx context.Context, world string, req WorldPluginPostRequest) (WorldPluginResponse, error) {
+	var res WorldPluginResponse
+	err := c.do(ctx, "POST", "/api/1/minecraft/"+url.PathEscape(world)+"/plugins", nil, &req, &res)
+	return res, err
+}
+
+// UpdateWorldPlugin is PUT /api/1/minecraft/{world}/plugins/{name}
+func (c *Client) UpdateWorldPlugin(ctx context.Context, world string, name string, req WorldPluginPutRequest) (WorldPluginResponse, error) {
+	var res WorldPluginResponse
+	err := c.do(ctx, "PUT", "/api/1/minecraft/"+url.PathEscape(world)+"/plugins/"+url.PathEscape(name), nil, &req, &res)
+	return res, err
+}
+
+// DeleteWorldPlugin is DELETE /api/1/minecraft/{world}/plugins/{name}
+func (c *Client) DeleteWorldPlugin(ctx context.Context, world string, name string) (WorldPluginResponse, error) {
+	var res WorldPluginResponse
+	err := c.do(ctx, "DELETE", "/api/1/minecraft/"+url.PathEscape(world)+"/plugins/"+url.PathEscape(name), nil, nil, &res)
+	return res, err
+}
+
+// ListWorldPreemptions is GET /api/1/minecraft/{world}/preemptions
+func (c *Client) ListWorldPreemptions(ctx context.Context, world string, limit int) (PreemptionList, error) {
+	q := url.Values{}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	var l PreemptionList
+	err := c.do(ctx, "GET", "/api/1/minecraft/"+url.PathEscape(world)+"/preemptions", q, nil, &l)
+	return l, err
+}
+
+// Reconcile is POST /api/1/reconcile
+// dryRunの場合は直さずに見つけたものを返す
+func (c *Client) Reconcile(ctx context.Context, dryRun bool) (ReconcileReport, error) {
+	q := url.Values{}
+	if dryRun {
+		q.Set("dryRun", "true")
+	}
+	var res ReconcileReport
+	err := c.do(ctx, "POST", "/api/1/reconcile", q, nil, &res)
+	return res, err
+}
+
+// GC is POST /api/1/gc
+// dryRunの場合は消さずに見つけたものを返す
+func (c *Client) GC(ctx context.Context, dryRun bool) (GCReport, error) {
+	q := url.Values{}
+	if dryRun {
+		q.Set("dryRun", "true")
+	}
+	var res GCReport
+	err := c.do(ctx, "POST", "/api/1/gc", q, nil, &res)
+	return res, err
+}
+
+// Reindex is POST /api/1/reindex
+func (c *Client) Reindex(ctx context.Context) (ReindexReport, error) {
+	var res ReindexReport
+	err := c.do(ctx, "POST", "/api/1/reindex", nil, nil, &res)
+	return res, err
+}
+
+// UploadPlugin is CreateWorldPluginのResponseのUploadURLにJarをPUTする
+func (c *Client) UploadPlugin(ctx context.Context, upload WorldPluginResponse, jar io.Reader, size int64) error {
+	return c.upload(ctx, upload.UploadURL, upload.ContentType, jar, size)
+}
+
+// ListVersionsOptions is GET /api/1/versions のQuery Parameter
+// 空の値は指定しなかったものとして扱う
+type ListVersionsOptions struct {
+	Limit  int
+	Type   string
+	Status string
+}
+
+// ListVersions is GET /api/1/versions
+func (c *Client) ListVersions(ctx context.Context, opts ListVersionsOptions) (MinecraftVersionList, error) {
+	q := url.Values{}
+	if opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if len(opts.Type) > 0 {
+		q.Set("type", opts.Type)
+	}
+	if len(opts.Status) > 0 {
+		q.Set("status", opts.Status)
+	}
+	var l MinecraftVersionList
+	err := c.do(ctx, "GET", "/api/1/versions", q, nil, &l)
+	return l, err
+}
+
+// PutConfig is POST /admin/api/1/config
+func (c *Client) PutConfig(ctx context.Context, config AppConfig) (AppConfig, error) {
+	var res AppConfig
+	err := c.do(ctx, "POST", "/admin/api/1/config", nil, &config, &res)
+	return res, err
+}
+
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, in interface{}, out interface{}) error {
+	u := c.Endpoint + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	body := bytes.NewReader(nil)
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	}
+	if len(c.Token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return newError(res.StatusCode, b)
+	}
+	if out == nil || len(b) < 1 {
+		return nil
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		return fmt.Errorf("response decode error: %s", err)
+	}
+	return nil
+}
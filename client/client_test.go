@@ -0,0 +1,169 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const specPath = "../appengine/sinmetalcraft/openapi.json"
+
+type spec struct {
+	Components struct {
+		Schemas map[string]struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+		} `json:"schemas"`
+	} `json:"components"`
+}
+
+func loadSpec(t *testing.T) spec {
+	b, err := ioutil.ReadFile(specPath)
+	if err != nil {
+		t.Fatalf("spec read error: %v", err)
+	}
+	var s spec
+	if err := json.Unmarshal(b, &s); err != nil {
+		t.Fatalf("spec decode error: %v", err)
+	}
+	return s
+}
+
+func jsonFields(v interface{}) []string {
+	var fields []string
+	rt := reflect.TypeOf(v)
+	for i := 0; i < rt.NumField(); i++ {
+		name := strings.Split(rt.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func TestTypesMatchSpec(t *testing.T) {
+	s := loadSpec(t)
+
+	types := map[string]interface{}{
+		"Minecraft":                  Minecraft{},
+		"MinecraftList":              MinecraftList{},
+		"MinecraftCloneRequest":      MinecraftCloneRequest{},
+		"Instance":                   Instance{},
+		"InstanceList":               InstanceList{},
+		"Snapshot":                   Snapshot{},
+		"SnapshotList":               SnapshotList{},
+		"SnapshotPostRequest":        SnapshotPostRequest{},
+		"SnapshotPostResponse":       SnapshotPostResponse{},
+		"ServerPostRequest":          ServerPostRequest{},
+		"ServerPutRequest":           ServerPutRequest{},
+		"Message":                    Message{},
+		"AppConfig":                  AppConfig{},
+		"AuditEvent":                 AuditEvent{},
+		"AuditDiff":                  AuditDiff{},
+		"AuditEventList":             AuditEventList{},
+		"WorldImport":                WorldImport{},
+		"WorldImportPostRequest":     WorldImportPostRequest{},
+		"WorldImportPostResponse":    WorldImportPostResponse{},
+		"WorldExport":                WorldExport{},
+		"WorldExportList":            WorldExportList{},
+		"Preemption":                 Preemption{},
+		"PreemptionList":             PreemptionList{},
+		"ReconcileFinding":           ReconcileFinding{},
+		"ReconcileReport":            ReconcileReport{},
+		"GCCandidate":                GCCandidate{},
+		"GCReport":                   GCReport{},
+		"WorldExportPostRequest":     WorldExportPostRequest{},
+		"WorldUpgrade":               WorldUpgrade{},
+		"WorldUpgradePostRequest":    WorldUpgradePostRequest{},
+		"ServerProperties":           ServerProperties{},
+		"ServerPropertiesPutRequest": ServerPropertiesPutRequest{},
+		"OverviewerConfig":           OverviewerConfig{},
+		"OverviewerConfigPutRequest": OverviewerConfigPutRequest{},
+		"OverviewerJob":              OverviewerJob{},
+		"OverviewerJobList":          OverviewerJobList{},
+		"OverviewerJobPostRequest":   OverviewerJobPostRequest{},
+		"WorldPlugin":                WorldPlugin{},
+		"WorldPluginList":            WorldPluginList{},
+		"WorldPluginPostRequest":     WorldPluginPostRequest{},
+		"WorldPluginPutRequest":      WorldPluginPutRequest{},
+		"WorldPluginResponse":        WorldPluginResponse{},
+		"MinecraftVersion":           MinecraftVersion{},
+		"MinecraftVersionList":       MinecraftVersionList{},
+	}
+	for name, v := range types {
+		schema, ok := s.Components.Schemas[name]
+		if !ok {
+			t.Errorf("schema %s is not found in spec", name)
+			continue
+		}
+		var props []string
+		for p := range schema.Properties {
+			props = append(props, p)
+		}
+		sort.Strings(props)
+
+		fields := jsonFields(v)
+		if !reflect.DeepEqual(fields, props) {
+			t.Errorf("%s fields = %v, spec properties = %v", name, fields, props)
+		}
+	}
+}
+
+func TestUpdateServer(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.URL.Path != "/api/1/server" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("unexpected Authorization header %q", r.Header.Get("Authorization"))
+		}
+		var req ServerPutRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatalf("request decode error: %v", err)
+		}
+		if req.Key != "k" || req.Operation != ServerOperationStart {
+			t.Errorf("unexpected request body %+v", req)
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write([]byte(`{"message": "minecraft-hoge start done!"}`))
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL, "token")
+	m, err := c.UpdateServer(context.Background(), ServerPutRequest{Key: "k", Operation: ServerOperationStart})
+	if err != nil {
+		t.Fatalf("UpdateServer error: %v", err)
+	}
+	if m.Message != "minecraft-hoge start done!" {
+		t.Fatalf("unexpected message %q", m.Message)
+	}
+}
+
+func TestError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"error":{"code":"forbidden","message":"admin only"}}`))
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL, "")
+	_, err := c.ListServers(context.Background())
+	e, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("err = %v, want *Error", err)
+	}
+	if e.StatusCode != http.StatusForbidden {
+		t.Fatalf("StatusCode = %d", e.StatusCode)
+	}
+	if e.Code != "forbidden" || e.Message != "admin only" {
+		t.Fatalf("Code = %q, Message = %q", e.Code, e.Message)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sinmetal/sinmetalcraft/client"
+)
+
+func auditList(args []string) error {
+	fs, o := newFlagSet("audit list")
+	var opts client.ListAuditEventsOptions
+	fs.IntVar(&opts.Limit, "limit", 0, "max events per page (server default 50)")
+	fs.StringVar(&opts.Cursor, "cursor", "", "cursor of the next page")
+	fs.StringVar(&opts.Actor, "actor", "", "filter by actor (email, token:EMAIL, cron, tq)")
+	fs.StringVar(&opts.Action, "action", "", "filter by action (e.g. world.update)")
+	fs.StringVar(&opts.Outcome, "outcome", "", "filter by outcome (success or failure)")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 1 {
+		return fmt.Errorf("usage: audit list [WORLD]")
+	}
+	if len(positional) == 1 {
+		opts.Target = positional[0]
+	}
+
+	c := newAPIClient(o)
+	l, err := c.ListAuditEvents(bg, opts)
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printValue(l)
+	}
+
+	var rows [][]string
+	for _, e := range l.Items {
+		var fields []string
+		for _, d := range e.Diff {
+			fields = append(fields, d.Field)
+		}
+		rows = append(rows, []string{
+			e.CreatedAt.Local().Format(time.RFC3339),
+			e.Actor,
+			e.Action,
+			e.Target,
+			e.Outcome,
+			strings.Join(fields, ","),
+			e.Error,
+		})
+	}
+	if err := printTable([]string{"TIME", "ACTOR", "ACTION", "TARGET", "OUTCOME", "CHANGED", "ERROR"}, rows); err != nil {
+		return err
+	}
+	if l.HasNext {
+		_, err = fmt.Fprintf(stdout, "\nnext page: audit list -cursor %s\n", l.Cursor)
+	}
+	return err
+}
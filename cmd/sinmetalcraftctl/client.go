@@ -0,0 +1,14 @@
+package main
+
+import (
+	"context"
+
+	"github.com/sinmetal/sinmetalcraft/client"
+)
+
+// bg is CLIはCancelしないので全てのAPI呼び出しでこのContextを使う
+var bg = context.Background()
+
+func newAPIClient(o *options) *client.Client {
+	return client.New(o.endpoint, o.token)
+}
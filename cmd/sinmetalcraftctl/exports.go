@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/sinmetal/sinmetalcraft/client"
+)
+
+func exportsList(args []string) error {
+	fs, o := newFlagSet("exports list")
+	limit := fs.Int("limit", 0, "max exports (server default 20)")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: exports list WORLD [-limit N]")
+	}
+
+	c := newAPIClient(o)
+	l, err := c.ListWorldExports(bg, positional[0], *limit)
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printValue(l)
+	}
+
+	var rows [][]string
+	for _, e := range l.Items {
+		rows = append(rows, []string{
+			strconv.FormatInt(e.ID, 10),
+			e.Snapshot,
+			e.Status,
+			strconv.FormatInt(e.Size, 10),
+			e.CreatedAt.Local().Format("2006-01-02 15:04:05"),
+			e.Error,
+		})
+	}
+	return printTable([]string{"ID", "SNAPSHOT", "STATUS", "SIZE", "CREATED", "ERROR"}, rows)
+}
+
+// exportsCreate is WorldのSnapshotをtar.gzにする
+// -waitを付けると終わるまでpollingして、Download URLを出力する
+func exportsCreate(args []string) error {
+	fs, o := newFlagSet("exports create")
+	var req client.WorldExportPostRequest
+	fs.StringVar(&req.Snapshot, "snapshot", "", "snapshot of WORLD (default latest snapshot)")
+	wait := fs.Bool("wait", false, "wait until export is done and print download url")
+	interval := fs.Duration("interval", 30*time.Second, "polling interval with -wait")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: exports create WORLD [-snapshot NAME] [-wait]")
+	}
+	world := positional[0]
+
+	c := newAPIClient(o)
+	e, err := c.CreateWorldExport(bg, world, req)
+	if err != nil {
+		return err
+	}
+	if !*wait {
+		if o.json {
+			return printValue(e)
+		}
+		_, err = fmt.Fprintf(stdout, "export %d accepted. exports get %s %d\n", e.ID, world, e.ID)
+		return err
+	}
+
+	for e.Status != client.WorldExportStatusDone && e.Status != client.WorldExportStatusFailed {
+		time.Sleep(*interval)
+		e, err = c.GetWorldExport(bg, world, e.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return printExport(o, e)
+}
+
+func exportsGet(args []string) error {
+	fs, o := newFlagSet("exports get")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		return fmt.Errorf("usage: exports get WORLD ID")
+	}
+	id, err := strconv.ParseInt(positional[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid id %s", positional[1])
+	}
+
+	c := newAPIClient(o)
+	e, err := c.GetWorldExport(bg, positional[0], id)
+	if err != nil {
+		return err
+	}
+	return printExport(o, e)
+}
+
+func printExport(o *options, e client.WorldExport) error {
+	if o.json {
+		return printValue(e)
+	}
+	switch e.Status {
+	case client.WorldExportStatusDone:
+		_, err := fmt.Fprintf(stdout, "%s (%d bytes, expires %s)\n", e.DownloadURL, e.Size, e.DownloadExpiresAt.Local().Format("15:04:05"))
+		return err
+	case client.WorldExportStatusFailed:
+		return fmt.Errorf("export failed: %s", e.Error)
+	}
+	_, err := fmt.Fprintf(stdout, "export %d is %s\n", e.ID, e.Status)
+	return err
+}
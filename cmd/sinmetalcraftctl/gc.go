@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sinmetal/sinmetalcraft/client"
+)
+
+// gcRun is 持ち主の無いInstance, Disk, Snapshotを見つけて、Grace Periodが過ぎたものを消す
+// -dry-runを付けると消さずに見つけたものと価格だけを表示する
+func gcRun(args []string) error {
+	fs, o := newFlagSet("gc run")
+	dryRun := fs.Bool("dry-run", false, "report orphaned resources without deleting them")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return fmt.Errorf("usage: gc run [-dry-run]")
+	}
+
+	c := newAPIClient(o)
+	report, err := c.GC(bg, *dryRun)
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printValue(report)
+	}
+
+	var rows [][]string
+	for _, cand := range report.Candidates {
+		result := cand.Action
+		switch {
+		case cand.Deleted:
+			result = "deleted"
+		case len(cand.Error) > 0:
+			result = "failed: " + cand.Error
+		case cand.Action == client.GCActionPending:
+			result = "delete after " + cand.DeleteAfter.Local().Format("2006-01-02 15:04:05")
+		}
+		rows = append(rows, []string{
+			cand.Kind,
+			cand.Name,
+			cand.Zone,
+			cand.World,
+			cand.Reason,
+			fmt.Sprintf("$%.2f", cand.EstimatedMonthlyCost),
+			result,
+		})
+	}
+	if err := printTable([]string{"KIND", "NAME", "ZONE", "WORLD", "REASON", "COST/MONTH", "RESULT"}, rows); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(stdout, "\n%d orphaned resources. deleted %d, %d waiting %dh grace period, %d allowlisted, %d failed. remaining $%.2f/month.\n", len(report.Candidates), report.Deleted, report.Pending, report.GracePeriodHours, report.Allowlisted, report.Failed, report.EstimatedMonthlyCost)
+	return err
+}
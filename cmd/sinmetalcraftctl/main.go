@@ -0,0 +1,140 @@
+// Command sinmetalcraftctl is sinmetalcraftのREST APIを叩くCLI
+//
+// 認証には OAuth2 Access Token を使う。
+//
+//	export SINMETALCRAFT_TOKEN=$(gcloud auth print-access-token)
+//	sinmetalcraftctl worlds list
+//
+// 全てのコマンドは -json を付けるとAPIのResponseをそのままJSONで出力する。
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+const defaultEndpoint = "https://sinmetalcraft.appspot.com"
+
+// options is 全てのサブコマンドで共通のflag
+type options struct {
+	endpoint string
+	token    string
+	json     bool
+}
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"worlds list", "[-limit N] [-cursor CURSOR] [-status STATUS] [-zone ZONE] [-jar VERSION]", worldsList},
+	{"worlds create", "-world NAME -zone ZONE -jar VERSION [-type TYPE -build BUILD] [-snapshot NAME]", worldsCreate},
+	{"worlds update", "WORLD [-zone ZONE] [-jar VERSION] [-type TYPE -build BUILD] [-ip ADDR] [-play-windows WINDOWS]", worldsUpdate},
+	{"worlds delete", "WORLD", worldsDelete},
+	{"worlds clone", "WORLD -world NAME [-snapshot NAME] [-zone ZONE]", worldsClone},
+	{"worlds import", "WORLD -file PATH -jar VERSION [-zone ZONE] [-wait]", worldsImport},
+	{"worlds upgrade", "WORLD -jar VERSION [-build BUILD] [-wait]", worldsUpgrade},
+	{"properties get", "WORLD", propertiesGet},
+	{"properties set", "WORLD KEY=VALUE... [-unset KEY,...]", propertiesSet},
+	{"overviewer get", "WORLD [-preview]", overviewerGet},
+	{"overviewer set", "WORLD [-dimensions LIST] [-rendermodes LIST] [-texture VERSION] [-prefix PREFIX]", overviewerSet},
+	{"overviewer render", "WORLD [-snapshot NAME]", overviewerRender},
+	{"overviewer jobs", "WORLD [-limit N]", overviewerJobs},
+	{"plugins list", "WORLD", pluginsList},
+	{"plugins add", "WORLD -name NAME -version VERSION (-file PATH | -url URL -sha256 SHA256) [-mc VERSION] [-disabled]", pluginsAdd},
+	{"plugins enable", "WORLD NAME", pluginsEnable},
+	{"plugins disable", "WORLD NAME", pluginsDisable},
+	{"plugins remove", "WORLD NAME", pluginsRemove},
+	{"preemptions list", "WORLD [-limit N]", preemptionsList},
+	{"reconcile run", "[-dry-run]", reconcileRun},
+	{"gc run", "[-dry-run]", gcRun},
+	{"reindex run", "", reindexRun},
+	{"server list", "", serverList},
+	{"server start", "WORLD", serverStart},
+	{"server reset", "WORLD", serverReset},
+	{"server stop", "WORLD", serverStop},
+	{"snapshots list", "[WORLD]", snapshotsList},
+	{"snapshots create", "WORLD [-label LABEL]", snapshotsCreate},
+	{"exports list", "WORLD [-limit N]", exportsList},
+	{"exports create", "WORLD [-snapshot NAME] [-wait]", exportsCreate},
+	{"exports get", "WORLD ID", exportsGet},
+	{"versions list", "[-type TYPE] [-status STATUS] [-limit N]", versionsList},
+	{"ops watch", "WORLD [-interval 10s] [-timeout 10m]", opsWatch},
+	{"audit list", "[WORLD] [-actor ACTOR] [-action ACTION] [-outcome OUTCOME] [-limit N] [-cursor CURSOR]", auditList},
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "sinmetalcraftctl: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	if len(args) < 2 {
+		usage(os.Stderr)
+		return fmt.Errorf("command is required")
+	}
+	name := args[0] + " " + args[1]
+	for _, c := range commands {
+		if c.name == name {
+			return c.run(args[2:])
+		}
+	}
+	usage(os.Stderr)
+	return fmt.Errorf("unknown command %q", name)
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: sinmetalcraftctl <command> [flags]")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "commands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "common flags:")
+	fmt.Fprintln(w, "  -endpoint URL  (default $SINMETALCRAFT_ENDPOINT or "+defaultEndpoint+")")
+	fmt.Fprintln(w, "  -token TOKEN   (default $SINMETALCRAFT_TOKEN)")
+	fmt.Fprintln(w, "  -json          print raw JSON")
+}
+
+// newFlagSet is 共通のflagを登録したFlagSetを作る
+func newFlagSet(name string) (*flag.FlagSet, *options) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	o := &options{}
+	endpoint := os.Getenv("SINMETALCRAFT_ENDPOINT")
+	if len(endpoint) < 1 {
+		endpoint = defaultEndpoint
+	}
+	fs.StringVar(&o.endpoint, "endpoint", endpoint, "API endpoint")
+	fs.StringVar(&o.token, "token", os.Getenv("SINMETALCRAFT_TOKEN"), "OAuth2 access token")
+	fs.BoolVar(&o.json, "json", false, "print raw JSON")
+	return fs, o
+}
+
+// parseFlags is 位置引数とflagが混ざっていてもparseする
+// e.g. worlds update myworld -jar 1.12.2
+// "--" より後ろは全て位置引数にする。"-" だけのものも位置引数にする
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		if parsed := len(args) - len(rest); parsed > 0 && args[parsed-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		if len(rest) < 1 {
+			return positional, nil
+		}
+		// FlagSetは "-" で止まるので、必ず1つ進める
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
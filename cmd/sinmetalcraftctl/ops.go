@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// opsWatch is WorldのOperationがDONEになるまでpollingする
+// OperationStatusはTQが30秒毎に更新するので、それより短い間隔で見てもあまり意味はない
+func opsWatch(args []string) error {
+	fs, o := newFlagSet("ops watch")
+	interval := fs.Duration("interval", 10*time.Second, "polling interval")
+	timeout := fs.Duration("timeout", 10*time.Minute, "give up after")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: ops watch WORLD [-interval 10s] [-timeout 10m]")
+	}
+
+	c := newAPIClient(o)
+	deadline := time.Now().Add(*timeout)
+	var last string
+	for {
+		w, err := c.GetWorld(bg, positional[0])
+		if err != nil {
+			return err
+		}
+
+		current := fmt.Sprintf("%s %s %s", w.Status, w.OperationType, w.OperationStatus)
+		if current != last {
+			if o.json {
+				b, err := json.Marshal(w)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(stdout, string(b))
+			} else {
+				fmt.Fprintf(stdout, "%s\t%s\tstatus=%s\toperation=%s\toperationStatus=%s\n",
+					time.Now().Format("15:04:05"), w.World, w.Status, w.OperationType, w.OperationStatus)
+			}
+			last = current
+		}
+
+		if w.OperationStatus == "DONE" {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout: %s operation is still %s", w.World, w.OperationStatus)
+		}
+		time.Sleep(*interval)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/sinmetal/sinmetalcraft/client"
+)
+
+var stdout io.Writer = os.Stdout
+
+// printJSON is APIのResponse Bodyを整形して出力する
+func printJSON(b []byte) error {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, b, "", "  "); err != nil {
+		_, err = stdout.Write(b)
+		return err
+	}
+	buf.WriteString("\n")
+	_, err := buf.WriteTo(stdout)
+	return err
+}
+
+// printValue is APIの結果をJSONで出力する
+func printValue(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return printJSON(b)
+}
+
+// printTable is headerとrowsを揃えて出力する
+func printTable(header []string, rows [][]string) error {
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		for i := range row {
+			if len(row[i]) < 1 {
+				row[i] = "-"
+			}
+		}
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// printMessage is {"message": ...} を返すAPIのResponseを出力する
+func printMessage(o *options, m client.Message) error {
+	if o.json {
+		return printValue(m)
+	}
+	_, err := fmt.Fprintln(stdout, m.Message)
+	return err
+}
+
+// lastSegment is GCEのResource URLの最後の部分を返す
+func lastSegment(s string) string {
+	i := strings.LastIndex(s, "/")
+	if i < 0 {
+		return s
+	}
+	return s[i+1:]
+}
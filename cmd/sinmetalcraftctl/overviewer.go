@@ -0,0 +1,188 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sinmetal/sinmetalcraft/client"
+)
+
+func overviewerGet(args []string) error {
+	fs, o := newFlagSet("overviewer get")
+	preview := fs.Bool("preview", false, "print the overviewer config file used by the next render")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: overviewer get WORLD [-preview]")
+	}
+
+	c := newAPIClient(o)
+	oc, err := c.GetOverviewerConfig(bg, positional[0])
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printValue(oc)
+	}
+	if *preview {
+		_, err = fmt.Fprint(stdout, oc.Preview)
+		return err
+	}
+	return printOverviewerConfig(oc)
+}
+
+// overviewerSet is 今のRender設定に指定したflagだけを上書きして置き換える
+// 次のRenderから反映される
+func overviewerSet(args []string) error {
+	fs, o := newFlagSet("overviewer set")
+	dimensions := fs.String("dimensions", "", "comma separated dimensions (overworld, nether, end)")
+	rendermodes := fs.String("rendermodes", "", "comma separated rendermodes (normal, day, night, cave, lighting)")
+	texture := fs.String("texture", "", "minecraft client version used as texture. empty is jar version of the world")
+	prefix := fs.String("prefix", "", "output prefix in the overviewer bucket. empty is the world name")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 || fs.NFlag() < 1 {
+		return fmt.Errorf("usage: overviewer set WORLD [-dimensions LIST] [-rendermodes LIST] [-texture VERSION] [-prefix PREFIX]")
+	}
+	world := positional[0]
+
+	c := newAPIClient(o)
+	oc, err := c.GetOverviewerConfig(bg, world)
+	if err != nil {
+		return err
+	}
+	req := client.OverviewerConfigPutRequest{
+		Dimensions:     oc.Dimensions,
+		Rendermodes:    oc.Rendermodes,
+		TextureVersion: oc.TextureVersion,
+		OutputPrefix:   oc.OutputPrefix,
+	}
+	// -textureと-prefixは空で元に戻せるように、指定されたかどうかで判断する
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "dimensions":
+			req.Dimensions = splitList(*dimensions)
+		case "rendermodes":
+			req.Rendermodes = splitList(*rendermodes)
+		case "texture":
+			req.TextureVersion = *texture
+		case "prefix":
+			req.OutputPrefix = *prefix
+		}
+	})
+
+	updated, err := c.UpdateOverviewerConfig(bg, world, req)
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printValue(updated)
+	}
+
+	var rows [][]string
+	for _, d := range updated.Diff {
+		rows = append(rows, []string{d.Field, fmt.Sprint(emptyIfNil(d.Before)), fmt.Sprint(emptyIfNil(d.After))})
+	}
+	if err := printTable([]string{"FIELD", "BEFORE", "AFTER"}, rows); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(stdout, "\n%s will use the new config on next render\n", world)
+	return err
+}
+
+func overviewerJobs(args []string) error {
+	fs, o := newFlagSet("overviewer jobs")
+	limit := fs.Int("limit", 0, "max jobs (server default 20)")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: overviewer jobs WORLD [-limit N]")
+	}
+
+	c := newAPIClient(o)
+	l, err := c.ListOverviewerJobs(bg, positional[0], *limit)
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printValue(l)
+	}
+
+	var rows [][]string
+	for _, j := range l.Items {
+		rows = append(rows, []string{
+			strconv.FormatInt(j.ID, 10),
+			j.Snapshot,
+			j.Trigger,
+			strconv.Itoa(j.Attempt),
+			j.Status,
+			j.CreatedAt.Local().Format("2006-01-02 15:04:05"),
+			j.Error,
+		})
+	}
+	return printTable([]string{"ID", "SNAPSHOT", "TRIGGER", "ATTEMPT", "STATUS", "CREATED", "ERROR"}, rows)
+}
+
+// overviewerRender is Cronを待たずにWorldのSnapshotをRenderする
+// 同じWorldのJobが動いている場合は409になる
+func overviewerRender(args []string) error {
+	fs, o := newFlagSet("overviewer render")
+	var req client.OverviewerJobPostRequest
+	fs.StringVar(&req.Snapshot, "snapshot", "", "snapshot of WORLD (default latest snapshot)")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: overviewer render WORLD [-snapshot NAME]")
+	}
+	world := positional[0]
+
+	c := newAPIClient(o)
+	j, err := c.CreateOverviewerJob(bg, world, req)
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printValue(j)
+	}
+	_, err = fmt.Fprintf(stdout, "overviewer job %d accepted. overviewer jobs %s\n", j.ID, world)
+	return err
+}
+
+func printOverviewerConfig(oc client.OverviewerConfig) error {
+	texture := oc.TextureVersion
+	if len(texture) < 1 {
+		texture = "(jar version)"
+	}
+	prefix := oc.OutputPrefix
+	if len(prefix) < 1 {
+		prefix = oc.World
+	}
+	return printTable([]string{"KEY", "VALUE"}, [][]string{
+		{"dimensions", strings.Join(oc.Dimensions, ",")},
+		{"rendermodes", strings.Join(oc.Rendermodes, ",")},
+		{"texture", texture},
+		{"prefix", prefix},
+	})
+}
+
+// splitList is "," 区切りの値を分ける
+func splitList(s string) []string {
+	var l []string
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if len(v) > 0 {
+			l = append(l, v)
+		}
+	}
+	return l
+}
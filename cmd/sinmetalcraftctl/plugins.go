@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/sinmetal/sinmetalcraft/client"
+)
+
+func pluginsList(args []string) error {
+	fs, o := newFlagSet("plugins list")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: plugins list WORLD")
+	}
+
+	c := newAPIClient(o)
+	l, err := c.ListWorldPlugins(bg, positional[0])
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printValue(l)
+	}
+
+	var rows [][]string
+	for _, p := range l.Items {
+		rows = append(rows, []string{
+			p.Name,
+			p.Version,
+			p.MinecraftVersion,
+			fmt.Sprint(p.Enabled),
+			p.Source,
+			strings.Join(p.Warnings, " "),
+		})
+	}
+	return printTable([]string{"NAME", "VERSION", "MINECRAFT", "ENABLED", "SOURCE", "WARNINGS"}, rows)
+}
+
+// pluginsAdd is Plugin, Modを追加する
+// -fileの場合はSHA256を計算してUploadする。-urlの場合は-sha256が必要
+func pluginsAdd(args []string) error {
+	fs, o := newFlagSet("plugins add")
+	var req client.WorldPluginPostRequest
+	fs.StringVar(&req.Name, "name", "", "plugin name")
+	fs.StringVar(&req.Version, "version", "", "plugin version")
+	fs.StringVar(&req.MinecraftVersion, "mc", "", "minecraft version the plugin is built for (e.g. 1.12 or 1.12.2)")
+	fs.StringVar(&req.URL, "url", "", "https URL of the jar")
+	fs.StringVar(&req.SHA256, "sha256", "", "sha256 of the jar (required with -url)")
+	file := fs.String("file", "", "jar to upload")
+	disabled := fs.Bool("disabled", false, "add without installing")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 || len(req.Name) < 1 || len(req.Version) < 1 || (len(req.URL) > 0) == (len(*file) > 0) {
+		return fmt.Errorf("usage: plugins add WORLD -name NAME -version VERSION (-file PATH | -url URL -sha256 SHA256) [-mc VERSION] [-disabled]")
+	}
+	world := positional[0]
+	if *disabled {
+		enabled := false
+		req.Enabled = &enabled
+	}
+
+	var f *os.File
+	var size int64
+	if len(*file) > 0 {
+		f, err = os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		size, err = io.Copy(h, f)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		req.SHA256 = hex.EncodeToString(h.Sum(nil))
+	}
+
+	c := newAPIClient(o)
+	res, err := c.CreateWorldPlugin(bg, world, req)
+	if err != nil {
+		return err
+	}
+	if f != nil {
+		if !o.json {
+			fmt.Fprintf(stdout, "uploading %s (%d bytes)\n", *file, size)
+		}
+		if err := c.UploadPlugin(bg, res, f, size); err != nil {
+			return err
+		}
+	}
+	return printPluginResponse(o, world, res, "added")
+}
+
+func pluginsEnable(args []string) error {
+	return pluginsSetEnabled("plugins enable", args, true)
+}
+
+func pluginsDisable(args []string) error {
+	return pluginsSetEnabled("plugins disable", args, false)
+}
+
+// pluginsSetEnabled is Pluginを消さずに、次の起動でInstallするかを切り替える
+func pluginsSetEnabled(name string, args []string, enabled bool) error {
+	fs, o := newFlagSet(name)
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		return fmt.Errorf("usage: %s WORLD NAME", name)
+	}
+
+	c := newAPIClient(o)
+	res, err := c.UpdateWorldPlugin(bg, positional[0], positional[1], client.WorldPluginPutRequest{Enabled: &enabled})
+	if err != nil {
+		return err
+	}
+	action := "enabled"
+	if !enabled {
+		action = "disabled"
+	}
+	return printPluginResponse(o, positional[0], res, action)
+}
+
+func pluginsRemove(args []string) error {
+	fs, o := newFlagSet("plugins remove")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		return fmt.Errorf("usage: plugins remove WORLD NAME")
+	}
+
+	c := newAPIClient(o)
+	res, err := c.DeleteWorldPlugin(bg, positional[0], positional[1])
+	if err != nil {
+		return err
+	}
+	return printPluginResponse(o, positional[0], res, "removed")
+}
+
+func printPluginResponse(o *options, world string, res client.WorldPluginResponse, action string) error {
+	if o.json {
+		return printValue(res)
+	}
+	fmt.Fprintf(stdout, "%s %s %s\n", res.Plugin.Name, res.Plugin.Version, action)
+	for _, w := range res.Plugin.Warnings {
+		fmt.Fprintf(stdout, "warning: %s\n", w)
+	}
+	if res.RestartRequired {
+		fmt.Fprintf(stdout, "%s will apply the change on next start\n", world)
+	}
+	return nil
+}
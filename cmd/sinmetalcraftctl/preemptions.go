@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+)
+
+func preemptionsList(args []string) error {
+	fs, o := newFlagSet("preemptions list")
+	limit := fs.Int("limit", 0, "max preemptions (server default 20)")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: preemptions list WORLD [-limit N]")
+	}
+
+	c := newAPIClient(o)
+	l, err := c.ListWorldPreemptions(bg, positional[0], *limit)
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printValue(l)
+	}
+
+	var rows [][]string
+	for _, p := range l.Items {
+		rows = append(rows, []string{
+			p.PreemptedAt.Local().Format("2006-01-02 15:04:05"),
+			p.Instance,
+			p.Zone,
+			fmt.Sprint(p.InPlayWindow),
+			p.Status,
+			p.Error,
+		})
+	}
+	return printTable([]string{"PREEMPTED", "INSTANCE", "ZONE", "PLAY WINDOW", "STATUS", "ERROR"}, rows)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sinmetal/sinmetalcraft/client"
+)
+
+func propertiesGet(args []string) error {
+	fs, o := newFlagSet("properties get")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: properties get WORLD")
+	}
+
+	c := newAPIClient(o)
+	sp, err := c.GetServerProperties(bg, positional[0])
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printValue(sp)
+	}
+	return printProperties(sp.Properties)
+}
+
+// propertiesSet is 今のserver.propertiesにKEY=VALUEを足して、-unsetのKeyを消してから置き換える
+// Serverが次に起動した時に反映される
+func propertiesSet(args []string) error {
+	fs, o := newFlagSet("properties set")
+	unset := fs.String("unset", "", "comma separated keys to remove")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) < 1 || (len(positional) < 2 && len(*unset) < 1) {
+		return fmt.Errorf("usage: properties set WORLD KEY=VALUE... [-unset KEY,...]")
+	}
+	world := positional[0]
+
+	c := newAPIClient(o)
+	sp, err := c.GetServerProperties(bg, world)
+	if err != nil {
+		return err
+	}
+	properties := sp.Properties
+	if properties == nil {
+		properties = make(map[string]string)
+	}
+	for _, kv := range positional[1:] {
+		i := strings.Index(kv, "=")
+		if i < 1 {
+			return fmt.Errorf("%q is not KEY=VALUE", kv)
+		}
+		properties[kv[:i]] = kv[i+1:]
+	}
+	for _, k := range strings.Split(*unset, ",") {
+		delete(properties, strings.TrimSpace(k))
+	}
+
+	updated, err := c.UpdateServerProperties(bg, world, client.ServerPropertiesPutRequest{Properties: properties})
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printValue(updated)
+	}
+
+	var rows [][]string
+	for _, d := range updated.Diff {
+		rows = append(rows, []string{d.Field, fmt.Sprint(emptyIfNil(d.Before)), fmt.Sprint(emptyIfNil(d.After))})
+	}
+	if err := printTable([]string{"KEY", "BEFORE", "AFTER"}, rows); err != nil {
+		return err
+	}
+	if updated.RestartRequired {
+		_, err = fmt.Fprintf(stdout, "\n%s will use the new properties on next start\n", world)
+	}
+	return err
+}
+
+func printProperties(properties map[string]string) error {
+	var keys []string
+	for k := range properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var rows [][]string
+	for _, k := range keys {
+		rows = append(rows, []string{k, properties[k]})
+	}
+	return printTable([]string{"KEY", "VALUE"}, rows)
+}
+
+func emptyIfNil(v interface{}) interface{} {
+	if v == nil {
+		return ""
+	}
+	return v
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+)
+
+// reconcileRun is DatastoreのWorldとGCEを比べて直す
+// -dry-runを付けると直さずに見つけたものだけを表示する
+func reconcileRun(args []string) error {
+	fs, o := newFlagSet("reconcile run")
+	dryRun := fs.Bool("dry-run", false, "report findings without fixing them")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return fmt.Errorf("usage: reconcile run [-dry-run]")
+	}
+
+	c := newAPIClient(o)
+	report, err := c.Reconcile(bg, *dryRun)
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printValue(report)
+	}
+
+	var rows [][]string
+	for _, f := range report.Findings {
+		result := "report only"
+		switch {
+		case len(f.Error) > 0:
+			result = "failed: " + f.Error
+		case f.Fixed:
+			result = "fixed"
+		case len(f.Fix) > 0:
+			result = "would fix"
+		}
+		rows = append(rows, []string{
+			f.World,
+			f.Kind,
+			f.Resource,
+			f.Zone,
+			f.Message,
+			f.Fix,
+			result,
+		})
+	}
+	if err := printTable([]string{"WORLD", "KIND", "RESOURCE", "ZONE", "MESSAGE", "FIX", "RESULT"}, rows); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(stdout, "\n%d worlds, %d instances, %d disks, %d snapshots. %d findings, fixed %d, %d need attention.\n", report.Worlds, report.Instances, report.Disks, report.Snapshots, len(report.Findings), report.Fixed, report.Unresolved)
+	return err
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// reindexRun is 全てのWorldをPutし直して、後からindexにしたPropertyをQueryで使えるようにする
+func reindexRun(args []string) error {
+	fs, o := newFlagSet("reindex run")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return fmt.Errorf("usage: reindex run")
+	}
+
+	c := newAPIClient(o)
+	report, err := c.Reindex(bg)
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printValue(report)
+	}
+	_, err = fmt.Fprintf(stdout, "reindexed %d/%d worlds.\n", report.Reindexed, report.Worlds)
+	if err != nil {
+		return err
+	}
+	if len(report.Failed) > 0 {
+		return fmt.Errorf("reindex failed: %s", strings.Join(report.Failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sinmetal/sinmetalcraft/client"
+)
+
+func serverList(args []string) error {
+	fs, o := newFlagSet("server list")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	c := newAPIClient(o)
+	l, err := c.ListServers(bg)
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printValue(l)
+	}
+
+	var rows [][]string
+	for _, ins := range l.Items {
+		rows = append(rows, []string{
+			ins.InstanceName,
+			lastSegment(ins.Zone),
+			ins.Status,
+			ins.IPAddr,
+			ins.CreationTimestamp,
+		})
+	}
+	return printTable([]string{"INSTANCE", "ZONE", "STATUS", "IP", "CREATED"}, rows)
+}
+
+// serverStart is Instanceが無ければLatestSnapshotから作成し、停止中であれば起動する
+func serverStart(args []string) error {
+	fs, o := newFlagSet("server start")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: server start WORLD")
+	}
+
+	c := newAPIClient(o)
+	w, err := c.GetWorld(bg, positional[0])
+	if err != nil {
+		return err
+	}
+
+	var m client.Message
+	if w.Status == "exists" {
+		m, err = c.UpdateServer(bg, client.ServerPutRequest{Key: w.Key, Operation: client.ServerOperationStart})
+	} else {
+		m, err = c.CreateServer(bg, client.ServerPostRequest{Key: w.Key})
+	}
+	if err != nil {
+		return err
+	}
+	return printMessage(o, m)
+}
+
+func serverReset(args []string) error {
+	fs, o := newFlagSet("server reset")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: server reset WORLD")
+	}
+
+	c := newAPIClient(o)
+	w, err := c.GetWorld(bg, positional[0])
+	if err != nil {
+		return err
+	}
+
+	m, err := c.UpdateServer(bg, client.ServerPutRequest{Key: w.Key, Operation: client.ServerOperationReset})
+	if err != nil {
+		return err
+	}
+	return printMessage(o, m)
+}
+
+// serverStop is Playerに知らせてからServerを止める
+// 停止後にWorldのSnapshotを作成してInstanceを削除するので、完了は ops watch で確認する
+func serverStop(args []string) error {
+	fs, o := newFlagSet("server stop")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: server stop WORLD")
+	}
+
+	c := newAPIClient(o)
+	w, err := c.GetWorld(bg, positional[0])
+	if err != nil {
+		return err
+	}
+
+	m, err := c.UpdateServer(bg, client.ServerPutRequest{Key: w.Key, Operation: client.ServerOperationStop})
+	if err != nil {
+		return err
+	}
+	return printMessage(o, m)
+}
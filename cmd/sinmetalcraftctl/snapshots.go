@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sinmetal/sinmetalcraft/client"
+)
+
+func snapshotsList(args []string) error {
+	fs, o := newFlagSet("snapshots list")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 1 {
+		return fmt.Errorf("usage: snapshots list [WORLD]")
+	}
+
+	var world string
+	if len(positional) == 1 {
+		world = positional[0]
+	}
+
+	c := newAPIClient(o)
+	l, err := c.ListSnapshots(bg, world, "")
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printValue(l)
+	}
+
+	var rows [][]string
+	for _, s := range l.Items {
+		rows = append(rows, []string{
+			s.Name,
+			s.World,
+			s.Label,
+			s.Status,
+			fmt.Sprintf("%d", s.DiskSizeGb),
+			fmt.Sprintf("%.1f", float64(s.StorageBytes)/1024/1024/1024),
+			s.CreationTimestamp,
+		})
+	}
+	return printTable([]string{"NAME", "WORLD", "LABEL", "STATUS", "DISK GB", "STORAGE GB", "CREATED"}, rows)
+}
+
+func snapshotsCreate(args []string) error {
+	fs, o := newFlagSet("snapshots create")
+	label := fs.String("label", "", "snapshot label (lowercase letters, numbers, - and _)")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: snapshots create WORLD [-label LABEL]")
+	}
+
+	c := newAPIClient(o)
+	res, err := c.CreateSnapshot(bg, positional[0], client.SnapshotPostRequest{Label: *label})
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printValue(res)
+	}
+	_, err = fmt.Fprintln(stdout, res.Message)
+	return err
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/sinmetal/sinmetalcraft/client"
+)
+
+// versionsList is jarVersionに使えるVersionを調べる
+// jarVersionに指定できるのはstatusがmirroredのVersionだけ
+func versionsList(args []string) error {
+	fs, o := newFlagSet("versions list")
+	var opts client.ListVersionsOptions
+	fs.StringVar(&opts.Type, "type", "", "filter by type (release or snapshot)")
+	fs.StringVar(&opts.Status, "status", "", "filter by status (listed, mirrored, unavailable or failed)")
+	fs.IntVar(&opts.Limit, "limit", 0, "max versions (server default 50)")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return fmt.Errorf("usage: versions list [-type TYPE] [-status STATUS] [-limit N]")
+	}
+
+	c := newAPIClient(o)
+	l, err := c.ListVersions(bg, opts)
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printValue(l)
+	}
+
+	var rows [][]string
+	for _, v := range l.Items {
+		rows = append(rows, []string{
+			v.ID,
+			v.Type,
+			v.Status,
+			strconv.FormatInt(v.ServerSize, 10),
+			v.ReleaseTime.Local().Format("2006-01-02 15:04:05"),
+			v.Error,
+		})
+	}
+	return printTable([]string{"ID", "TYPE", "STATUS", "SIZE", "RELEASED", "ERROR"}, rows)
+}
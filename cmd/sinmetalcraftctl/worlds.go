@@ -0,0 +1,367 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sinmetal/sinmetalcraft/client"
+)
+
+func worldsList(args []string) error {
+	fs, o := newFlagSet("worlds list")
+	var opts client.ListWorldsOptions
+	fs.IntVar(&opts.Limit, "limit", 0, "max worlds per page (server default 20)")
+	fs.StringVar(&opts.Cursor, "cursor", "", "cursor of the next page")
+	fs.StringVar(&opts.Status, "status", "", "filter by status")
+	fs.StringVar(&opts.Zone, "zone", "", "filter by GCE zone")
+	fs.StringVar(&opts.JarVersion, "jar", "", "filter by minecraft server jar version")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	c := newAPIClient(o)
+	l, err := c.ListWorlds(bg, opts)
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printValue(l)
+	}
+
+	var rows [][]string
+	for _, w := range l.Items {
+		rows = append(rows, []string{
+			w.World,
+			w.Zone,
+			w.JarVersion,
+			w.ServerType,
+			provisioningOf(w),
+			w.Status,
+			w.OperationType,
+			w.OperationStatus,
+			w.IPAddr,
+			w.LatestSnapshot,
+		})
+	}
+	if err := printTable([]string{"WORLD", "ZONE", "JAR", "TYPE", "VM", "STATUS", "OPERATION", "OPERATION STATUS", "IP", "LATEST SNAPSHOT"}, rows); err != nil {
+		return err
+	}
+	if l.HasNext {
+		_, err = fmt.Fprintf(stdout, "\nnext page: worlds list -cursor %s\n", l.Cursor)
+	}
+	return err
+}
+
+func worldsCreate(args []string) error {
+	fs, o := newFlagSet("worlds create")
+	var w client.Minecraft
+	fs.StringVar(&w.World, "world", "", "world name")
+	fs.StringVar(&w.Zone, "zone", "asia-northeast1-b", "GCE zone")
+	fs.StringVar(&w.JarVersion, "jar", "", "minecraft server jar version")
+	fs.StringVar(&w.ServerType, "type", client.ServerTypeVanilla, "server type (vanilla, paper, fabric or forge)")
+	fs.StringVar(&w.ServerBuild, "build", "", "paper build, fabric loader version or forge version")
+	fs.StringVar(&w.LatestSnapshot, "snapshot", "", "snapshot to create world disk from")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if len(w.World) < 1 {
+		return fmt.Errorf("-world is required")
+	}
+	if len(w.JarVersion) < 1 {
+		return fmt.Errorf("-jar is required")
+	}
+
+	c := newAPIClient(o)
+	created, err := c.CreateWorld(bg, w)
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printValue(created)
+	}
+	_, err = fmt.Fprintf(stdout, "%s created\n", created.World)
+	return err
+}
+
+func worldsUpdate(args []string) error {
+	fs, o := newFlagSet("worlds update")
+	zone := fs.String("zone", "", "GCE zone")
+	jar := fs.String("jar", "", "minecraft server jar version")
+	serverType := fs.String("type", "", "server type (vanilla, paper, fabric or forge)")
+	build := fs.String("build", "", "paper build, fabric loader version or forge version")
+	ip := fs.String("ip", "", "IP address")
+	playWindows := fs.String("play-windows", "", `semicolon separated play windows in Asia/Tokyo (e.g. "sat,sun 10:00-23:00;daily 20:00-24:00"). empty clears`)
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: worlds update WORLD [-zone ZONE] [-jar VERSION] [-type TYPE -build BUILD] [-ip ADDR] [-play-windows WINDOWS]")
+	}
+
+	c := newAPIClient(o)
+	w, err := c.GetWorld(bg, positional[0])
+	if err != nil {
+		return err
+	}
+	if len(*zone) > 0 {
+		w.Zone = *zone
+	}
+	if len(*jar) > 0 {
+		w.JarVersion = *jar
+	}
+	// vanillaに戻す時はBuildを空にする必要があるので、-typeを指定した時は-buildも指定した値にする
+	if len(*serverType) > 0 {
+		w.ServerType = *serverType
+		w.ServerBuild = *build
+	} else if len(*build) > 0 {
+		w.ServerBuild = *build
+	}
+	if len(*ip) > 0 {
+		w.IPAddr = *ip
+	}
+	// 空で消せるように、指定されたかどうかで判断する
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "play-windows" {
+			w.PlayWindows = splitPlayWindows(*playWindows)
+		}
+	})
+
+	updated, err := c.UpdateWorld(bg, w)
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printValue(updated)
+	}
+	_, err = fmt.Fprintf(stdout, "%s updated\n", w.World)
+	return err
+}
+
+func worldsDelete(args []string) error {
+	fs, o := newFlagSet("worlds delete")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: worlds delete WORLD")
+	}
+
+	c := newAPIClient(o)
+	w, err := c.GetWorld(bg, positional[0])
+	if err != nil {
+		return err
+	}
+
+	if err := c.DeleteWorld(bg, w.Key); err != nil {
+		return err
+	}
+	if o.json {
+		return printValue(struct{}{})
+	}
+	_, err = fmt.Fprintf(stdout, "%s deleted\n", w.World)
+	return err
+}
+
+func worldsClone(args []string) error {
+	fs, o := newFlagSet("worlds clone")
+	var req client.MinecraftCloneRequest
+	fs.StringVar(&req.World, "world", "", "new world name")
+	fs.StringVar(&req.Snapshot, "snapshot", "", "snapshot of WORLD (default latest snapshot)")
+	fs.StringVar(&req.Zone, "zone", "", "GCE zone (default same as WORLD)")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: worlds clone WORLD -world NAME [-snapshot NAME] [-zone ZONE]")
+	}
+	if len(req.World) < 1 {
+		return fmt.Errorf("-world is required")
+	}
+
+	c := newAPIClient(o)
+	created, err := c.CloneWorld(bg, positional[0], req)
+	if err != nil {
+		return err
+	}
+	if o.json {
+		return printValue(created)
+	}
+	_, err = fmt.Fprintf(stdout, "%s created from %s\n", created.World, created.LatestSnapshot)
+	return err
+}
+
+// worldsImport is ArchiveをUploadしてWorldを作る
+// -waitを付けるとImportが終わるまでpollingする
+func worldsImport(args []string) error {
+	fs, o := newFlagSet("worlds import")
+	file := fs.String("file", "", "world archive (.zip, .tar.gz or .tgz) containing level.dat and region/")
+	var req client.WorldImportPostRequest
+	fs.StringVar(&req.Zone, "zone", "asia-northeast1-b", "GCE zone")
+	fs.StringVar(&req.JarVersion, "jar", "", "minecraft server jar version")
+	wait := fs.Bool("wait", false, "wait until import is done")
+	interval := fs.Duration("interval", 30*time.Second, "polling interval with -wait")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: worlds import WORLD -file PATH -jar VERSION [-zone ZONE] [-wait]")
+	}
+	if len(req.JarVersion) < 1 {
+		return fmt.Errorf("-jar is required")
+	}
+	req.Format, err = archiveFormat(*file)
+	if err != nil {
+		return err
+	}
+	world := positional[0]
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	c := newAPIClient(o)
+	upload, err := c.CreateWorldImport(bg, world, req)
+	if err != nil {
+		return err
+	}
+	if !o.json {
+		fmt.Fprintf(stdout, "uploading %s (%d bytes)\n", *file, st.Size())
+	}
+	if err := c.UploadWorldArchive(bg, upload, f, st.Size()); err != nil {
+		return err
+	}
+	imp, err := c.StartWorldImport(bg, world)
+	if err != nil {
+		return err
+	}
+
+	var last string
+	for {
+		if imp.Status != last {
+			if o.json {
+				if err := printValue(imp); err != nil {
+					return err
+				}
+			} else {
+				fmt.Fprintf(stdout, "%s\t%s\tstatus=%s\n", time.Now().Format("15:04:05"), imp.World, imp.Status)
+			}
+			last = imp.Status
+		}
+		if !*wait || imp.Status == client.WorldImportStatusDone {
+			return nil
+		}
+		if imp.Status == client.WorldImportStatusFailed {
+			return fmt.Errorf("import failed: %s", imp.Error)
+		}
+		time.Sleep(*interval)
+
+		imp, err = c.GetWorldImport(bg, world)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// archiveFormat is 拡張子からWorldImportのformatを決める
+func archiveFormat(file string) (string, error) {
+	switch {
+	case len(file) < 1:
+		return "", fmt.Errorf("-file is required")
+	case strings.HasSuffix(file, ".zip"):
+		return "zip", nil
+	case strings.HasSuffix(file, ".tar.gz"), strings.HasSuffix(file, ".tgz"):
+		return "tar.gz", nil
+	}
+	return "", fmt.Errorf("%s is not .zip, .tar.gz or .tgz", file)
+}
+
+// worldsUpgrade is Upgrade前のSnapshotを作ってから新しいVersionで起動する
+// 起動に失敗した場合はServer側で元のVersionに戻す。-waitを付けると終わるまでpollingする
+func worldsUpgrade(args []string) error {
+	fs, o := newFlagSet("worlds upgrade")
+	var req client.WorldUpgradePostRequest
+	fs.StringVar(&req.JarVersion, "jar", "", "minecraft server jar version")
+	fs.StringVar(&req.ServerBuild, "build", "", "server build for the new version. required unless the world is vanilla")
+	wait := fs.Bool("wait", false, "wait until upgrade is done or rolled back")
+	interval := fs.Duration("interval", 30*time.Second, "polling interval with -wait")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: worlds upgrade WORLD -jar VERSION [-build BUILD] [-wait]")
+	}
+	if len(req.JarVersion) < 1 {
+		return fmt.Errorf("-jar is required")
+	}
+	world := positional[0]
+
+	c := newAPIClient(o)
+	u, err := c.CreateWorldUpgrade(bg, world, req)
+	if err != nil {
+		return err
+	}
+
+	var last string
+	for {
+		if u.Status != last {
+			if o.json {
+				if err := printValue(u); err != nil {
+					return err
+				}
+			} else {
+				fmt.Fprintf(stdout, "%s\t%s\t%s -> %s\tstatus=%s\n", time.Now().Format("15:04:05"), u.World, u.FromVersion, u.ToVersion, u.Status)
+			}
+			last = u.Status
+		}
+		if !*wait || u.Status == client.WorldUpgradeStatusDone {
+			return nil
+		}
+		if u.Status == client.WorldUpgradeStatusRolledBack {
+			return fmt.Errorf("upgrade rolled back to %s: %s", u.FromVersion, u.Error)
+		}
+		if u.Status == client.WorldUpgradeStatusFailed {
+			return fmt.Errorf("upgrade failed: %s", u.Error)
+		}
+		time.Sleep(*interval)
+
+		u, err = c.GetWorldUpgrade(bg, world)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// splitPlayWindows is ";" 区切りのPlayWindowを分ける
+// 空の場合もPlayWindowsを消すために空のSliceを返す
+func splitPlayWindows(s string) []string {
+	windows := []string{}
+	for _, w := range strings.Split(s, ";") {
+		w = strings.TrimSpace(w)
+		if len(w) > 0 {
+			windows = append(windows, w)
+		}
+	}
+	return windows
+}
+
+// provisioningOf is 空の場合はpreemptibleとして表示する
+func provisioningOf(w client.Minecraft) string {
+	if len(w.Provisioning) < 1 {
+		return client.ProvisioningPreemptible
+	}
+	return w.Provisioning
+}
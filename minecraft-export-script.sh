@@ -0,0 +1,26 @@
+#!/bin/bash
+# World Export用Instanceのstartup-script
+# Snapshotから作ったDiskをtar.gzにしてUploadし、Metadataのexport-stateをdoneにする。Instanceの削除はApp Engineが行う
+ATTRIBUTES=http://metadata/computeMetadata/v1/instance/attributes
+EXPORT_DISK=$(curl $ATTRIBUTES/export-disk -H "Metadata-Flavor: Google")
+EXPORT_OBJECT=$(curl $ATTRIBUTES/export-object -H "Metadata-Flavor: Google")
+INSTANCE_ZONE=$(curl http://metadata/computeMetadata/v1/instance/zone -H "Metadata-Flavor: Google")
+INSTANCE_ZONE=${INSTANCE_ZONE##*/}
+
+fail() {
+  echo "EXPORT ERROR: $1"
+  gcloud compute instances add-metadata $HOSTNAME --zone=$INSTANCE_ZONE --metadata export-state=error,export-error="$1"
+  exit 1
+}
+
+# DiskはREAD_ONLYでAttachしているので、journalを再生せずにmountする
+WORLD_DISK=/dev/disk/by-id/google-$EXPORT_DISK
+sudo mkdir -p /mnt/world
+sudo mount -o ro,noload $WORLD_DISK /mnt/world || fail "mount failed"
+
+sudo tar -czf /tmp/world.tar.gz -C /mnt/world --exclude=./session.lock --exclude=./lost+found . || fail "tar failed"
+SIZE=$(stat -c %s /tmp/world.tar.gz)
+sudo gsutil cp /tmp/world.tar.gz $EXPORT_OBJECT || fail "upload failed"
+
+sudo umount /mnt/world
+gcloud compute instances add-metadata $HOSTNAME --zone=$INSTANCE_ZONE --metadata export-size=$SIZE,export-state=done
@@ -0,0 +1,44 @@
+#!/bin/bash
+# World Import用Instanceのstartup-script
+# ArchiveをDiskに展開して、Metadataのimport-stateをdoneにする。Snapshotの作成とInstanceの削除はApp Engineが行う
+ATTRIBUTES=http://metadata/computeMetadata/v1/instance/attributes
+ARCHIVE=$(curl $ATTRIBUTES/archive -H "Metadata-Flavor: Google")
+FORMAT=$(curl $ATTRIBUTES/archive-format -H "Metadata-Flavor: Google")
+ROOT=$(curl $ATTRIBUTES/archive-root -H "Metadata-Flavor: Google")
+IMPORT_DISK=$(curl $ATTRIBUTES/import-disk -H "Metadata-Flavor: Google")
+INSTANCE_ZONE=$(curl http://metadata/computeMetadata/v1/instance/zone -H "Metadata-Flavor: Google")
+INSTANCE_ZONE=${INSTANCE_ZONE##*/}
+
+fail() {
+  echo "IMPORT ERROR: $1"
+  gcloud compute instances add-metadata $HOSTNAME --zone=$INSTANCE_ZONE --metadata import-state=error,import-error="$1"
+  exit 1
+}
+
+WORLD_DISK=/dev/disk/by-id/google-$IMPORT_DISK
+sudo mkfs.ext4 -F -E lazy_itable_init=0,lazy_journal_init=0,discard $WORLD_DISK || fail "mkfs failed"
+sudo mkdir -p /mnt/world
+sudo mount -o discard,defaults $WORLD_DISK /mnt/world || fail "mount failed"
+
+sudo gsutil cp $ARCHIVE /tmp/world-archive || fail "archive download failed"
+# 同じDiskに展開してからmvするので、Archiveの中のDirectoryの分だけ容量が増えることは無い
+sudo mkdir /mnt/world/.import
+case $FORMAT in
+  zip)
+    which unzip > /dev/null || sudo apt-get install -y unzip
+    sudo unzip -q /tmp/world-archive -d /mnt/world/.import || fail "unzip failed"
+    ;;
+  tar.gz)
+    sudo tar -xzf /tmp/world-archive -C /mnt/world/.import --no-same-owner || fail "tar failed"
+    ;;
+  *)
+    fail "unknown format $FORMAT"
+    ;;
+esac
+sudo find "/mnt/world/.import/$ROOT" -mindepth 1 -maxdepth 1 -exec mv -t /mnt/world {} + || fail "move failed"
+sudo rm -rf /mnt/world/.import /tmp/world-archive
+sudo rm -f /mnt/world/session.lock
+
+sync
+sudo umount /mnt/world || fail "umount failed"
+gcloud compute instances add-metadata $HOSTNAME --zone=$INSTANCE_ZONE --metadata import-state=done
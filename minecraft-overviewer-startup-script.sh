@@ -1,28 +1,28 @@
 #!/bin/bash
+# Overviewer用Instanceのstartup-script
+# SnapshotからRenderしてUploadし、進み具合をMetadataのoverviewer-stateに書く。Instanceの削除はApp Engineが行う
 cd /home/minecraft
-sudo /usr/share/google/safe_format_and_mount /dev/sdb /home/minecraft/world/
-sudo rm world/session.lock
-WORLD=$(curl http://metadata/computeMetadata/v1/instance/attributes/world -H "Metadata-Flavor: Google")
-MC_VERSION=$(curl http://metadata/computeMetadata/v1/instance/attributes/minecraft-version -H "Metadata-Flavor: Google")
-sudo gsutil cp "gs://sinmetalcraft-overviewer/client/*" /home/minecraft
-sudo echo 'worlds["'$WORLD'"] = "/home/minecraft/world"' >> minecraft-overviwer.config
-sudo echo 'renders["normalrender"] = {' >> minecraft-overviwer.config
-sudo echo '"world": "'$WORLD'",' >> minecraft-overviwer.config
-sudo echo '"title": "'$WORLD'",' >> minecraft-overviwer.config
-sudo echo '}' >> minecraft-overviwer.config
-sudo echo 'texturepath = "/home/minecraft/minecraft_client.'$MC_VERSION.jar'"' >> minecraft-overviwer.config
-sudo echo 'outputdir = "/home/minecraft/overviewer/'$WORLD'"' >> minecraft-overviwer.config
+INSTANCE_ZONE=$(curl http://metadata/computeMetadata/v1/instance/zone -H "Metadata-Flavor: Google")
+INSTANCE_ZONE=${INSTANCE_ZONE##*/}
 
-sudo overviewer.py --config=/home/minecraft/minecraft-overviwer.config
-gsutil -m -h "Cache-Control: public,max-age=3600" cp -a public-read -r overviewer/$WORLD gs://sinmetalcraft-overviewer
+fail() {
+  echo "OVERVIEWER ERROR: $1"
+  gcloud compute instances add-metadata $HOSTNAME --zone=$INSTANCE_ZONE --metadata overviewer-state=error,overviewer-error="$1"
+  exit 1
+}
 
-INSTANCE_NAME=$(curl http://metadata/computeMetadata/v1/instance/name -H "Metadata-Flavor: Google")
-INSTANCE_ZONE=$(curl http://metadata/computeMetadata/v1/instance/zone -H "Metadata-Flavor: Google")
+gcloud compute instances add-metadata $HOSTNAME --zone=$INSTANCE_ZONE --metadata overviewer-state=rendering
+
+sudo /usr/share/google/safe_format_and_mount /dev/sdb /home/minecraft/world/ || fail "mount failed"
+sudo rm world/session.lock
+OUTPUT=$(curl http://metadata/computeMetadata/v1/instance/attributes/overviewer-output -H "Metadata-Flavor: Google")
+sudo gsutil cp "gs://sinmetalcraft-overviewer/client/*" /home/minecraft || fail "client download failed"
+# 設定ファイルはApp EngineがWorldのOverviewerConfigから作ってMetadataで渡す
+sudo curl -f -o minecraft-overviwer.config http://metadata/computeMetadata/v1/instance/attributes/overviewer-config -H "Metadata-Flavor: Google" || fail "config download failed"
+
+sudo overviewer.py --config=/home/minecraft/minecraft-overviwer.config || fail "render failed"
 
-echo $INSTANCE_NAME
+gcloud compute instances add-metadata $HOSTNAME --zone=$INSTANCE_ZONE --metadata overviewer-state=uploading
+gsutil -m -h "Cache-Control: public,max-age=3600" rsync -a public-read -r overviewer/output $OUTPUT || fail "upload failed"
 
-IFS='/'
-set -- $INSTANCE_ZONE
-INSTANCE_ZONE=$4
-echo $INSTANCE_ZONE
-yes | gcloud compute instances delete $INSTANCE_NAME --zone $INSTANCE_ZONE
+gcloud compute instances add-metadata $HOSTNAME --zone=$INSTANCE_ZONE --metadata overviewer-state=done
@@ -0,0 +1,27 @@
+#!/bin/bash
+# Metadataのflush-requestが変わったらWorldをDiskに書き出して、flush-doneに同じ値を書く
+# App Engineはflush-doneを見てからSnapshotを作成し、作成が終わるとflush-requestを消す
+# flush-requestが消えるか10分経ったらWorldの書き込みを再開する
+MD=http://metadata/computeMetadata/v1/instance
+ZONE=$(curl -s $MD/zone -H "Metadata-Flavor: Google" | awk -F/ '{print $NF}')
+LAST=""
+while true; do
+  REQ=$(curl -sf $MD/attributes/flush-request -H "Metadata-Flavor: Google")
+  if [ -n "${REQ}" ] && [ "${REQ}" != "${LAST}" ]; then
+    sudo screen -S mcs -X stuff 'save-off\n'
+    sudo screen -S mcs -X stuff 'save-all flush\n'
+    sleep 10
+    sync
+    gcloud compute instances add-metadata $HOSTNAME --zone=$ZONE --metadata flush-done=$REQ
+    LAST=$REQ
+    for i in $(seq 1 120); do
+      CUR=$(curl -sf $MD/attributes/flush-request -H "Metadata-Flavor: Google")
+      if [ "${CUR}" != "${REQ}" ]; then
+        break
+      fi
+      sleep 5
+    done
+    sudo screen -S mcs -X stuff 'save-on\n'
+  fi
+  sleep 5
+done
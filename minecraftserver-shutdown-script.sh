@@ -1,5 +1,22 @@
 #!/bin/bash
-sudo screen -r -X stuff '/stop\n'
+# Playerに停止を知らせてから、Worldを保存してMinecraft Serverを止める
+# Preemptの場合は30秒しか猶予がないので、待たずに止める
+# Preemptのメッセージはログ経由でApp Engineにも届き、Preemptの記録と再起動に使う
+PREEMPTED=$(curl http://metadata/computeMetadata/v1/instance/preempted -H "Metadata-Flavor: Google")
+if [ "${PREEMPTED}" != "TRUE" ]; then
+  sudo screen -S mcs -X stuff 'say Server will stop in 10 seconds.\n'
+  sleep 10
+else
+  sudo screen -S mcs -X stuff 'say sinmetalcraft: this server is being preempted by GCE. it will restart automatically during play time.\n'
+fi
+sudo screen -S mcs -X stuff 'save-all\n'
+sleep 3
+sudo screen -S mcs -X stuff 'stop\n'
+for i in $(seq 1 30); do
+  pgrep -f nogui > /dev/null || break
+  sleep 1
+done
+sync
 cd /home/minecraft
 sudo tar cvf world.tar world
 WORLD=$(curl http://metadata/computeMetadata/v1/instance/attributes/world -H "Metadata-Flavor: Google")
@@ -1,8 +1,4 @@
 #!/bin/bash
-# Update Cloud DNS
-sudo gsutil cp gs://sinmetalcraft-minecraft-shell/dns.sh .
-sudo chmod 700 dns.sh
-sudo ./dns.sh
 # Minecraft Server Start
 cd /home/minecraft
 sudo gsutil cp gs://sinmetalcraft-minecraft-shell/ops.json .
@@ -18,14 +14,90 @@ MC_JAR=$MC_APP$MC_VERSION$JAR
 GCS_BUCKET=gs://sinmetalcraft-minecraft-jar/
 GCS_MC_JAR_PATH=$GCS_BUCKET$MC_JAR
 sudo gsutil cp $GCS_MC_JAR_PATH .
+# Server Type (vanilla, paper, fabric, forge)
+# server-* が無い古いInstanceはvanillaとして起動する
+md() {
+  curl -sf http://metadata/computeMetadata/v1/instance/attributes/$1 -H "Metadata-Flavor: Google"
+}
+SERVER_TYPE=$(md server-type)
+SERVER_TYPE=${SERVER_TYPE:-vanilla}
+SERVER_BUILD=$(md server-build)
+SERVER_DOWNLOAD=$(md server-download)
+SERVER_DOWNLOAD_FILE=$(md server-download-file)
+SERVER_INSTALL_ARGS=$(md server-install-args)
+SERVER_LAUNCH_ARGS=$(md server-launch-args)
+SERVER_LAUNCH_ARGS=${SERVER_LAUNCH_ARGS:-"-jar $MC_JAR nogui"}
+# Fabric InstallerはServer Jarを server.jar として探す
+if [ ${SERVER_TYPE} = "fabric" ]; then
+  sudo cp $MC_JAR server.jar
+fi
+# Type, Version, Buildが変わった時だけDownloadしてInstallする
+SERVER_INSTALLED="$SERVER_TYPE $MC_VERSION $SERVER_BUILD"
+if [ ${SERVER_TYPE} != "vanilla" ] && [ "$(cat .server-installed 2>/dev/null)" != "$SERVER_INSTALLED" ]; then
+  case $SERVER_DOWNLOAD in
+    gs://*) sudo gsutil cp $SERVER_DOWNLOAD $SERVER_DOWNLOAD_FILE ;;
+    *) sudo curl -sfL -o $SERVER_DOWNLOAD_FILE $SERVER_DOWNLOAD ;;
+  esac
+  if [ -n "$SERVER_INSTALL_ARGS" ]; then
+    sudo java -jar $SERVER_DOWNLOAD_FILE $SERVER_INSTALL_ARGS
+  fi
+  echo "$SERVER_INSTALLED" | sudo tee .server-installed > /dev/null
+fi
+# Plugin, Modを入れる。前回入れたものを消してから、有効なものだけSHA256を確認して入れる
+if [ -f .managed-plugins ]; then
+  sudo xargs -r rm -f < .managed-plugins
+  sudo rm -f .managed-plugins
+fi
+PLUGIN_DIR=$(md server-plugin-dir)
+if [ -n "$PLUGIN_DIR" ]; then
+  sudo mkdir -p $PLUGIN_DIR
+  md server-plugins > server-plugins.list
+  while read -r -u 3 FILE SHA256 URL; do
+    [ -z "$FILE" ] && continue
+    case $URL in
+      gs://*) sudo gsutil cp $URL plugin.tmp ;;
+      *) sudo curl -sfL -o plugin.tmp $URL ;;
+    esac
+    if echo "$SHA256  plugin.tmp" | sha256sum -c --status; then
+      sudo mv plugin.tmp $PLUGIN_DIR/$FILE
+      echo $PLUGIN_DIR/$FILE | sudo tee -a .managed-plugins > /dev/null
+    else
+      echo "plugin checksum mismatch. $FILE"
+      sudo rm -f plugin.tmp
+    fi
+  done 3< server-plugins.list
+fi
+# APIで設定したserver.propertiesのKeyを上書きする。変更は次に起動した時に反映される
+# 前回上書きしたKeyを消してから上書きするので、APIで消したKeyはServerのDefaultに戻る
+if [ -f .managed-properties ]; then
+  while IFS= read -r KEY; do
+    [ -z "$KEY" ] && continue
+    sudo sed -i "/^${KEY//./\\.}=/d" server.properties
+  done < .managed-properties
+  sudo rm -f .managed-properties
+fi
+md server-properties > server-properties.override
+while IFS= read -r LINE; do
+  KEY=${LINE%%=*}
+  [ -z "$KEY" ] && continue
+  sudo sed -i "/^${KEY//./\\.}=/d" server.properties
+  echo "$LINE" | sudo tee -a server.properties > /dev/null
+  echo "$KEY" | sudo tee -a .managed-properties > /dev/null
+done < server-properties.override
+# Snapshot前にWorldを書き出すためのWatcher
+sudo gsutil cp gs://sinmetalcraft-minecraft-shell/minecraftserver-flush-watcher.sh .
+sudo chmod 700 minecraftserver-flush-watcher.sh
+sudo nohup ./minecraftserver-flush-watcher.sh > /dev/null 2>&1 &
 STATE=$(curl http://metadata/computeMetadata/v1/instance/attributes/state -H "Metadata-Flavor: Google")
 echo $STATE
 if [ ${STATE} = "exists" ]; then
   echo "EXISTS INSTNCE"
   sudo rm world/session.lock
-  sudo screen -d -m -S mcs java -Xms1G -Xmx7G -d64 -jar $MC_JAR nogui
+  sudo screen -d -m -S mcs java -Xms1G -Xmx7G $SERVER_LAUNCH_ARGS
   exit 0
 fi
 echo "NEW INSTNCE"
-sudo screen -d -m -S mcs java -Xms1G -Xmx7G -d64 -jar $MC_JAR nogui
-gcloud compute instances add-metadata $HOSTNAME --zone=asia-northeast1-b --metadata state=exists
+sudo screen -d -m -S mcs java -Xms1G -Xmx7G $SERVER_LAUNCH_ARGS
+# Capacityが足りずに別のZoneに作ったInstanceもあるので、ZoneはMetadata Serverから取る
+ZONE=$(curl -s http://metadata/computeMetadata/v1/instance/zone -H "Metadata-Flavor: Google" | awk -F/ '{print $NF}')
+gcloud compute instances add-metadata $HOSTNAME --zone=$ZONE --metadata state=exists